@@ -0,0 +1,171 @@
+// Package mqtttest provides the fixtures of the integration tests: a broker on a free local port, clients
+// publishing to it and helpers waiting for the asynchronous delivery of messages.
+package mqtttest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Time a test waits for a message or a condition by default
+const Timeout = 5 * time.Second
+
+// Starts a broker listening on the address and returns the function stopping it. The embedded broker
+// lives in the package under test, which can't be imported here without an import cycle.
+type StartFunc func(address string) (stop func(), err error)
+
+// A broker started for a test
+type Broker struct {
+	Host string
+	Port int
+}
+
+// Start a broker on a free local port, it is stopped when the test ends
+func StartBroker(tb testing.TB, start StartFunc) *Broker {
+	tb.Helper()
+	b := &Broker{Host: "127.0.0.1", Port: FreePort(tb)}
+	stop, err := start(b.Address())
+	if err != nil {
+		tb.Fatalf("starting broker on %v: %v", b.Address(), err)
+	}
+	tb.Cleanup(stop)
+	return b
+}
+
+// Address the broker listens on
+func (b *Broker) Address() string {
+	return net.JoinHostPort(b.Host, fmt.Sprint(b.Port))
+}
+
+// URL of the broker for paho clients
+func (b *Broker) URL() string {
+	return "tcp://" + b.Address()
+}
+
+// Return a free TCP port of the loopback interface
+func FreePort(tb testing.TB) int {
+	tb.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("finding a free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// Connect a client with the client ID to the broker, it is disconnected when the test ends
+func (b *Broker) Client(tb testing.TB, clientID string) mqtt.Client {
+	tb.Helper()
+	opts := mqtt.NewClientOptions().AddBroker(b.URL()).SetClientID(clientID).SetAutoReconnect(false)
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); !token.WaitTimeout(Timeout) || token.Error() != nil {
+		tb.Fatalf("connecting %q to %v: %v", clientID, b.URL(), token.Error())
+	}
+	tb.Cleanup(func() { client.Disconnect(250) })
+	return client
+}
+
+// Connect an MQTT 5 client with the client ID to the broker, it is disconnected when the test ends
+func (b *Broker) Client5(tb testing.TB, clientID string) *paho.Client {
+	tb.Helper()
+	conn, err := net.DialTimeout("tcp", b.Address(), Timeout)
+	if err != nil {
+		tb.Fatalf("connecting %q to %v: %v", clientID, b.Address(), err)
+	}
+	client := paho.NewClient(paho.ClientConfig{Conn: conn})
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+	if _, err := client.Connect(ctx, &paho.Connect{ClientID: clientID, CleanStart: true, KeepAlive: 30}); err != nil {
+		tb.Fatalf("connecting %q to %v: %v", clientID, b.Address(), err)
+	}
+	tb.Cleanup(func() { client.Disconnect(&paho.Disconnect{}) })
+	return client
+}
+
+// Publish a message with its MQTT 5 properties and wait for the broker acknowledgement of QoS 1 and 2 messages
+func Publish5(tb testing.TB, client *paho.Client, p *paho.Publish) {
+	tb.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+	if _, err := client.Publish(ctx, p); err != nil {
+		tb.Fatalf("publishing to %q: %v", p.Topic, err)
+	}
+}
+
+// Publish a payload with QoS 1 and wait for the broker acknowledgement. Payloads other than strings and
+// byte slices are encoded as JSON.
+func Publish(tb testing.TB, client mqtt.Client, topic string, payload interface{}, retained bool) {
+	tb.Helper()
+	switch payload.(type) {
+	case string, []byte:
+	default:
+		payload = JSON(tb, payload)
+	}
+	if token := client.Publish(topic, 1, retained, payload); !token.WaitTimeout(Timeout) || token.Error() != nil {
+		tb.Fatalf("publishing to %q: %v", topic, token.Error())
+	}
+}
+
+// Subscribe the client to the filter and return the received messages
+func Subscribe(tb testing.TB, client mqtt.Client, filter string) <-chan mqtt.Message {
+	tb.Helper()
+	messages := make(chan mqtt.Message, 100)
+	token := client.Subscribe(filter, 1, func(_ mqtt.Client, m mqtt.Message) { messages <- m })
+	if !token.WaitTimeout(Timeout) || token.Error() != nil {
+		tb.Fatalf("subscribing to %q: %v", filter, token.Error())
+	}
+	return messages
+}
+
+// Wait for a message, fails the test after the timeout
+func Receive(tb testing.TB, messages <-chan mqtt.Message) mqtt.Message {
+	tb.Helper()
+	select {
+	case m := <-messages:
+		return m
+	case <-time.After(Timeout):
+		tb.Fatal("no message received")
+		return nil
+	}
+}
+
+// Wait until the condition holds, fails the test with the message after the timeout
+func Eventually(tb testing.TB, condition func() bool, format string, args ...interface{}) {
+	tb.Helper()
+	deadline := time.Now().Add(Timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			tb.Fatalf(format, args...)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Encode a value as JSON
+func JSON(tb testing.TB, v interface{}) []byte {
+	tb.Helper()
+	payload, err := json.Marshal(v)
+	if err != nil {
+		tb.Fatalf("encoding %v: %v", v, err)
+	}
+	return payload
+}
+
+// Payload of a welding power source sample in the standard weld reading schema
+func WeldSample(current, voltage float64) map[string]interface{} {
+	return map[string]interface{}{"current_a": current, "voltage_v": voltage, "wire_feed_speed_m_min": 8.5, "arc_on": current > 0}
+}
+
+// Telwin payload: two key value pairs, the second value is the URL encoded JSON of the sample
+func TelwinSample(tb testing.TB, current, voltage float64) string {
+	tb.Helper()
+	return "id=1&data=" + url.QueryEscape(string(JSON(tb, WeldSample(current, voltage))))
+}
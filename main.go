@@ -2,11 +2,20 @@ package main
 
 import (
 	"context"
+	"os"
 
 	"github.com/lab101/mqtt-welding/mqttclient"
+	"go.viam.com/rdk/components/board"
+	"go.viam.com/rdk/components/camera"
+	"go.viam.com/rdk/components/encoder"
+	"go.viam.com/rdk/components/generic"
+	"go.viam.com/rdk/components/motor"
+	"go.viam.com/rdk/components/movementsensor"
+	"go.viam.com/rdk/components/powersensor"
 	"go.viam.com/rdk/components/sensor"
 	"go.viam.com/rdk/logging"
 	"go.viam.com/rdk/module"
+	genericservice "go.viam.com/rdk/services/generic"
 	"go.viam.com/utils"
 )
 
@@ -29,6 +38,66 @@ func mainWithArgs(ctx context.Context, args []string, logger logging.Logger) (er
 	if err != nil {
 		return err
 	}
+	err = myMod.AddModelFromRegistry(ctx, sensor.API, mqttclient.GaugeModel)
+	if err != nil {
+		return err
+	}
+	err = myMod.AddModelFromRegistry(ctx, sensor.API, mqttclient.SyncGateModel)
+	if err != nil {
+		return err
+	}
+	err = myMod.AddModelFromRegistry(ctx, camera.API, mqttclient.CameraModel)
+	if err != nil {
+		return err
+	}
+	err = myMod.AddModelFromRegistry(ctx, movementsensor.API, mqttclient.MovementSensorModel)
+	if err != nil {
+		return err
+	}
+	err = myMod.AddModelFromRegistry(ctx, powersensor.API, mqttclient.PowerSensorModel)
+	if err != nil {
+		return err
+	}
+	err = myMod.AddModelFromRegistry(ctx, generic.API, mqttclient.SwitchModel)
+	if err != nil {
+		return err
+	}
+	err = myMod.AddModelFromRegistry(ctx, generic.API, mqttclient.ButtonModel)
+	if err != nil {
+		return err
+	}
+	err = myMod.AddModelFromRegistry(ctx, generic.API, mqttclient.GenericModel)
+	if err != nil {
+		return err
+	}
+	err = myMod.AddModelFromRegistry(ctx, board.API, mqttclient.BoardModel)
+	if err != nil {
+		return err
+	}
+	err = myMod.AddModelFromRegistry(ctx, motor.API, mqttclient.MotorModel)
+	if err != nil {
+		return err
+	}
+	err = myMod.AddModelFromRegistry(ctx, encoder.API, mqttclient.EncoderModel)
+	if err != nil {
+		return err
+	}
+	err = myMod.AddModelFromRegistry(ctx, genericservice.API, mqttclient.TriggerModel)
+	if err != nil {
+		return err
+	}
+	err = myMod.AddModelFromRegistry(ctx, genericservice.API, mqttclient.BrokerModel)
+	if err != nil {
+		return err
+	}
+	err = myMod.AddModelFromRegistry(ctx, genericservice.API, mqttclient.BridgeModel)
+	if err != nil {
+		return err
+	}
+	err = myMod.AddModelFromRegistry(ctx, genericservice.API, mqttclient.EdgeNodeModel)
+	if err != nil {
+		return err
+	}
 
 	// Each module runs as its own process
 	err = myMod.Start(ctx)
@@ -36,6 +105,11 @@ func mainWithArgs(ctx context.Context, args []string, logger logging.Logger) (er
 	if err != nil {
 		return err
 	}
+	// Optional Prometheus endpoint, set in the env of the module configuration
+	err = mqttclient.ServeMetrics(ctx, os.Getenv("MQTT_METRICS_ADDRESS"), logger)
+	if err != nil {
+		return err
+	}
 	<-ctx.Done()
 	return nil
 }
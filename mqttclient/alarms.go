@@ -0,0 +1,179 @@
+package mqttclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Maps the alarms configuration attribute
+type AlarmsConfig struct {
+	Topics      []string `json:"topics"`       // Topic filters of the fault messages
+	IDField     string   `json:"id_field"`     // Field identifying the alarm, e.g. the fault code, default the topic
+	ActiveField string   `json:"active_field"` // Optional field, messages only latch an alarm while it is set
+	AckTopic    string   `json:"ack_topic"`    // Optional topic acknowledging alarms by ID, "all" acknowledges every alarm
+}
+
+// Validate the alarms configuration
+func (cfg *AlarmsConfig) Validate() error {
+	if len(cfg.Topics) == 0 {
+		return fmt.Errorf("alarms require topics")
+	}
+	for _, topic := range cfg.Topics {
+		if !validTopicFilter(topic) {
+			return fmt.Errorf("invalid alarms topic %q", topic)
+		}
+	}
+	if cfg.AckTopic != "" && !validTopicFilter(cfg.AckTopic) {
+		return fmt.Errorf("invalid alarms ack_topic %q", cfg.AckTopic)
+	}
+	return nil
+}
+
+// An alarm latched until it is acknowledged
+type latchedAlarm struct {
+	id          string
+	topic       string
+	first, last time.Time
+	count       uint64
+	payload     interface{}
+}
+
+// Latches the alarms of fault messages until they are acknowledged
+type alarmLatch struct {
+	AlarmsConfig
+	active map[string]*latchedAlarm
+}
+
+func newAlarmLatch(cfg *AlarmsConfig) *alarmLatch {
+	if cfg == nil {
+		return nil
+	}
+	return &alarmLatch{AlarmsConfig: *cfg, active: map[string]*latchedAlarm{}}
+}
+
+func (a *alarmLatch) isFaultTopic(topic string) bool {
+	for _, filter := range a.Topics {
+		if topicMatches(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Latch the alarm of a fault message, repeated alarms update the latched alarm
+func (a *alarmLatch) add(topic string, payload interface{}, at time.Time) {
+	if a.ActiveField != "" {
+		v, ok := lookupField(payload, a.ActiveField)
+		if !ok {
+			return
+		}
+		if active, ok := toArcState(v); !ok || !active {
+			return
+		}
+	}
+	id := topic
+	if a.IDField != "" {
+		v, ok := lookupField(payload, a.IDField)
+		if !ok || v == nil {
+			return
+		}
+		id = fmt.Sprint(v)
+	}
+	alarm, ok := a.active[id]
+	if !ok {
+		alarm = &latchedAlarm{id: id, first: at}
+		a.active[id] = alarm
+	}
+	alarm.topic = topic
+	alarm.last = at
+	alarm.count++
+	alarm.payload = payload
+}
+
+// Acknowledge an alarm by ID, or all alarms, and return the number of acknowledged alarms
+func (a *alarmLatch) ack(id string) int {
+	if id == "all" {
+		n := len(a.active)
+		a.active = map[string]*latchedAlarm{}
+		return n
+	}
+	if _, ok := a.active[id]; !ok {
+		return 0
+	}
+	delete(a.active, id)
+	return 1
+}
+
+// Return the alarm IDs of an ack message, a plain ID, a JSON string or list, or {"id": ...}
+func ackIDs(payload []byte) []string {
+	var v interface{}
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return []string{strings.TrimSpace(string(payload))}
+	}
+	if m, ok := v.(map[string]interface{}); ok {
+		v = m["id"]
+	}
+	var ids []string
+	switch x := v.(type) {
+	case []interface{}:
+		for _, id := range x {
+			ids = append(ids, fmt.Sprint(id))
+		}
+	case nil:
+	default:
+		ids = append(ids, fmt.Sprint(x))
+	}
+	return ids
+}
+
+// Return the active alarms in the order they were first raised
+func (a *alarmLatch) readings() []interface{} {
+	alarms := make([]*latchedAlarm, 0, len(a.active))
+	for _, alarm := range a.active {
+		alarms = append(alarms, alarm)
+	}
+	sort.Slice(alarms, func(i, j int) bool {
+		if !alarms[i].first.Equal(alarms[j].first) {
+			return alarms[i].first.Before(alarms[j].first)
+		}
+		return alarms[i].id < alarms[j].id
+	})
+	readings := make([]interface{}, 0, len(alarms))
+	for _, alarm := range alarms {
+		readings = append(readings, map[string]interface{}{
+			"id":      alarm.id,
+			"topic":   alarm.topic,
+			"first":   alarm.first.UTC().Format(time.RFC3339Nano),
+			"last":    alarm.last.UTC().Format(time.RFC3339Nano),
+			"count":   alarm.count,
+			"payload": alarm.payload,
+		})
+	}
+	return readings
+}
+
+// Latch the alarm of a fault message or acknowledge the alarms of an ack message. Ack messages are not
+// captured. Must be called with the mutex held.
+func (s *mqttClient) latchAlarms(msg *receivedMessage) bool {
+	if s.alarms == nil {
+		return false
+	}
+	if s.alarms.AckTopic != "" && topicMatches(s.alarms.AckTopic, msg.Topic()) {
+		for _, id := range ackIDs(msg.Payload()) {
+			s.alarms.ack(id)
+		}
+		return true
+	}
+	if !s.alarms.isFaultTopic(msg.Topic()) {
+		return false
+	}
+	payload, err := s.parse(msg)
+	if err != nil {
+		return false
+	}
+	s.alarms.add(msg.Topic(), payload, msg.received)
+	return false
+}
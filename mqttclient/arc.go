@@ -0,0 +1,291 @@
+package mqttclient
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Maps the arc_tracking configuration attribute
+type ArcTrackingConfig struct {
+	Field       string   `json:"field"`        // Arc state or numeric field, default arc_on
+	Threshold   *float64 `json:"threshold"`    // The arc is on while the numeric field is above the threshold
+	Reset       string   `json:"reset"`        // Supported none (default), daily, shift
+	ShiftStarts []string `json:"shift_starts"` // Local start times of the shifts like "06:00", required for the shift reset
+	Timezone    string   `json:"timezone"`     // IANA time zone of the resets, default the machine time zone
+	MaxGap      float64  `json:"max_gap_s"`    // Longer gaps between two messages are not counted as arc on time, default 5
+}
+
+const defaultArcMaxGap = 5 * time.Second
+
+// Maps the shifts configuration attribute, the shift calendar of the productivity counters
+type ShiftsConfig struct {
+	Starts   []string `json:"starts"`   // Local start times of the shifts like "06:00"
+	Names    []string `json:"names"`    // Optional names of the shifts in the order of the starts
+	Timezone string   `json:"timezone"` // IANA time zone of the shifts, default the machine time zone
+}
+
+// Validate the shift calendar
+func (cfg *ShiftsConfig) Validate() error {
+	if len(cfg.Starts) == 0 {
+		return fmt.Errorf("shifts require starts")
+	}
+	if len(cfg.Names) > 0 && len(cfg.Names) != len(cfg.Starts) {
+		return fmt.Errorf("shifts require a name for every start")
+	}
+	if _, err := parseShiftStarts(cfg.Starts); err != nil {
+		return err
+	}
+	if _, err := time.LoadLocation(cfg.Timezone); err != nil {
+		return fmt.Errorf("invalid shifts timezone %q: %v", cfg.Timezone, err)
+	}
+	return nil
+}
+
+// Validate the arc tracking configuration, the shift reset uses the shift calendar unless shift_starts are set
+func (cfg *ArcTrackingConfig) Validate(shifts *ShiftsConfig) error {
+	switch cfg.Reset {
+	case "", "none", "daily":
+	case "shift":
+		if len(cfg.ShiftStarts) == 0 && shifts == nil {
+			return fmt.Errorf("arc_tracking shift reset requires shift_starts or shifts")
+		}
+	default:
+		return fmt.Errorf("arc_tracking reset must be none, daily or shift")
+	}
+	if _, err := parseShiftStarts(cfg.ShiftStarts); err != nil {
+		return err
+	}
+	if _, err := time.LoadLocation(cfg.Timezone); err != nil {
+		return fmt.Errorf("invalid arc_tracking timezone %q: %v", cfg.Timezone, err)
+	}
+	if cfg.MaxGap < 0 {
+		return fmt.Errorf("arc_tracking max_gap_s must be >= 0")
+	}
+	return nil
+}
+
+// Parse "HH:MM" shift start times into sorted offsets from midnight
+func parseShiftStarts(starts []string) ([]time.Duration, error) {
+	var offsets []time.Duration
+	for _, start := range starts {
+		t, err := time.Parse("15:04", start)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shift start %q (should be HH:MM)", start)
+		}
+		offsets = append(offsets, time.Duration(t.Hour())*time.Hour+time.Duration(t.Minute())*time.Minute)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	return offsets, nil
+}
+
+// Periods of counters reset at midnight or at the shift starts
+type resetSchedule struct {
+	mode     string
+	shifts   []time.Duration
+	names    []string // Names of the shifts, empty if the shifts are not named
+	location *time.Location
+}
+
+// Return the reset schedule, without shift starts and time zone those of the shift calendar are used
+func newResetSchedule(mode string, shiftStarts []string, timezone string, calendar *ShiftsConfig) (resetSchedule, error) {
+	var names []string
+	if calendar != nil {
+		if len(shiftStarts) == 0 {
+			shiftStarts, names = calendar.Starts, calendar.Names
+		}
+		if timezone == "" {
+			timezone = calendar.Timezone
+		}
+	}
+	shifts, err := parseShiftStarts(shiftStarts)
+	if err != nil {
+		return resetSchedule{}, err
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return resetSchedule{}, err
+	}
+	r := resetSchedule{mode: mode, shifts: shifts, location: location}
+	if len(names) > 0 {
+		// The names are in the order of the starts, the shifts are sorted
+		byOffset := make(map[time.Duration]string, len(names))
+		for i, start := range shiftStarts {
+			offset, _ := parseShiftStarts([]string{start})
+			byOffset[offset[0]] = names[i]
+		}
+		for _, offset := range shifts {
+			r.names = append(r.names, byOffset[offset])
+		}
+	}
+	return r, nil
+}
+
+// Return the name of the shift running at t, empty if the shifts are not named
+func (r resetSchedule) shift(t time.Time) string {
+	if len(r.names) == 0 {
+		return ""
+	}
+	local := t.In(r.location)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, r.location)
+	// Before the first start the last shift of the previous day is running
+	name := r.names[len(r.names)-1]
+	for i, offset := range r.shifts {
+		if !midnight.Add(offset).After(t) {
+			name = r.names[i]
+		}
+	}
+	return name
+}
+
+// Return the next reset after t, zero if the counters are never reset
+func (r resetSchedule) next(t time.Time) time.Time {
+	local := t.In(r.location)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, r.location)
+	switch r.mode {
+	case "daily":
+		return midnight.AddDate(0, 0, 1)
+	case "shift":
+		for _, day := range []time.Time{midnight, midnight.AddDate(0, 0, 1)} {
+			for _, offset := range r.shifts {
+				if start := day.Add(offset); start.After(t) {
+					return start
+				}
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// Cumulative arc on time, arc starts and duty cycle since the last reset
+type arcTracker struct {
+	field     string
+	threshold *float64
+	maxGap    time.Duration
+	schedule  resetSchedule
+	on        bool
+	last      time.Time // Time of the last arc state
+	arcOn     time.Duration
+	starts    uint64
+	since     time.Time // Start of the period
+	nextReset time.Time
+	previous  map[string]interface{} // Totals of the previous period
+}
+
+func newArcTracker(cfg *ArcTrackingConfig, shifts *ShiftsConfig, now time.Time) (*arcTracker, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	schedule, err := newResetSchedule(cfg.Reset, cfg.ShiftStarts, cfg.Timezone, shifts)
+	if err != nil {
+		return nil, err
+	}
+	t := &arcTracker{field: cfg.Field, threshold: cfg.Threshold, maxGap: defaultArcMaxGap, schedule: schedule}
+	if t.field == "" {
+		t.field = weldArcOn
+	}
+	if cfg.MaxGap > 0 {
+		t.maxGap = time.Duration(cfg.MaxGap * float64(time.Second))
+	}
+	t.reset(now)
+	return t, nil
+}
+
+// Start a new period, the totals of the ended period are kept
+func (t *arcTracker) reset(now time.Time) {
+	if !t.since.IsZero() {
+		t.previous = map[string]interface{}{
+			"arc_on_s":   t.arcOn.Seconds(),
+			"arc_starts": t.starts,
+			"duty_cycle": t.arcOn.Seconds() / now.Sub(t.since).Seconds(),
+			"since":      t.since.UTC().Format(time.RFC3339),
+			"until":      now.UTC().Format(time.RFC3339),
+		}
+		if shift := t.schedule.shift(t.since); shift != "" {
+			t.previous["shift"] = shift
+		}
+	}
+	t.arcOn, t.starts = 0, 0
+	t.since = now
+	t.nextReset = t.schedule.next(now)
+}
+
+// Reset the counters if the period has ended, the arc on time is split at the reset
+func (t *arcTracker) rollover(now time.Time) {
+	for !t.nextReset.IsZero() && !now.Before(t.nextReset) {
+		if t.on && !t.last.IsZero() && t.last.Before(t.nextReset) && t.nextReset.Sub(t.last) <= t.maxGap {
+			t.arcOn += t.nextReset.Sub(t.last)
+			t.last = t.nextReset
+		}
+		t.reset(t.nextReset)
+	}
+}
+
+// Record the arc state of a message
+func (t *arcTracker) add(on bool, at time.Time) {
+	t.rollover(at)
+	if t.on && !t.last.IsZero() {
+		if dt := at.Sub(t.last); dt > 0 && dt <= t.maxGap {
+			t.arcOn += dt
+		}
+	}
+	if on && !t.on {
+		t.starts++
+	}
+	t.on = on
+	t.last = at
+}
+
+// Return the arc state of a parsed payload, false if it does not contain the field
+func (t *arcTracker) state(payload interface{}) (bool, bool) {
+	v, ok := lookupField(payload, t.field)
+	if !ok {
+		return false, false
+	}
+	if t.threshold != nil {
+		f, ok := toFloat(v)
+		return f > *t.threshold, ok
+	}
+	return toArcState(v)
+}
+
+func (t *arcTracker) readings(now time.Time) map[string]interface{} {
+	t.rollover(now)
+	arcOn := t.arcOn
+	// The running arc counts until now, unless the messages stopped
+	if t.on && now.Sub(t.last) <= t.maxGap {
+		arcOn += now.Sub(t.last)
+	}
+	dutyCycle := 0.0
+	if elapsed := now.Sub(t.since); elapsed > 0 {
+		dutyCycle = arcOn.Seconds() / elapsed.Seconds()
+	}
+	readings := map[string]interface{}{
+		"arc_on":     t.on,
+		"arc_on_s":   arcOn.Seconds(),
+		"arc_starts": t.starts,
+		"duty_cycle": dutyCycle,
+		"since":      t.since.UTC().Format(time.RFC3339),
+	}
+	if shift := t.schedule.shift(now); shift != "" {
+		readings["shift"] = shift
+	}
+	if t.previous != nil {
+		readings["previous"] = t.previous
+	}
+	return readings
+}
+
+// Update the arc tracking with a newly received message. Must be called with the mutex held.
+func (s *mqttClient) computeArc(msg *receivedMessage) {
+	if s.arc == nil {
+		return
+	}
+	payload, err := s.parseWithDerived(msg)
+	if err != nil {
+		return
+	}
+	if on, ok := s.arc.state(payload); ok {
+		s.arc.add(on, msg.received)
+	}
+}
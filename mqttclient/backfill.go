@@ -0,0 +1,79 @@
+package mqttclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// The backlog request is not awaited longer
+const backfillRequestTimeout = 5 * time.Second
+
+// Maps JSON backfill configuration attributes.
+type BackfillConfig struct {
+	RequestTopic string  `json:"request_topic"` // Topic the backlog request is published to after an outage
+	ReplayTopic  string  `json:"replay_topic"`  // Optional topic filter the backlog is replayed on, default the regular topics
+	MinOutage    float64 `json:"min_outage_s"`  // Shorter outages are not backfilled
+}
+
+// Validate the backfill configuration
+func (cfg *BackfillConfig) Validate() error {
+	if cfg.RequestTopic == "" || !validTopicName(cfg.RequestTopic) {
+		return fmt.Errorf("invalid backfill request_topic %q", cfg.RequestTopic)
+	}
+	if cfg.ReplayTopic != "" && !validTopicFilter(cfg.ReplayTopic) {
+		return fmt.Errorf("invalid backfill replay_topic %q", cfg.ReplayTopic)
+	}
+	if cfg.MinOutage < 0 {
+		return fmt.Errorf("backfill min_outage_s must be >= 0")
+	}
+	return nil
+}
+
+// Request sent to the publisher for the messages missed during an outage
+type backfillRequest struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	ClientID string `json:"client_id,omitempty"`
+	Topic    string `json:"topic"`
+}
+
+// Remember when the messages stopped arriving. Must be called with the mutex held.
+func (s *mqttClient) startOutage() {
+	if s.backfill == nil || !s.outageStart.IsZero() {
+		return
+	}
+	s.outageStart = s.lastMessageAt
+	if s.outageStart.IsZero() {
+		s.outageStart = time.Now()
+	}
+}
+
+// Request the backlog of the outage after a reconnect, the replayed messages are captured with their
+// payload timestamps
+func (s *mqttClient) requestBackfill() {
+	s.mutex.Lock()
+	from, to := s.outageStart, time.Now()
+	s.outageStart = time.Time{}
+	cfg := s.backfill
+	s.mutex.Unlock()
+	if cfg == nil || from.IsZero() || to.Sub(from) < time.Duration(cfg.MinOutage*float64(time.Second)) {
+		return
+	}
+	payload, err := json.Marshal(backfillRequest{
+		From:     from.UTC().Format(time.RFC3339Nano),
+		To:       to.UTC().Format(time.RFC3339Nano),
+		ClientID: s.ClientID,
+		Topic:    s.Topic,
+	})
+	if err != nil {
+		s.logger.Errorf("error encoding backfill request: %v", err)
+		return
+	}
+	token := s.publishNoWait(cfg.RequestTopic, s.QoS, false, payload)
+	if !token.WaitTimeout(backfillRequestTimeout) || token.Error() != nil {
+		s.logger.Warnf("backfill request to %q failed: %v", cfg.RequestTopic, token.Error())
+		return
+	}
+	s.logger.Infof("requested the backlog from %s to %s on %q", from.UTC().Format(time.RFC3339), to.UTC().Format(time.RFC3339), cfg.RequestTopic)
+}
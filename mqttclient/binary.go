@@ -0,0 +1,157 @@
+package mqttclient
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+)
+
+// Method name of the binary captures written by the client
+const binaryCaptureMethod = "BinaryPayload"
+
+// Maps JSON binary capture configuration attributes.
+type BinaryCaptureConfig struct {
+	Topics   []string `json:"topics"`    // Topic filters of the binary payloads, default all subscribed topics
+	MimeType string   `json:"mime_type"` // Default detected from the payload
+	Field    string   `json:"field"`     // Optional JSON payload field with the base64 encoded data, the other fields are the metadata
+}
+
+// Validate the binary capture configuration
+func (cfg *BinaryCaptureConfig) Validate() error {
+	for _, topic := range cfg.Topics {
+		if !validTopicFilter(topic) {
+			return fmt.Errorf("invalid binary_capture topic %q", topic)
+		}
+	}
+	if cfg.MimeType != "" {
+		if _, _, err := mime.ParseMediaType(cfg.MimeType); err != nil {
+			return fmt.Errorf("invalid binary_capture mime_type %q: %v", cfg.MimeType, err)
+		}
+	}
+	return nil
+}
+
+// File extensions of common MIME types, the data manager derives the MIME type of synced binary data from it
+var captureFileExtensions = map[string]string{
+	"image/jpeg":               ".jpeg",
+	"image/png":                ".png",
+	"application/json":         ".json",
+	"application/octet-stream": ".bin",
+	"text/plain":               ".txt",
+	"text/csv":                 ".csv",
+}
+
+// Return the file extension of a MIME type
+func captureFileExtension(mimeType string) string {
+	if ext, ok := captureFileExtensions[mimeType]; ok {
+		return ext
+	}
+	if exts, err := mime.ExtensionsByType(mimeType); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// Payload written as binary capture, returned by Readings instead of the payload bytes
+type binaryPayload struct {
+	mimeType string
+	size     int
+	path     string
+}
+
+func (b *binaryPayload) readings() map[string]interface{} {
+	return map[string]interface{}{
+		"mime_type": b.mimeType,
+		"size":      b.size,
+		"file":      filepath.Base(b.path),
+	}
+}
+
+// Whether the payload of a topic is captured as binary data
+func (s *mqttClient) isBinaryTopic(topic string) bool {
+	if s.binaryCapture == nil {
+		return false
+	}
+	if len(s.binaryCapture.Topics) == 0 {
+		return true
+	}
+	for _, filter := range s.binaryCapture.Topics {
+		if topicMatches(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Extract the binary data and its metadata from a payload, and the JSON fields if the data is a field
+func (s *mqttClient) extractBinary(msg *receivedMessage) ([]byte, map[string]string, map[string]interface{}, error) {
+	metadata := map[string]string{
+		"topic":    msg.Topic(),
+		"qos":      fmt.Sprint(msg.Qos()),
+		"retained": fmt.Sprint(msg.Retained()),
+	}
+	field := s.binaryCapture.Field
+	if field == "" {
+		return msg.Payload(), metadata, nil, nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(msg.Payload(), &fields); err != nil {
+		return nil, nil, nil, fmt.Errorf("error parsing JSON message: %v", err)
+	}
+	v, ok := lookupField(fields, field)
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("binary field %q not found", field)
+	}
+	encoded, ok := v.(string)
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("binary field %q is not a string", field)
+	}
+	payload, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error decoding binary field %q: %v", field, err)
+	}
+	// The other top level fields describe the data, nested values are kept as JSON
+	for k, v := range fields {
+		if k == field {
+			continue
+		}
+		if str, ok := v.(string); ok {
+			metadata[k] = str
+		} else if b, err := json.Marshal(v); err == nil {
+			metadata[k] = string(b)
+		}
+	}
+	return payload, metadata, fields, nil
+}
+
+// Write the payload of a message as binary capture file for the data manager. Must be called with the mutex held.
+func (s *mqttClient) captureBinary(msg *receivedMessage) error {
+	payload, metadata, fields, err := s.extractBinary(msg)
+	if err != nil {
+		return err
+	}
+	mimeType := s.binaryCapture.MimeType
+	if mimeType == "" {
+		mimeType, _, _ = mime.ParseMediaType(http.DetectContentType(payload))
+	}
+	metadata["mime_type"] = mimeType
+	// Binary payloads skip the readings pipeline, a timestamp can only be read from the other JSON fields
+	if s.timestampField != "" && fields != nil {
+		if v, ok := lookupField(fields, s.timestampField); ok {
+			if ts, err := parseTimestamp(v); err == nil {
+				msg.timestamp = ts
+			}
+		}
+	}
+	t := s.captureTime(msg)
+	tags := s.captureTags(msg, fields)
+	path, err := s.captureWriter.writeBinary(binaryCaptureMethod, tags, metadata, captureFileExtension(mimeType), payload, t, t)
+	if err != nil {
+		return err
+	}
+	msg.binary = &binaryPayload{mimeType: mimeType, size: len(payload), path: path}
+	return nil
+}
@@ -0,0 +1,356 @@
+package mqttclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	pb "go.viam.com/api/component/board/v1"
+	"go.viam.com/rdk/components/board"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+)
+
+// Board model with GPIO pins and analogs backed by MQTT state and command topics
+var BoardModel = resource.NewModel("lab101", "mqtt", "board")
+
+func init() {
+	resource.RegisterComponent(board.API, BoardModel,
+		resource.Registration[board.Board, *BoardConfig]{Constructor: newBoard})
+}
+
+// Maps a virtual GPIO pin to its topics
+type PinConfig struct {
+	Name         string `json:"name"`
+	StateTopic   string `json:"state_topic"`   // Topic reporting the pin state
+	CommandTopic string `json:"command_topic"` // Topic the pin state is published to
+	PWMTopic     string `json:"pwm_topic"`     // Optional topic the PWM duty cycle is published to
+	OnPayload    string `json:"on_payload"`    // Payload of the high state, default "1"
+	OffPayload   string `json:"off_payload"`   // Payload of the low state, default "0"
+}
+
+// Maps a virtual analog to its topics
+type AnalogConfig struct {
+	Name         string  `json:"name"`
+	StateTopic   string  `json:"state_topic"`   // Topic reporting the analog value
+	Field        string  `json:"field"`         // Optional JSON payload field with the value
+	CommandTopic string  `json:"command_topic"` // Optional topic written values are published to
+	Min          float32 `json:"min"`
+	Max          float32 `json:"max"`
+}
+
+// Maps JSON board configuration attributes.
+type BoardConfig struct {
+	BrokerConfig `json:",squash"`
+	QoS          int            `json:"qos"`
+	Pins         []PinConfig    `json:"pins"`
+	Analogs      []AnalogConfig `json:"analogs"`
+}
+
+// Implement board configuration validation and return implicit dependencies.
+func (cfg *BoardConfig) Validate(path string) ([]string, error) {
+	if err := cfg.BrokerConfig.Validate(path); err != nil {
+		return nil, err
+	}
+	if cfg.QoS < 0 || cfg.QoS > 2 {
+		return nil, fmt.Errorf("qos must be between 0 and 2 %q", path)
+	}
+	names := map[string]bool{}
+	for _, pin := range cfg.Pins {
+		if pin.Name == "" || names[pin.Name] {
+			return nil, fmt.Errorf("pin names must be unique and not empty %q", path)
+		}
+		if pin.StateTopic == "" && pin.CommandTopic == "" {
+			return nil, fmt.Errorf("pin %q requires a state_topic or command_topic %q", pin.Name, path)
+		}
+		names[pin.Name] = true
+	}
+	names = map[string]bool{}
+	for _, analog := range cfg.Analogs {
+		if analog.Name == "" || names[analog.Name] {
+			return nil, fmt.Errorf("analog names must be unique and not empty %q", path)
+		}
+		if analog.StateTopic == "" && analog.CommandTopic == "" {
+			return nil, fmt.Errorf("analog %q requires a state_topic or command_topic %q", analog.Name, path)
+		}
+		names[analog.Name] = true
+	}
+	return []string{}, nil
+}
+
+type mqttBoard struct {
+	resource.Named
+	resource.AlwaysRebuild
+	logger      logging.Logger
+	client      mqtt.Client
+	qos         byte
+	pins        map[string]*mqttPin
+	analogs     map[string]*mqttAnalog
+	analogNames []string
+	mutex       sync.Mutex
+}
+
+type mqttPin struct {
+	board *mqttBoard
+	cfg   PinConfig
+	high  bool
+	pwm   float64
+	freq  uint
+}
+
+type mqttAnalog struct {
+	board *mqttBoard
+	cfg   AnalogConfig
+	value int
+	valid bool
+}
+
+// Board constructor, the board is rebuilt on reconfiguration
+func newBoard(ctx context.Context, deps resource.Dependencies, conf resource.Config, logger logging.Logger) (board.Board, error) {
+	boardConfig, err := resource.NativeConfig[*BoardConfig](conf)
+	if err != nil {
+		return nil, err
+	}
+	b := &mqttBoard{
+		Named:   conf.ResourceName().AsNamed(),
+		logger:  logger,
+		qos:     byte(boardConfig.QoS),
+		pins:    map[string]*mqttPin{},
+		analogs: map[string]*mqttAnalog{},
+	}
+	filters := map[string]byte{}
+	handlers := map[string]mqtt.MessageHandler{}
+	for _, cfg := range boardConfig.Pins {
+		if cfg.OnPayload == "" {
+			cfg.OnPayload = "1"
+		}
+		if cfg.OffPayload == "" {
+			cfg.OffPayload = "0"
+		}
+		pin := &mqttPin{board: b, cfg: cfg}
+		b.pins[cfg.Name] = pin
+		if cfg.StateTopic != "" {
+			filters[cfg.StateTopic] = b.qos
+			handlers[cfg.StateTopic] = pin.onState
+		}
+	}
+	for _, cfg := range boardConfig.Analogs {
+		analog := &mqttAnalog{board: b, cfg: cfg}
+		b.analogs[cfg.Name] = analog
+		b.analogNames = append(b.analogNames, cfg.Name)
+		if cfg.StateTopic != "" {
+			filters[cfg.StateTopic] = b.qos
+			handlers[cfg.StateTopic] = analog.onState
+		}
+	}
+	if b.client, err = boardConfig.connect(ctx); err != nil {
+		return nil, fmt.Errorf("error initializing mqtt board: %v", err)
+	}
+	if len(filters) > 0 {
+		// Dispatch the messages of each state topic, several topics may match wildcard filters
+		dispatch := func(client mqtt.Client, msg mqtt.Message) {
+			for filter, handler := range handlers {
+				if topicMatches(filter, msg.Topic()) {
+					handler(client, msg)
+				}
+			}
+		}
+		if err := waitForToken(ctx, b.client.SubscribeMultiple(filters, dispatch)); err != nil {
+			b.client.Disconnect(250)
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Update the pin state from a state message, the on payload and common truthy values are high
+func (p *mqttPin) onState(client mqtt.Client, msg mqtt.Message) {
+	state := strings.TrimSpace(string(msg.Payload()))
+	p.board.mutex.Lock()
+	defer p.board.mutex.Unlock()
+	switch {
+	case state == p.cfg.OnPayload:
+		p.high = true
+	case state == p.cfg.OffPayload:
+		p.high = false
+	default:
+		high, err := strconv.ParseBool(strings.ToLower(state))
+		if err != nil {
+			high = strings.EqualFold(state, "on") || strings.EqualFold(state, "high")
+		}
+		p.high = high
+	}
+}
+
+// Publish the on or off payload to the command topic
+func (p *mqttPin) Set(ctx context.Context, high bool, extra map[string]interface{}) error {
+	if p.cfg.CommandTopic == "" {
+		return fmt.Errorf("pin %q has no command_topic", p.cfg.Name)
+	}
+	payload := p.cfg.OffPayload
+	if high {
+		payload = p.cfg.OnPayload
+	}
+	if err := publishAndWait(ctx, p.board.client, p.cfg.CommandTopic, p.board.qos, false, payload); err != nil {
+		return err
+	}
+	// Without a state topic the last commanded state is reported
+	if p.cfg.StateTopic == "" {
+		p.board.mutex.Lock()
+		p.high = high
+		p.board.mutex.Unlock()
+	}
+	return nil
+}
+
+// Return the pin state
+func (p *mqttPin) Get(ctx context.Context, extra map[string]interface{}) (bool, error) {
+	p.board.mutex.Lock()
+	defer p.board.mutex.Unlock()
+	return p.high, nil
+}
+
+// Return the last PWM duty cycle set
+func (p *mqttPin) PWM(ctx context.Context, extra map[string]interface{}) (float64, error) {
+	p.board.mutex.Lock()
+	defer p.board.mutex.Unlock()
+	return p.pwm, nil
+}
+
+// Publish the PWM duty cycle to the PWM topic
+func (p *mqttPin) SetPWM(ctx context.Context, dutyCyclePct float64, extra map[string]interface{}) error {
+	if p.cfg.PWMTopic == "" {
+		return fmt.Errorf("pin %q has no pwm_topic", p.cfg.Name)
+	}
+	payload := strconv.FormatFloat(dutyCyclePct, 'f', -1, 64)
+	if err := publishAndWait(ctx, p.board.client, p.cfg.PWMTopic, p.board.qos, false, payload); err != nil {
+		return err
+	}
+	p.board.mutex.Lock()
+	p.pwm = dutyCyclePct
+	p.board.mutex.Unlock()
+	return nil
+}
+
+// Return the last PWM frequency set
+func (p *mqttPin) PWMFreq(ctx context.Context, extra map[string]interface{}) (uint, error) {
+	p.board.mutex.Lock()
+	defer p.board.mutex.Unlock()
+	return p.freq, nil
+}
+
+// The PWM frequency is not published, it is only stored
+func (p *mqttPin) SetPWMFreq(ctx context.Context, freqHz uint, extra map[string]interface{}) error {
+	p.board.mutex.Lock()
+	p.freq = freqHz
+	p.board.mutex.Unlock()
+	return nil
+}
+
+// Update the analog value from a state message, a number or a JSON payload field
+func (a *mqttAnalog) onState(client mqtt.Client, msg mqtt.Message) {
+	var v interface{} = string(msg.Payload())
+	if a.cfg.Field != "" {
+		var payload interface{}
+		if err := json.Unmarshal(msg.Payload(), &payload); err != nil {
+			a.board.logger.Debugf("analog %q: invalid JSON payload: %v", a.cfg.Name, err)
+			return
+		}
+		var ok bool
+		if v, ok = lookupField(payload, a.cfg.Field); !ok {
+			return
+		}
+	}
+	f, ok := toFloat(v)
+	if !ok {
+		a.board.logger.Debugf("analog %q: non numeric value %v", a.cfg.Name, v)
+		return
+	}
+	a.board.mutex.Lock()
+	a.value = int(f)
+	a.valid = true
+	a.board.mutex.Unlock()
+}
+
+// Return the last analog value
+func (a *mqttAnalog) Read(ctx context.Context, extra map[string]interface{}) (board.AnalogValue, error) {
+	a.board.mutex.Lock()
+	defer a.board.mutex.Unlock()
+	if !a.valid {
+		return board.AnalogValue{}, fmt.Errorf("no value received for analog %q", a.cfg.Name)
+	}
+	return board.AnalogValue{Value: a.value, Min: a.cfg.Min, Max: a.cfg.Max}, nil
+}
+
+// Publish the analog value to the command topic
+func (a *mqttAnalog) Write(ctx context.Context, value int, extra map[string]interface{}) error {
+	if a.cfg.CommandTopic == "" {
+		return fmt.Errorf("analog %q has no command_topic", a.cfg.Name)
+	}
+	if err := publishAndWait(ctx, a.board.client, a.cfg.CommandTopic, a.board.qos, false, strconv.Itoa(value)); err != nil {
+		return err
+	}
+	if a.cfg.StateTopic == "" {
+		a.board.mutex.Lock()
+		a.value = value
+		a.valid = true
+		a.board.mutex.Unlock()
+	}
+	return nil
+}
+
+// Return the analog with the given name
+func (b *mqttBoard) AnalogByName(name string) (board.Analog, error) {
+	if a, ok := b.analogs[name]; ok {
+		return a, nil
+	}
+	return nil, fmt.Errorf("unknown analog %q", name)
+}
+
+// Digital interrupts are not supported
+func (b *mqttBoard) DigitalInterruptByName(name string) (board.DigitalInterrupt, error) {
+	return nil, errUnimplemented
+}
+
+// Return the GPIO pin with the given name
+func (b *mqttBoard) GPIOPinByName(name string) (board.GPIOPin, error) {
+	if p, ok := b.pins[name]; ok {
+		return p, nil
+	}
+	return nil, fmt.Errorf("unknown pin %q", name)
+}
+
+// Return the configured analog names
+func (b *mqttBoard) AnalogNames() []string {
+	return b.analogNames
+}
+
+// Digital interrupts are not supported
+func (b *mqttBoard) DigitalInterruptNames() []string {
+	return nil
+}
+
+// Power modes are not supported
+func (b *mqttBoard) SetPowerMode(ctx context.Context, mode pb.PowerMode, duration *time.Duration) error {
+	return errUnimplemented
+}
+
+// Digital interrupts are not supported
+func (b *mqttBoard) StreamTicks(ctx context.Context, interrupts []board.DigitalInterrupt, ch chan board.Tick,
+	extra map[string]interface{},
+) error {
+	return errUnimplemented
+}
+
+// Disconnect from the broker
+func (b *mqttBoard) Close(ctx context.Context) error {
+	if b.client != nil {
+		b.client.Disconnect(250) // Timeout in milliseconds
+	}
+	return nil
+}
@@ -0,0 +1,340 @@
+package mqttclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+	"go.viam.com/rdk/services/generic"
+)
+
+// Service model republishing messages from a source broker to a target broker
+var BridgeModel = resource.NewModel("lab101", "mqtt", "bridge")
+
+// Default number of messages stored while the target broker is unreachable
+const defaultBridgeBufferLength = 1000
+
+func init() {
+	resource.RegisterService(generic.API, BridgeModel,
+		resource.Registration[resource.Resource, *BridgeConfig]{Constructor: newBridge})
+}
+
+// Maps a bridged topic filter to its target topic and payload
+type BridgeRule struct {
+	Topic       string `json:"topic"`        // Source topic filter
+	StripPrefix string `json:"strip_prefix"` // Removed from the source topic
+	Prefix      string `json:"prefix"`       // Prepended to the target topic
+	Transform   string `json:"transform"`    // Optional expression on msg and topic producing the target payload
+	QoS         *int   `json:"qos"`          // Target QoS, default the QoS of the source message
+	Retain      bool   `json:"retain"`
+}
+
+// Maps JSON bridge configuration attributes.
+type BridgeConfig struct {
+	Source        BrokerConfig         `json:"source"`
+	Target        BrokerConfig         `json:"target"`
+	QoS           int                  `json:"qos"` // Subscription QoS on the source broker
+	Rules         []BridgeRule         `json:"rules"`
+	BufferLength  int                  `json:"buffer_length"`  // Messages stored while the target is unreachable, default 1000
+	HomeAssistant *HomeAssistantConfig `json:"home_assistant"` // Announce the fields of forwarded JSON objects
+}
+
+// Implement bridge configuration validation and return implicit dependencies.
+func (cfg *BridgeConfig) Validate(path string) ([]string, error) {
+	if err := cfg.Source.Validate(path + ".source"); err != nil {
+		return nil, err
+	}
+	if err := cfg.Target.Validate(path + ".target"); err != nil {
+		return nil, err
+	}
+	if cfg.QoS < 0 || cfg.QoS > 2 {
+		return nil, fmt.Errorf("qos must be between 0 and 2 %q", path)
+	}
+	if cfg.BufferLength < 0 {
+		return nil, fmt.Errorf("buffer_length must be >= 0 %q", path)
+	}
+	if cfg.HomeAssistant != nil {
+		if err := cfg.HomeAssistant.Validate(path); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.Rules) == 0 {
+		return nil, fmt.Errorf("at least one rule is required %q", path)
+	}
+	for _, rule := range cfg.Rules {
+		if !validTopicFilter(rule.Topic) {
+			return nil, fmt.Errorf("invalid rule topic filter %q %q", rule.Topic, path)
+		}
+		if rule.QoS != nil && (*rule.QoS < 0 || *rule.QoS > 2) {
+			return nil, fmt.Errorf("rule qos must be between 0 and 2 %q", path)
+		}
+		if rule.Transform != "" {
+			if _, err := compileExpr(rule.Transform); err != nil {
+				return nil, fmt.Errorf("invalid transform %q: %v %q", rule.Transform, err, path)
+			}
+		}
+	}
+	return []string{}, nil
+}
+
+type bridgeRule struct {
+	BridgeRule
+	transform expr
+}
+
+type bridgedMessage struct {
+	id       uint64
+	topic    string
+	qos      byte
+	retained bool
+	payload  []byte
+}
+
+type mqttBridge struct {
+	resource.Named
+	resource.AlwaysRebuild
+	logger       logging.Logger
+	source       mqtt.Client
+	target       mqtt.Client
+	rules        []bridgeRule
+	discovery    *haDiscovery
+	bufferLength int
+	queue        []bridgedMessage
+	nextID       uint64
+	forwarded    uint64
+	dropped      uint64
+	failed       uint64
+	wake         chan struct{}
+	ctx          context.Context
+	cancel       context.CancelFunc
+	wg           sync.WaitGroup
+	mutex        sync.Mutex
+}
+
+// Bridge constructor, the bridge is rebuilt on reconfiguration
+func newBridge(ctx context.Context, deps resource.Dependencies, conf resource.Config, logger logging.Logger) (resource.Resource, error) {
+	bridgeConfig, err := resource.NativeConfig[*BridgeConfig](conf)
+	if err != nil {
+		return nil, err
+	}
+	b := &mqttBridge{
+		Named:        conf.ResourceName().AsNamed(),
+		logger:       logger,
+		bufferLength: bridgeConfig.BufferLength,
+		wake:         make(chan struct{}, 1),
+	}
+	if b.bufferLength == 0 {
+		b.bufferLength = defaultBridgeBufferLength
+	}
+	b.discovery = newHADiscovery(bridgeConfig.HomeAssistant, conf.ResourceName().ShortName())
+	filters := map[string]byte{}
+	for _, rule := range bridgeConfig.Rules {
+		r := bridgeRule{BridgeRule: rule}
+		if rule.Transform != "" {
+			if r.transform, err = compileExpr(rule.Transform); err != nil {
+				return nil, err
+			}
+		}
+		b.rules = append(b.rules, r)
+		filters[rule.Topic] = byte(bridgeConfig.QoS)
+	}
+
+	// The target connection is retried in the background, messages are stored until it is up. A shared
+	// target connection must be reachable, it is only retried once established.
+	if bridgeConfig.Target.SharedConnection {
+		if b.target, err = bridgeConfig.Target.connect(ctx); err != nil {
+			return nil, fmt.Errorf("error connecting target broker: %v", err)
+		}
+		b.target.(*sharedClient).setHandlers(func(mqtt.Client) { b.signal() }, nil)
+	} else {
+		targetOpts, err := newClientOptions(&bridgeConfig.Target)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting target broker: %v", err)
+		}
+		targetOpts.SetConnectRetry(true)
+		targetOpts.SetOnConnectHandler(func(mqtt.Client) { b.signal() })
+		b.target = newMQTTClient(&bridgeConfig.Target, targetOpts)
+		b.target.Connect()
+	}
+
+	// Subscribe on every connection to the source, the session is not persistent. A shared connection
+	// restores the subscriptions itself.
+	if bridgeConfig.Source.SharedConnection {
+		if b.source, err = bridgeConfig.Source.connect(ctx); err != nil {
+			b.target.Disconnect(250)
+			return nil, fmt.Errorf("error connecting source broker: %v", err)
+		}
+		if err := waitForToken(ctx, b.source.SubscribeMultiple(filters, b.onMessage)); err != nil {
+			b.source.Disconnect(250)
+			b.target.Disconnect(250)
+			return nil, fmt.Errorf("bridge subscription failed: %v", err)
+		}
+	} else {
+		sourceOpts, err := newClientOptions(&bridgeConfig.Source)
+		if err != nil {
+			b.target.Disconnect(250)
+			return nil, fmt.Errorf("error connecting source broker: %v", err)
+		}
+		sourceOpts.SetOnConnectHandler(func(client mqtt.Client) {
+			if token := client.SubscribeMultiple(filters, b.onMessage); token.Wait() && token.Error() != nil {
+				b.logger.Errorf("bridge subscription failed: %v", token.Error())
+			}
+		})
+		b.source = newMQTTClient(&bridgeConfig.Source, sourceOpts)
+		if token := b.source.Connect(); token.Wait() && token.Error() != nil {
+			b.target.Disconnect(250)
+			return nil, fmt.Errorf("error connecting source broker: %v", token.Error())
+		}
+	}
+
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	b.wg.Add(1)
+	go b.forward()
+	return b, nil
+}
+
+// Map a source message with the first matching rule and store it for forwarding
+func (b *mqttBridge) onMessage(client mqtt.Client, msg mqtt.Message) {
+	for _, rule := range b.rules {
+		if !topicMatches(rule.Topic, msg.Topic()) {
+			continue
+		}
+		out := bridgedMessage{
+			topic:    rule.Prefix + strings.TrimPrefix(msg.Topic(), rule.StripPrefix),
+			qos:      msg.Qos(),
+			retained: rule.Retain,
+			payload:  msg.Payload(),
+		}
+		if rule.QoS != nil {
+			out.qos = byte(*rule.QoS)
+		}
+		if rule.transform != nil {
+			payload, err := b.transform(rule.transform, msg)
+			if err != nil {
+				b.logger.Debugf("bridge transform failed for %q: %v", msg.Topic(), err)
+				b.mutex.Lock()
+				b.failed++
+				b.mutex.Unlock()
+				return
+			}
+			out.payload = payload
+		}
+		b.mutex.Lock()
+		if b.discovery != nil {
+			// The discovery configs are forwarded before the first message with new fields
+			var payload interface{}
+			if json.Unmarshal(out.payload, &payload) == nil {
+				paths, values := map[string][]string{}, map[string]interface{}{}
+				jsonMetrics(nil, payload, paths, values)
+				for _, config := range b.discovery.configs(out.topic, paths, values) {
+					b.enqueue(bridgedMessage{topic: config.topic, qos: 1, retained: true, payload: config.payload})
+				}
+			}
+		}
+		b.enqueue(out)
+		b.mutex.Unlock()
+		b.signal()
+		return
+	}
+}
+
+// Store a message for forwarding, the oldest message is dropped when the buffer is full. The caller
+// holds the mutex.
+func (b *mqttBridge) enqueue(msg bridgedMessage) {
+	b.nextID++
+	msg.id = b.nextID
+	if len(b.queue) >= b.bufferLength {
+		b.queue = b.queue[1:]
+		b.dropped++
+	}
+	b.queue = append(b.queue, msg)
+}
+
+// Evaluate a transform expression, strings are published as is and other values as JSON
+func (b *mqttBridge) transform(e expr, msg mqtt.Message) ([]byte, error) {
+	var payload interface{}
+	if err := json.Unmarshal(msg.Payload(), &payload); err != nil {
+		payload = string(msg.Payload())
+	}
+	v, err := e.eval(map[string]interface{}{"msg": payload, "topic": msg.Topic()})
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := v.(string); ok {
+		return []byte(s), nil
+	}
+	return json.Marshal(v)
+}
+
+// Wake up the forwarding loop
+func (b *mqttBridge) signal() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Publish the stored messages in order while the target is connected
+func (b *mqttBridge) forward() {
+	defer b.wg.Done()
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-b.wake:
+		}
+		for b.ctx.Err() == nil && b.target.IsConnectionOpen() {
+			b.mutex.Lock()
+			if len(b.queue) == 0 {
+				b.mutex.Unlock()
+				break
+			}
+			msg := b.queue[0]
+			b.mutex.Unlock()
+			if err := publishAndWait(b.ctx, b.target, msg.topic, msg.qos, msg.retained, msg.payload); err != nil {
+				// Keep the message and retry once the target reconnects
+				b.logger.Debugf("bridge publish failed: %v", err)
+				break
+			}
+			b.mutex.Lock()
+			// The message may have been dropped from a full queue while publishing
+			if len(b.queue) > 0 && b.queue[0].id == msg.id {
+				b.queue = b.queue[1:]
+			}
+			b.forwarded++
+			b.mutex.Unlock()
+		}
+	}
+}
+
+// DoCommand returns the bridge counters: {"status": true}
+func (b *mqttBridge) DoCommand(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	if _, ok := cmd["status"]; !ok {
+		return nil, errUnimplemented
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return map[string]interface{}{
+		"source_connected": b.source.IsConnectionOpen(),
+		"target_connected": b.target.IsConnectionOpen(),
+		"forwarded":        b.forwarded,
+		"queued":           len(b.queue),
+		"dropped":          b.dropped,
+		"failed":           b.failed,
+	}, nil
+}
+
+// Stop forwarding and disconnect from both brokers, stored messages are lost. Cancelling the context
+// ends the wait for the acknowledgement of a message in flight, the target may never come back.
+func (b *mqttBridge) Close(ctx context.Context) error {
+	b.cancel()
+	b.source.Disconnect(250) // Timeout in milliseconds
+	b.wg.Wait()
+	b.target.Disconnect(250)
+	return nil
+}
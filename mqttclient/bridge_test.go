@@ -0,0 +1,185 @@
+package mqttclient
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+	"go.viam.com/rdk/services/generic"
+
+	"github.com/lab101/mqtt-welding/internal/mqtttest"
+)
+
+// Create a bridge, it is closed when the test ends
+func newTestBridge(t *testing.T, cfg *BridgeConfig) *mqttBridge {
+	t.Helper()
+	conf := resource.Config{Name: "bridge", API: generic.API, Model: BridgeModel, ConvertedAttributes: cfg}
+	res, err := newBridge(context.Background(), nil, conf, logging.NewTestLogger(t))
+	if err != nil {
+		t.Fatalf("creating bridge: %v", err)
+	}
+	t.Cleanup(func() { res.Close(context.Background()) })
+	return res.(*mqttBridge)
+}
+
+// Close doesn't wait for the acknowledgement of a message the target never acknowledges
+func TestBridgeCloseWithUnacknowledgedMessage(t *testing.T) {
+	source := startTestBroker(t)
+	target := startMuteBroker(t)
+	qos := 1
+	b := newTestBridge(t, &BridgeConfig{
+		Source: BrokerConfig{Host: source.Host, Port: source.Port, ClientID: "bridge-source"},
+		Target: BrokerConfig{Host: target.IP.String(), Port: target.Port, ClientID: "bridge-target"},
+		Rules:  []BridgeRule{{Topic: "weld/#", QoS: &qos}},
+	})
+	mqtttest.Eventually(t, b.target.IsConnectionOpen, "target not connected")
+
+	mqtttest.Publish(t, source.Client(t, "publisher"), "weld/cell1/data", "sample", false)
+	mqtttest.Eventually(t, func() bool {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		return len(b.queue) == 1
+	}, "message not stored")
+
+	closed := make(chan error, 1)
+	go func() { closed <- b.Close(context.Background()) }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close waited for the acknowledgement of the target")
+	}
+}
+
+// The oldest messages are dropped when the buffer is full
+func TestBridgeQueue(t *testing.T) {
+	tests := []struct {
+		name         string
+		bufferLength int
+		messages     int
+		queued       []uint64 // IDs of the stored messages
+		dropped      uint64
+	}{
+		{"empty", 3, 0, nil, 0},
+		{"below the buffer length", 3, 2, []uint64{1, 2}, 0},
+		{"full", 3, 3, []uint64{1, 2, 3}, 0},
+		{"overflow drops the oldest", 3, 5, []uint64{3, 4, 5}, 2},
+		{"buffer of one", 1, 3, []uint64{3}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &mqttBridge{bufferLength: tt.bufferLength}
+			for i := 0; i < tt.messages; i++ {
+				b.enqueue(bridgedMessage{topic: fmt.Sprint("weld/", i)})
+			}
+			var queued []uint64
+			for _, msg := range b.queue {
+				queued = append(queued, msg.id)
+			}
+			if !reflect.DeepEqual(queued, tt.queued) || b.dropped != tt.dropped {
+				t.Errorf("queued %v, dropped %d, want %v, %d", queued, b.dropped, tt.queued, tt.dropped)
+			}
+		})
+	}
+}
+
+// A source message is stored with the target topic, QoS and payload of the first matching rule
+func TestBridgeRules(t *testing.T) {
+	qos0, qos2 := 0, 2
+	rules := []BridgeRule{
+		{Topic: "weld/+/alarm", Prefix: "plant/", QoS: &qos2, Retain: true},
+		{Topic: "weld/#", StripPrefix: "weld/", Prefix: "plant/cells/"},
+		{Topic: "power/#", Transform: `{"current": msg.I, "topic": topic}`, QoS: &qos0},
+		{Topic: "text/#", Transform: `"state " + msg`},
+	}
+	tests := []struct {
+		name   string
+		msg    injectedMessage
+		want   *bridgedMessage // nil if the message is not stored
+		failed uint64
+	}{
+		{
+			name: "first matching rule",
+			msg:  injectedMessage{topic: "weld/cell1/alarm", qos: 1, payload: []byte("overcurrent")},
+			want: &bridgedMessage{topic: "plant/weld/cell1/alarm", qos: 2, retained: true, payload: []byte("overcurrent")},
+		},
+		{
+			name: "strip prefix and source QoS",
+			msg:  injectedMessage{topic: "weld/cell1/data", qos: 1, payload: []byte("{}")},
+			want: &bridgedMessage{topic: "plant/cells/cell1/data", qos: 1, payload: []byte("{}")},
+		},
+		{
+			name: "transform into a JSON object",
+			msg:  injectedMessage{topic: "power/cell1", qos: 1, payload: []byte(`{"I": 180, "U": 21}`)},
+			want: &bridgedMessage{topic: "power/cell1", qos: 0, payload: []byte(`{"current":180,"topic":"power/cell1"}`)},
+		},
+		{
+			name: "transform into a string",
+			msg:  injectedMessage{topic: "text/cell1", payload: []byte("idle")},
+			want: &bridgedMessage{topic: "text/cell1", payload: []byte("state idle")},
+		},
+		{
+			name:   "failed transform",
+			msg:    injectedMessage{topic: "power/cell1", payload: []byte(`{"U": 21}`)},
+			failed: 1,
+		},
+		{
+			name: "no matching rule",
+			msg:  injectedMessage{topic: "gas/cell1", payload: []byte("14")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &mqttBridge{logger: logging.NewTestLogger(t), bufferLength: 10, wake: make(chan struct{}, 1)}
+			for _, rule := range rules {
+				r := bridgeRule{BridgeRule: rule}
+				if rule.Transform != "" {
+					var err error
+					if r.transform, err = compileExpr(rule.Transform); err != nil {
+						t.Fatal(err)
+					}
+				}
+				b.rules = append(b.rules, r)
+			}
+			b.onMessage(nil, &tt.msg)
+			if tt.want == nil {
+				if len(b.queue) != 0 || b.failed != tt.failed {
+					t.Errorf("queued %v, %d failed, want none and %d failed", b.queue, b.failed, tt.failed)
+				}
+				return
+			}
+			tt.want.id = 1
+			if len(b.queue) != 1 || !reflect.DeepEqual(b.queue[0], *tt.want) {
+				t.Errorf("queued %+v, want %+v", b.queue, *tt.want)
+			}
+		})
+	}
+}
+
+// The stored messages are forwarded in order
+func TestBridgeForwards(t *testing.T) {
+	source, target := startTestBroker(t), startTestBroker(t)
+	newTestBridge(t, &BridgeConfig{
+		Source: BrokerConfig{Host: source.Host, Port: source.Port, ClientID: "bridge-source"},
+		Target: BrokerConfig{Host: target.Host, Port: target.Port, ClientID: "bridge-target"},
+		QoS:    1,
+		Rules:  []BridgeRule{{Topic: "weld/#", Prefix: "plant/"}},
+	})
+	messages := mqtttest.Subscribe(t, target.Client(t, "subscriber"), "plant/#")
+	publisher := source.Client(t, "publisher")
+	for i := 0; i < 5; i++ {
+		mqtttest.Publish(t, publisher, "weld/cell1/data", fmt.Sprint(i), false)
+	}
+	for i := 0; i < 5; i++ {
+		m := mqtttest.Receive(t, messages)
+		if m.Topic() != "plant/weld/cell1/data" || string(m.Payload()) != fmt.Sprint(i) {
+			t.Errorf("forwarded %q to %q, want %q to plant/weld/cell1/data", m.Payload(), m.Topic(), fmt.Sprint(i))
+		}
+	}
+}
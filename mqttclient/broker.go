@@ -0,0 +1,375 @@
+package mqttclient
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	mochipackets "github.com/mochi-mqtt/server/v2/packets"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+	"go.viam.com/rdk/services/generic"
+)
+
+// Service model running an embedded MQTT broker on the machine
+var BrokerModel = resource.NewModel("lab101", "mqtt", "broker")
+
+// Default listen address of the embedded broker, only reachable from the machine as clients are not authenticated
+const defaultBrokerListen = "127.0.0.1:1883"
+
+// Default listen address of the embedded broker with credentials, reachable from the network
+const defaultAuthenticatedBrokerListen = ":1883"
+
+func init() {
+	resource.RegisterService(generic.API, BrokerModel,
+		resource.Registration[resource.Resource, *BrokerServiceConfig]{Constructor: newBrokerService})
+}
+
+// Maps the upstream attribute, local messages matching the topics are forwarded upstream
+type UpstreamConfig struct {
+	BrokerConfig `json:",squash"`
+	Topics       []string `json:"topics"` // Forwarded topic filters, default ["#"]
+	QoS          int      `json:"qos"`
+}
+
+// Maps JSON broker service configuration attributes.
+type BrokerServiceConfig struct {
+	Listen   string          `json:"listen"`   // Listen address, default "127.0.0.1:1883", ":1883" with a username
+	Username string          `json:"username"` // Optional credentials required from clients
+	Password string          `json:"password"`
+	Upstream *UpstreamConfig `json:"upstream"`
+}
+
+// Implement broker service configuration validation and return implicit dependencies.
+func (cfg *BrokerServiceConfig) Validate(path string) ([]string, error) {
+	if cfg.Listen != "" {
+		if _, _, err := net.SplitHostPort(cfg.Listen); err != nil {
+			return nil, fmt.Errorf("invalid listen address %q: %v %q", cfg.Listen, err, path)
+		}
+	}
+	if cfg.Password != "" && cfg.Username == "" {
+		return nil, fmt.Errorf("password requires a username %q", path)
+	}
+	if cfg.Upstream != nil {
+		if err := cfg.Upstream.BrokerConfig.Validate(path + ".upstream"); err != nil {
+			return nil, err
+		}
+		if cfg.Upstream.QoS < 0 || cfg.Upstream.QoS > 2 {
+			return nil, fmt.Errorf("upstream qos must be between 0 and 2 %q", path)
+		}
+		for _, topic := range cfg.Upstream.Topics {
+			if !validTopicFilter(topic) {
+				return nil, fmt.Errorf("invalid upstream topic filter %q %q", topic, path)
+			}
+		}
+	}
+	return []string{}, nil
+}
+
+// Check a subscription topic filter, '#' must be the last level and wildcards must fill a whole level
+func validTopicFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+	return true
+}
+
+type mqttBrokerService struct {
+	resource.Named
+	resource.AlwaysRebuild
+	logger   logging.Logger
+	broker   *embeddedBroker
+	upstream mqtt.Client
+	cfg      *BrokerServiceConfig
+}
+
+// Broker service constructor, the broker is restarted on reconfiguration
+func newBrokerService(ctx context.Context, deps resource.Dependencies, conf resource.Config, logger logging.Logger) (resource.Resource, error) {
+	serviceConfig, err := resource.NativeConfig[*BrokerServiceConfig](conf)
+	if err != nil {
+		return nil, err
+	}
+	s := &mqttBrokerService{
+		Named:  conf.ResourceName().AsNamed(),
+		logger: logger,
+		cfg:    serviceConfig,
+	}
+	if up := serviceConfig.Upstream; up != nil {
+		if s.upstream, err = up.connect(ctx); err != nil {
+			return nil, fmt.Errorf("error connecting upstream broker: %v", err)
+		}
+	}
+	listen := serviceConfig.Listen
+	switch {
+	case listen == "" && serviceConfig.Username != "":
+		listen = defaultAuthenticatedBrokerListen
+	case listen == "":
+		listen = defaultBrokerListen
+	case serviceConfig.Username == "":
+		if host, _, _ := net.SplitHostPort(listen); host == "" || net.ParseIP(host).IsUnspecified() {
+			logger.Warn("embedded broker listens on all interfaces without credentials, any host of the network can publish and subscribe")
+		}
+	}
+	s.broker, err = newEmbeddedBroker(listen, serviceConfig.Username, serviceConfig.Password, s.forward, logger)
+	if err != nil {
+		if s.upstream != nil {
+			s.upstream.Disconnect(250)
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+// Forward a local message upstream when it matches the upstream topics
+func (s *mqttBrokerService) forward(p *packets.PublishPacket) {
+	if s.upstream == nil {
+		return
+	}
+	topics := s.cfg.Upstream.Topics
+	if len(topics) == 0 {
+		topics = []string{"#"}
+	}
+	for _, filter := range topics {
+		if topicMatches(filter, p.TopicName) {
+			// Don't wait for the acknowledgement, the upstream client queues the message
+			s.upstream.Publish(p.TopicName, byte(s.cfg.Upstream.QoS), p.Retain, p.Payload)
+			return
+		}
+	}
+}
+
+// DoCommand returns the broker status: {"status": true}
+func (s *mqttBrokerService) DoCommand(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	if _, ok := cmd["status"]; !ok {
+		return nil, errUnimplemented
+	}
+	status := s.broker.status()
+	if s.upstream != nil {
+		status["upstream_connected"] = s.upstream.IsConnected()
+	}
+	return status, nil
+}
+
+// Stop the broker and disconnect from the upstream broker
+func (s *mqttBrokerService) Close(ctx context.Context) error {
+	err := s.broker.close()
+	if s.upstream != nil {
+		s.upstream.Disconnect(250) // Timeout in milliseconds
+	}
+	return err
+}
+
+// Embedded MQTT 3.1.1 and 5 broker, mochi-mqtt listening on one TCP address. Clients authenticate with the
+// username and password if one is configured, all authenticated clients may publish and subscribe to all
+// topics.
+type embeddedBroker struct {
+	server    *mochi.Server
+	listener  *listeners.TCP
+	username  string
+	password  string
+	onPublish func(*packets.PublishPacket)
+	log       *brokerLogHandler
+	routed    atomic.Uint64
+}
+
+// QoS 1 and 2 messages kept per client, including the messages queued for an offline persistent session
+const brokerMaxInflight = 1000
+
+// Start a broker listening on the address
+func newEmbeddedBroker(address, username, password string, onPublish func(*packets.PublishPacket), logger logging.Logger) (*embeddedBroker, error) {
+	capabilities := mochi.NewDefaultServerCapabilities()
+	capabilities.MaximumInflight = brokerMaxInflight
+	log := &brokerLogHandler{logger: logger, state: &brokerLogState{}}
+	b := &embeddedBroker{
+		server: mochi.New(&mochi.Options{
+			Capabilities: capabilities,
+			Logger:       slog.New(log),
+		}),
+		log:       log,
+		listener:  listeners.NewTCP(listeners.Config{ID: "tcp", Address: address}),
+		username:  username,
+		password:  password,
+		onPublish: onPublish,
+	}
+	if err := b.server.AddHook(&brokerHook{broker: b}, nil); err != nil {
+		return nil, fmt.Errorf("error starting embedded broker: %v", err)
+	}
+	if err := b.server.AddListener(b.listener); err != nil {
+		return nil, fmt.Errorf("error starting embedded broker: %v", err)
+	}
+	if err := b.server.Serve(); err != nil {
+		b.server.Close()
+		return nil, fmt.Errorf("error starting embedded broker: %v", err)
+	}
+	return b, nil
+}
+
+// Hook of the broker authenticating the clients and reporting the published messages
+type brokerHook struct {
+	mochi.HookBase
+	broker *embeddedBroker
+}
+
+func (h *brokerHook) ID() string {
+	return "lab101-broker"
+}
+
+func (h *brokerHook) Provides(b byte) bool {
+	switch b {
+	case mochi.OnConnectAuthenticate, mochi.OnACLCheck, mochi.OnPublished, mochi.OnWillSent:
+		return true
+	}
+	return false
+}
+
+// Accept all clients without a configured username, otherwise the credentials must match
+func (h *brokerHook) OnConnectAuthenticate(cl *mochi.Client, pk mochipackets.Packet) bool {
+	if h.broker.username == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare(pk.Connect.Username, []byte(h.broker.username)) == 1 &&
+		subtle.ConstantTimeCompare(pk.Connect.Password, []byte(h.broker.password)) == 1
+}
+
+func (h *brokerHook) OnACLCheck(cl *mochi.Client, topic string, write bool) bool {
+	return true
+}
+
+func (h *brokerHook) OnPublished(cl *mochi.Client, pk mochipackets.Packet) {
+	h.broker.published(pk)
+}
+
+func (h *brokerHook) OnWillSent(cl *mochi.Client, pk mochipackets.Packet) {
+	h.broker.published(pk)
+}
+
+// Count a message routed to the subscribers and pass it to the publish handler
+func (b *embeddedBroker) published(pk mochipackets.Packet) {
+	b.routed.Add(1)
+	if b.onPublish == nil {
+		return
+	}
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = pk.TopicName
+	p.Payload = pk.Payload
+	p.Qos = pk.FixedHeader.Qos
+	p.Retain = pk.FixedHeader.Retain
+	b.onPublish(p)
+}
+
+// Check a publish topic name, wildcards are not allowed
+func validTopicName(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "+#")
+}
+
+// Return the connected clients and broker counters
+func (b *embeddedBroker) status() map[string]interface{} {
+	clients := []string{}
+	offline := 0
+	for id, cl := range b.server.Clients.GetAll() {
+		switch {
+		case cl.Net.Inline:
+		case cl.Closed():
+			offline++
+		default:
+			clients = append(clients, id)
+		}
+	}
+	sort.Strings(clients)
+	return map[string]interface{}{
+		"address":          b.listener.Address(),
+		"clients":          stringList(clients),
+		"offline_sessions": offline,
+		"subscriptions":    int(atomic.LoadInt64(&b.server.Info.Subscriptions)),
+		"inflight":         int(atomic.LoadInt64(&b.server.Info.Inflight)),
+		"retained":         b.server.Topics.Retained.Len(),
+		"routed":           b.routed.Load(),
+	}
+}
+
+// Stop listening and disconnect all clients. The goroutines of the broker end in the background, their
+// log records are dropped once the broker is closed.
+func (b *embeddedBroker) close() error {
+	err := b.server.Close()
+	b.log.state.mutex.Lock()
+	b.log.state.closed = true
+	b.log.state.mutex.Unlock()
+	return err
+}
+
+// Writes the log records of the broker to the logger of the service. The broker logs every client
+// connection at info level and every connection closed by a client as warning, these are debug messages
+// of the service.
+type brokerLogHandler struct {
+	logger logging.Logger
+	attrs  []interface{}
+	state  *brokerLogState // Shared by the handlers with attributes
+}
+
+type brokerLogState struct {
+	closed bool
+	mutex  sync.RWMutex // Held while a record is written, so none is written once the broker is closed
+}
+
+func (h *brokerLogHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *brokerLogHandler) Handle(_ context.Context, r slog.Record) error {
+	h.state.mutex.RLock()
+	defer h.state.mutex.RUnlock()
+	if h.state.closed {
+		return nil
+	}
+	args := append([]interface{}{}, h.attrs...)
+	closed := false
+	r.Attrs(func(a slog.Attr) bool {
+		if err, ok := a.Value.Any().(error); ok && (errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed)) {
+			closed = true
+		}
+		args = append(args, a.Key, a.Value.Any())
+		return true
+	})
+	switch {
+	case r.Level >= slog.LevelError:
+		h.logger.Errorw(r.Message, args...)
+	case r.Level >= slog.LevelWarn && !closed:
+		h.logger.Warnw(r.Message, args...)
+	default:
+		h.logger.Debugw(r.Message, args...)
+	}
+	return nil
+}
+
+func (h *brokerLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	args := append([]interface{}{}, h.attrs...)
+	for _, a := range attrs {
+		args = append(args, a.Key, a.Value.Any())
+	}
+	return &brokerLogHandler{logger: h.logger, attrs: args, state: h.state}
+}
+
+func (h *brokerLogHandler) WithGroup(string) slog.Handler {
+	return h
+}
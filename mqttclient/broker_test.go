@@ -0,0 +1,254 @@
+package mqttclient
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"go.viam.com/rdk/logging"
+
+	"github.com/lab101/mqtt-welding/internal/mqtttest"
+)
+
+// Time a test waits to make sure a packet is not sent
+const brokerQuietTime = 200 * time.Millisecond
+
+// Start the embedded broker on a free local port, it is stopped when the test ends
+func newTestEmbeddedBroker(t *testing.T) (*embeddedBroker, *mqtttest.Broker) {
+	t.Helper()
+	var broker *embeddedBroker
+	b := mqtttest.StartBroker(t, func(address string) (func(), error) {
+		var err error
+		if broker, err = newEmbeddedBroker(address, "", "", nil, logging.NewTestLogger(t)); err != nil {
+			return nil, err
+		}
+		return func() { broker.close() }, nil
+	})
+	return broker, b
+}
+
+// A client speaking MQTT packets directly, to control the acknowledgements the broker receives
+type rawClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Connect a raw client and return the CONNACK
+func dialRaw(t *testing.T, b *mqtttest.Broker, clientID string, clean bool) (*rawClient, *packets.ConnackPacket) {
+	t.Helper()
+	conn, err := net.Dial("tcp", b.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &rawClient{conn: conn, reader: bufio.NewReader(conn)}
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ProtocolName, connect.ProtocolVersion = "MQTT", 4
+	connect.ClientIdentifier, connect.CleanSession = clientID, clean
+	c.send(t, connect)
+	ack, ok := c.read(t).(*packets.ConnackPacket)
+	if !ok || ack.ReturnCode != packets.Accepted {
+		t.Fatalf("connection of %q refused: %v", clientID, ack)
+	}
+	return c, ack
+}
+
+func (c *rawClient) send(t *testing.T, p packets.ControlPacket) {
+	t.Helper()
+	if err := p.Write(c.conn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *rawClient) read(t *testing.T) packets.ControlPacket {
+	t.Helper()
+	_ = c.conn.SetReadDeadline(time.Now().Add(mqtttest.Timeout))
+	p, err := packets.ReadPacket(c.reader)
+	if err != nil {
+		t.Fatalf("reading packet: %v", err)
+	}
+	return p
+}
+
+// Fail if the client receives a packet within the quiet time
+func (c *rawClient) expectNothing(t *testing.T) {
+	t.Helper()
+	_ = c.conn.SetReadDeadline(time.Now().Add(brokerQuietTime))
+	if p, err := packets.ReadPacket(c.reader); err == nil {
+		t.Fatalf("unexpected packet %v", p)
+	}
+}
+
+func (c *rawClient) subscribe(t *testing.T, filter string, qos byte) byte {
+	t.Helper()
+	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	sub.MessageID, sub.Topics, sub.Qoss = 1, []string{filter}, []byte{qos}
+	c.send(t, sub)
+	ack, ok := c.read(t).(*packets.SubackPacket)
+	if !ok || len(ack.ReturnCodes) != 1 {
+		t.Fatalf("subscription of %q not acknowledged: %v", filter, ack)
+	}
+	return ack.ReturnCodes[0]
+}
+
+func (c *rawClient) publish(t *testing.T, topic string, qos byte, id uint16, dup bool) {
+	t.Helper()
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName, pub.Qos, pub.MessageID, pub.Dup, pub.Payload = topic, qos, id, dup, []byte("payload")
+	c.send(t, pub)
+}
+
+func (c *rawClient) readPublish(t *testing.T) *packets.PublishPacket {
+	t.Helper()
+	p, ok := c.read(t).(*packets.PublishPacket)
+	if !ok {
+		t.Fatalf("received %v instead of a message", p)
+	}
+	return p
+}
+
+// An incoming QoS 2 message is delivered once, also if the publisher retransmits it before releasing it
+func TestBrokerDeliversQoS2Once(t *testing.T) {
+	_, b := newTestEmbeddedBroker(t)
+	subscriber, _ := dialRaw(t, b, "subscriber", true)
+	subscriber.subscribe(t, "weld/result", 0)
+	publisher, _ := dialRaw(t, b, "publisher", true)
+
+	for _, dup := range []bool{false, true} {
+		publisher.publish(t, "weld/result", 2, 7, dup)
+		if rec, ok := publisher.read(t).(*packets.PubrecPacket); !ok || rec.MessageID != 7 {
+			t.Fatalf("received %v instead of PUBREC", rec)
+		}
+	}
+	rel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+	rel.MessageID = 7
+	publisher.send(t, rel)
+	if comp, ok := publisher.read(t).(*packets.PubcompPacket); !ok || comp.MessageID != 7 {
+		t.Fatalf("received %v instead of PUBCOMP", comp)
+	}
+	if p := subscriber.readPublish(t); p.TopicName != "weld/result" {
+		t.Errorf("delivered message on %q", p.TopicName)
+	}
+	subscriber.expectNothing(t)
+}
+
+// QoS 2 subscriptions are granted, unacknowledged messages are sent again when the session resumes
+func TestBrokerResendsUnacknowledged(t *testing.T) {
+	broker, b := newTestEmbeddedBroker(t)
+	subscriber, _ := dialRaw(t, b, "subscriber", false)
+	if qos := subscriber.subscribe(t, "weld/result", 2); qos != 2 {
+		t.Fatalf("granted QoS %d, want 2", qos)
+	}
+	publisher, _ := dialRaw(t, b, "publisher", true)
+	publisher.publish(t, "weld/result", 1, 1, false)
+	publisher.read(t)
+
+	p := subscriber.readPublish(t)
+	if p.Qos != 1 || p.Dup {
+		t.Fatalf("delivered QoS %d dup %v, want the QoS of the message", p.Qos, p.Dup)
+	}
+	subscriber.conn.Close()
+	subscriber, _ = dialRaw(t, b, "subscriber", false)
+	if again := subscriber.readPublish(t); again.MessageID != p.MessageID || !again.Dup {
+		t.Fatalf("resent message %d = %d dup %v", p.MessageID, again.MessageID, again.Dup)
+	}
+	ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+	ack.MessageID = p.MessageID
+	subscriber.send(t, ack)
+
+	publisher.publish(t, "weld/result", 2, 2, false)
+	publisher.read(t)
+	rel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+	rel.MessageID = 2
+	publisher.send(t, rel)
+	publisher.read(t)
+	p = subscriber.readPublish(t)
+	if p.Qos != 2 {
+		t.Fatalf("delivered QoS %d, want 2", p.Qos)
+	}
+	rec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+	rec.MessageID = p.MessageID
+	subscriber.send(t, rec)
+	if rel, ok := subscriber.read(t).(*packets.PubrelPacket); !ok || rel.MessageID != p.MessageID {
+		t.Fatalf("received %v instead of PUBREL", rel)
+	}
+	comp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+	comp.MessageID = p.MessageID
+	subscriber.send(t, comp)
+	mqtttest.Eventually(t, func() bool { return broker.status()["inflight"] == 0 }, "acknowledged messages still inflight")
+}
+
+// A persistent session keeps its subscriptions and the messages published while it is offline
+func TestBrokerPersistentSession(t *testing.T) {
+	broker, b := newTestEmbeddedBroker(t)
+	subscriber, ack := dialRaw(t, b, "station", false)
+	if ack.SessionPresent {
+		t.Error("new session reported as present")
+	}
+	subscriber.subscribe(t, "weld/result", 1)
+	subscriber.send(t, packets.NewControlPacket(packets.Disconnect))
+	mqtttest.Eventually(t, func() bool { return broker.status()["offline_sessions"] == 1 }, "session not kept")
+
+	// The broker handles the packets of a client in order, the QoS 0 message is routed before the PUBACK
+	publisher, _ := dialRaw(t, b, "publisher", true)
+	publisher.publish(t, "weld/result", 0, 0, false)
+	publisher.publish(t, "weld/result", 1, 1, false)
+	publisher.read(t)
+
+	subscriber, ack = dialRaw(t, b, "station", false)
+	if !ack.SessionPresent {
+		t.Error("resumed session not reported as present")
+	}
+	if p := subscriber.readPublish(t); p.Qos != 1 {
+		t.Errorf("queued message with QoS %d", p.Qos)
+	}
+	subscriber.expectNothing(t)
+
+	// A clean session discards the stored session
+	subscriber.conn.Close()
+	subscriber, ack = dialRaw(t, b, "station", true)
+	if ack.SessionPresent {
+		t.Error("clean session reported as present")
+	}
+	publisher.publish(t, "weld/result", 1, 2, false)
+	publisher.read(t)
+	subscriber.expectNothing(t)
+}
+
+// Clients of a broker with credentials connect with the username and password of their configuration
+func TestBrokerAuthentication(t *testing.T) {
+	b := mqtttest.StartBroker(t, func(address string) (func(), error) {
+		broker, err := newEmbeddedBroker(address, "cell1", "secret", nil, logging.NewTestLogger(t))
+		if err != nil {
+			return nil, err
+		}
+		return func() { broker.close() }, nil
+	})
+	tests := []struct {
+		name     string
+		username string
+		password string
+		ok       bool
+	}{
+		{"credentials", "cell1", "secret", true},
+		{"wrong password", "cell1", "guess", false},
+		{"no credentials", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &BrokerConfig{Host: b.Host, Port: b.Port, ClientID: "gauge", Username: tt.username, Password: tt.password}
+			ctx, cancel := context.WithTimeout(context.Background(), mqtttest.Timeout)
+			defer cancel()
+			client, err := cfg.connect(ctx)
+			if err == nil {
+				client.Disconnect(0)
+			}
+			if (err == nil) != tt.ok {
+				t.Errorf("connect = %v, want success %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package mqttclient
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.viam.com/rdk/components/generic"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+)
+
+// Button model publishing a payload on push. The RDK version used by this module has no
+// button API yet, so the button is a generic component pushed with the push command.
+var ButtonModel = resource.NewModel("lab101", "mqtt", "button")
+
+func init() {
+	resource.RegisterComponent(generic.API, ButtonModel,
+		resource.Registration[resource.Resource, *ButtonConfig]{Constructor: newButton})
+}
+
+// Maps JSON button configuration attributes.
+type ButtonConfig struct {
+	BrokerConfig `json:",squash"`
+	Topic        string `json:"topic"`
+	QoS          int    `json:"qos"`
+	Retained     bool   `json:"retained"`
+	Payload      string `json:"payload"`    // Payload template, default {"pushed": "{{timestamp}}"}
+	MachineID    string `json:"machine_id"` // Value of {{machine_id}}, default the hostname
+}
+
+// Implement button configuration validation and return implicit dependencies.
+func (cfg *ButtonConfig) Validate(path string) ([]string, error) {
+	if cfg.Topic == "" {
+		return nil, fmt.Errorf("topic is required %q", path)
+	}
+	if err := cfg.BrokerConfig.Validate(path); err != nil {
+		return nil, err
+	}
+	if cfg.QoS < 0 || cfg.QoS > 2 {
+		return nil, fmt.Errorf("qos must be between 0 and 2 %q", path)
+	}
+	return []string{}, nil
+}
+
+type mqttButton struct {
+	resource.Named
+	resource.AlwaysRebuild
+	logger    logging.Logger
+	client    mqtt.Client
+	cfg       *ButtonConfig
+	machineID string
+}
+
+// Button constructor, the button is rebuilt on reconfiguration
+func newButton(ctx context.Context, deps resource.Dependencies, conf resource.Config, logger logging.Logger) (resource.Resource, error) {
+	buttonConfig, err := resource.NativeConfig[*ButtonConfig](conf)
+	if err != nil {
+		return nil, err
+	}
+	b := &mqttButton{
+		Named:     conf.ResourceName().AsNamed(),
+		logger:    logger,
+		cfg:       buttonConfig,
+		machineID: buttonConfig.MachineID,
+	}
+	if b.machineID == "" {
+		b.machineID, _ = os.Hostname()
+	}
+	if b.client, err = buttonConfig.connect(ctx); err != nil {
+		return nil, fmt.Errorf("error initializing mqtt button: %v", err)
+	}
+	return b, nil
+}
+
+// Fill the {{timestamp}}, {{machine_id}} and {{name}} placeholders of the payload template
+func (b *mqttButton) payload(now time.Time) string {
+	template := b.cfg.Payload
+	if template == "" {
+		template = `{"pushed": "{{timestamp}}"}`
+	}
+	return strings.NewReplacer(
+		"{{timestamp}}", now.UTC().Format(time.RFC3339Nano),
+		"{{machine_id}}", b.machineID,
+		"{{name}}", b.Name().ShortName(),
+	).Replace(template)
+}
+
+// Publish the payload to the topic
+func (b *mqttButton) Push(ctx context.Context) error {
+	return publishAndWait(ctx, b.client, b.cfg.Topic, byte(b.cfg.QoS), b.cfg.Retained, b.payload(time.Now()))
+}
+
+// DoCommand implements the button method: {"push": true}
+func (b *mqttButton) DoCommand(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	if _, ok := cmd["push"]; ok {
+		if err := b.Push(ctx); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"pushed": true}, nil
+	}
+	return nil, errUnimplemented
+}
+
+// Disconnect from the broker
+func (b *mqttButton) Close(ctx context.Context) error {
+	if b.client != nil {
+		b.client.Disconnect(250) // Timeout in milliseconds
+	}
+	return nil
+}
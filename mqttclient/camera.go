@@ -0,0 +1,151 @@
+package mqttclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg" // Register the JPEG decoder
+	_ "image/png"  // Register the PNG decoder
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.viam.com/rdk/components/camera"
+	"go.viam.com/rdk/gostream"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+)
+
+// Camera model fed by JPEG/PNG images published on a topic
+var CameraModel = resource.NewModel("lab101", "mqtt", "camera")
+
+func init() {
+	resource.RegisterComponent(camera.API, CameraModel, resource.Registration[camera.Camera, *CameraConfig]{Constructor: newCamera})
+}
+
+// Maps JSON camera configuration attributes.
+type CameraConfig struct {
+	BrokerConfig `json:",squash"`
+	Topic        string `json:"topic"`
+	QoS          int    `json:"qos"`
+	Encoding     string `json:"encoding"`    // Supported raw (default), base64
+	ImageField   string `json:"image_field"` // Optional JSON payload field containing the base64 encoded image
+}
+
+// Implement camera configuration validation and return implicit dependencies.
+func (cfg *CameraConfig) Validate(path string) ([]string, error) {
+	if cfg.Topic == "" {
+		return nil, fmt.Errorf("topic is required %q", path)
+	}
+	if err := cfg.BrokerConfig.Validate(path); err != nil {
+		return nil, err
+	}
+	if cfg.QoS < 0 || cfg.QoS > 2 {
+		return nil, fmt.Errorf("qos must be between 0 and 2 %q", path)
+	}
+	if cfg.Encoding != "" && cfg.Encoding != "raw" && cfg.Encoding != "base64" {
+		return nil, fmt.Errorf("encoding must be raw or base64 %q", path)
+	}
+	return []string{}, nil
+}
+
+type mqttCamera struct {
+	resource.Named
+	resource.AlwaysRebuild
+	camera.VideoSource
+	logger      logging.Logger
+	client      mqtt.Client
+	encoding    string
+	imageField  string
+	latestImage []byte
+	decoded     image.Image
+	mutex       sync.Mutex
+}
+
+// Camera constructor, the camera is rebuilt on reconfiguration
+func newCamera(ctx context.Context, deps resource.Dependencies, conf resource.Config, logger logging.Logger) (camera.Camera, error) {
+	cameraConfig, err := resource.NativeConfig[*CameraConfig](conf)
+	if err != nil {
+		return nil, err
+	}
+	c := &mqttCamera{
+		Named:      conf.ResourceName().AsNamed(),
+		logger:     logger,
+		encoding:   cameraConfig.Encoding,
+		imageField: cameraConfig.ImageField,
+	}
+	c.VideoSource, err = camera.NewVideoSourceFromReader(ctx, gostream.VideoReaderFunc(c.read), nil, camera.ColorStream)
+	if err != nil {
+		return nil, err
+	}
+	c.client, err = cameraConfig.connectAndSubscribe(ctx, cameraConfig.Topic, byte(cameraConfig.QoS), c.onMessage)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("error initializing mqtt camera: %v", err), c.VideoSource.Close(ctx))
+	}
+	return c, nil
+}
+
+// Store the latest image payload, decoding happens when the image is read
+func (c *mqttCamera) onMessage(client mqtt.Client, msg mqtt.Message) {
+	img, err := c.extractImage(msg.Payload())
+	if err != nil {
+		c.logger.Debugf("dropped image message: %v", err)
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.latestImage = img
+	c.decoded = nil
+}
+
+// Extract the encoded image bytes from a payload
+func (c *mqttCamera) extractImage(payload []byte) ([]byte, error) {
+	encoded := payload
+	if c.imageField != "" {
+		var fields map[string]interface{}
+		if err := json.Unmarshal(payload, &fields); err != nil {
+			return nil, fmt.Errorf("error parsing JSON message: %v", err)
+		}
+		v, ok := lookupField(fields, c.imageField)
+		if !ok {
+			return nil, fmt.Errorf("image field %q not found", c.imageField)
+		}
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("image field %q is not a string", c.imageField)
+		}
+		encoded = []byte(s)
+	}
+	if c.encoding == "base64" || c.imageField != "" {
+		return base64.StdEncoding.DecodeString(string(encoded))
+	}
+	return encoded, nil
+}
+
+// Return the latest image
+func (c *mqttCamera) read(ctx context.Context) (image.Image, func(), error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.latestImage == nil {
+		return nil, nil, errors.New("no image received yet")
+	}
+	if c.decoded == nil {
+		img, _, err := image.Decode(bytes.NewReader(c.latestImage))
+		if err != nil {
+			return nil, nil, fmt.Errorf("error decoding image: %v", err)
+		}
+		c.decoded = img
+	}
+	return c.decoded, func() {}, nil
+}
+
+// Disconnect from the broker and close the video source
+func (c *mqttCamera) Close(ctx context.Context) error {
+	if c.client != nil {
+		c.client.Disconnect(250) // Timeout in milliseconds
+	}
+	return c.VideoSource.Close(ctx)
+}
@@ -0,0 +1,397 @@
+package mqttclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "go.viam.com/api/app/datasync/v1"
+	"go.viam.com/rdk/components/sensor"
+	"go.viam.com/rdk/protoutils"
+	"go.viam.com/rdk/services/datamanager/datacapture"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Method name of the tabular captures written by the client, the same the data manager uses
+const readingsCaptureMethod = "Readings"
+
+// The in progress tabular capture files are completed for sync at this interval
+const captureFlushInterval = 10 * time.Second
+
+// Size of the tabular capture files, the same the data manager uses
+const maxCaptureFileSize = 256 * 1024
+
+// Default capture directory of the data manager
+func defaultCaptureDir() string {
+	return filepath.Join(os.Getenv("HOME"), ".viam", "capture")
+}
+
+// Writes captures to the capture directory of the data manager, which syncs them like its own
+// captures. Unlike the data manager the client knows the tags of every message.
+type captureWriter struct {
+	dir     string
+	name    string
+	buffers map[string]*datacapture.Buffer // Tabular captures by method and tags
+}
+
+func newCaptureWriter(dir, name string) *captureWriter {
+	if dir == "" {
+		dir = defaultCaptureDir()
+	}
+	return &captureWriter{dir: dir, name: name, buffers: map[string]*datacapture.Buffer{}}
+}
+
+// Build the capture metadata and create the directory of a method, the layout is the same the data manager uses
+func (w *captureWriter) metadata(method string, dataType v1.DataType, params map[string]string, ext string, tags []string) (*v1.DataCaptureMetadata, string, error) {
+	methodParams, err := protoutils.ConvertStringMapToAnyPBMap(params)
+	if err != nil {
+		return nil, "", err
+	}
+	md := &v1.DataCaptureMetadata{
+		ComponentType:    sensor.API.String(),
+		ComponentName:    w.name,
+		MethodName:       method,
+		Type:             dataType,
+		MethodParameters: methodParams,
+		FileExtension:    ext,
+		Tags:             tags,
+	}
+	// The capture files replace the reserved characters of the whole path, e.g. "rdk_component_sensor"
+	dir := datacapture.FilePathWithReplacedReservedChars(filepath.Join(w.dir, md.ComponentType, md.ComponentName, md.MethodName))
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, "", err
+	}
+	return md, dir, nil
+}
+
+// Append readings to the tabular capture of the method and tags
+func (w *captureWriter) writeTabular(method string, tags []string, readings map[string]interface{}, requested, received time.Time) error {
+	v, err := structValue(readings)
+	if err != nil {
+		return err
+	}
+	pbReadings := &structpb.Struct{Fields: map[string]*structpb.Value{"readings": v}}
+	key := method + "\x00" + strings.Join(tags, "\x00")
+	buffer, ok := w.buffers[key]
+	if !ok {
+		md, dir, err := w.metadata(method, v1.DataType_DATA_TYPE_TABULAR_SENSOR, nil, ".dat", tags)
+		if err != nil {
+			return err
+		}
+		buffer = datacapture.NewBuffer(dir, md, maxCaptureFileSize)
+		w.buffers[key] = buffer
+	}
+	return buffer.Write(&v1.SensorData{
+		Metadata: &v1.SensorMetadata{TimeRequested: timestamppb.New(requested.UTC()), TimeReceived: timestamppb.New(received.UTC())},
+		Data:     &v1.SensorData_Struct{Struct: pbReadings},
+	})
+}
+
+// Convert a reading to a struct value like its JSON encoding. The types of parsed payloads and readings
+// are converted directly, other types take the JSON round trip.
+func structValue(v interface{}) (*structpb.Value, error) {
+	switch v := v.(type) {
+	case nil:
+		return structpb.NewNullValue(), nil
+	case bool:
+		return structpb.NewBoolValue(v), nil
+	case string:
+		return structpb.NewStringValue(strings.ToValidUTF8(v, "\uFFFD")), nil
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("unsupported reading value %v", v)
+		}
+		return structpb.NewNumberValue(v), nil
+	case int:
+		return structpb.NewNumberValue(float64(v)), nil
+	case int32:
+		return structpb.NewNumberValue(float64(v)), nil
+	case int64:
+		return structpb.NewNumberValue(float64(v)), nil
+	case uint64:
+		return structpb.NewNumberValue(float64(v)), nil
+	case map[string]interface{}:
+		fields := make(map[string]*structpb.Value, len(v))
+		for k, item := range v {
+			value, err := structValue(item)
+			if err != nil {
+				return nil, err
+			}
+			fields[strings.ToValidUTF8(k, "\uFFFD")] = value
+		}
+		return structpb.NewStructValue(&structpb.Struct{Fields: fields}), nil
+	case []interface{}:
+		values := make([]*structpb.Value, len(v))
+		for i, item := range v {
+			value, err := structValue(item)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = value
+		}
+		return structpb.NewListValue(&structpb.ListValue{Values: values}), nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		return nil, err
+	}
+	return structpb.NewValue(decoded)
+}
+
+// Write binary data to its own capture file and return its path
+func (w *captureWriter) writeBinary(method string, tags []string, params map[string]string, ext string, payload []byte, requested, received time.Time) (string, error) {
+	md, dir, err := w.metadata(method, v1.DataType_DATA_TYPE_BINARY_SENSOR, params, ext, tags)
+	if err != nil {
+		return "", err
+	}
+	f, err := datacapture.NewFile(dir, md)
+	if err != nil {
+		return "", err
+	}
+	err = f.WriteNext(&v1.SensorData{
+		Metadata: &v1.SensorMetadata{TimeRequested: timestamppb.New(requested.UTC()), TimeReceived: timestamppb.New(received.UTC())},
+		Data:     &v1.SensorData_Binary{Binary: payload},
+	})
+	if err != nil {
+		return "", errors.Join(err, f.Delete())
+	}
+	// The file is renamed when closed to mark it complete for sync
+	path := strings.TrimSuffix(f.GetPath(), datacapture.InProgressFileExt) + datacapture.FileExt
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// Complete the in progress tabular capture files so the data manager syncs them
+func (w *captureWriter) flush() error {
+	var errs []error
+	for key, buffer := range w.buffers {
+		errs = append(errs, buffer.Flush())
+		// Tags often change with every weld, so idle buffers are not kept
+		delete(w.buffers, key)
+	}
+	return errors.Join(errs...)
+}
+
+// Complete the captures of the previous configuration and create the writer if the client writes
+// captures itself. Must be called with the mutex held.
+func (s *mqttClient) resetCaptureWriter(dir string) {
+	if s.captureWriter != nil {
+		if err := s.captureWriter.flush(); err != nil {
+			s.logger.Errorf("error completing capture files: %v", err)
+		}
+		s.captureWriter = nil
+	}
+	if s.directCapture || s.binaryCapture != nil {
+		s.captureWriter = newCaptureWriter(dir, s.Name().ShortName())
+	}
+	s.startCaptureFlush()
+}
+
+// Start completing the tabular capture files periodically. A previously started flush is stopped.
+func (s *mqttClient) startCaptureFlush() {
+	if s.stopCaptureFlush != nil {
+		s.stopCaptureFlush()
+		s.stopCaptureFlush = nil
+	}
+	if s.captureWriter == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopCaptureFlush = cancel
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(captureFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.done:
+				return
+			case <-ticker.C:
+			}
+			s.mutex.Lock()
+			if s.captureWriter != nil {
+				if err := s.captureWriter.flush(); err != nil {
+					s.logger.Errorf("error completing capture files: %v", err)
+				}
+			}
+			s.mutex.Unlock()
+		}
+	}()
+}
+
+var (
+	topicSegmentSource = regexp.MustCompile(`^topic\[(\d+)\]$`)
+	userPropertySource = regexp.MustCompile(`^user_property\[(.+)\]$`)
+)
+
+// Source of a capture tag value, a topic level, an MQTT 5 user property or a payload field
+type captureTag struct {
+	name     string
+	segment  int    // Topic level, -1 for a user property or a payload field
+	property string // User property key
+	field    string
+}
+
+// Parse the capture tags configuration, the tags are sorted by name
+func parseCaptureTags(tags map[string]string) ([]captureTag, error) {
+	var parsed []captureTag
+	for _, name := range sortedKeys(tags) {
+		source := tags[name]
+		if name == "" || strings.Contains(name, ":") {
+			return nil, fmt.Errorf("invalid capture tag name %q", name)
+		}
+		tag := captureTag{name: name, segment: -1}
+		if m := topicSegmentSource.FindStringSubmatch(source); m != nil {
+			tag.segment, _ = strconv.Atoi(m[1])
+		} else if m := userPropertySource.FindStringSubmatch(source); m != nil {
+			tag.property = m[1]
+		} else if source != "" {
+			tag.field = source
+		} else {
+			return nil, fmt.Errorf("capture tag %q requires a source", name)
+		}
+		parsed = append(parsed, tag)
+	}
+	return parsed, nil
+}
+
+// Return the "name:value" tags of a message in name order, tags without value are omitted
+func (s *mqttClient) captureTags(msg *receivedMessage, payload interface{}) []string {
+	if len(s.captureTagSources) == 0 {
+		return nil
+	}
+	levels := strings.Split(msg.Topic(), "/")
+	fields, _ := payload.(map[string]interface{})
+	tags := []string{}
+	for _, tag := range s.captureTagSources {
+		var value interface{}
+		if tag.segment >= 0 {
+			if tag.segment < len(levels) && levels[tag.segment] != "" {
+				value = levels[tag.segment]
+			}
+		} else if tag.property != "" {
+			if v, ok := userProperty(msg.Message, tag.property); ok && v != "" {
+				value = v
+			}
+		} else if fields != nil {
+			value, _ = lookupField(fields, tag.field)
+		}
+		if value == nil {
+			continue
+		}
+		if _, nested := value.(map[string]interface{}); nested {
+			continue
+		}
+		tags = append(tags, fmt.Sprintf("%s:%v", tag.name, value))
+	}
+	return tags
+}
+
+// Write a message as tabular capture of its stream instead of queueing it for the data manager. Must be
+// called with the mutex held.
+func (s *mqttClient) captureReadings(msg *receivedMessage, stream *captureStream) error {
+	payload, err := s.parse(msg)
+	if err != nil {
+		return err
+	}
+	method := readingsCaptureMethod
+	if stream != nil {
+		method = stream.Name
+	}
+	readings := s.formatReadings(msg, payload)
+	t := s.captureTime(msg)
+	return s.captureWriter.writeTabular(method, s.captureTags(msg, payload), readings, t, t)
+}
+
+// Payload timestamps further ahead of the local clock are not trusted by default
+const defaultMaxClockSkew = time.Minute
+
+// Return the time of a capture, with capture_time "payload" the payload timestamp unless it is out
+// of the clock skew bounds, otherwise the receive time
+func (s *mqttClient) captureTime(msg *receivedMessage) time.Time {
+	if s.captureTimeSource != "payload" || msg.timestamp.IsZero() {
+		return msg.received
+	}
+	if skew := msg.timestamp.Sub(msg.received); skew > s.maxClockSkew {
+		s.logger.Debugf("payload timestamp of message on %q is %v in the future, using the receive time", msg.Topic(), skew)
+		return msg.received
+	}
+	if age := msg.received.Sub(msg.timestamp); s.maxTimestampAge > 0 && age > s.maxTimestampAge {
+		s.logger.Debugf("payload timestamp of message on %q is %v old, using the receive time", msg.Topic(), age)
+		return msg.received
+	}
+	return msg.timestamp
+}
+
+var captureStreamName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// Maps JSON capture stream configuration attributes.
+type CaptureStreamConfig struct {
+	Name               string   `json:"name"`                 // Method name of the captures, e.g. WeldResults
+	Topics             []string `json:"topics"`               // Topic filters of the messages captured in this stream
+	CaptureFrequencyHz float64  `json:"capture_frequency_hz"` // Maximum capture rate, default every message
+}
+
+// Validate a capture stream configuration
+func (cfg *CaptureStreamConfig) Validate() error {
+	if !captureStreamName.MatchString(cfg.Name) || cfg.Name == readingsCaptureMethod || cfg.Name == binaryCaptureMethod {
+		return fmt.Errorf("invalid capture stream name %q", cfg.Name)
+	}
+	if len(cfg.Topics) == 0 {
+		return fmt.Errorf("capture stream %q requires topics", cfg.Name)
+	}
+	for _, topic := range cfg.Topics {
+		if !validTopicFilter(topic) {
+			return fmt.Errorf("invalid topic %q of capture stream %q", topic, cfg.Name)
+		}
+	}
+	if cfg.CaptureFrequencyHz < 0 {
+		return fmt.Errorf("capture_frequency_hz of capture stream %q must be >= 0", cfg.Name)
+	}
+	return nil
+}
+
+// A capture stream and the time of its last capture
+type captureStream struct {
+	CaptureStreamConfig
+	lastCaptured time.Time
+}
+
+// Return the capture stream of a topic, nil for the default "Readings" stream
+func (s *mqttClient) captureStream(topic string) *captureStream {
+	for _, stream := range s.captureStreams {
+		for _, filter := range stream.Topics {
+			if topicMatches(filter, topic) {
+				return stream
+			}
+		}
+	}
+	return nil
+}
+
+// Whether a message is due for capture at the frequency of the stream, records the capture if it is
+func (c *captureStream) due(t time.Time) bool {
+	if c.CaptureFrequencyHz > 0 && t.Sub(c.lastCaptured) < time.Duration(float64(time.Second)/c.CaptureFrequencyHz) {
+		return false
+	}
+	c.lastCaptured = t
+	return true
+}
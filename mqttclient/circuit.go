@@ -0,0 +1,59 @@
+package mqttclient
+
+import (
+	"sync"
+	"time"
+)
+
+// Default time the connection attempts are suspended after too many failures
+const defaultConnectCooldown = 5 * time.Minute
+
+// Suspends the connection attempts after too many consecutive failures, so a struggling broker is not
+// hammered by reconnect loops. The component is degraded until the cool-down has passed.
+type circuitBreaker struct {
+	maxFailures int // 0 disables the breaker
+	cooldown    time.Duration
+	failures    int // Consecutive attempts without connection
+	openUntil   time.Time
+	mutex       sync.Mutex
+}
+
+func newCircuitBreaker(maxFailures int, cooldownS float64) *circuitBreaker {
+	b := &circuitBreaker{maxFailures: maxFailures, cooldown: defaultConnectCooldown}
+	if cooldownS > 0 {
+		b.cooldown = time.Duration(cooldownS * float64(time.Second))
+	}
+	return b
+}
+
+// Count a connection attempt, returns true if the previous attempts exhausted the budget and the
+// breaker opened
+func (b *circuitBreaker) attempt() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.maxFailures == 0 {
+		return false
+	}
+	b.failures++
+	if b.failures <= b.maxFailures {
+		return false
+	}
+	b.failures = 0
+	b.openUntil = time.Now().Add(b.cooldown)
+	return true
+}
+
+// Reset the failures after a successful connection
+func (b *circuitBreaker) connected() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures = 0
+	b.openUntil = time.Time{}
+}
+
+// Whether the breaker is open and when the connection is attempted again
+func (b *circuitBreaker) degraded() (bool, time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return time.Now().Before(b.openUntil), b.openUntil
+}
@@ -1,15 +1,24 @@
 package mqttclient
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/url"
+	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
 	"go.viam.com/rdk/components/sensor"
 	"go.viam.com/rdk/data"
 	"go.viam.com/rdk/logging"
@@ -30,30 +39,137 @@ var Model = resource.NewModel("lab101", "mqtt", "client")
 
 // Maps JSON component configuration attributes.
 type Config struct {
-	Topic       string `json:"topic"`
-	Host        string `json:"host"`
-	Port        int    `json:"port"`
-	QoS         int    `json:"qos"`
-	QueueLength int    `json:"q_length"`
-	ClientID    string `json:"clientid"`
-	PayloadType string `json:"payload"` // Supported json, string, raw (default)
+	Topic              string                `json:"topic"`
+	Host               string                `json:"host"`
+	Port               int                   `json:"port"`
+	QoS                int                   `json:"qos"`
+	QueueLength        int                   `json:"q_length"`
+	ClientID           string                `json:"clientid"`
+	Username           string                `json:"username"` // Optional credentials of the broker connection
+	Password           string                `json:"password"`
+	TLS                *TLSConfig            `json:"tls"`                    // Connect to the broker with TLS
+	Transport          string                `json:"transport"`              // tcp (default) or quic
+	ProtocolVersion    int                   `json:"protocol_version"`       // 4 (MQTT 3.1.1, default) or 5
+	TopicAliasMaximum  int                   `json:"topic_alias_maximum"`    // MQTT 5 topic aliases used in each direction
+	ReceiveMaximum     int                   `json:"receive_maximum"`        // QoS 1 and 2 messages an MQTT 5 broker sends at once
+	SessionExpiry      float64               `json:"session_expiry_s"`       // MQTT 5 session kept after the connection is lost
+	PayloadType        string                `json:"payload"`                // Supported json, string, auto, raw (default)
+	Filters            []string              `json:"filters"`                // Threshold rules like "current_amps > 30", all must match for a message to be queued
+	PayloadRegex       *RegexFilter          `json:"payload_regex"`          // Include/exclude expressions applied to string payloads
+	Filter             string                `json:"filter"`                 // Expression on msg and topic like `msg.status == "FAULT" || topic.endsWith("/alarm")`
+	ReadingsLayout     string                `json:"readings_layout"`        // Supported nested (default), flat
+	RawEncoding        string                `json:"raw_encoding"`           // Encoding of raw payloads in readings: base64, hex, default bytes
+	UTF8Replacement    *string               `json:"utf8_replacement"`       // Replacement of invalid UTF-8 sequences in string payloads, default U+FFFD
+	Units              map[string]string     `json:"units"`                  // Unit per output field added as "units" reading, e.g. {"current_a": "A"}
+	IncludeFields      []string              `json:"include_fields"`         // Only keep these payload fields in readings
+	ExcludeFields      []string              `json:"exclude_fields"`         // Drop these payload fields from readings
+	DerivedFields      []string              `json:"derived_fields"`         // Computed fields like "power_w = volts * amps" or "energy_j += power_w * dt"
+	RollingStats       *RollingStatsConfig   `json:"rolling_stats"`          // EWMA and standard deviation of numeric fields
+	IncludeStats       bool                  `json:"include_stats"`          // Add message rate and throughput metrics as "stats" reading
+	IncludeErrors      bool                  `json:"include_client_errors"`  // Add the MQTT client error count and last error as "client_errors" reading
+	TimestampField     string                `json:"timestamp_field"`        // Payload field with the publish time, used to measure latency
+	ConsumeMode        string                `json:"consume_mode"`           // Supported none (default), queue, latest
+	Join               *JoinConfig           `json:"join"`                   // Combine the latest messages of several topics into one reading
+	DeadLetterTopic    string                `json:"dead_letter_topic"`      // Topic messages failing parsing are republished to
+	IncludeParseErrors bool                  `json:"include_parse_errors"`   // Add the parse failure count and last failures as "parse_errors" reading
+	HistoryLength      int                   `json:"history_length"`         // Received messages kept for the history command, default 100, -1 disables
+	RedactFields       []string              `json:"redact_fields"`          // Payload fields masked when tracing messages
+	NoDataBehavior     string                `json:"no_data_behavior"`       // Readings without message or connection: nil (default), error, reading
+	OnDisconnect       string                `json:"on_disconnect"`          // Readings while disconnected: error, last_known, empty, default no_data_behavior
+	LogSummaryInterval float64               `json:"log_summary_interval_s"` // Interval of the received messages summary log, default 60, -1 disables
+	MaxPayloadBytes    int                   `json:"max_payload_bytes"`      // Larger messages are dropped, default unlimited
+	MessageTTL         float64               `json:"message_ttl_s"`          // Queued messages older than this are not captured, default unlimited
+	LatestTTL          float64               `json:"latest_ttl_s"`           // Readings returns no data if the latest message is older than this, default unlimited
+	DrainDir           string                `json:"drain_dir"`              // Directory the queued messages are written to on close
+	CleanSession       *bool                 `json:"clean_session"`          // Default true, false keeps the broker session across reconnects
+	MaxConnectFailures int                   `json:"max_connect_failures"`   // Consecutive failed connection attempts before the cool-down, default unlimited
+	ConnectCooldown    float64               `json:"connect_cooldown_s"`     // Time without connection attempts after too many failures, default 300
+	WatchdogTimeout    float64               `json:"watchdog_s"`             // Reconnect if no message arrived for this long while connected
+	WatchdogTopic      string                `json:"watchdog_topic"`         // Periodic topic watched by the watchdog, default any subscribed topic
+	StoreDir           string                `json:"store_dir"`              // Directory of the file backed QoS 1 and 2 inflight message store, default in memory
+	OrderMatters       *bool                 `json:"order_matters"`          // Default true, false handles messages concurrently and possibly out of order
+	MaxResumeInflight  int                   `json:"max_resume_inflight"`    // Stored messages published at once when resuming a session, default unlimited
+	SharedConnection   bool                  `json:"shared_connection"`      // Share one connection with the components using the same broker and client ID
+	BinaryCapture      *BinaryCaptureConfig  `json:"binary_capture"`         // Capture payloads as binary data instead of readings
+	DirectCapture      bool                  `json:"direct_capture"`         // Write the messages as captures instead of queueing them for the data manager
+	CaptureTags        map[string]string     `json:"capture_tags"`           // Tags of the captures written by the client, e.g. {"weld_id": "weld_id", "cell": "topic[1]"}
+	CaptureDir         string                `json:"capture_dir"`            // Capture directory of the data manager, default ~/.viam/capture
+	CaptureStreams     []CaptureStreamConfig `json:"capture_streams"`        // Captures of topic groups with their own method name and frequency
+	CaptureTime        string                `json:"capture_time"`           // Time of the captures written by the client: received (default), payload
+	MaxClockSkew       float64               `json:"max_clock_skew_s"`       // Payload timestamps further in the future use the receive time, default 60
+	MaxTimestampAge    float64               `json:"max_timestamp_age_s"`    // Older payload timestamps use the receive time, default unlimited
+	Backfill           *BackfillConfig       `json:"backfill"`               // Request the messages missed during an outage after reconnecting
+	Preset             string                `json:"preset"`                 // Decoder normalizing the payload into the standard weld reading schema, e.g. weld_basic
+	PresetFields       map[string]string     `json:"preset_fields"`          // Source payload fields of the standard fields, replacing the preset defaults
+	Shifts             *ShiftsConfig         `json:"shifts"`                 // Shift calendar of the arc tracking and weld counting resets
+	ArcTracking        *ArcTrackingConfig    `json:"arc_tracking"`           // Add the arc on time, arc starts and duty cycle as "arc" reading
+	HeatInput          *HeatInputConfig      `json:"heat_input"`             // Compute the heat input in kJ/mm per message or per weld segment
+	WeldCounting       *WeldCountingConfig   `json:"weld_counting"`          // Add the weld count and durations as "welds" reading
+	WPS                *WPSConfig            `json:"wps"`                    // Flag samples and welds out of the welding procedure limits
+	Consumables        *ConsumablesConfig    `json:"consumables"`            // Track the wire and gas usage as "consumables" reading
+	ProgramContext     *ProgramContextConfig `json:"program_context"`        // Add the program and part identifiers of a program topic to every message
+	Alarms             *AlarmsConfig         `json:"alarms"`                 // Latch the alarms of fault topics as "active_alarms" reading until acknowledged
+	Counters           []CounterConfig       `json:"counters"`               // Device counters converted into monotonic totals and increments
+	Derivatives        *DerivativesConfig    `json:"derivatives"`            // Rate of change of numeric fields, e.g. dI/dt of the arc current
+	SubscriptionOpts   SubscriptionOptions   `json:"subscription_options"`   // No local and retained handling options by topic filter
+	Simulate           bool                  `json:"simulate"`               // Generate synthetic messages instead of connecting to the broker
+	Simulation         *SimulationConfig     `json:"simulation"`             // Rate, topic and waveforms of the simulated messages
+	Replay             *ReplayConfig         `json:"replay"`                 // Replay a recording instead of connecting to the broker
+	RecordToFile       *RecordConfig         `json:"record_to_file"`         // Append every received message to a rotating local file
+	IngestBuffer       int                   `json:"ingest_buffer"`          // Messages buffered between the MQTT callback and the processing, default 0 (none)
+	ParseWorkers       int                   `json:"parse_workers"`          // Goroutines parsing the buffered payloads off the callback, default 0 (none)
+	RetainedBootstrap  float64               `json:"retained_bootstrap_s"`   // Wait up to this long for the retained messages before the component is ready
 }
 
 // Implement component configuration validation and and return implicit dependencies.
 func (cfg *Config) Validate(path string) ([]string, error) {
-	// Check if the topic is set
-	if cfg.Topic == "" {
+	// Check if the topic is set, in join mode the join topics are used instead
+	if cfg.Join != nil {
+		if err := cfg.Join.Validate(); err != nil {
+			return nil, fmt.Errorf("%v %q", err, path)
+		}
+	} else if cfg.Topic == "" {
 		return nil, fmt.Errorf("topic is required %q", path)
 	}
 
-	// Check if the host is set
-	if cfg.Host == "" {
-		return nil, fmt.Errorf("host is required %q", path)
+	// Check the replay, no broker is needed
+	if cfg.Replay != nil {
+		if err := cfg.Replay.Validate(); err != nil {
+			return nil, fmt.Errorf("%v %q", err, path)
+		}
+		if cfg.Simulate {
+			return nil, fmt.Errorf("replay and simulate can't be combined %q", path)
+		}
 	}
 
-	// Check if the port is valid
-	if cfg.Port <= 0 {
-		return nil, fmt.Errorf("invalid port (should be > 0) %q", path)
+	// Check the simulation, no broker is needed
+	if cfg.Simulate {
+		if cfg.Simulation != nil {
+			if err := cfg.Simulation.Validate(); err != nil {
+				return nil, fmt.Errorf("%v %q", err, path)
+			}
+		}
+		if cfg.Topic == "" && (cfg.Simulation == nil || cfg.Simulation.Topic == "") {
+			return nil, fmt.Errorf("simulation topic is required in join mode %q", path)
+		}
+		if cfg.PayloadType != "json" && cfg.PayloadType != "auto" {
+			return nil, fmt.Errorf("simulate requires payload json or auto %q", path)
+		}
+	} else if cfg.Replay == nil {
+		// Check if the host is set
+		if cfg.Host == "" {
+			return nil, fmt.Errorf("host is required %q", path)
+		}
+
+		// Check if the port is valid
+		if cfg.Port <= 0 {
+			return nil, fmt.Errorf("invalid port (should be > 0) %q", path)
+		}
+
+		// Check the protocol, the credentials and the TLS certificates
+		if err := cfg.broker().validateConnection(path); err != nil {
+			return nil, err
+		}
 	}
 
 	// Check if qos is within a valid range (usually 0 to 2 for MQTT)
@@ -61,35 +177,461 @@ func (cfg *Config) Validate(path string) ([]string, error) {
 		return nil, fmt.Errorf("qos must be between 0 and 2 %q", path)
 	}
 
+	// Check if the filter rules can be parsed
+	for _, rule := range cfg.Filters {
+		if _, err := parseFilterRule(rule); err != nil {
+			return nil, fmt.Errorf("%v %q", err, path)
+		}
+	}
+
+	// Check if the payload regex compiles
+	if _, err := newPayloadRegex(cfg.PayloadRegex); err != nil {
+		return nil, fmt.Errorf("%v %q", err, path)
+	}
+
+	// Check if the derived fields can be parsed
+	for _, def := range cfg.DerivedFields {
+		if _, err := parseDerivedField(def); err != nil {
+			return nil, fmt.Errorf("%v %q", err, path)
+		}
+	}
+
+	// Check the rolling statistics configuration
+	if cfg.RollingStats != nil {
+		if err := cfg.RollingStats.Validate(); err != nil {
+			return nil, fmt.Errorf("%v %q", err, path)
+		}
+	}
+
+	// Check if the consume mode is supported
+	switch cfg.ConsumeMode {
+	case "", "none", "queue", "latest":
+	default:
+		return nil, fmt.Errorf("consume_mode must be none, queue or latest %q", path)
+	}
+
+	// Check if the readings layout is supported
+	if cfg.ReadingsLayout != "" && cfg.ReadingsLayout != "nested" && cfg.ReadingsLayout != "flat" {
+		return nil, fmt.Errorf("readings_layout must be nested or flat %q", path)
+	}
+
+	// Check if the raw encoding is supported
+	if cfg.RawEncoding != "" && cfg.RawEncoding != "base64" && cfg.RawEncoding != "hex" {
+		return nil, fmt.Errorf("raw_encoding must be base64 or hex %q", path)
+	}
+	if cfg.UTF8Replacement != nil && !utf8.ValidString(*cfg.UTF8Replacement) {
+		return nil, fmt.Errorf("utf8_replacement must be valid UTF-8 %q", path)
+	}
+
+	// Check if the units have field names
+	for field := range cfg.Units {
+		if field == "" {
+			return nil, fmt.Errorf("units must not contain an empty field name %q", path)
+		}
+	}
+
+	// Check if the dead-letter topic is a valid topic name
+	if cfg.DeadLetterTopic != "" && !validTopicName(cfg.DeadLetterTopic) {
+		return nil, fmt.Errorf("dead_letter_topic must not contain wildcards %q", path)
+	}
+
+	// Check if the no data behavior is supported
+	switch cfg.NoDataBehavior {
+	case "", "nil", "error", "reading":
+	default:
+		return nil, fmt.Errorf("no_data_behavior must be nil, error or reading %q", path)
+	}
+
+	// A persistent session is identified by the client ID
+	if cfg.CleanSession != nil && !*cfg.CleanSession && cfg.ClientID == "" {
+		return nil, fmt.Errorf("clientid is required when clean_session is false %q", path)
+	}
+
+	// Check the connection retry budget
+	if cfg.MaxConnectFailures < 0 || cfg.ConnectCooldown < 0 {
+		return nil, fmt.Errorf("max_connect_failures and connect_cooldown_s must be >= 0 %q", path)
+	}
+
+	// The stored inflight messages belong to the session of the client ID
+	if cfg.StoreDir != "" && cfg.ClientID == "" {
+		return nil, fmt.Errorf("clientid is required when store_dir is set %q", path)
+	}
+
+	// Check the inflight limit
+	if cfg.MaxResumeInflight < 0 {
+		return nil, fmt.Errorf("max_resume_inflight must be >= 0 %q", path)
+	}
+
+	// The inflight messages of an MQTT 5 connection are kept in memory
+	if cfg.ProtocolVersion == protocolMQTT5 && (cfg.StoreDir != "" || cfg.MaxResumeInflight > 0) {
+		return nil, fmt.Errorf("store_dir and max_resume_inflight are not supported with protocol_version 5 %q", path)
+	}
+
+	// The session options belong to the connection, a shared connection has a clean session with ordered delivery
+	if cfg.SharedConnection {
+		if (cfg.CleanSession != nil && !*cfg.CleanSession) || cfg.StoreDir != "" || (cfg.OrderMatters != nil && !*cfg.OrderMatters) || cfg.MaxResumeInflight > 0 {
+			return nil, fmt.Errorf("clean_session, store_dir, order_matters and max_resume_inflight are not supported with shared_connection %q", path)
+		}
+	}
+
+	// Check the watchdog
+	if cfg.WatchdogTimeout < 0 {
+		return nil, fmt.Errorf("watchdog_s must be >= 0 %q", path)
+	}
+	if cfg.WatchdogTopic != "" && !validTopicFilter(cfg.WatchdogTopic) {
+		return nil, fmt.Errorf("invalid watchdog_topic %q %q", cfg.WatchdogTopic, path)
+	}
+
+	// Check the drop limits
+	if cfg.MaxPayloadBytes < 0 {
+		return nil, fmt.Errorf("max_payload_bytes must be >= 0 %q", path)
+	}
+	if cfg.MessageTTL < 0 {
+		return nil, fmt.Errorf("message_ttl_s must be >= 0 %q", path)
+	}
+	if cfg.LatestTTL < 0 {
+		return nil, fmt.Errorf("latest_ttl_s must be >= 0 %q", path)
+	}
+
+	// Check if the disconnected read behavior is supported
+	switch cfg.OnDisconnect {
+	case "", "error", "last_known", "empty":
+	default:
+		return nil, fmt.Errorf("on_disconnect must be error, last_known or empty %q", path)
+	}
+
+	// Check the binary capture configuration
+	if cfg.BinaryCapture != nil {
+		if err := cfg.BinaryCapture.Validate(); err != nil {
+			return nil, fmt.Errorf("%v %q", err, path)
+		}
+	}
+
+	// Tags are only known for the captures written by the client
+	if len(cfg.CaptureTags) > 0 {
+		if !cfg.DirectCapture && cfg.BinaryCapture == nil {
+			return nil, fmt.Errorf("capture_tags require direct_capture or binary_capture %q", path)
+		}
+		if _, err := parseCaptureTags(cfg.CaptureTags); err != nil {
+			return nil, fmt.Errorf("%v %q", err, path)
+		}
+	}
+
+	// Streams are only known for the captures written by the client
+	if len(cfg.CaptureStreams) > 0 && !cfg.DirectCapture {
+		return nil, fmt.Errorf("capture_streams require direct_capture %q", path)
+	}
+	streamNames := map[string]bool{}
+	for _, stream := range cfg.CaptureStreams {
+		if err := stream.Validate(); err != nil {
+			return nil, fmt.Errorf("%v %q", err, path)
+		}
+		if streamNames[stream.Name] {
+			return nil, fmt.Errorf("duplicate capture stream %q %q", stream.Name, path)
+		}
+		streamNames[stream.Name] = true
+	}
+
+	// Payload timestamps are only used for the captures written by the client
+	switch cfg.CaptureTime {
+	case "", "received":
+	case "payload":
+		if cfg.TimestampField == "" {
+			return nil, fmt.Errorf("capture_time payload requires timestamp_field %q", path)
+		}
+		if !cfg.DirectCapture && cfg.BinaryCapture == nil {
+			return nil, fmt.Errorf("capture_time payload requires direct_capture or binary_capture %q", path)
+		}
+	default:
+		return nil, fmt.Errorf("capture_time must be received or payload %q", path)
+	}
+	if cfg.MaxClockSkew < 0 || cfg.MaxTimestampAge < 0 {
+		return nil, fmt.Errorf("max_clock_skew_s and max_timestamp_age_s must be >= 0 %q", path)
+	}
+
+	// The backlog is only useful if it is captured at the original time
+	if cfg.Backfill != nil {
+		if err := cfg.Backfill.Validate(); err != nil {
+			return nil, fmt.Errorf("%v %q", err, path)
+		}
+		if cfg.CaptureTime != "payload" {
+			return nil, fmt.Errorf("backfill requires capture_time payload %q", path)
+		}
+		// Replayed parts can't be matched to the join topics they were published on
+		if cfg.Join != nil && cfg.Backfill.ReplayTopic != "" {
+			return nil, fmt.Errorf("backfill replay_topic is not supported with join, the backlog is replayed on the join topics %q", path)
+		}
+	}
+
+	// Check the shift calendar
+	if cfg.Shifts != nil {
+		if err := cfg.Shifts.Validate(); err != nil {
+			return nil, fmt.Errorf("%v %q", err, path)
+		}
+	}
+
+	// Check the arc tracking configuration
+	if cfg.ArcTracking != nil {
+		if err := cfg.ArcTracking.Validate(cfg.Shifts); err != nil {
+			return nil, fmt.Errorf("%v %q", err, path)
+		}
+	}
+
+	// Check the heat input configuration
+	if cfg.HeatInput != nil {
+		if err := cfg.HeatInput.Validate(cfg.ArcTracking != nil); err != nil {
+			return nil, fmt.Errorf("%v %q", err, path)
+		}
+	}
+
+	// Check the weld counting configuration
+	if cfg.WeldCounting != nil {
+		if err := cfg.WeldCounting.Validate(cfg.Shifts); err != nil {
+			return nil, fmt.Errorf("%v %q", err, path)
+		}
+	}
+
+	// Check the WPS limits
+	if cfg.WPS != nil {
+		if err := cfg.WPS.Validate(); err != nil {
+			return nil, fmt.Errorf("%v %q", err, path)
+		}
+	}
+
+	// Check the consumables configuration
+	if cfg.Consumables != nil {
+		if err := cfg.Consumables.Validate(); err != nil {
+			return nil, fmt.Errorf("%v %q", err, path)
+		}
+	}
+
+	// Check the program context configuration
+	if cfg.ProgramContext != nil {
+		if err := cfg.ProgramContext.Validate(); err != nil {
+			return nil, fmt.Errorf("%v %q", err, path)
+		}
+	}
+
+	// Check the alarms configuration
+	if cfg.Alarms != nil {
+		if err := cfg.Alarms.Validate(); err != nil {
+			return nil, fmt.Errorf("%v %q", err, path)
+		}
+	}
+
+	// Check the device counters
+	for _, counter := range cfg.Counters {
+		if err := counter.Validate(); err != nil {
+			return nil, fmt.Errorf("%v %q", err, path)
+		}
+	}
+
+	// Check the derivatives configuration
+	if cfg.Derivatives != nil {
+		if err := cfg.Derivatives.Validate(); err != nil {
+			return nil, fmt.Errorf("%v %q", err, path)
+		}
+	}
+
+	// Check the recorder configuration
+	if cfg.RecordToFile != nil {
+		if err := cfg.RecordToFile.Validate(); err != nil {
+			return nil, fmt.Errorf("%v %q", err, path)
+		}
+	}
+
+	// Check the subscription options
+	if err := cfg.SubscriptionOpts.Validate(); err != nil {
+		return nil, fmt.Errorf("%v %q", err, path)
+	}
+
+	// Check the preset and its source fields
+	if _, err := newWeldPreset(cfg.Preset, cfg.PresetFields); err != nil {
+		return nil, fmt.Errorf("%v %q", err, path)
+	}
+	if cfg.Preset == "" && len(cfg.PresetFields) > 0 {
+		return nil, fmt.Errorf("preset_fields require a preset %q", path)
+	}
+
+	// Check if the ingest buffer and parse workers are valid
+	if cfg.IngestBuffer < 0 {
+		return nil, fmt.Errorf("ingest_buffer must be >= 0 %q", path)
+	}
+	if cfg.ParseWorkers < 0 {
+		return nil, fmt.Errorf("parse_workers must be >= 0 %q", path)
+	}
+
+	// Check if the retained bootstrap time is valid
+	if cfg.RetainedBootstrap < 0 {
+		return nil, fmt.Errorf("retained_bootstrap_s must be >= 0 %q", path)
+	}
+
+	// Check if the history length is valid
+	if cfg.HistoryLength < -1 {
+		return nil, fmt.Errorf("history_length must be >= -1 %q", path)
+	}
+
+	// Check if the filter expression compiles
+	if cfg.Filter != "" {
+		if _, err := compileExpr(cfg.Filter); err != nil {
+			return nil, fmt.Errorf("invalid filter expression: %v %q", err, path)
+		}
+	}
+
 	return []string{}, nil
 }
 
+// The broker connection attributes of the configuration
+func (cfg *Config) broker() *BrokerConfig {
+	return &BrokerConfig{
+		Host:              cfg.Host,
+		Port:              cfg.Port,
+		ClientID:          cfg.ClientID,
+		Username:          cfg.Username,
+		Password:          cfg.Password,
+		TLS:               cfg.TLS,
+		Transport:         cfg.Transport,
+		ProtocolVersion:   cfg.ProtocolVersion,
+		TopicAliasMaximum: cfg.TopicAliasMaximum,
+		ReceiveMaximum:    cfg.ReceiveMaximum,
+		SessionExpiry:     cfg.SessionExpiry,
+	}
+}
+
 type mqttClient struct {
 	resource.Named
-	logger        logging.Logger
-	client        mqtt.Client
-	Topic         string
-	Host          string
-	Port          int
-	QoS           byte
-	ClientID      string
-	payloadType   string
-	messageQueue  []mqtt.Message
-	queueLength   int
-	latestMessage mqtt.Message
-	mutex         sync.Mutex
+	logger              logging.Logger
+	client              atomic.Pointer[mqtt.Client] // Nil in simulation and replay mode, read by the connection handlers without the mutex
+	Topic               string
+	Host                string
+	Port                int
+	QoS                 byte
+	ClientID            string
+	connection          BrokerConfig // Protocol, credentials and TLS settings of the broker connection
+	payloadType         string
+	preset              *weldPreset
+	messageQueue        []*receivedMessage
+	queueLength         int
+	latestMessage       *receivedMessage
+	latestByTopic       map[string]*receivedMessage // Latest message of every received topic
+	retainedAt          time.Time                   // Receive time of the last retained message
+	filters             []filterRule
+	payloadRegex        *payloadRegex
+	filterExpr          expr
+	readingsLayout      string
+	rawEncoding         string
+	units               map[string]interface{} // Unit per output field, nil without units
+	utf8Replacement     string
+	includeFields       []string
+	excludeFields       []string
+	derivedFields       []derivedField
+	accumulators        map[string]float64
+	lastReceived        time.Time
+	rollingStats        *RollingStatsConfig
+	stats               map[string]*rollingStat
+	derivativesConfig   *DerivativesConfig
+	derivatives         map[string]*derivative
+	includeStats        bool
+	includeErrors       bool
+	arc                 *arcTracker
+	heatInput           *heatInput
+	welds               *weldCounter
+	weldSummaryTopic    string
+	weldCapture         string
+	wps                 *wpsChecker
+	wpsAlarmTopic       string
+	consumables         *consumablesTracker
+	programs            *programContext
+	alarms              *alarmLatch
+	counters            []*counterTracker
+	subscriptionOpts    SubscriptionOptions
+	ownMessages         ownMessages
+	stopConsumablesSave func()
+	simulation          *simulator // Set if messages are generated instead of received from the broker
+	stopSimulation      context.CancelFunc
+	replay              *replayProgress // Set if a recording is replayed instead of receiving from the broker
+	stopReplay          context.CancelFunc
+	recorder            *recorder
+	handoff             *messageHandoff // Set if the callback hands the messages off to a processing goroutine
+	handoffMutex        sync.RWMutex    // Guards handoff, the callback doesn't take the mutex to hand off a message
+	throughput          throughput
+	timestampField      string
+	latency             latencyTracker
+	sequences           map[string]uint64 // Last sequence number per topic, kept across reconfigurations
+	consumeMode         string
+	join                *JoinConfig
+	joinLatest          map[string]*receivedMessage
+	deadLetterTopic     string
+	includeParseErrors  bool
+	parseErrors         parseErrorLog
+	status              connectionStatus
+	history             messageHistory
+	capturePaused       bool   // Set by the pause_capture command, kept across reconfigurations
+	pausedMessages      uint64 // Messages not queued while capture was paused
+	redactFields        []string
+	traceRemaining      int // Number of received messages still to be logged by the trace command
+	noDataBehavior      string
+	onDisconnect        string
+	metrics             clientMetrics
+	messageLog          messageLog
+	maxPayloadBytes     int
+	messageTTL          time.Duration
+	latestTTL           time.Duration
+	drainDir            string
+	cleanSession        bool
+	breaker             *circuitBreaker
+	breakerTimer        *time.Timer // Reconnects after the cool-down
+	collisions          collisionDetector
+	storeDir            string
+	orderMatters        bool
+	maxResumeInflight   int
+	sharedConnection    bool
+	binaryCapture       *BinaryCaptureConfig
+	directCapture       bool
+	captureTagSources   []captureTag
+	captureWriter       *captureWriter // Set if the client writes captures itself
+	captureStreams      []*captureStream
+	captureTimeSource   string
+	maxClockSkew        time.Duration
+	maxTimestampAge     time.Duration
+	backfill            *BackfillConfig
+	lastMessageAt       time.Time // Receive time of the last message
+	outageStart         time.Time // Start of the outage to backfill, zero if connected
+	stopCaptureFlush    context.CancelFunc
+	watchdogTopic       string
+	watchdogSeen        time.Time // Last message on the watchdog topic
+	stopWatchdog        context.CancelFunc
+	closed              bool          // No messages are accepted after Close
+	done                chan struct{} // Closed by Close to stop the internal goroutines
+	closeOnce           sync.Once
+	wg                  sync.WaitGroup
+	mutex               sync.Mutex
 }
 
 // Sensor type constructor.
 // Called upon sensor instantiation when a sensor model is added to the machine configuration
 func newSensor(ctx context.Context, deps resource.Dependencies, conf resource.Config, logger logging.Logger) (sensor.Sensor, error) {
 	s := &mqttClient{
-		Named:  conf.ResourceName().AsNamed(),
-		logger: logger,
+		Named:     conf.ResourceName().AsNamed(),
+		logger:    logger,
+		sequences: map[string]uint64{},
+		done:      make(chan struct{}),
+	}
+	s.metrics.queueDepth = func() int {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		return len(s.messageQueue)
 	}
+	s.metrics.handoffDepth = s.handoffDepth
 	if err := s.Reconfigure(ctx, deps, conf); err != nil {
-		return nil, err
+		// A sensor waiting for the broker is kept and reports the failure in its status, otherwise stop the
+		// background connection attempts and goroutines of the discarded sensor
+		if !errors.Is(err, errConnectPending) {
+			s.Close(ctx)
+			return nil, err
+		}
 	}
+	registerMetrics(s.Name().ShortName(), &s.metrics)
 	return s, nil
 }
 
@@ -101,10 +643,12 @@ func (s *mqttClient) Reconfigure(ctx context.Context, deps resource.Dependencies
 		return err
 	}
 
-	// Stop existing MQTT client if connected
-	if s.client != nil && s.client.IsConnected() {
-		s.client.Disconnect(250) // Timeout in milliseconds
+	// Stop the existing MQTT client, also if it is still trying to connect
+	if client := s.currentClient(); client != nil {
+		client.Disconnect(250) // Timeout in milliseconds
 	}
+	// The buffered messages are processed with the previous configuration
+	s.stopHandoff()
 
 	// Reconfigure the MQTT_Client instance with new settings from clientConfig
 	s.Topic = clientConfig.Topic
@@ -113,72 +657,468 @@ func (s *mqttClient) Reconfigure(ctx context.Context, deps resource.Dependencies
 	s.QoS = byte(clientConfig.QoS) // Assuming qos in Config is an int and needs conversion to byte
 	s.queueLength = clientConfig.QueueLength
 	s.ClientID = clientConfig.ClientID
+	s.connection = *clientConfig.broker()
+	s.collisions.reset()
 	s.payloadType = clientConfig.PayloadType
-	// Log the new configuration (optional, adjust logging as needed)
-	s.logger.Infof("Reconfigured mqtt client with topic: %s, host: %s, port: %d, qos: %d, clientID: %s, payload: %s, q_length: %v", s.Topic, s.Host, s.Port, s.QoS, s.ClientID, s.payloadType, s.queueLength)
-
-	// Error handling channel
-	errChan := make(chan error, 1)
-
-	// Start InitMQTTClient in a goroutine
-	go func() {
-		errChan <- s.InitMQTTClient(ctx)
-		close(errChan)
-	}()
-
-	// Handle errors from the goroutine
-	for err := range errChan {
+	if s.preset, err = newWeldPreset(clientConfig.Preset, clientConfig.PresetFields); err != nil {
+		return err
+	}
+	s.readingsLayout = clientConfig.ReadingsLayout
+	s.rawEncoding = clientConfig.RawEncoding
+	s.units = nil
+	if len(clientConfig.Units) > 0 {
+		s.units = map[string]interface{}{}
+		for field, unit := range clientConfig.Units {
+			s.units[field] = unit
+		}
+	}
+	s.utf8Replacement = string(utf8.RuneError)
+	if clientConfig.UTF8Replacement != nil {
+		s.utf8Replacement = *clientConfig.UTF8Replacement
+	}
+	s.consumeMode = clientConfig.ConsumeMode
+	s.join = clientConfig.Join
+	s.joinLatest = map[string]*receivedMessage{}
+	s.includeFields = clientConfig.IncludeFields
+	s.excludeFields = clientConfig.ExcludeFields
+	s.filters = nil
+	for _, rule := range clientConfig.Filters {
+		filter, err := parseFilterRule(rule)
 		if err != nil {
-			// Handle error, e.g., log it or restart the initialization process
-			s.logger.Errorf("Error initializing mqtt client: %v", err)
-			// Take appropriate action based on the error
+			return err
 		}
+		s.filters = append(s.filters, filter)
+	}
+	s.payloadRegex, err = newPayloadRegex(clientConfig.PayloadRegex)
+	if err != nil {
+		return err
 	}
+	s.derivedFields = nil
+	for _, def := range clientConfig.DerivedFields {
+		field, err := parseDerivedField(def)
+		if err != nil {
+			return err
+		}
+		s.derivedFields = append(s.derivedFields, field)
+	}
+	s.accumulators = map[string]float64{}
+	s.lastReceived = time.Time{}
+	s.rollingStats = clientConfig.RollingStats
+	s.stats = map[string]*rollingStat{}
+	s.derivativesConfig = clientConfig.Derivatives
+	s.derivatives = map[string]*derivative{}
+	s.includeStats = clientConfig.IncludeStats
+	s.includeErrors = clientConfig.IncludeErrors
+	if s.arc, err = newArcTracker(clientConfig.ArcTracking, clientConfig.Shifts, time.Now()); err != nil {
+		return err
+	}
+	s.heatInput = newHeatInput(clientConfig.HeatInput)
+	if s.welds, err = newWeldCounter(clientConfig.WeldCounting, clientConfig.Shifts, time.Now()); err != nil {
+		return err
+	}
+	s.weldSummaryTopic, s.weldCapture = "", ""
+	if clientConfig.WeldCounting != nil {
+		s.weldSummaryTopic = clientConfig.WeldCounting.SummaryTopic
+		s.weldCapture = clientConfig.WeldCounting.Capture
+	}
+	s.programs = newProgramContext(clientConfig.ProgramContext)
+	s.alarms = newAlarmLatch(clientConfig.Alarms)
+	s.counters = newCounterTrackers(clientConfig.Counters)
+	s.subscriptionOpts = clientConfig.SubscriptionOpts
+	s.wps, s.wpsAlarmTopic = newWPSChecker(clientConfig.WPS), ""
+	if clientConfig.WPS != nil {
+		s.wpsAlarmTopic = clientConfig.WPS.AlarmTopic
+	}
+	s.timestampField = clientConfig.TimestampField
+	s.latency = latencyTracker{}
+	s.deadLetterTopic = clientConfig.DeadLetterTopic
+	s.includeParseErrors = clientConfig.IncludeParseErrors
+	s.parseErrors = parseErrorLog{}
+	s.history = newMessageHistory(clientConfig.HistoryLength)
+	s.redactFields = clientConfig.RedactFields
+	s.noDataBehavior = clientConfig.NoDataBehavior
+	s.onDisconnect = clientConfig.OnDisconnect
+	s.messageLog = newMessageLog(clientConfig.LogSummaryInterval)
+	s.maxPayloadBytes = clientConfig.MaxPayloadBytes
+	s.messageTTL = time.Duration(clientConfig.MessageTTL * float64(time.Second))
+	s.latestTTL = time.Duration(clientConfig.LatestTTL * float64(time.Second))
+	s.drainDir = clientConfig.DrainDir
+	s.binaryCapture = clientConfig.BinaryCapture
+	s.directCapture = clientConfig.DirectCapture
+	s.captureStreams = nil
+	for _, stream := range clientConfig.CaptureStreams {
+		s.captureStreams = append(s.captureStreams, &captureStream{CaptureStreamConfig: stream})
+	}
+	s.captureTimeSource = clientConfig.CaptureTime
+	s.maxClockSkew = defaultMaxClockSkew
+	if clientConfig.MaxClockSkew > 0 {
+		s.maxClockSkew = time.Duration(clientConfig.MaxClockSkew * float64(time.Second))
+	}
+	s.maxTimestampAge = time.Duration(clientConfig.MaxTimestampAge * float64(time.Second))
+	s.backfill = clientConfig.Backfill
+	s.outageStart = time.Time{}
+	if s.captureTagSources, err = parseCaptureTags(clientConfig.CaptureTags); err != nil {
+		return err
+	}
+	s.storeDir = clientConfig.StoreDir
+	s.orderMatters = clientConfig.OrderMatters == nil || *clientConfig.OrderMatters
+	s.maxResumeInflight = clientConfig.MaxResumeInflight
+	s.cleanSession = clientConfig.CleanSession == nil || *clientConfig.CleanSession
+	s.sharedConnection = clientConfig.SharedConnection
+	if s.breakerTimer != nil {
+		s.breakerTimer.Stop()
+	}
+	s.breaker = newCircuitBreaker(clientConfig.MaxConnectFailures, clientConfig.ConnectCooldown)
+	s.filterExpr = nil
+	if clientConfig.Filter != "" {
+		if s.filterExpr, err = compileExpr(clientConfig.Filter); err != nil {
+			return err
+		}
+	}
+	// Log the new configuration (optional, adjust logging as needed)
+	s.logger.Infof("Reconfigured mqtt client with topic: %s, host: %s, port: %d, qos: %d, clientID: %s, payload: %s, q_length: %v", s.Topic, s.Host, s.Port, s.QoS, s.ClientID, s.payloadType, s.queueLength)
 
-	return err
+	s.startHandoff(clientConfig.IngestBuffer, clientConfig.ParseWorkers)
+	var connecting time.Time
+	// The connection is retried in the background if it can't be established before ctx is done
+	if clientConfig.Simulate || clientConfig.Replay != nil {
+		// Stops the connection attempts of the previous configuration
+		s.setClient(nil)
+	} else {
+		connecting = time.Now()
+		err = s.InitMQTTClient(ctx)
+	}
+	s.mutex.Lock()
+	s.resetSimulation(clientConfig.Simulate, clientConfig.Simulation)
+	s.resetReplay(clientConfig.Replay)
+	s.resetRecorder(clientConfig.RecordToFile)
+	s.startWatchdog(time.Duration(clientConfig.WatchdogTimeout*float64(time.Second)), clientConfig.WatchdogTopic)
+	s.resetCaptureWriter(clientConfig.CaptureDir)
+	s.resetConsumables(clientConfig.Consumables)
+	s.mutex.Unlock()
+	if err != nil {
+		s.logger.Errorf("Error initializing mqtt client: %v", err)
+		return err
+	}
+	if clientConfig.RetainedBootstrap > 0 && !connecting.IsZero() {
+		s.awaitRetained(ctx, connecting, time.Duration(clientConfig.RetainedBootstrap*float64(time.Second)))
+	}
+	return nil
 }
 
 // Get sensor reading
 func (s *mqttClient) Readings(ctx context.Context, extra map[string]interface{}) (map[string]interface{}, error) {
+	// Payload format requested by the caller
+	msgType, err := msgTypeOverride(extra)
+	if err != nil {
+		return nil, err
+	}
+	// Ad-hoc read of a topic requested by the caller, it may subscribe without holding the mutex
+	if topic, ok := extra["topic"].(string); ok {
+		return s.topicReadings(ctx, topic, msgType, extra)
+	}
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	// Explicit queue access requested by the caller
+	if mode, ok := extra["mode"].(string); ok {
+		return s.queueReadings(mode, extra["count"], msgType)
+	}
 	// If Viam data manager return the latest message if the message queue is not empty and remove it from the queue
 	if extra[data.FromDMString] == true {
-		if len(s.messageQueue) != 0 {
-			oldestMessage := s.messageQueue[0]
-			s.messageQueue = s.messageQueue[1:]
-			parsedPayload, err := parsePayload(s.payloadType, oldestMessage)
+		if oldestMessage := s.popMessage(); oldestMessage != nil {
+			parsedPayload, err := s.parse(oldestMessage)
 			if err != nil {
 				s.logger.Error(err)
+				s.metrics.drop(dropParseFailure)
 				return nil, data.ErrNoCaptureToStore
 			}
-			return map[string]interface{}{
-				"payload": parsedPayload,
-				"qos":     int32(s.QoS),
-				"topic":   s.Topic,
-			}, nil
+			return s.formatReadings(oldestMessage, parsedPayload), nil
 		} else {
 			return nil, data.ErrNoCaptureToStore
 		}
 	}
+	// Health checks must not mistake a lost connection for a quiet topic
+	if !s.connected() && !s.brokerless() {
+		switch {
+		case s.onDisconnect == "error", s.onDisconnect == "" && s.noDataBehavior == "error":
+			return nil, s.notConnectedError()
+		case s.onDisconnect == "empty":
+			return map[string]interface{}{}, nil
+		}
+	}
+	// Consumers which must not process a message twice pop from the queue as well
+	if s.consumeMode == "queue" {
+		oldestMessage := s.popMessage()
+		if oldestMessage == nil {
+			return s.noData()
+		}
+		parsedPayload, err := s.parseAs(oldestMessage, msgType)
+		if err != nil {
+			return nil, err
+		}
+		return s.withConnected(s.formatReadings(oldestMessage, parsedPayload)), nil
+	}
 	// If not data manager return the latest message
+	// A latest message older than latest_ttl_s is stale, e.g. the welder was powered off
+	if s.latestMessage != nil && s.expired(s.latestMessage) {
+		s.latestMessage = nil
+	}
 	// Check if there have been any messages received
 	if s.latestMessage != nil {
-		parsedPayload, err := parsePayload(s.payloadType, s.latestMessage)
+		parsedPayload, err := s.parseAs(s.latestMessage, msgType)
 		if err != nil {
-			s.logger.Errorf("error parsing JSON message:", err, parsedPayload)
+			s.logger.Errorf("error parsing message on %q: %v", s.latestMessage.Topic(), err)
 			return nil, err
 		}
-		return map[string]interface{}{
-			"payload": parsedPayload,
-			"qos":     int32(s.QoS),
-			"topic":   s.Topic,
-		}, nil
+		readings := s.formatReadings(s.latestMessage, parsedPayload)
+		// Only return the latest message once
+		if s.consumeMode == "latest" {
+			s.latestMessage = nil
+		}
+		return s.withConnected(readings), nil
 
+	} else if s.includeParseErrors && s.parseErrors.count > 0 {
+		// Parse failures stay visible when no message could be parsed
+		return s.withConnected(map[string]interface{}{"parse_errors": s.parseErrors.readings()}), nil
 	} else {
-		return nil, nil
+		return s.noData()
+	}
+
+}
+
+// Whether a latest message is older than latest_ttl_s
+func (s *mqttClient) expired(msg *receivedMessage) bool {
+	return s.latestTTL > 0 && time.Since(msg.received) > s.latestTTL
+}
+
+// Returned by Readings with no_data_behavior "error"
+var (
+	errNotConnected = errors.New("MQTT client not connected")
+	errNoMessage    = errors.New("no MQTT message received")
+)
+
+// The current MQTT client, nil in simulation and replay mode
+func (s *mqttClient) currentClient() mqtt.Client {
+	if client := s.client.Load(); client != nil {
+		return *client
+	}
+	return nil
+}
+
+// Replace the MQTT client, the connection attempts of a replaced client stop
+func (s *mqttClient) setClient(client mqtt.Client) {
+	if client == nil {
+		s.client.Store(nil)
+		return
+	}
+	s.client.Store(&client)
+}
+
+// Whether the client is connected to the broker
+func (s *mqttClient) connected() bool {
+	client := s.currentClient()
+	return client != nil && client.IsConnectionOpen()
+}
+
+// Whether messages are simulated or replayed instead of received from the broker. Must be called with
+// the mutex held.
+func (s *mqttClient) brokerless() bool {
+	return s.simulation != nil || s.replay != nil
+}
+
+// Error returned by Readings while disconnected, with the reason if the connection attempts stopped
+func (s *mqttClient) notConnectedError() error {
+	if reason := s.status.haltReason(); reason != "" {
+		return fmt.Errorf("%w, %s", errNotConnected, reason)
+	}
+	if degraded, retryAt := s.breaker.degraded(); degraded {
+		return fmt.Errorf("%w, too many connection failures, degraded until %s", errNotConnected, retryAt.Format(time.RFC3339))
+	}
+	return errNotConnected
+}
+
+// Readings result when there is no message according to no_data_behavior
+func (s *mqttClient) noData() (map[string]interface{}, error) {
+	switch s.noDataBehavior {
+	case "error":
+		return nil, errNoMessage
+	case "reading":
+		return s.withConnected(map[string]interface{}{"topic": s.Topic}), nil
+	}
+	return nil, nil
+}
+
+// Add the connection state to readings with no_data_behavior "reading", and the degraded state if the
+// connection attempts are suspended
+func (s *mqttClient) withConnected(readings map[string]interface{}) map[string]interface{} {
+	if s.noDataBehavior == "reading" {
+		readings["connected"] = s.connected()
+	}
+	if degraded, retryAt := s.breaker.degraded(); degraded {
+		readings["degraded"] = true
+		readings["retry_at"] = retryAt.UTC().Format(time.RFC3339)
+	}
+	if reason := s.status.haltReason(); reason != "" {
+		readings["halted"] = reason
+	}
+	return readings
+}
+
+// Return queued messages for the "mode" extra parameter, "peek" leaves them in the queue and "pop" removes them.
+// Without "count" a single message is returned like a regular reading, otherwise a list of up to count messages.
+func (s *mqttClient) queueReadings(mode string, count interface{}, msgType string) (map[string]interface{}, error) {
+	if mode != "peek" && mode != "pop" {
+		return nil, fmt.Errorf("invalid mode %q (should be peek or pop)", mode)
+	}
+	n := 1
+	if count != nil {
+		f, ok := toFloat(count)
+		if !ok || f < 1 {
+			return nil, fmt.Errorf("invalid count %v (should be >= 1)", count)
+		}
+		n = int(f)
+	}
+	s.dropExpired(time.Now())
+	n = min(n, len(s.messageQueue))
+	messages := make([]*receivedMessage, n)
+	copy(messages, s.messageQueue[:n])
+	if mode == "pop" {
+		clear(s.messageQueue[:n])
+		s.messageQueue = s.messageQueue[n:]
+	}
+
+	var readings []interface{}
+	for _, msg := range messages {
+		parsedPayload, err := s.parseAs(msg, msgType)
+		if err != nil {
+			s.logger.Error(err)
+			continue
+		}
+		readings = append(readings, s.formatReadings(msg, parsedPayload))
+	}
+	if count == nil {
+		if len(readings) == 0 {
+			return nil, nil
+		}
+		return readings[0].(map[string]interface{}), nil
+	}
+	if readings == nil {
+		readings = []interface{}{}
+	}
+	return map[string]interface{}{"messages": readings, "queue_length": len(s.messageQueue)}, nil
+}
+
+// Remove and return the oldest message from the queue, nil if the queue is empty
+func (s *mqttClient) popMessage() *receivedMessage {
+	for len(s.messageQueue) > 0 {
+		oldestMessage := s.messageQueue[0]
+		// The backing array must not keep the payload and parsed fields of the message alive
+		s.messageQueue[0] = nil
+		s.messageQueue = s.messageQueue[1:]
+		// Messages which waited longer than the TTL or their MQTT 5 expiry interval are discarded
+		if s.messageTTL > 0 && time.Since(oldestMessage.received) > s.messageTTL {
+			s.metrics.drop(dropTTLExpired)
+			continue
+		}
+		if oldestMessage.expiryElapsed(time.Now()) {
+			s.metrics.drop(dropMessageExpired)
+			continue
+		}
+		return oldestMessage
+	}
+	return nil
+}
+
+// Build the readings map for a parsed payload according to the configured layout
+func (s *mqttClient) formatReadings(msg *receivedMessage, parsedPayload interface{}) map[string]interface{} {
+	readings := map[string]interface{}{
+		"qos":   int32(s.QoS),
+		"topic": s.Topic,
+	}
+	if msg.seq != 0 {
+		readings["seq"] = msg.seq
+	}
+	if props := userProperties(msg.Message); props != nil {
+		readings["user_properties"] = props
 	}
+	// Derived fields are added to object payloads, otherwise they are top level keys
+	parsedPayload, merged := mergeDerived(parsedPayload, msg.derived)
+	if !merged {
+		for k, v := range msg.derived {
+			readings[k] = v
+		}
+	}
+	parsedPayload = selectFields(parsedPayload, s.includeFields, s.excludeFields)
+	if s.includeStats {
+		readings["stats"] = s.throughput.readings(time.Now())
+	}
+	if s.arc != nil {
+		readings["arc"] = s.arc.readings(time.Now())
+	}
+	if s.heatInput != nil && s.heatInput.segments {
+		readings["heat_input"] = s.heatInput.readings()
+	}
+	if s.welds != nil {
+		readings["welds"] = s.welds.readings(time.Now())
+	}
+	if s.wps != nil {
+		readings["wps"] = s.wps.readings()
+	}
+	if s.consumables != nil {
+		readings["consumables"] = s.consumables.readings()
+	}
+	if s.programs != nil {
+		readings["program_context"] = s.programs.readings()
+	}
+	if s.alarms != nil {
+		readings["active_alarms"] = s.alarms.readings()
+	}
+	if len(s.counters) > 0 {
+		counters := map[string]interface{}{}
+		for _, c := range s.counters {
+			counters[c.Name] = c.readings()
+		}
+		readings["counters"] = counters
+	}
+	if s.timestampField != "" {
+		readings["latency"] = s.latency.readings()
+	}
+	if s.includeParseErrors {
+		readings["parse_errors"] = s.parseErrors.readings()
+	}
+	if s.includeErrors {
+		readings["client_errors"] = s.status.errorReadings()
+	}
+	if s.units != nil {
+		readings["units"] = s.units
+	}
+	// Flat layout promotes the payload fields to top level keys, other payloads stay nested
+	if fields, ok := parsedPayload.(map[string]interface{}); ok && s.readingsLayout == "flat" {
+		for k, v := range fields {
+			if _, reserved := readings[k]; !reserved {
+				readings[k] = v
+			}
+		}
+		return readings
+	}
+	if raw, ok := parsedPayload.([]byte); ok && s.rawEncoding != "" {
+		setRawPayload(readings, raw, s.rawEncoding)
+		return readings
+	}
+	readings["payload"] = parsedPayload
+	return readings
+}
 
+// Add a raw payload to readings as string in the given encoding, with the encoding and the payload length,
+// the bytes themselves don't serialize predictably through the API
+func setRawPayload(readings map[string]interface{}, raw []byte, encoding string) {
+	if encoding == "hex" {
+		readings["payload"] = hex.EncodeToString(raw)
+	} else {
+		readings["payload"] = base64.StdEncoding.EncodeToString(raw)
+	}
+	readings["payload_encoding"] = encoding
+	readings["payload_length"] = len(raw)
 }
 
 // Parse mqtt message
@@ -195,6 +1135,10 @@ func parsePayload(mtype string, msg mqtt.Message) (interface{}, error) {
 	case "telwin":
 		s := string(msg.Payload())
 		sparts := strings.FieldsFunc(s, Split)
+		// Two key value pairs, the second value is the URL encoded JSON
+		if len(sparts) < 4 {
+			return nil, fmt.Errorf("error parsing telwin message: expected 4 fields, got %d", len(sparts))
+		}
 		//b64, err := base64.StdEncoding.DecodeString(sparts[3])
 		unescaped, err := url.QueryUnescape(sparts[3])
 		if err != nil {
@@ -206,12 +1150,53 @@ func parsePayload(mtype string, msg mqtt.Message) (interface{}, error) {
 			return nil, fmt.Errorf("error parsing JSON message: %v", err)
 		}
 		payload = map[string]interface{}{sparts[0]: sparts[1], sparts[2]: jsonStruct}
+	case "auto":
+		// Without the MQTT 5 content type the payload is sniffed: JSON objects and arrays, text, raw
+		b := msg.Payload()
+		trimmed := bytes.TrimSpace(b)
+		if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(trimmed) {
+			return parsePayload("json", msg)
+		}
+		if utf8.Valid(b) {
+			payload = string(b)
+		} else {
+			payload = b
+		}
 	default:
 		payload = msg.Payload()
 	}
 	return payload, nil
 }
 
+// Check if a message matches all configured filter rules and should be queued
+func (s *mqttClient) passesFilters(msg *receivedMessage) bool {
+	if s.payloadRegex != nil && !s.payloadRegex.match(string(msg.Payload())) {
+		return false
+	}
+	if len(s.filters) == 0 && s.filterExpr == nil {
+		return true
+	}
+	payload, err := s.parseWithDerived(msg)
+	if err != nil {
+		s.logger.Debugf("filtered out unparsable message: %v", err)
+		return false
+	}
+	for _, filter := range s.filters {
+		if !filter.match(payload) {
+			return false
+		}
+	}
+	if s.filterExpr != nil {
+		match, err := evalBool(s.filterExpr, map[string]interface{}{"msg": payload, "topic": msg.Topic()})
+		if err != nil {
+			s.logger.Debugf("filter expression failed: %v", err)
+			return false
+		}
+		return match
+	}
+	return true
+}
+
 func Split(r rune) bool {
 	return r == '=' || r == '&' || r == '"'
 }
@@ -235,6 +1220,198 @@ func (s *mqttClient) DoCommand(ctx context.Context, cmd map[string]interface{})
 			} else {
 				return map[string]interface{}{"result": "success"}, nil
 			}
+		case "status":
+			status := s.status.response(s.connected())
+			if degraded, retryAt := s.breaker.degraded(); degraded {
+				status["degraded"] = true
+				status["retry_at"] = retryAt.UTC().Format(time.RFC3339)
+			}
+			return status, nil
+		case "flush_queue":
+			// true flushes the whole queue, a topic filter only its messages
+			args := struct {
+				Topic string `json:"topic"`
+			}{}
+			if _, ok := v.(bool); !ok {
+				if err := decodeCommandArgs(v, &args); err != nil {
+					return nil, err
+				}
+				if !validTopicFilter(args.Topic) {
+					return nil, fmt.Errorf("invalid topic filter %q", args.Topic)
+				}
+			}
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			flushed := s.flushQueue(args.Topic)
+			return map[string]interface{}{"flushed": flushed, "queue_length": len(s.messageQueue)}, nil
+		case "replay":
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			if s.replay == nil {
+				return nil, fmt.Errorf("no replay configured")
+			}
+			return s.replay.readings(), nil
+		case "subscriptions":
+			return map[string]interface{}{"subscriptions": s.status.subscriptions()}, nil
+		case "pause_capture", "resume_capture":
+			// Only queueing for data capture is paused, the latest message is still updated
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			paused := k == "pause_capture"
+			if paused && !s.capturePaused {
+				s.pausedMessages = 0
+			}
+			s.capturePaused = paused
+			s.logger.Infof("data capture paused: %v", paused)
+			return map[string]interface{}{"capture_paused": s.capturePaused, "paused_messages": s.pausedMessages}, nil
+		case "inject":
+			// Run a synthetic message through the full pipeline to test data capture end to end
+			msg := Message{Topic: s.Topic, Qos: s.QoS}
+			if err := decodeCommandArgs(v, &msg); err != nil {
+				return nil, err
+			}
+			if !validTopicName(msg.Topic) {
+				return nil, fmt.Errorf("invalid inject topic %q", msg.Topic)
+			}
+			var payload []byte
+			switch p := msg.Payload.(type) {
+			case string:
+				payload = []byte(p)
+			case nil:
+			default:
+				var err error
+				if payload, err = json.Marshal(p); err != nil {
+					return nil, err
+				}
+			}
+			// Not handed off, the response includes the injected message
+			s.receive(&receivedMessage{Message: &injectedMessage{topic: msg.Topic, qos: msg.Qos, retained: msg.Retained, payload: payload}, received: time.Now()})
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			return map[string]interface{}{"result": "success", "queue_length": len(s.messageQueue)}, nil
+		case "export":
+			args := exportArgs{}
+			if _, ok := v.(bool); !ok {
+				if err := decodeCommandArgs(v, &args); err != nil {
+					return nil, err
+				}
+			}
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			return s.export(args)
+		case "message_logging":
+			args := messageLogArgs{}
+			if err := decodeCommandArgs(v, &args); err != nil {
+				return nil, err
+			}
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			if args.SummaryIntervalS != nil {
+				s.messageLog.interval = max(time.Duration(*args.SummaryIntervalS*float64(time.Second)), 0)
+			}
+			if args.PerMessage != nil {
+				s.messageLog.perMessage = *args.PerMessage
+			}
+			return map[string]interface{}{
+				"summary_interval_s": s.messageLog.interval.Seconds(),
+				"per_message":        s.messageLog.perMessage,
+			}, nil
+		case "metrics":
+			return s.metrics.readings(), nil
+		case "ack_alarm":
+			// An alarm ID, a list of IDs or "all"
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			if s.alarms == nil {
+				return nil, fmt.Errorf("alarms are not configured")
+			}
+			var ids []interface{}
+			switch x := v.(type) {
+			case []interface{}:
+				ids = x
+			default:
+				ids = []interface{}{x}
+			}
+			acknowledged := 0
+			for _, id := range ids {
+				acknowledged += s.alarms.ack(fmt.Sprint(id))
+			}
+			return map[string]interface{}{"acknowledged": acknowledged, "active_alarms": s.alarms.readings()}, nil
+		case "consumables":
+			// true returns the totals, "spool" or "cylinder" records a change, "all" resets the totals
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			if s.consumables == nil {
+				return nil, fmt.Errorf("consumables tracking is not configured")
+			}
+			if what, ok := v.(string); ok {
+				if err := s.consumables.reset(what, time.Now()); err != nil {
+					return nil, err
+				}
+				if err := s.consumables.save(); err != nil {
+					return nil, err
+				}
+			}
+			return s.consumables.readings(), nil
+		case "log_level":
+			name, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("log_level must be a string")
+			}
+			level, err := logging.LevelFromString(name)
+			if err != nil {
+				return nil, err
+			}
+			s.logger.SetLevel(level)
+			return map[string]interface{}{"log_level": level.String()}, nil
+		case "trace":
+			args := traceArgs{}
+			if n, ok := toFloat(v); ok {
+				args.Count = int(n)
+			} else if err := decodeCommandArgs(v, &args); err != nil {
+				return nil, err
+			}
+			if args.Count < 0 || args.Count > maxTraceCount {
+				return nil, fmt.Errorf("trace count must be between 0 and %d", maxTraceCount)
+			}
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			s.traceRemaining = args.Count
+			return map[string]interface{}{"trace_remaining": s.traceRemaining}, nil
+		case "history":
+			args := historyArgs{}
+			if _, ok := v.(bool); !ok {
+				if err := decodeCommandArgs(v, &args); err != nil {
+					return nil, err
+				}
+			}
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			return s.historyReadings(args)
+		case "ping":
+			args := pingArgs{}
+			if _, ok := v.(bool); !ok {
+				if err := decodeCommandArgs(v, &args); err != nil {
+					return nil, err
+				}
+			}
+			return ping(ctx, s.currentClient(), s.ClientID, args)
+		case "check_connection":
+			args := checkArgs{}
+			if _, ok := v.(bool); !ok {
+				if err := decodeCommandArgs(v, &args); err != nil {
+					return nil, err
+				}
+			}
+			if s.Host == "" {
+				return nil, fmt.Errorf("no broker configured")
+			}
+			return checkConnection(ctx, s.brokerConfig(), s.topicFilters(), args), nil
+		case "reconnect":
+			if err := s.reconnect(ctx); err != nil {
+				return nil, fmt.Errorf("reconnect failed: %v", err)
+			}
+			return s.status.response(s.currentClient().IsConnectionOpen()), nil
 		}
 	}
 	return nil, errUnimplemented
@@ -250,11 +1427,18 @@ type Message struct {
 
 // Publish a MQTT message
 func (s *mqttClient) publish(topic string, qos byte, retained bool, payload interface{}) error {
-	if s.client.IsConnected() {
-		t := s.client.Publish(topic, qos, retained, payload)
+	if s.connected() {
+		switch p := payload.(type) {
+		case string:
+			s.recordOwnMessage(topic, []byte(p))
+		case []byte:
+			s.recordOwnMessage(topic, p)
+		}
+		t := s.currentClient().Publish(topic, qos, retained, payload)
 		_ = t.Wait() // Can also use '<-t.Done()' in releases > 1.2.0
 		if t.Error() != nil {
 			s.logger.Error(t.Error())
+			s.status.failed("publish", fmt.Errorf("publishing to %q failed: %w", topic, t.Error()))
 			return t.Error()
 		}
 	} else {
@@ -265,44 +1449,616 @@ func (s *mqttClient) publish(topic string, qos byte, retained bool, payload inte
 
 // New function to initialize MQTT client and start the goroutine
 func (s *mqttClient) InitMQTTClient(ctx context.Context) error {
-	// Create a client and connect to the broker
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s:%d", s.Host, s.Port))
-	opts.SetClientID(s.ClientID) // Set a unique client ID
-
-	s.client = mqtt.NewClient(opts)
-	if token := s.client.Connect(); token.Wait() && token.Error() != nil {
-		return token.Error()
+	if err := s.connect(ctx); err != nil {
+		return err
 	}
 
 	// Start the goroutine to listen to the topic
+	s.wg.Add(1)
 	go func() {
-		if token := s.client.Subscribe(s.Topic, s.QoS, func(client mqtt.Client, msg mqtt.Message) {
-			s.mutex.Lock()
-			defer s.mutex.Unlock()
+		defer s.wg.Done()
+		if err := s.subscribe(); err != nil {
+			// Handle subscription error
+			s.logger.Errorf("subscription error: %v", err)
+		}
+	}()
 
-			// TODO: use flag instead of duplicating messages
-			s.latestMessage = msg
-			s.logger.Debugf("message queue length: %v", len(s.messageQueue))
-			if len(s.messageQueue) == s.queueLength {
-				s.messageQueue = s.messageQueue[1:]
-				s.messageQueue = append(s.messageQueue, msg)
-			}
-			s.messageQueue = append(s.messageQueue, msg)
+	return nil
+}
 
-		}); token.Wait() && token.Error() != nil {
-			// Handle subscription error
-			s.logger.Errorf("subscription error:", token.Error())
+// Time to wait for the broker connection if the context has no deadline
+const defaultConnectTimeout = 30 * time.Second
+
+// Interval of the connection attempts until the broker is reachable
+const connectRetryInterval = 5 * time.Second
+
+// CONNACK return codes after which the connection is not retried, the attempts can't succeed until
+// the configuration or the broker ACLs are changed. The MQTT 5 reason codes don't overlap the MQTT 3.1.1
+// return codes.
+var haltingReturnCodes = map[byte]bool{
+	packets.ErrRefusedBadProtocolVersion:    true,
+	packets.ErrRefusedIDRejected:            true,
+	packets.ErrRefusedBadUsernameOrPassword: true,
+	packets.ErrRefusedNotAuthorised:         true,
+	0x84:                                    true, // Unsupported Protocol Version
+	0x85:                                    true, // Client Identifier not valid
+	0x86:                                    true, // Bad User Name or Password
+	0x87:                                    true, // Not authorized
+	0x8A:                                    true, // Banned
+	0x8C:                                    true, // Bad authentication method
+}
+
+var errClientReplaced = errors.New("client closed or replaced")
+
+// Returned when the broker isn't reachable in time, the connection attempts continue
+var errConnectPending = errors.New("retrying in the background")
+
+// Create a client and connect to the broker. If the context is done first, an error is returned
+// and the connection is retried in the background, the topics are subscribed once it succeeds.
+// The attempts stop if the broker refuses the connection for a reason retrying can't fix.
+func (s *mqttClient) connect(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultConnectTimeout)
+		defer cancel()
+	}
+	cfg := s.brokerConfig()
+	broker := cfg.url()
+	if s.sharedConnection {
+		return s.connectShared(ctx, cfg)
+	}
+	opts, err := newClientOptions(cfg)
+	if err != nil {
+		s.status.failed("connect", err)
+		return err
+	}
+	var client mqtt.Client
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		s.logger.Warnf("connection lost: %v", err)
+		s.status.lost(err)
+		s.mutex.Lock()
+		s.startOutage()
+		s.mutex.Unlock()
+		// Only one client with a client ID can be connected, a client with the same ID takes the connection
+		if s.ClientID != "" && s.collisions.lost(time.Now()) {
+			go s.avoidCollision(client)
+		}
+	})
+	// A persistent session resumes the subscriptions on the broker side, they are still re-issued on
+	// every automatic reconnect so a broker restart never leaves the client unsubscribed
+	opts.SetAutoReconnect(true)
+	opts.SetCleanSession(s.cleanSession)
+	opts.SetResumeSubs(!s.cleanSession)
+	// Strict ordering calls the handler in the receiving goroutine, otherwise each message is handled in
+	// its own goroutine for throughput on high rate topics
+	opts.SetOrderMatters(s.orderMatters)
+	opts.SetMaxResumePubInFlight(s.maxResumeInflight)
+	if s.storeDir != "" {
+		// Inflight QoS 1 and 2 messages survive restarts, one directory per client ID
+		opts.SetStore(mqtt.NewFileStore(filepath.Join(s.storeDir, discoveryInvalidChars.ReplaceAllString(s.ClientID, "_"))))
+	}
+	opts.SetConnectionAttemptHandler(func(_ *url.URL, tlsCfg *tls.Config) *tls.Config {
+		if s.breaker.attempt() {
+			// Disconnect waits for the connection goroutine calling this handler
+			go s.tripBreaker(client)
+		}
+		return tlsCfg
+	})
+	var connections atomic.Uint64
+	opts.SetOnConnectHandler(func(mqtt.Client) {
+		s.breaker.connected()
+		s.collisions.connected(time.Now())
+		s.metrics.connects.Add(1)
+		// The first connection is subscribed by the caller
+		if connections.Add(1) == 1 {
+			return
 		}
+		s.logger.Infof("reconnected to broker %s, resubscribing", broker)
+		s.status.reconnected()
+		if err := s.subscribe(); err != nil {
+			s.logger.Errorf("resubscription error: %v", err)
+			return
+		}
+		s.requestBackfill()
+	})
+
+	client = newMQTTClient(cfg, opts)
+	s.setClient(client)
+	s.status.resume()
+	result := make(chan error, 1)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		result <- s.connectAttempts(client, broker)
 	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+	}
 
+	err = fmt.Errorf("timed out connecting to broker %s, %w: %w", broker, errConnectPending, ctx.Err())
+	s.status.failed("connect", err)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := <-result; err != nil {
+			return
+		}
+		s.logger.Infof("connected to broker %s", broker)
+		if err := s.subscribe(); err != nil {
+			s.logger.Errorf("subscription error: %v", err)
+		}
+	}()
+	return err
+}
+
+// The broker connection of the client
+func (s *mqttClient) brokerConfig() *BrokerConfig {
+	cfg := s.connection
+	cfg.Host, cfg.Port, cfg.ClientID = s.Host, s.Port, s.ClientID
+	return &cfg
+}
+
+// Use the connection shared with the components of the same broker and client ID. The connection
+// restores the subscriptions after a reconnect, the client requests the backfill of the outage. The
+// connection attempt is not retried, the circuit breaker and the collision detection are per connection.
+func (s *mqttClient) connectShared(ctx context.Context, cfg *BrokerConfig) error {
+	broker := cfg.url()
+	cfg.SharedConnection = true
+	client, err := acquireSharedConnection(ctx, cfg)
+	if err != nil {
+		err = fmt.Errorf("error connecting to broker %s: %w", broker, err)
+		s.status.failed("connect", err)
+		return err
+	}
+	client.(*sharedClient).setHandlers(func(mqtt.Client) {
+		s.metrics.connects.Add(1)
+		s.logger.Infof("reconnected to broker %s", broker)
+		s.status.reconnected()
+		s.requestBackfill()
+	}, func(err error) {
+		s.logger.Warnf("connection lost: %v", err)
+		s.status.lost(err)
+		s.mutex.Lock()
+		s.startOutage()
+		s.mutex.Unlock()
+	})
+	s.setClient(client)
+	s.metrics.connects.Add(1)
+	s.status.resume()
+	s.status.connected(broker, false)
 	return nil
 }
 
-// Add a Close method to clean up the MQTT client
+// Attempt to connect until the client is connected, closed or replaced, or the broker refuses the
+// connection with a halting return code
+func (s *mqttClient) connectAttempts(client mqtt.Client, broker string) error {
+	for {
+		token := client.Connect()
+		select {
+		case <-token.Done():
+		case <-s.done:
+			return errClientReplaced
+		}
+		sessionPresent, code := connectResult(token)
+		if token.Error() == nil {
+			s.status.connected(broker, sessionPresent)
+			return nil
+		}
+		if haltingReturnCodes[code] {
+			err := fmt.Errorf("broker %s refused the connection, not retrying: %w", broker, token.Error())
+			s.logger.Error(err)
+			s.status.halted(code, err)
+			return err
+		}
+		s.status.failed("connect", token.Error())
+		s.logger.Debugf("connection attempt failed, retrying in %v: %v", connectRetryInterval, token.Error())
+		select {
+		case <-time.After(connectRetryInterval):
+		case <-s.done:
+			return errClientReplaced
+		}
+		if s.currentClient() != client {
+			return errClientReplaced
+		}
+		if degraded, retryAt := s.breaker.degraded(); degraded {
+			return fmt.Errorf("too many connection failures, degraded until %s", retryAt.Format(time.RFC3339))
+		}
+	}
+}
+
+// Return the configured topic filters with their QoS
+func (s *mqttClient) topicFilters() map[string]byte {
+	filters := map[string]byte{}
+	if s.join == nil {
+		filters[s.Topic] = s.QoS
+	} else {
+		for _, topic := range s.join.Topics {
+			filters[topic] = s.QoS
+		}
+	}
+	if s.backfill != nil && s.backfill.ReplayTopic != "" {
+		filters[s.backfill.ReplayTopic] = s.QoS
+	}
+	// Topics of the program context and alarms are subscribed unless the topics cover them
+	var extra []string
+	if s.programs != nil {
+		extra = append(extra, s.programs.topic)
+	}
+	if s.alarms != nil {
+		extra = append(extra, s.alarms.Topics...)
+		if s.alarms.AckTopic != "" {
+			extra = append(extra, s.alarms.AckTopic)
+		}
+	}
+	for _, topic := range extra {
+		covered := false
+		for filter := range filters {
+			covered = covered || topicMatches(filter, topic)
+		}
+		if !covered {
+			filters[topic] = s.QoS
+		}
+	}
+	return filters
+}
+
+// Subscribe to the configured topics and wait for the broker acknowledgement
+func (s *mqttClient) subscribe() error {
+	filters := s.topicFilters()
+	token := s.currentClient().SubscribeMultiple(filters, s.onMessage)
+	select {
+	case <-token.Done():
+	case <-s.done:
+		return errors.New("client closed")
+	}
+	if token.Error() != nil {
+		s.status.failed("subscribe", token.Error())
+		return token.Error()
+	}
+	granted := subscribeResult(token)
+	s.status.subscribed(filters, granted)
+	// Brokers may grant a lower QoS than requested without failing the subscription
+	for _, filter := range sortedKeys(filters) {
+		qos, ok := granted[filter]
+		switch subscriptionResult(filters[filter], qos, ok) {
+		case "downgraded":
+			s.logger.Warnf("broker granted QoS %d instead of %d for %q", qos, filters[filter], filter)
+		case "rejected", "missing":
+			err := fmt.Errorf("broker rejected the subscription of %q", filter)
+			s.logger.Error(err)
+			s.status.failed("subscribe", err)
+		}
+	}
+	return nil
+}
+
+// Stop the connection attempts of the client until the cool-down has passed
+func (s *mqttClient) tripBreaker(client mqtt.Client) {
+	_, retryAt := s.breaker.degraded()
+	err := fmt.Errorf("too many connection failures, degraded until %s", retryAt.Format(time.RFC3339))
+	s.logger.Warn(err)
+	s.status.failed("connect", err)
+	client.Disconnect(0)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed || s.currentClient() != client {
+		return
+	}
+	s.breakerTimer = time.AfterFunc(time.Until(retryAt), func() {
+		s.mutex.Lock()
+		replaced := s.closed || s.currentClient() != client
+		s.mutex.Unlock()
+		if replaced {
+			return
+		}
+		s.logger.Infof("connection cool-down passed, reconnecting")
+		// Stop waiting for the connection when the client is closed
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-s.done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		if err := s.reconnect(ctx); err != nil {
+			s.logger.Errorf("reconnect failed: %v", err)
+		}
+	})
+}
+
+// Disconnect and establish a new connection and subscriptions, e.g. when the broker session is wedged
+func (s *mqttClient) reconnect(ctx context.Context) error {
+	s.mutex.Lock()
+	if s.brokerless() {
+		s.mutex.Unlock()
+		return fmt.Errorf("no broker connection in simulation or replay mode")
+	}
+	s.startOutage()
+	s.mutex.Unlock()
+	if client := s.currentClient(); client != nil {
+		client.Disconnect(250) // Timeout in milliseconds
+	}
+	if err := s.connect(ctx); err != nil {
+		return err
+	}
+	if err := s.subscribe(); err != nil {
+		return err
+	}
+	s.requestBackfill()
+	return nil
+}
+
+// Handle a message received from the broker
+func (s *mqttClient) onMessage(client mqtt.Client, m mqtt.Message) {
+	msg := &receivedMessage{Message: m, received: time.Now()}
+	if s.handOff(msg) {
+		return
+	}
+	s.receive(msg)
+}
+
+// Handle a received message, replayed messages can keep their recorded receive time
+func (s *mqttClient) receive(msg *receivedMessage) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return
+	}
+	m := msg.Message
+
+	s.lastMessageAt = msg.received
+	s.throughput.add(msg.received, len(m.Payload()))
+	s.status.received(m.Topic(), msg.received)
+	s.metrics.received.Add(1)
+	s.record(msg)
+	if s.skipBySubscriptionOptions(m, msg.received) {
+		s.metrics.drop(dropSubscriptionOptions)
+		return
+	}
+	s.history.add(msg)
+	s.feedWatchdog(msg)
+	s.trace(msg)
+	if s.join != nil && !s.bypassesJoin(m.Topic()) {
+		if msg = s.correlate(msg); msg == nil {
+			return
+		}
+	}
+	s.ingest(msg)
+}
+
+// Run a message through the processing pipeline and queue it for data capture. Must be called with the mutex held.
+func (s *mqttClient) ingest(msg *receivedMessage) {
+	queued, dropped := false, false
+	defer func() { s.logMessage(msg, queued, dropped) }()
+	if s.maxPayloadBytes > 0 && len(msg.Payload()) > s.maxPayloadBytes {
+		s.metrics.drop(dropOversize)
+		dropped = true
+		return
+	}
+	// Binary payloads are written as binary captures and don't go through the readings pipeline
+	if s.isBinaryTopic(msg.Topic()) {
+		if s.capturePaused {
+			s.pausedMessages++
+			s.metrics.drop(dropCapturePaused)
+			dropped = true
+			return
+		}
+		if err := s.captureBinary(msg); err != nil {
+			s.logger.Warnf("binary capture of message on %q failed: %v", msg.Topic(), err)
+			s.metrics.drop(dropCaptureFailure)
+			dropped = true
+			return
+		}
+		s.setLatest(msg)
+		queued = true
+		return
+	}
+	// Alarm acknowledgements are not captured
+	if s.latchAlarms(msg) {
+		return
+	}
+	if !s.checkParse(msg) {
+		s.metrics.drop(dropParseFailure)
+		dropped = true
+		return
+	}
+	s.computeDerived(msg)
+	s.correlateProgram(msg)
+	s.trackCounters(msg)
+	s.computeStats(msg)
+	s.computeArc(msg)
+	s.computeHeatInput(msg)
+	s.checkWPS(msg)
+	s.trackConsumables(msg)
+	if summary := s.countWelds(msg); summary != nil && s.weldCapture != "" && s.weldCapture != "samples" {
+		// The summary is captured after the message ending the weld
+		defer s.ingestWeldSummary(summary)
+	}
+	s.computeLatency(msg)
+	s.computeDerivatives(msg)
+
+	// The latest message and the queue share the message, filtered messages are still the latest
+	s.setLatest(msg)
+	if !s.passesFilters(msg) {
+		s.metrics.drop(dropFilterRejected)
+		dropped = true
+		return
+	}
+	if s.capturePaused {
+		s.pausedMessages++
+		s.metrics.drop(dropCapturePaused)
+		dropped = true
+		return
+	}
+	// Only the weld summaries are captured
+	if s.weldCapture == "summaries" {
+		return
+	}
+	var stream *captureStream
+	if s.directCapture {
+		// Messages between two captures of a stream are not captured
+		if stream = s.captureStream(msg.Topic()); stream != nil && !stream.due(msg.received) {
+			s.metrics.drop(dropSampled)
+			dropped = true
+			return
+		}
+	}
+	queued, dropped = s.enqueue(msg, stream)
+}
+
+// Capture the summary of a weld, it is not filtered or sampled. Must be called with the mutex held.
+func (s *mqttClient) ingestWeldSummary(summary *receivedMessage) {
+	queued, dropped := false, false
+	defer func() { s.logMessage(summary, queued, dropped) }()
+	if s.capturePaused {
+		s.pausedMessages++
+		s.metrics.drop(dropCapturePaused)
+		dropped = true
+		return
+	}
+	queued, dropped = s.enqueue(summary, s.captureStream(summary.Topic()))
+}
+
+// Number a message and capture it directly or append it to the queue. Must be called with the mutex held.
+func (s *mqttClient) enqueue(msg *receivedMessage, stream *captureStream) (queued, dropped bool) {
+	s.sequences[msg.Topic()]++
+	msg.seq = s.sequences[msg.Topic()]
+	if s.directCapture {
+		if err := s.captureReadings(msg, stream); err != nil {
+			s.logger.Warnf("capture of message on %q failed: %v", msg.Topic(), err)
+			s.metrics.drop(dropCaptureFailure)
+			return false, true
+		}
+		return true, false
+	}
+	if len(s.messageQueue) >= s.queueLength && len(s.messageQueue) > 0 {
+		s.messageQueue[0] = nil
+		s.messageQueue = s.messageQueue[1:]
+		s.metrics.drop(dropQueueOverflow)
+		dropped = true
+	}
+	s.messageQueue = append(s.messageQueue, msg)
+	return true, dropped
+}
+
+// Discard the queued messages whose MQTT 5 expiry interval elapsed. Must be called with the mutex held.
+func (s *mqttClient) dropExpired(now time.Time) {
+	kept := s.messageQueue[:0]
+	for _, msg := range s.messageQueue {
+		if msg.expiryElapsed(now) {
+			s.metrics.drop(dropMessageExpired)
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	clear(s.messageQueue[len(kept):])
+	s.messageQueue = kept
+}
+
+// Discard the queued messages matching the topic filter, or all messages if it is empty, and return
+// their number. Must be called with the mutex held.
+func (s *mqttClient) flushQueue(topic string) int {
+	matches := func(msg *receivedMessage) bool {
+		return topic == "" || topicMatches(topic, msg.Topic())
+	}
+	kept := s.messageQueue[:0]
+	for _, msg := range s.messageQueue {
+		if !matches(msg) {
+			kept = append(kept, msg)
+		}
+	}
+	flushed := len(s.messageQueue) - len(kept)
+	for i := len(kept); i < len(s.messageQueue); i++ {
+		s.messageQueue[i] = nil
+	}
+	s.messageQueue = kept
+	// The stale latest message must not be returned by Readings either
+	if s.latestMessage != nil && matches(s.latestMessage) {
+		s.latestMessage = nil
+	}
+	for t, msg := range s.latestByTopic {
+		if matches(msg) {
+			delete(s.latestByTopic, t)
+		}
+	}
+	return flushed
+}
+
+// The broker acknowledgement is not awaited longer on close
+const unsubscribeTimeout = time.Second
+
+// Shut down in order: unsubscribe, stop accepting messages, drain the queue, stop the internal
+// goroutines and disconnect
 func (s *mqttClient) Close(ctx context.Context) error {
-	if s.client != nil && s.client.IsConnected() {
-		s.client.Disconnect(250) // Timeout in milliseconds
+	unregisterMetrics(s.Name().ShortName(), &s.metrics)
+	if s.connected() {
+		topics := sortedKeys(s.topicFilters())
+		if token := s.currentClient().Unsubscribe(topics...); !token.WaitTimeout(unsubscribeTimeout) || token.Error() != nil {
+			s.logger.Warnf("unsubscribing on close failed: %v", token.Error())
+		}
+	}
+	// The buffered messages are still queued and drained
+	s.stopHandoff()
+
+	s.mutex.Lock()
+	s.closed = true
+	if s.breakerTimer != nil {
+		s.breakerTimer.Stop()
+	}
+	if s.stopWatchdog != nil {
+		s.stopWatchdog()
+	}
+	if s.stopCaptureFlush != nil {
+		s.stopCaptureFlush()
+	}
+	if s.captureWriter != nil {
+		if err := s.captureWriter.flush(); err != nil {
+			s.logger.Errorf("error completing capture files: %v", err)
+		}
+	}
+	if s.stopConsumablesSave != nil {
+		s.stopConsumablesSave()
+	}
+	if s.stopSimulation != nil {
+		s.stopSimulation()
+	}
+	if s.stopReplay != nil {
+		s.stopReplay()
+	}
+	if s.recorder != nil {
+		if err := s.recorder.close(); err != nil {
+			s.logger.Errorf("error closing recording %v: %v", s.recorder.path, err)
+		}
+	}
+	if s.consumables != nil {
+		if err := s.consumables.save(); err != nil {
+			s.logger.Errorf("error saving consumables: %v", err)
+		}
+	}
+	if s.drainDir != "" && len(s.messageQueue) > 0 {
+		if result, err := s.export(exportArgs{Dir: s.drainDir}); err != nil {
+			s.logger.Errorf("error draining the queue: %v", err)
+		} else {
+			s.logger.Infof("drained %v queued messages to %v", result["messages"], result["path"])
+		}
+	}
+	s.messageQueue = nil
+	s.mutex.Unlock()
+
+	// Close is called again for a sensor discarded after a failed reconfiguration
+	s.closeOnce.Do(func() {
+		if s.done != nil {
+			close(s.done)
+		}
+	})
+	s.wg.Wait()
+	// Also stops the connection attempts of a client which never connected
+	if client := s.currentClient(); client != nil {
+		client.Disconnect(250) // Timeout in milliseconds
 	}
 	return nil
 }
@@ -0,0 +1,250 @@
+package mqttclient
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+	"go.viam.com/rdk/components/sensor"
+	"go.viam.com/rdk/data"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+
+	"github.com/lab101/mqtt-welding/internal/mqtttest"
+)
+
+// Start the embedded broker on a free local port for the test
+func startTestBroker(t testing.TB) *mqtttest.Broker {
+	t.Helper()
+	return mqtttest.StartBroker(t, func(address string) (func(), error) {
+		b, err := newEmbeddedBroker(address, "", "", nil, logging.NewTestLogger(t))
+		if err != nil {
+			return nil, err
+		}
+		return func() { b.close() }, nil
+	})
+}
+
+// Create a client component connected to the broker, it is closed when the test ends. Returns once the
+// subscription is acknowledged.
+func newTestSensor(t testing.TB, b *mqtttest.Broker, name string, cfg *Config) *mqttClient {
+	t.Helper()
+	cfg.Host, cfg.Port = b.Host, b.Port
+	if cfg.ClientID == "" {
+		cfg.ClientID = name
+	}
+	conf := resource.Config{Name: name, API: sensor.API, Model: Model, ConvertedAttributes: cfg}
+	ctx := context.Background()
+	sens, err := newSensor(ctx, nil, conf, logging.NewTestLogger(t))
+	if err != nil {
+		t.Fatalf("creating sensor: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := sens.Close(ctx); err != nil {
+			t.Errorf("closing sensor: %v", err)
+		}
+	})
+	s := sens.(*mqttClient)
+	mqtttest.Eventually(t, func() bool { return !s.status.lastSubscribed().IsZero() }, "sensor %q did not subscribe", name)
+	return s
+}
+
+// Wait until the component received the number of messages and processed the buffered ones
+func awaitReceived(t testing.TB, s *mqttClient, n uint64) {
+	t.Helper()
+	mqtttest.Eventually(t, func() bool { return s.metrics.received.Load() >= n && s.handoffDepth() == 0 },
+		"received %d of %d messages", s.metrics.received.Load(), n)
+}
+
+// The field of the nested payload of readings
+func payloadField(t testing.TB, readings map[string]interface{}, field string) interface{} {
+	t.Helper()
+	payload, ok := readings["payload"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("readings without object payload: %v", readings)
+	}
+	return payload[field]
+}
+
+func TestSensorReadsLatestMessage(t *testing.T) {
+	b := startTestBroker(t)
+	s := newTestSensor(t, b, "latest", &Config{Topic: "weld/+/data", QueueLength: 10, PayloadType: "json"})
+	pub := b.Client(t, "publisher")
+
+	ctx := context.Background()
+	if readings, err := s.Readings(ctx, nil); err != nil || readings != nil {
+		t.Fatalf("readings before any message = %v, %v; want no data", readings, err)
+	}
+	mqtttest.Publish(t, pub, "weld/cell1/data", mqtttest.WeldSample(180, 21.5), false)
+	mqtttest.Publish(t, pub, "weld/cell2/data", mqtttest.WeldSample(200, 22), false)
+	awaitReceived(t, s, 2)
+
+	readings, err := s.Readings(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := payloadField(t, readings, "current_a"); got != 200.0 {
+		t.Errorf("current_a = %v, want the latest message 200", got)
+	}
+	if readings["topic"] != "weld/+/data" {
+		t.Errorf("topic = %v, want the subscribed filter", readings["topic"])
+	}
+}
+
+func TestSensorQueuesForDataManager(t *testing.T) {
+	b := startTestBroker(t)
+	s := newTestSensor(t, b, "queue", &Config{Topic: "weld/cell1/data", QueueLength: 2, PayloadType: "json"})
+	pub := b.Client(t, "publisher")
+
+	for _, current := range []float64{100, 110, 120} {
+		mqtttest.Publish(t, pub, "weld/cell1/data", mqtttest.WeldSample(current, 20), false)
+	}
+	awaitReceived(t, s, 3)
+	if got := s.metrics.dropped[dropQueueOverflow].Load(); got != 1 {
+		t.Errorf("queue overflow drops = %d, want 1", got)
+	}
+
+	// The data manager captures the queued messages oldest first, the oldest was dropped
+	ctx := context.Background()
+	for _, want := range []float64{110, 120} {
+		readings, err := s.Readings(ctx, data.FromDMExtraMap)
+		if err != nil {
+			t.Fatalf("capture of %v: %v", want, err)
+		}
+		if got := payloadField(t, readings, "current_a"); got != want {
+			t.Errorf("captured current_a = %v, want %v", got, want)
+		}
+		if readings["seq"] == nil {
+			t.Errorf("captured readings without sequence number: %v", readings)
+		}
+	}
+	if _, err := s.Readings(ctx, data.FromDMExtraMap); !errors.Is(err, data.ErrNoCaptureToStore) {
+		t.Errorf("capture of an empty queue = %v, want %v", err, data.ErrNoCaptureToStore)
+	}
+
+	// Readings of other callers don't consume the queue
+	readings, err := s.Readings(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := payloadField(t, readings, "current_a"); got != 120.0 {
+		t.Errorf("latest current_a = %v, want 120", got)
+	}
+}
+
+func TestSensorDirectCapture(t *testing.T) {
+	b := startTestBroker(t)
+	dir := t.TempDir()
+	s := newTestSensor(t, b, "direct", &Config{Topic: "weld/cell1/data", QueueLength: 10, PayloadType: "json", DirectCapture: true, CaptureDir: dir})
+	pub := b.Client(t, "publisher")
+
+	for _, current := range []float64{100, 110} {
+		mqtttest.Publish(t, pub, "weld/cell1/data", mqtttest.WeldSample(current, 20), false)
+	}
+	awaitReceived(t, s, 2)
+	if got := s.metrics.droppedTotal(); got != 0 {
+		t.Errorf("dropped %d messages, want all captured: %v", got, s.metrics.readings())
+	}
+	s.mutex.Lock()
+	queued := len(s.messageQueue)
+	s.mutex.Unlock()
+	if queued != 0 {
+		t.Errorf("%d messages queued, want them captured directly", queued)
+	}
+	// The captures are written to the directory layout of the data manager, with the reserved characters
+	// of the path replaced
+	methodDir := filepath.Join(dir, "rdk_component_sensor", "direct", readingsCaptureMethod)
+	if files, err := os.ReadDir(methodDir); err != nil || len(files) == 0 {
+		t.Errorf("capture files in %v: %v, %v", methodDir, files, err)
+	}
+}
+
+func TestSensorParsesTelwinPayload(t *testing.T) {
+	b := startTestBroker(t)
+	s := newTestSensor(t, b, "telwin", &Config{Topic: "telwin/+", QueueLength: 10, PayloadType: "telwin"})
+	pub := b.Client(t, "publisher")
+
+	mqtttest.Publish(t, pub, "telwin/1", mqtttest.TelwinSample(t, 150, 19), false)
+	awaitReceived(t, s, 1)
+	readings, err := s.Readings(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sample, ok := payloadField(t, readings, "data").(map[string]interface{})
+	if !ok || sample["current_a"] != 150.0 {
+		t.Errorf("telwin payload = %v, want the decoded sample", readings["payload"])
+	}
+}
+
+func TestCloseStopsGoroutines(t *testing.T) {
+	b := startTestBroker(t)
+	pub := b.Client(t, "publisher")
+	// The broker and the publisher outlive the sensor
+	ignore := goleak.IgnoreCurrent()
+
+	s := newTestSensor(t, b, "close", &Config{Topic: "weld/cell1/data", QueueLength: 10, PayloadType: "json", IngestBuffer: 10, ParseWorkers: 2})
+	mqtttest.Publish(t, pub, "weld/cell1/data", mqtttest.WeldSample(100, 20), false)
+	awaitReceived(t, s, 1)
+	if err := s.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	goleak.VerifyNone(t, ignore)
+	// The cleanup closes the sensor a second time
+}
+
+// A sensor created while the broker is unreachable keeps retrying and subscribes once the broker is up
+func TestSensorConnectsInBackground(t *testing.T) {
+	port := mqtttest.FreePort(t)
+	cfg := &Config{Topic: "weld/cell1/data", Host: "127.0.0.1", Port: port, ClientID: "background", QueueLength: 10, PayloadType: "json"}
+	conf := resource.Config{Name: "background", API: sensor.API, Model: Model, ConvertedAttributes: cfg}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	sens, err := newSensor(ctx, nil, conf, logging.NewTestLogger(t))
+	if err != nil {
+		t.Fatalf("creating sensor without broker: %v", err)
+	}
+	t.Cleanup(func() { sens.Close(context.Background()) })
+	s := sens.(*mqttClient)
+
+	b := &mqtttest.Broker{Host: "127.0.0.1", Port: port}
+	broker, err := newEmbeddedBroker(b.Address(), "", "", nil, logging.NewTestLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.close() })
+	deadline := time.Now().Add(2 * connectRetryInterval)
+	for s.status.lastSubscribed().IsZero() {
+		if time.Now().After(deadline) {
+			t.Fatal("sensor did not connect to the broker started after it")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The client is replaced while it is read, e.g. by the status of the connection
+	stop := make(chan struct{})
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				s.connected()
+			}
+		}
+	}()
+	_, err = s.DoCommand(context.Background(), map[string]interface{}{"reconnect": true})
+	close(stop)
+	<-polled
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.connected() {
+		t.Error("sensor not connected after the reconnect")
+	}
+}
@@ -0,0 +1,108 @@
+package mqttclient
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Connections lost sooner after connecting count towards a client ID collision
+const collisionConnectionTime = 10 * time.Second
+
+// Short connections within the collision window after which a collision is assumed
+const collisionThreshold = 3
+
+const collisionWindow = time.Minute
+
+// Detects the reconnect storm of two clients using the same client ID. The broker drops the connection
+// of a client when another client connects with its ID, both reconnect automatically and keep taking the
+// connection from each other.
+type collisionDetector struct {
+	connectedAt time.Time
+	short       []time.Time // Times connections were lost shortly after connecting, within the window
+	detected    bool        // Set once a collision was handled, until the next reconfiguration
+	mutex       sync.Mutex
+}
+
+func (d *collisionDetector) connected(now time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.connectedAt = now
+}
+
+// Record a lost connection, returns true once when the lost connections indicate a collision
+func (d *collisionDetector) lost(now time.Time) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.detected || d.connectedAt.IsZero() || now.Sub(d.connectedAt) > collisionConnectionTime {
+		return false
+	}
+	kept := d.short[:0]
+	for _, t := range d.short {
+		if now.Sub(t) <= collisionWindow {
+			kept = append(kept, t)
+		}
+	}
+	d.short = append(kept, now)
+	if len(d.short) < collisionThreshold {
+		return false
+	}
+	d.detected = true
+	return true
+}
+
+func (d *collisionDetector) reset() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.connectedAt, d.short, d.detected = time.Time{}, nil, false
+}
+
+// Suffix appended to a colliding client ID, stable across restarts of the same component on the same
+// machine. Machines of a fleet often share the host name, the machine part ID set by viam-server tells
+// them apart.
+func collisionSuffix(name string) string {
+	host, _ := os.Hostname()
+	h := fnv.New32a()
+	h.Write([]byte(os.Getenv("VIAM_MACHINE_PART_ID") + "/" + host + "/" + name))
+	return fmt.Sprintf("-%06x", h.Sum32()&0xffffff)
+}
+
+// Handle a client ID collision of the client: reconnect with a suffixed client ID, or only warn if the
+// client keeps a persistent session, which belongs to the configured client ID
+func (s *mqttClient) avoidCollision(client mqtt.Client) {
+	s.mutex.Lock()
+	if s.closed || s.currentClient() != client {
+		s.mutex.Unlock()
+		return
+	}
+	original := s.ClientID
+	err := fmt.Errorf("client ID %q is likely used by another client, the broker dropped %d connections within %v shortly after connecting", original, collisionThreshold, collisionWindow)
+	s.status.failed("connect", err)
+	if !s.cleanSession {
+		s.mutex.Unlock()
+		s.logger.Errorf("%v. The persistent session belongs to the client ID, configure a unique clientid", err)
+		return
+	}
+	s.ClientID = original + collisionSuffix(s.Name().ShortName())
+	s.mutex.Unlock()
+	s.logger.Errorf("%v. Reconnecting as %q, configure a unique clientid", err, s.ClientID)
+
+	// Stop waiting for the connection when the client is closed
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if err := s.reconnect(ctx); err != nil {
+		s.logger.Errorf("reconnect failed: %v", err)
+	}
+}
@@ -0,0 +1,267 @@
+package mqttclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Broker connection attributes shared by the models
+type BrokerConfig struct {
+	Host              string     `json:"host"`
+	Port              int        `json:"port"`
+	ClientID          string     `json:"clientid"`
+	Username          string     `json:"username"` // Optional credentials of the connection
+	Password          string     `json:"password"`
+	TLS               *TLSConfig `json:"tls"`                 // Connect with TLS, the broker port is usually 8883
+	Transport         string     `json:"transport"`           // tcp (default) or quic, QUIC always encrypts with the TLS settings
+	ProtocolVersion   int        `json:"protocol_version"`    // 4 (MQTT 3.1.1, default) or 5
+	SharedConnection  bool       `json:"shared_connection"`   // Share one connection with the components using the same broker and client ID
+	TopicAliasMaximum int        `json:"topic_alias_maximum"` // MQTT 5 topic aliases used in each direction, default 0 (none)
+	ReceiveMaximum    int        `json:"receive_maximum"`     // QoS 1 and 2 messages an MQTT 5 broker sends at once, default 65535
+	SessionExpiry     float64    `json:"session_expiry_s"`    // MQTT 5 session kept after the connection is lost, a reconnect resumes it
+	WillDelay         float64    `json:"will_delay_s"`        // The broker publishes the last will after this delay, at the latest when the session expires
+}
+
+// Maps the tls attribute of a broker connection
+type TLSConfig struct {
+	CACert             string `json:"ca_cert"`     // PEM file of the CA of the broker certificate, default the system roots
+	ClientCert         string `json:"client_cert"` // PEM files of the client certificate and key, for brokers requiring one
+	ClientKey          string `json:"client_key"`
+	ServerName         string `json:"server_name"`          // Name verified in the broker certificate, default the host
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"` // Don't verify the broker certificate, only for tests
+}
+
+// Validate the broker connection attributes
+func (cfg *BrokerConfig) Validate(path string) error {
+	// Check if the host is set
+	if cfg.Host == "" {
+		return fmt.Errorf("host is required %q", path)
+	}
+
+	// Check if the port is valid
+	if cfg.Port <= 0 {
+		return fmt.Errorf("invalid port (should be > 0) %q", path)
+	}
+	return cfg.validateConnection(path)
+}
+
+// Validate the protocol, credentials and TLS attributes, the certificate files are loaded to report a
+// missing or invalid file with the configuration
+func (cfg *BrokerConfig) validateConnection(path string) error {
+	if cfg.ProtocolVersion != 0 && cfg.ProtocolVersion != protocolMQTT311 && cfg.ProtocolVersion != protocolMQTT5 {
+		return fmt.Errorf("protocol_version must be 4 (MQTT 3.1.1) or 5 %q", path)
+	}
+	if cfg.Transport != "" && cfg.Transport != transportTCP && cfg.Transport != transportQUIC {
+		return fmt.Errorf("transport must be tcp or quic %q", path)
+	}
+	if cfg.TopicAliasMaximum < 0 || cfg.TopicAliasMaximum > math.MaxUint16 {
+		return fmt.Errorf("topic_alias_maximum must be between 0 and %d %q", math.MaxUint16, path)
+	}
+	if cfg.TopicAliasMaximum > 0 && cfg.ProtocolVersion != protocolMQTT5 {
+		return fmt.Errorf("topic_alias_maximum requires protocol_version 5 %q", path)
+	}
+	if cfg.ReceiveMaximum < 0 || cfg.ReceiveMaximum > math.MaxUint16 {
+		return fmt.Errorf("receive_maximum must be between 1 and %d %q", math.MaxUint16, path)
+	}
+	if cfg.ReceiveMaximum > 0 && cfg.ProtocolVersion != protocolMQTT5 {
+		return fmt.Errorf("receive_maximum requires protocol_version 5 %q", path)
+	}
+	if cfg.SessionExpiry < 0 || cfg.SessionExpiry >= math.MaxUint32 || cfg.WillDelay < 0 || cfg.WillDelay >= math.MaxUint32 {
+		return fmt.Errorf("session_expiry_s and will_delay_s must be between 0 and %d %q", uint32(math.MaxUint32-1), path)
+	}
+	if (cfg.SessionExpiry > 0 || cfg.WillDelay > 0) && cfg.ProtocolVersion != protocolMQTT5 {
+		return fmt.Errorf("session_expiry_s and will_delay_s require protocol_version 5 %q", path)
+	}
+	if cfg.WillDelay > cfg.SessionExpiry {
+		// The broker publishes the will when the session ends at the latest
+		return fmt.Errorf("will_delay_s requires a session_expiry_s at least as long %q", path)
+	}
+	if cfg.Password != "" && cfg.Username == "" {
+		return fmt.Errorf("password requires a username %q", path)
+	}
+	if cfg.TLS != nil {
+		if (cfg.TLS.ClientCert == "") != (cfg.TLS.ClientKey == "") {
+			return fmt.Errorf("tls client_cert and client_key must be set together %q", path)
+		}
+		if _, err := cfg.TLS.load(); err != nil {
+			return fmt.Errorf("%v %q", err, path)
+		}
+	}
+	return nil
+}
+
+// Load the certificates into a TLS configuration
+func (cfg *TLSConfig) load() (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: cfg.ServerName, InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if cfg.CACert != "" {
+		pem, err := os.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("reading tls ca_cert: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("tls ca_cert contains no PEM certificate")
+		}
+	}
+	if cfg.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading tls client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// Return the URL of the broker, ssl:// with TLS and quic:// over QUIC
+func (cfg *BrokerConfig) url() string {
+	scheme := "tcp"
+	if cfg.Transport == transportQUIC {
+		scheme = transportQUIC
+	} else if cfg.TLS != nil {
+		scheme = "ssl"
+	}
+	return fmt.Sprintf("%s://%s:%d", scheme, cfg.Host, cfg.Port)
+}
+
+// Create the client options to connect to a broker with the credentials and TLS settings of the configuration
+func newClientOptions(cfg *BrokerConfig) (*mqtt.ClientOptions, error) {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(cfg.url())
+	opts.SetClientID(cfg.ClientID) // Set a unique client ID
+	opts.SetUsername(cfg.Username)
+	opts.SetPassword(cfg.Password)
+	if cfg.TLS != nil {
+		tlsConfig, err := cfg.TLS.load()
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	if cfg.Transport == transportQUIC {
+		if opts.TLSConfig == nil {
+			opts.SetTLSConfig(&tls.Config{})
+		}
+		// A reconnect resumes the TLS session, saving a round trip on slow links
+		opts.TLSConfig.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+		opts.SetCustomOpenConnectionFn(openQUICConnection)
+	}
+	if cfg.ProtocolVersion == protocolMQTT311 {
+		opts.SetProtocolVersion(protocolMQTT311)
+	}
+	return opts, nil
+}
+
+// Create the client of a broker connection with the protocol version of the configuration
+func newMQTTClient(cfg *BrokerConfig, opts *mqtt.ClientOptions) mqtt.Client {
+	if cfg.ProtocolVersion == protocolMQTT5 {
+		return newMQTT5Client(cfg, opts)
+	}
+	return mqtt.NewClient(opts)
+}
+
+// Connect to the broker until the context is done, or for 30 seconds if it has no deadline. The
+// connection reconnects automatically and subscribes the topics of the component again after every
+// reconnect, the session is not persistent.
+func (cfg *BrokerConfig) connect(ctx context.Context) (mqtt.Client, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultConnectTimeout)
+		defer cancel()
+	}
+	if cfg.SharedConnection {
+		return acquireSharedConnection(ctx, cfg)
+	}
+	return openPrivateConnection(ctx, cfg)
+}
+
+// Connect to the broker and subscribe to a topic
+func (cfg *BrokerConfig) connectAndSubscribe(ctx context.Context, topic string, qos byte, handler mqtt.MessageHandler) (mqtt.Client, error) {
+	client, err := cfg.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := waitForToken(ctx, client.Subscribe(topic, qos, handler)); err != nil {
+		client.Disconnect(250)
+		return nil, fmt.Errorf("subscribing to %q: %w", topic, err)
+	}
+	return client, nil
+}
+
+// Wait until the operation of the token completed or the context is done, or for 30 seconds if it has
+// no deadline
+func waitForToken(ctx context.Context, token mqtt.Token) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultConnectTimeout)
+		defer cancel()
+	}
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Whether the broker had a session for the client and the return code of a completed connect, the
+// reason code of the CONNACK for an MQTT 5 connection
+func connectResult(token mqtt.Token) (bool, byte) {
+	switch t := token.(type) {
+	case *mqtt.ConnectToken:
+		return t.SessionPresent(), t.ReturnCode()
+	case *mqtt5Token:
+		var refused *connectRefusedError
+		if errors.As(t.err, &refused) {
+			return false, refused.code
+		}
+		if t.err != nil {
+			return false, packets.ErrNetworkError
+		}
+		return t.sessionPresent, packets.Accepted
+	}
+	return false, packets.ErrNetworkError
+}
+
+// The granted QoS by topic filter of a completed subscription, 0x80 for the filters rejected by the broker
+func subscribeResult(token mqtt.Token) map[string]byte {
+	switch t := token.(type) {
+	case *mqtt.SubscribeToken:
+		return t.Result()
+	case *mqtt5Token:
+		return t.granted
+	}
+	return nil
+}
+
+// Time to wait for the broker acknowledgement of a publish if the context has no deadline
+const defaultPublishTimeout = 10 * time.Second
+
+// Publish a message and wait for the broker to acknowledge it until the context is done. The
+// acknowledgement of a QoS 1 or 2 message is only received once the client reconnected.
+func publishAndWait(ctx context.Context, client mqtt.Client, topic string, qos byte, retained bool, payload interface{}) error {
+	if client == nil || !client.IsConnected() {
+		return fmt.Errorf("MQTT client not connected")
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultPublishTimeout)
+		defer cancel()
+	}
+	t := client.Publish(topic, qos, retained, payload)
+	select {
+	case <-t.Done():
+		return t.Error()
+	case <-ctx.Done():
+		return fmt.Errorf("publishing to %q not acknowledged: %w", topic, ctx.Err())
+	}
+}
@@ -0,0 +1,102 @@
+package mqttclient
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+
+	"github.com/lab101/mqtt-welding/internal/mqtttest"
+)
+
+// Accept connections and acknowledge the CONNECT, other packets are never answered, like a broker which
+// stalls or a connection dropped without the client noticing
+func startMuteBroker(t *testing.T) *net.TCPAddr {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				if _, err := packets.ReadPacket(reader); err != nil {
+					return
+				}
+				if packets.NewControlPacket(packets.Connack).Write(conn) != nil {
+					return
+				}
+				for {
+					if _, err := packets.ReadPacket(reader); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr)
+}
+
+// A publish which is never acknowledged returns when the context is done
+func TestPublishAndWaitHonorsContext(t *testing.T) {
+	addr := startMuteBroker(t)
+	opts, err := newClientOptions(&BrokerConfig{Host: addr.IP.String(), Port: addr.Port, ClientID: "mute"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer client.Disconnect(0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = publishAndWait(ctx, client, "motor/cmd", 1, false, "stop")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unacknowledged publish = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("publish returned after %v", elapsed)
+	}
+}
+
+// The connection of a component subscribes again after a reconnect, the session is not persistent
+func TestConnectionResubscribes(t *testing.T) {
+	b := startTestBroker(t)
+	cfg := &BrokerConfig{Host: b.Host, Port: b.Port, ClientID: "gauge"}
+	messages := make(chan mqtt.Message, 10)
+	client, err := cfg.connectAndSubscribe(context.Background(), "gauge/value", 0, func(_ mqtt.Client, m mqtt.Message) {
+		messages <- m
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(250)
+
+	// A client with the same ID takes over the session, the component reconnects with a clean session
+	dialRaw(t, b, "gauge", true)
+	publisher := b.Client(t, "publisher")
+	mqtttest.Eventually(t, func() bool {
+		mqtttest.Publish(t, publisher, "gauge/value", "42", false)
+		select {
+		case <-messages:
+			return true
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}, "no message received after the reconnect")
+}
@@ -0,0 +1,270 @@
+package mqttclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Maps the consumables configuration attribute
+type ConsumablesConfig struct {
+	WireFeedSpeed string  `json:"wire_feed_speed"`    // Wire feed speed field in m/min, default wire_feed_speed_m_min
+	GasFlow       string  `json:"gas_flow"`           // Gas flow field in l/min, default gas_flow_l_min
+	WireDiameter  float64 `json:"wire_diameter_mm"`   // Adds the wire mass
+	WireDensity   float64 `json:"wire_density_g_cm3"` // Default 7.85 (steel)
+	SpoolKg       float64 `json:"spool_kg"`           // Wire mass of a full spool, adds the remaining wire
+	CylinderL     float64 `json:"cylinder_l"`         // Gas volume of a full cylinder, adds the remaining gas
+	MaxGap        float64 `json:"max_gap_s"`          // Longer gaps between two messages are not counted, default 5
+	StateDir      string  `json:"state_dir"`          // Directory of the persisted totals, default the module data directory
+}
+
+const (
+	defaultWireDensity = 7.85
+	// The totals are persisted at this interval if they changed
+	consumablesSaveInterval = time.Minute
+)
+
+// Validate the consumables configuration
+func (cfg *ConsumablesConfig) Validate() error {
+	if cfg.WireDiameter < 0 || cfg.WireDensity < 0 || cfg.SpoolKg < 0 || cfg.CylinderL < 0 || cfg.MaxGap < 0 {
+		return fmt.Errorf("consumables values must be >= 0")
+	}
+	if cfg.SpoolKg > 0 && cfg.WireDiameter == 0 {
+		return fmt.Errorf("consumables spool_kg requires wire_diameter_mm")
+	}
+	return nil
+}
+
+// Persisted consumable totals
+type consumablesState struct {
+	WireM           float64   `json:"wire_m"`           // Since the first start
+	GasL            float64   `json:"gas_l"`            // Since the first start
+	SpoolWireM      float64   `json:"spool_wire_m"`     // Since the last spool change
+	CylinderGasL    float64   `json:"cylinder_gas_l"`   // Since the last cylinder change
+	Since           time.Time `json:"since"`            // First start
+	SpoolChanged    time.Time `json:"spool_changed"`    // Last spool change, zero if never
+	CylinderChanged time.Time `json:"cylinder_changed"` // Last cylinder change, zero if never
+}
+
+// Accumulates the wire consumption from the wire feed speed during arc time and the gas usage from
+// the gas flow
+type consumablesTracker struct {
+	wireFeedSpeed, gasFlow string
+	kgPerM                 float64 // Wire mass per length, 0 without wire diameter
+	spoolKg, cylinderL     float64
+	maxGap                 time.Duration
+	path                   string
+	state                  consumablesState
+	dirty                  bool
+	// Values of the last message, they apply until the next
+	wire, gas     float64
+	wireAt, gasAt time.Time
+	wireOn        bool
+}
+
+func newConsumablesTracker(cfg *ConsumablesConfig, name string, now time.Time) *consumablesTracker {
+	if cfg == nil {
+		return nil
+	}
+	c := &consumablesTracker{
+		wireFeedSpeed: cfg.WireFeedSpeed,
+		gasFlow:       cfg.GasFlow,
+		spoolKg:       cfg.SpoolKg,
+		cylinderL:     cfg.CylinderL,
+		maxGap:        defaultArcMaxGap,
+		state:         consumablesState{Since: now},
+	}
+	if c.wireFeedSpeed == "" {
+		c.wireFeedSpeed = weldWireFeedSpeed
+	}
+	if c.gasFlow == "" {
+		c.gasFlow = weldGasFlow
+	}
+	if cfg.WireDiameter > 0 {
+		density := cfg.WireDensity
+		if density == 0 {
+			density = defaultWireDensity
+		}
+		// Cross section in mm² times g/cm³ is g/m, or 1e-3 kg/m
+		c.kgPerM = math.Pi * cfg.WireDiameter * cfg.WireDiameter / 4 * density / 1000
+	}
+	if cfg.MaxGap > 0 {
+		c.maxGap = time.Duration(cfg.MaxGap * float64(time.Second))
+	}
+	dir := cfg.StateDir
+	if dir == "" {
+		if dir = os.Getenv("VIAM_MODULE_DATA"); dir == "" {
+			dir = os.TempDir()
+		}
+	}
+	c.path = filepath.Join(dir, discoveryInvalidChars.ReplaceAllString(name, "_")+"-consumables.json")
+	return c
+}
+
+// Load the persisted totals, a missing file starts from zero
+func (c *consumablesTracker) load() error {
+	b, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &c.state)
+}
+
+// Persist the totals if they changed, the file is replaced atomically
+func (c *consumablesTracker) save() error {
+	if !c.dirty {
+		return nil
+	}
+	b, err := json.Marshal(c.state)
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// Integrate the values of the previous message until this one and record the values of a payload.
+// The wire is only counted while the arc is on.
+func (c *consumablesTracker) add(payload interface{}, arcOn bool, at time.Time) {
+	if v, ok := lookupField(payload, c.wireFeedSpeed); ok {
+		if f, ok := toFloat(v); ok {
+			if dt := at.Sub(c.wireAt); c.wireOn && !c.wireAt.IsZero() && dt > 0 && dt <= c.maxGap {
+				m := c.wire * dt.Minutes()
+				c.state.WireM += m
+				c.state.SpoolWireM += m
+				c.dirty = true
+			}
+			c.wire, c.wireAt, c.wireOn = f, at, arcOn
+		}
+	}
+	if v, ok := lookupField(payload, c.gasFlow); ok {
+		if f, ok := toFloat(v); ok {
+			if dt := at.Sub(c.gasAt); !c.gasAt.IsZero() && dt > 0 && dt <= c.maxGap {
+				l := c.gas * dt.Minutes()
+				c.state.GasL += l
+				c.state.CylinderGasL += l
+				c.dirty = true
+			}
+			c.gas, c.gasAt = f, at
+		}
+	}
+}
+
+// Record a spool or cylinder change, or reset all totals
+func (c *consumablesTracker) reset(what string, now time.Time) error {
+	switch what {
+	case "spool":
+		c.state.SpoolWireM = 0
+		c.state.SpoolChanged = now
+	case "cylinder":
+		c.state.CylinderGasL = 0
+		c.state.CylinderChanged = now
+	case "all":
+		c.state = consumablesState{Since: now}
+	default:
+		return fmt.Errorf("invalid consumables reset %q (should be spool, cylinder or all)", what)
+	}
+	c.dirty = true
+	return nil
+}
+
+func (c *consumablesTracker) readings() map[string]interface{} {
+	readings := map[string]interface{}{
+		"wire_m":         c.state.WireM,
+		"spool_wire_m":   c.state.SpoolWireM,
+		"gas_l":          c.state.GasL,
+		"cylinder_gas_l": c.state.CylinderGasL,
+		"since":          c.state.Since.UTC().Format(time.RFC3339),
+	}
+	if c.kgPerM > 0 {
+		readings["wire_kg"] = c.state.WireM * c.kgPerM
+		readings["spool_wire_kg"] = c.state.SpoolWireM * c.kgPerM
+	}
+	if c.spoolKg > 0 {
+		readings["spool_remaining_kg"] = math.Max(c.spoolKg-c.state.SpoolWireM*c.kgPerM, 0)
+	}
+	if c.cylinderL > 0 {
+		readings["cylinder_remaining_l"] = math.Max(c.cylinderL-c.state.CylinderGasL, 0)
+	}
+	if !c.state.SpoolChanged.IsZero() {
+		readings["spool_changed"] = c.state.SpoolChanged.UTC().Format(time.RFC3339)
+	}
+	if !c.state.CylinderChanged.IsZero() {
+		readings["cylinder_changed"] = c.state.CylinderChanged.UTC().Format(time.RFC3339)
+	}
+	return readings
+}
+
+// Update the consumables with a newly received message. Must be called with the mutex held, after the
+// arc tracking.
+func (s *mqttClient) trackConsumables(msg *receivedMessage) {
+	if s.consumables == nil {
+		return
+	}
+	payload, err := s.parseWithDerived(msg)
+	if err != nil {
+		return
+	}
+	// Without arc tracking the wire feed speed is expected to be 0 while not welding
+	arcOn := s.arc == nil || s.arc.on
+	s.consumables.add(payload, arcOn, msg.received)
+}
+
+// Persist the totals of the previous configuration, load the persisted totals and start persisting
+// them periodically. Must be called with the mutex held.
+func (s *mqttClient) resetConsumables(cfg *ConsumablesConfig) {
+	if s.stopConsumablesSave != nil {
+		s.stopConsumablesSave()
+		s.stopConsumablesSave = nil
+	}
+	if s.consumables != nil {
+		if err := s.consumables.save(); err != nil {
+			s.logger.Errorf("error saving consumables: %v", err)
+		}
+	}
+	if s.consumables = newConsumablesTracker(cfg, s.Name().ShortName(), time.Now()); s.consumables == nil {
+		return
+	}
+	if err := s.consumables.load(); err != nil {
+		s.logger.Errorf("error loading consumables from %v, starting from zero: %v", s.consumables.path, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopConsumablesSave = cancel
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(consumablesSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.done:
+				return
+			case <-ticker.C:
+			}
+			s.mutex.Lock()
+			if s.consumables != nil {
+				if err := s.consumables.save(); err != nil {
+					s.logger.Errorf("error saving consumables: %v", err)
+				}
+			}
+			s.mutex.Unlock()
+		}
+	}()
+}
@@ -0,0 +1,102 @@
+package mqttclient
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Maps JSON counter configuration attributes
+type CounterConfig struct {
+	Field string  `json:"field"` // Payload field of the device counter
+	Name  string  `json:"name"`  // Prefix of the derived fields, default the field
+	Max   float64 `json:"max"`   // Largest counter value before it wraps to 0, e.g. 65535, default no rollover
+}
+
+// Validate a counter configuration
+func (cfg *CounterConfig) Validate() error {
+	if cfg.Field == "" {
+		return fmt.Errorf("counter requires a field")
+	}
+	if cfg.Max < 0 {
+		return fmt.Errorf("max of counter %q must be >= 0", cfg.Field)
+	}
+	return nil
+}
+
+// Converts a device counter which rolls over or is reset into a monotonic total
+type counterTracker struct {
+	CounterConfig
+	last      float64
+	seen      bool
+	total     float64
+	rollovers uint64
+	resets    uint64
+}
+
+func newCounterTrackers(cfgs []CounterConfig) []*counterTracker {
+	var counters []*counterTracker
+	for _, cfg := range cfgs {
+		c := &counterTracker{CounterConfig: cfg}
+		if c.Name == "" {
+			c.Name = strings.ReplaceAll(c.Field, ".", "_")
+		}
+		counters = append(counters, c)
+	}
+	return counters
+}
+
+// Return the increment since the previous value. A decrease by more than half the range is a rollover,
+// any other decrease a reset of the device counter, which counted from 0 since.
+func (c *counterTracker) add(v float64) float64 {
+	if !c.seen {
+		c.last, c.seen = v, true
+		return 0
+	}
+	delta := v - c.last
+	if delta < 0 {
+		if c.Max > 0 && c.last-v > c.Max/2 {
+			delta = c.Max + 1 - c.last + v
+			c.rollovers++
+		} else {
+			delta = v
+			c.resets++
+		}
+	}
+	c.last = v
+	c.total += delta
+	return delta
+}
+
+func (c *counterTracker) readings() map[string]interface{} {
+	return map[string]interface{}{
+		"total":     c.total,
+		"last":      c.last,
+		"rollovers": c.rollovers,
+		"resets":    c.resets,
+	}
+}
+
+// Add the monotonic <name>_total and the <name>_delta since the previous message of the device counters
+// to the derived fields. Must be called with the mutex held.
+func (s *mqttClient) trackCounters(msg *receivedMessage) {
+	if len(s.counters) == 0 {
+		return
+	}
+	payload, err := s.parse(msg)
+	if err != nil {
+		return
+	}
+	for _, c := range s.counters {
+		v, ok := lookupField(payload, c.Field)
+		if !ok {
+			continue
+		}
+		f, ok := toFloat(v)
+		if !ok {
+			continue
+		}
+		delta := c.add(f)
+		msg.setDerived(c.Name+"_delta", delta)
+		msg.setDerived(c.Name+"_total", c.total)
+	}
+}
@@ -0,0 +1,47 @@
+package mqttclient
+
+import "testing"
+
+func TestCounterTrackerAdd(t *testing.T) {
+	tests := []struct {
+		name      string
+		max       float64
+		values    []float64
+		deltas    []float64
+		total     float64
+		rollovers uint64
+		resets    uint64
+	}{
+		{"first value is the baseline", 65535, []float64{100}, []float64{0}, 0, 0, 0},
+		{"increments", 65535, []float64{100, 110, 130}, []float64{0, 10, 20}, 30, 0, 0},
+		{"unchanged", 65535, []float64{100, 100}, []float64{0, 0}, 0, 0, 0},
+		{"rollover", 65535, []float64{65530, 4}, []float64{0, 10}, 10, 1, 0},
+		{"rollover to 0", 65535, []float64{65535, 0}, []float64{0, 1}, 1, 1, 0},
+		{"reset", 65535, []float64{1000, 5}, []float64{0, 5}, 5, 0, 1},
+		{"decrease by half the range is a reset", 100, []float64{60, 10}, []float64{0, 10}, 10, 0, 1},
+		{"decrease by more than half the range is a rollover", 100, []float64{60, 9}, []float64{0, 50}, 50, 1, 0},
+		{"without max every decrease is a reset", 0, []float64{65530, 4}, []float64{0, 4}, 4, 0, 1},
+		{"counting after a rollover", 255, []float64{250, 3, 13}, []float64{0, 9, 10}, 19, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCounterTrackers([]CounterConfig{{Field: "cycles", Max: tt.max}})[0]
+			for i, v := range tt.values {
+				if got := c.add(v); got != tt.deltas[i] {
+					t.Errorf("add(%v) = %v, want %v", v, got, tt.deltas[i])
+				}
+			}
+			if c.total != tt.total || c.rollovers != tt.rollovers || c.resets != tt.resets {
+				t.Errorf("total %v, rollovers %d, resets %d, want %v, %d, %d",
+					c.total, c.rollovers, c.resets, tt.total, tt.rollovers, tt.resets)
+			}
+		})
+	}
+}
+
+func TestCounterTrackerName(t *testing.T) {
+	counters := newCounterTrackers([]CounterConfig{{Field: "wire.meters"}, {Field: "arc.starts", Name: "starts"}})
+	if counters[0].Name != "wire_meters" || counters[1].Name != "starts" {
+		t.Errorf("names %q and %q", counters[0].Name, counters[1].Name)
+	}
+}
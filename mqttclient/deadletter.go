@@ -0,0 +1,80 @@
+package mqttclient
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+	"unicode/utf8"
+)
+
+// Number of failed messages kept for the parse_errors reading
+const parseErrorsWindow = 10
+
+// Record of a message that failed parsing
+type parseFailure struct {
+	topic    string
+	err      error
+	payload  []byte
+	received time.Time
+}
+
+// Encode the failure as a map, payloads which aren't valid UTF-8 are base64 encoded
+func (f *parseFailure) toMap() map[string]interface{} {
+	m := map[string]interface{}{
+		"topic":    f.topic,
+		"error":    f.err.Error(),
+		"received": f.received.UTC().Format(time.RFC3339Nano),
+	}
+	if utf8.Valid(f.payload) {
+		m["payload"] = string(f.payload)
+	} else {
+		m["payload_base64"] = base64.StdEncoding.EncodeToString(f.payload)
+	}
+	return m
+}
+
+// Counts parse failures and keeps the last ones
+type parseErrorLog struct {
+	count uint64
+	last  []*parseFailure
+}
+
+func (l *parseErrorLog) add(f *parseFailure) {
+	l.count++
+	if len(l.last) == parseErrorsWindow {
+		l.last = l.last[1:]
+	}
+	l.last = append(l.last, f)
+}
+
+// Return the failure count and the last failures as a readings map
+func (l *parseErrorLog) readings() map[string]interface{} {
+	last := make([]interface{}, 0, len(l.last))
+	for _, f := range l.last {
+		last = append(last, f.toMap())
+	}
+	return map[string]interface{}{"count": l.count, "last": last}
+}
+
+// Check if the message can be parsed, failed messages are published to the dead-letter topic and
+// recorded for the parse_errors reading. Must be called with the mutex held.
+func (s *mqttClient) checkParse(msg *receivedMessage) bool {
+	if s.deadLetterTopic == "" && !s.includeParseErrors {
+		return true
+	}
+	if _, err := s.parse(msg); err == nil {
+		return true
+	}
+	failure := &parseFailure{topic: msg.Topic(), err: msg.parseErr, payload: msg.Payload(), received: msg.received}
+	s.parseErrors.add(failure)
+	if s.deadLetterTopic != "" {
+		payload, err := json.Marshal(failure.toMap())
+		if err != nil {
+			s.logger.Errorf("error encoding dead letter: %v", err)
+			return false
+		}
+		// Don't wait for the acknowledgement in the message handler
+		s.publishNoWait(s.deadLetterTopic, s.QoS, false, payload)
+	}
+	return false
+}
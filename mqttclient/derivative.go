@@ -0,0 +1,94 @@
+package mqttclient
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Maps the derivatives configuration attribute
+type DerivativesConfig struct {
+	Fields []string `json:"fields"`   // Numeric payload or derived fields to compute the rate of change for
+	Window float64  `json:"window_s"` // Time window of the rate of change, default the previous sample
+}
+
+// Validate the derivatives configuration
+func (cfg *DerivativesConfig) Validate() error {
+	if len(cfg.Fields) == 0 {
+		return fmt.Errorf("derivatives requires at least one field")
+	}
+	if cfg.Window < 0 {
+		return fmt.Errorf("derivatives window_s must be >= 0")
+	}
+	return nil
+}
+
+type timedSample struct {
+	at time.Time
+	v  float64
+}
+
+// Recent samples of a field
+type derivative struct {
+	samples []timedSample
+}
+
+// Add a sample and return the rate of change per second since the oldest sample in the window, false
+// for the first sample or samples at the same time
+func (d *derivative) add(v float64, at time.Time, window time.Duration) (float64, bool) {
+	// Keep the newest sample at or before the window start as base
+	for len(d.samples) > 1 && !d.samples[1].at.After(at.Add(-window)) {
+		d.samples = d.samples[1:]
+	}
+	if window == 0 && len(d.samples) > 1 {
+		d.samples = d.samples[len(d.samples)-1:]
+	}
+	var rate float64
+	ok := false
+	if len(d.samples) > 0 {
+		base := d.samples[0]
+		if dt := at.Sub(base.at).Seconds(); dt > 0 {
+			rate, ok = (v-base.v)/dt, true
+		}
+	}
+	d.samples = append(d.samples, timedSample{at: at, v: v})
+	return rate, ok
+}
+
+// Update the derivatives with a newly received message and add the <field>_rate values to its derived
+// fields. The payload timestamp is used if present. Must be called with the mutex held.
+func (s *mqttClient) computeDerivatives(msg *receivedMessage) {
+	if s.derivativesConfig == nil {
+		return
+	}
+	payload, err := s.parseWithDerived(msg)
+	if err != nil {
+		return
+	}
+
+	at := msg.received
+	if !msg.timestamp.IsZero() {
+		at = msg.timestamp
+	}
+	window := time.Duration(s.derivativesConfig.Window * float64(time.Second))
+	for _, field := range s.derivativesConfig.Fields {
+		v, ok := lookupField(payload, field)
+		if !ok {
+			continue
+		}
+		f, ok := numeric(v)
+		if !ok {
+			continue
+		}
+		d, ok := s.derivatives[field]
+		if !ok {
+			d = &derivative{}
+			s.derivatives[field] = d
+		}
+		rate, ok := d.add(f, at, window)
+		if !ok {
+			continue
+		}
+		msg.setDerived(strings.ReplaceAll(field, ".", "_")+"_rate", rate)
+	}
+}
@@ -0,0 +1,104 @@
+package mqttclient
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var identifierRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Derived field definition, e.g. "power_w = volts * amps" or "energy_j += power_w * dt"
+type derivedField struct {
+	name       string
+	accumulate bool
+	expr       expr
+}
+
+// Parse a derived field definition of the form "<name> = <expr>" or "<name> += <expr>"
+func parseDerivedField(def string) (derivedField, error) {
+	accumulate := false
+	name, src, ok := strings.Cut(def, "+=")
+	if ok {
+		accumulate = true
+	} else if name, src, ok = strings.Cut(def, "="); !ok {
+		return derivedField{}, fmt.Errorf("invalid derived field %q (expected \"<name> = <expr>\")", def)
+	}
+	name = strings.TrimSpace(name)
+	if !identifierRegex.MatchString(name) {
+		return derivedField{}, fmt.Errorf("invalid derived field name %q", name)
+	}
+	e, err := compileExpr(src)
+	if err != nil {
+		return derivedField{}, fmt.Errorf("invalid derived field %q: %v", def, err)
+	}
+	return derivedField{name: name, accumulate: accumulate, expr: e}, nil
+}
+
+// Compute the derived fields for a newly received message. Expressions can reference
+// top level payload fields, previously derived fields, topic, msg (the whole payload)
+// and dt (seconds since the previous message). Must be called with the mutex held.
+func (s *mqttClient) computeDerived(msg *receivedMessage) {
+	if len(s.derivedFields) == 0 {
+		return
+	}
+	dt := 0.0
+	if !s.lastReceived.IsZero() {
+		dt = msg.received.Sub(s.lastReceived).Seconds()
+	}
+	s.lastReceived = msg.received
+
+	payload, err := s.parse(msg)
+	if err != nil {
+		s.logger.Debugf("cannot compute derived fields: %v", err)
+		return
+	}
+	env := map[string]interface{}{}
+	if fields, ok := payload.(map[string]interface{}); ok {
+		for k, v := range fields {
+			env[k] = v
+		}
+	}
+	env["msg"] = payload
+	env["topic"] = msg.Topic()
+	env["dt"] = dt
+
+	msg.derived, msg.merged = map[string]interface{}{}, nil
+	for _, field := range s.derivedFields {
+		v, err := field.expr.eval(env)
+		if err != nil {
+			s.logger.Debugf("cannot compute derived field %s: %v", field.name, err)
+			continue
+		}
+		if field.accumulate {
+			f, ok := numeric(v)
+			if !ok {
+				s.logger.Debugf("cannot accumulate non numeric derived field %s: %v", field.name, v)
+				continue
+			}
+			s.accumulators[field.name] += f
+			v = s.accumulators[field.name]
+		}
+		env[field.name] = v
+		msg.setDerived(field.name, v)
+	}
+}
+
+// Merge the derived fields into an object payload, the input is not modified
+func mergeDerived(payload interface{}, derived map[string]interface{}) (interface{}, bool) {
+	fields, ok := payload.(map[string]interface{})
+	if !ok {
+		return payload, false
+	}
+	if len(derived) == 0 {
+		return payload, true
+	}
+	out := make(map[string]interface{}, len(fields)+len(derived))
+	for k, v := range fields {
+		out[k] = v
+	}
+	for k, v := range derived {
+		out[k] = v
+	}
+	return out, true
+}
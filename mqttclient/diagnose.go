@@ -0,0 +1,209 @@
+package mqttclient
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Default timeout of every step of the connection check
+const defaultCheckTimeout = 5 * time.Second
+
+// Arguments of the check_connection command
+type checkArgs struct {
+	TimeoutMs int `json:"timeout_ms"` // Timeout of every step, default 5000
+}
+
+// Result of a step of the connection check
+type checkStep struct {
+	name   string
+	start  time.Time
+	detail interface{}
+	err    error
+}
+
+func (c *checkStep) readings() map[string]interface{} {
+	step := map[string]interface{}{
+		"step":        c.name,
+		"ok":          c.err == nil,
+		"duration_ms": float64(time.Since(c.start).Microseconds()) / 1000,
+	}
+	if c.detail != nil {
+		step["detail"] = c.detail
+	}
+	if c.err != nil {
+		step["error"] = c.err.Error()
+	}
+	return step
+}
+
+// Check the broker connectivity of a configuration step by step, DNS resolution, TCP connection and TLS
+// handshake or QUIC handshake, MQTT connection and subscriptions, with a connection of its own so the running connection is
+// not affected. The response names the first failed step and its reason.
+func checkConnection(ctx context.Context, cfg *BrokerConfig, filters map[string]byte, args checkArgs) map[string]interface{} {
+	host, port := cfg.Host, cfg.Port
+	timeout := defaultCheckTimeout
+	if args.TimeoutMs > 0 {
+		timeout = time.Duration(args.TimeoutMs) * time.Millisecond
+	}
+	var steps []interface{}
+	result := map[string]interface{}{"broker": net.JoinHostPort(host, strconv.Itoa(port))}
+	// Record a step and return whether it succeeded
+	done := func(step *checkStep) bool {
+		steps = append(steps, step.readings())
+		result["steps"] = steps
+		if step.err != nil {
+			result["ok"] = false
+			result["failed_step"] = step.name
+			result["error"] = step.err.Error()
+			return false
+		}
+		return true
+	}
+
+	step := &checkStep{name: "dns", start: time.Now()}
+	dnsCtx, cancel := context.WithTimeout(ctx, timeout)
+	addrs, err := net.DefaultResolver.LookupHost(dnsCtx, host)
+	cancel()
+	if step.err = err; err == nil {
+		step.detail = stringList(addrs)
+	}
+	if !done(step) {
+		return result
+	}
+
+	if cfg.Transport == transportQUIC {
+		// The QUIC handshake includes the TLS handshake
+		step = &checkStep{name: "quic", start: time.Now()}
+		tlsConfig := &tls.Config{}
+		if cfg.TLS != nil {
+			tlsConfig, err = cfg.TLS.load()
+		}
+		if err == nil {
+			quicCtx, cancel := context.WithTimeout(ctx, timeout)
+			var conn *quicConn
+			if conn, err = dialQUIC(quicCtx, net.JoinHostPort(host, strconv.Itoa(port)), tlsConfig); err == nil {
+				state := conn.conn.ConnectionState().TLS
+				step.detail = map[string]interface{}{"address": conn.RemoteAddr().String(), "version": tls.VersionName(state.Version), "server": state.PeerCertificates[0].Subject.String()}
+				defer conn.Close()
+			}
+			cancel()
+		}
+		step.err = err
+		if !done(step) {
+			return result
+		}
+	} else {
+		step = &checkStep{name: "tcp", start: time.Now()}
+		dialer := net.Dialer{Timeout: timeout}
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err == nil {
+			step.detail = conn.RemoteAddr().String()
+			defer conn.Close()
+		}
+		step.err = err
+		if !done(step) {
+			return result
+		}
+
+		if cfg.TLS != nil {
+			step = &checkStep{name: "tls", start: time.Now()}
+			tlsConfig, err := cfg.TLS.load()
+			if err == nil {
+				if tlsConfig.ServerName == "" {
+					tlsConfig.ServerName = host
+				}
+				tlsConn := tls.Client(conn, tlsConfig)
+				tlsCtx, cancel := context.WithTimeout(ctx, timeout)
+				if err = tlsConn.HandshakeContext(tlsCtx); err == nil {
+					state := tlsConn.ConnectionState()
+					step.detail = map[string]interface{}{"version": tls.VersionName(state.Version), "server": state.PeerCertificates[0].Subject.String()}
+				}
+				cancel()
+			}
+			step.err = err
+			if !done(step) {
+				return result
+			}
+		}
+	}
+
+	// A client ID of its own, the broker would disconnect the running client otherwise
+	step = &checkStep{name: "mqtt_connect", start: time.Now()}
+	checkConfig := *cfg
+	checkConfig.ClientID += "-check"
+	opts, err := newClientOptions(&checkConfig)
+	if err != nil {
+		step.err = err
+		done(step)
+		return result
+	}
+	opts.SetAutoReconnect(false)
+	opts.SetConnectRetry(false)
+	opts.SetConnectTimeout(timeout)
+	client := newMQTTClient(cfg, opts)
+	token := client.Connect()
+	if !token.WaitTimeout(timeout) {
+		step.err = errors.New("timed out waiting for the CONNACK, the port may not be an MQTT listener or TLS is required")
+	} else if token.Error() != nil {
+		step.err = token.Error()
+		if code, reason, ok := connectRefusal(token); ok {
+			step.detail = map[string]interface{}{"return_code": code, "reason": reason}
+		}
+	}
+	if !done(step) {
+		return result
+	}
+	defer client.Disconnect(250)
+
+	step = &checkStep{name: "subscribe", start: time.Now()}
+	token = client.SubscribeMultiple(filters, func(mqtt.Client, mqtt.Message) {})
+	if !token.WaitTimeout(timeout) {
+		step.err = errors.New("timed out waiting for the SUBACK")
+	} else if token.Error() != nil {
+		step.err = token.Error()
+	} else {
+		granted := subscribeResult(token)
+		subscriptions := []interface{}{}
+		var rejected []string
+		for _, filter := range sortedKeys(filters) {
+			qos, ok := granted[filter]
+			outcome := subscriptionResult(filters[filter], qos, ok)
+			subscriptions = append(subscriptions, map[string]interface{}{"topic": filter, "requested_qos": filters[filter], "granted_qos": qos, "result": outcome})
+			if outcome == "rejected" || outcome == "missing" {
+				rejected = append(rejected, filter)
+			}
+		}
+		step.detail = subscriptions
+		if len(rejected) > 0 {
+			step.err = fmt.Errorf("broker rejected the subscription of %q, check the broker ACL", rejected)
+		}
+	}
+	if !done(step) {
+		return result
+	}
+	result["ok"] = true
+	return result
+}
+
+// The return code and reason of a connection refused by the broker, the MQTT 5 reason code for an MQTT 5
+// connection
+func connectRefusal(token mqtt.Token) (byte, string, bool) {
+	if t, ok := token.(*mqtt.ConnectToken); ok {
+		code := t.ReturnCode()
+		reason, ok := packets.ConnackReturnCodes[code]
+		return code, reason, ok && code != packets.Accepted
+	}
+	var refused *connectRefusedError
+	if errors.As(token.Error(), &refused) {
+		return refused.code, refused.reason(), true
+	}
+	return 0, "", false
+}
@@ -0,0 +1,443 @@
+package mqttclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+	"go.viam.com/rdk/services/generic"
+)
+
+// Service model acting as a Sparkplug B Edge Node for the readings of sensor dependencies
+var EdgeNodeModel = resource.NewModel("lab101", "mqtt", "sparkplug-edge-node")
+
+// Default interval between two readings of the sensors
+const defaultEdgeNodeIntervalMs = 1000
+
+// Sparkplug B node control metric requesting a new NBIRTH
+const sparkplugRebirthMetric = "Node Control/Rebirth"
+
+func init() {
+	resource.RegisterService(generic.API, EdgeNodeModel,
+		resource.Registration[resource.Resource, *EdgeNodeConfig]{Constructor: newEdgeNode})
+}
+
+// Maps JSON edge node configuration attributes.
+type EdgeNodeConfig struct {
+	BrokerConfig  `json:",squash"`
+	GroupID       string               `json:"group_id"`
+	EdgeNodeID    string               `json:"edge_node_id"`
+	Sensors       []string             `json:"sensors"`        // Resources whose readings are published as metrics
+	IntervalMs    int                  `json:"interval_ms"`    // Interval between two readings, default 1000
+	HomeAssistant *HomeAssistantConfig `json:"home_assistant"` // Publish JSON state and discovery configs
+}
+
+// Implement edge node configuration validation and return the sensors as dependencies.
+func (cfg *EdgeNodeConfig) Validate(path string) ([]string, error) {
+	if err := cfg.BrokerConfig.Validate(path); err != nil {
+		return nil, err
+	}
+	if cfg.GroupID == "" || cfg.EdgeNodeID == "" {
+		return nil, fmt.Errorf("group_id and edge_node_id are required %q", path)
+	}
+	if !validTopicName(cfg.GroupID) || !validTopicName(cfg.EdgeNodeID) {
+		return nil, fmt.Errorf("group_id and edge_node_id must not contain wildcards %q", path)
+	}
+	if len(cfg.Sensors) == 0 {
+		return nil, fmt.Errorf("at least one sensor is required %q", path)
+	}
+	if cfg.IntervalMs < 0 {
+		return nil, fmt.Errorf("interval_ms must be >= 0 %q", path)
+	}
+	if cfg.HomeAssistant != nil {
+		if err := cfg.HomeAssistant.Validate(path); err != nil {
+			return nil, err
+		}
+	}
+	return append([]string{}, cfg.Sensors...), nil
+}
+
+type edgeNodeSensor struct {
+	name   string
+	sensor resource.Sensor
+}
+
+type mqttEdgeNode struct {
+	resource.Named
+	resource.AlwaysRebuild
+	logger     logging.Logger
+	client     mqtt.Client
+	cfg        *EdgeNodeConfig
+	sensors    []edgeNodeSensor
+	bdSeq      uint64 // Birth/death sequence number of the current session
+	nextBdSeq  uint64 // Sequence number of the next session, persisted across restarts
+	bdSeqPath  string
+	seq        uint64
+	metrics    map[string]interface{} // Last published metric values
+	discovery  *haDiscovery
+	stateTopic string
+	births     uint64
+	messages   uint64
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+	mutex      sync.Mutex
+}
+
+// Edge node constructor, the node is rebuilt on reconfiguration
+func newEdgeNode(ctx context.Context, deps resource.Dependencies, conf resource.Config, logger logging.Logger) (resource.Resource, error) {
+	nodeConfig, err := resource.NativeConfig[*EdgeNodeConfig](conf)
+	if err != nil {
+		return nil, err
+	}
+	n := &mqttEdgeNode{
+		Named:   conf.ResourceName().AsNamed(),
+		logger:  logger,
+		cfg:     nodeConfig,
+		metrics: map[string]interface{}{},
+	}
+	for _, name := range nodeConfig.Sensors {
+		r, err := dependencyByName(deps, name)
+		if err != nil {
+			return nil, err
+		}
+		s, ok := r.(resource.Sensor)
+		if !ok {
+			return nil, fmt.Errorf("resource %q has no readings", name)
+		}
+		n.sensors = append(n.sensors, edgeNodeSensor{name: name, sensor: s})
+	}
+	if ha := nodeConfig.HomeAssistant; ha != nil {
+		n.discovery = newHADiscovery(ha, nodeConfig.EdgeNodeID)
+		n.stateTopic = ha.StateTopic
+		if n.stateTopic == "" {
+			n.stateTopic = fmt.Sprintf("viam/%s/%s/state", nodeConfig.GroupID, nodeConfig.EdgeNodeID)
+		}
+	}
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	// The first birth certificate already lists the metrics
+	n.metrics = n.read()
+	dir := os.Getenv("VIAM_MODULE_DATA")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	n.bdSeqPath = filepath.Join(dir, discoveryInvalidChars.ReplaceAllString(nodeConfig.GroupID+"-"+nodeConfig.EdgeNodeID, "_")+"-bdseq")
+	if n.nextBdSeq, err = loadBdSeq(n.bdSeqPath); err != nil {
+		logger.Warnf("error loading the sparkplug bdSeq, starting from 0: %v", err)
+	}
+
+	// The broker publishes NDEATH with the bdSeq of the session when the connection is lost. Every
+	// connection is a new session, the will is built again before the client reconnects.
+	if nodeConfig.SharedConnection {
+		if err := n.connectShared(ctx); err != nil {
+			n.cancel()
+			return nil, fmt.Errorf("error initializing sparkplug edge node: %v", err)
+		}
+	} else {
+		opts, err := newClientOptions(&nodeConfig.BrokerConfig)
+		if err != nil {
+			n.cancel()
+			return nil, fmt.Errorf("error initializing sparkplug edge node: %v", err)
+		}
+		opts.SetBinaryWill(n.topic("NDEATH"), n.newSession(), 1, false)
+		opts.SetReconnectingHandler(func(_ mqtt.Client, opts *mqtt.ClientOptions) {
+			opts.SetBinaryWill(n.topic("NDEATH"), n.newSession(), 1, false)
+		})
+		opts.SetOnConnectHandler(n.onConnect)
+		n.client = newMQTTClient(&nodeConfig.BrokerConfig, opts)
+		if token := n.client.Connect(); token.Wait() && token.Error() != nil {
+			n.cancel()
+			return nil, fmt.Errorf("error initializing sparkplug edge node: %v", token.Error())
+		}
+	}
+	n.wg.Add(1)
+	go n.run()
+	return n, nil
+}
+
+// Use the connection shared with the components of the same broker and client ID. The node owns the
+// last will of the connection, the connection publishes the birth certificate again after a reconnect.
+func (n *mqttEdgeNode) connectShared(ctx context.Context) error {
+	client, err := n.cfg.BrokerConfig.connect(ctx)
+	if err != nil {
+		return err
+	}
+	shared := client.(*sharedClient)
+	n.client = client
+	if err := shared.setWill(func() (string, []byte) { return n.topic("NDEATH"), n.newSession() }); err != nil {
+		client.Disconnect(250)
+		return err
+	}
+	// The connection restarted with the will is already established, the birth certificate is published here
+	shared.setHandlers(n.onConnect, nil)
+	n.onConnect(client)
+	return nil
+}
+
+// Start the session of a connection attempt: take the next bdSeq, persist its successor and return the
+// NDEATH payload of the session
+func (n *mqttEdgeNode) newSession() []byte {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.bdSeq = n.nextBdSeq
+	n.nextBdSeq = (n.bdSeq + 1) % 256
+	if err := saveBdSeq(n.bdSeqPath, n.nextBdSeq); err != nil {
+		n.logger.Warnf("error persisting the sparkplug bdSeq: %v", err)
+	}
+	return n.deathCertificate()
+}
+
+// Load the persisted bdSeq of the next session, a missing file starts from 0
+func loadBdSeq(path string) (uint64, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	seq, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return seq % 256, nil
+}
+
+// Persist the bdSeq of the next session, the file is replaced atomically
+func saveBdSeq(path string, seq uint64) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(seq, 10)), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Encode the NDEATH payload with the bdSeq of the session, the caller holds the mutex
+func (n *mqttEdgeNode) deathCertificate() []byte {
+	death := &sparkplugPayload{
+		timestamp: uint64(time.Now().UnixMilli()),
+		metrics:   []sparkplugMetric{{name: "bdSeq", value: n.bdSeq}},
+	}
+	return death.marshal()
+}
+
+// Return the Sparkplug B topic of a node message type
+func (n *mqttEdgeNode) topic(messageType string) string {
+	return fmt.Sprintf("spBv1.0/%s/%s/%s", n.cfg.GroupID, messageType, n.cfg.EdgeNodeID)
+}
+
+// Subscribe to node commands and publish the birth certificate on every connection
+func (n *mqttEdgeNode) onConnect(client mqtt.Client) {
+	if token := client.Subscribe(n.topic("NCMD"), 1, n.onCommand); token.Wait() && token.Error() != nil {
+		n.logger.Errorf("sparkplug NCMD subscription failed: %v", token.Error())
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.birth()
+}
+
+// Publish NBIRTH on a rebirth request
+func (n *mqttEdgeNode) onCommand(client mqtt.Client, msg mqtt.Message) {
+	payload, err := unmarshalSparkplugPayload(msg.Payload())
+	if err != nil {
+		n.logger.Debugf("invalid sparkplug NCMD payload: %v", err)
+		return
+	}
+	for _, m := range payload.metrics {
+		if m.name == sparkplugRebirthMetric && m.value == true {
+			n.mutex.Lock()
+			n.birth()
+			n.mutex.Unlock()
+		}
+	}
+}
+
+// Publish NBIRTH with all metrics and reset the sequence number, the caller holds the mutex
+func (n *mqttEdgeNode) birth() {
+	now := uint64(time.Now().UnixMilli())
+	metrics := []sparkplugMetric{
+		{name: "bdSeq", value: n.bdSeq},
+		{name: sparkplugRebirthMetric, value: false},
+	}
+	for _, name := range sortedKeys(n.metrics) {
+		metrics = append(metrics, sparkplugMetric{name: name, timestamp: now, value: n.metrics[name]})
+	}
+	n.seq = 0
+	payload := &sparkplugPayload{timestamp: now, seq: n.seq, metrics: metrics}
+	n.client.Publish(n.topic("NBIRTH"), 0, false, payload.marshal())
+	n.births++
+	n.publishState()
+}
+
+// Publish the metrics as JSON state and announce new metrics to Home Assistant, the caller holds the mutex
+func (n *mqttEdgeNode) publishState() {
+	if n.discovery == nil {
+		return
+	}
+	paths := make(map[string][]string, len(n.metrics))
+	for name := range n.metrics {
+		paths[name] = []string{name}
+	}
+	for _, config := range n.discovery.configs(n.stateTopic, paths, n.metrics) {
+		n.client.Publish(config.topic, 1, true, config.payload)
+	}
+	state, err := json.Marshal(n.metrics)
+	if err != nil {
+		n.logger.Debugf("error encoding state: %v", err)
+		return
+	}
+	n.client.Publish(n.stateTopic, 0, true, state)
+}
+
+// Read the sensors every interval and publish the changed metrics
+func (n *mqttEdgeNode) run() {
+	defer n.wg.Done()
+	interval := time.Duration(n.cfg.IntervalMs) * time.Millisecond
+	if interval == 0 {
+		interval = defaultEdgeNodeIntervalMs * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		values := n.read()
+		n.mutex.Lock()
+		n.publish(values)
+		n.mutex.Unlock()
+	}
+}
+
+// Read the sensors and flatten their readings into metrics named "<sensor>/<reading>"
+func (n *mqttEdgeNode) read() map[string]interface{} {
+	values := map[string]interface{}{}
+	for _, s := range n.sensors {
+		readings, err := s.sensor.Readings(n.ctx, nil)
+		if err != nil {
+			n.logger.Debugf("readings of %q failed: %v", s.name, err)
+			continue
+		}
+		flattenMetrics(s.name, readings, values)
+	}
+	return values
+}
+
+// Add nested readings as metrics, nested names are joined with "/"
+func flattenMetrics(prefix string, readings map[string]interface{}, values map[string]interface{}) {
+	for k, v := range readings {
+		if nested, ok := v.(map[string]interface{}); ok {
+			flattenMetrics(prefix+"/"+k, nested, values)
+			continue
+		}
+		values[prefix+"/"+k] = sparkplugValue(v)
+	}
+}
+
+// Publish NDATA with the changed metrics, new metrics require a rebirth as the birth certificate
+// must list all metrics. The caller holds the mutex.
+func (n *mqttEdgeNode) publish(values map[string]interface{}) {
+	if !n.client.IsConnectionOpen() {
+		return
+	}
+	rebirth := false
+	changed := []string{}
+	for name, v := range values {
+		old, ok := n.metrics[name]
+		if !ok {
+			rebirth = true
+		}
+		if !ok || !reflect.DeepEqual(old, v) {
+			changed = append(changed, name)
+			n.metrics[name] = v
+		}
+	}
+	if rebirth {
+		n.birth()
+		return
+	}
+	if len(changed) == 0 {
+		return
+	}
+	sort.Strings(changed)
+	now := uint64(time.Now().UnixMilli())
+	metrics := make([]sparkplugMetric, 0, len(changed))
+	for _, name := range changed {
+		metrics = append(metrics, sparkplugMetric{name: name, timestamp: now, value: values[name]})
+	}
+	n.seq = (n.seq + 1) % 256
+	payload := &sparkplugPayload{timestamp: now, seq: n.seq, metrics: metrics}
+	n.client.Publish(n.topic("NDATA"), 0, false, payload.marshal())
+	n.messages++
+	n.publishState()
+}
+
+// Return the keys of a map in sorted order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Return strings as list, readings don't support typed slices
+func stringList(strings []string) []interface{} {
+	list := make([]interface{}, len(strings))
+	for i, s := range strings {
+		list[i] = s
+	}
+	return list
+}
+
+// DoCommand implements {"rebirth": true} and {"status": true}
+func (n *mqttEdgeNode) DoCommand(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if _, ok := cmd["rebirth"]; ok {
+		n.birth()
+		return map[string]interface{}{"result": "success"}, nil
+	}
+	if _, ok := cmd["status"]; ok {
+		return map[string]interface{}{
+			"connected": n.client.IsConnectionOpen(),
+			"bdSeq":     n.bdSeq,
+			"seq":       n.seq,
+			"metrics":   len(n.metrics),
+			"births":    n.births,
+			"messages":  n.messages,
+		}, nil
+	}
+	return nil, errUnimplemented
+}
+
+// Stop publishing and disconnect, the broker doesn't publish NDEATH on a clean disconnect so it is published first
+func (n *mqttEdgeNode) Close(ctx context.Context) error {
+	n.cancel()
+	n.wg.Wait()
+	if n.client.IsConnected() {
+		n.mutex.Lock()
+		death := n.deathCertificate()
+		n.mutex.Unlock()
+		if err := publishAndWait(ctx, n.client, n.topic("NDEATH"), 1, false, death); err != nil {
+			n.logger.Warnf("error publishing NDEATH: %v", err)
+		}
+	}
+	n.client.Disconnect(250) // Timeout in milliseconds
+	return nil
+}
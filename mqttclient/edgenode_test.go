@@ -0,0 +1,84 @@
+package mqttclient
+
+import (
+	"context"
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+	"go.viam.com/rdk/services/generic"
+
+	"github.com/lab101/mqtt-welding/internal/mqtttest"
+)
+
+// Create an edge node publishing the readings of a client sensor, it is closed when the test ends
+func newTestEdgeNode(t *testing.T, b *mqtttest.Broker, sens *mqttClient) *mqttEdgeNode {
+	t.Helper()
+	cfg := &EdgeNodeConfig{
+		BrokerConfig: BrokerConfig{Host: b.Host, Port: b.Port, ClientID: "edge"},
+		GroupID:      "welding",
+		EdgeNodeID:   "cell1",
+		Sensors:      []string{sens.Name().ShortName()},
+	}
+	conf := resource.Config{Name: "edge", API: generic.API, Model: EdgeNodeModel, ConvertedAttributes: cfg}
+	deps := resource.Dependencies{sens.Name(): sens}
+	node, err := newEdgeNode(context.Background(), deps, conf, logging.NewTestLogger(t))
+	if err != nil {
+		t.Fatalf("creating edge node: %v", err)
+	}
+	t.Cleanup(func() { node.Close(context.Background()) })
+	return node.(*mqttEdgeNode)
+}
+
+// The bdSeq metric of a Sparkplug B message
+func sparkplugBdSeq(t *testing.T, m mqtt.Message) interface{} {
+	t.Helper()
+	payload, err := unmarshalSparkplugPayload(m.Payload())
+	if err != nil {
+		t.Fatalf("decoding %s: %v", m.Topic(), err)
+	}
+	for _, metric := range payload.metrics {
+		if metric.name == "bdSeq" {
+			return metric.value
+		}
+	}
+	t.Fatalf("%s without bdSeq", m.Topic())
+	return nil
+}
+
+// Every connection is a new session with the next bdSeq, the last will carries the bdSeq of its session
+// and the sequence continues after a restart
+func TestEdgeNodeBdSeq(t *testing.T) {
+	t.Setenv("VIAM_MODULE_DATA", t.TempDir())
+	b := startTestBroker(t)
+	sens := newTestSensor(t, b, "weld", &Config{Topic: "weld/cell1/data", QueueLength: 10, PayloadType: "json"})
+	observer := b.Client(t, "observer")
+	births := mqtttest.Subscribe(t, observer, "spBv1.0/welding/NBIRTH/cell1")
+	deaths := mqtttest.Subscribe(t, observer, "spBv1.0/welding/NDEATH/cell1")
+
+	node := newTestEdgeNode(t, b, sens)
+	if seq := sparkplugBdSeq(t, mqtttest.Receive(t, births)); seq != uint64(0) {
+		t.Errorf("first NBIRTH bdSeq = %v, want 0", seq)
+	}
+
+	// A client taking over the client ID drops the connection, the broker publishes the will
+	b.Client(t, "edge")
+	if seq := sparkplugBdSeq(t, mqtttest.Receive(t, deaths)); seq != uint64(0) {
+		t.Errorf("NDEATH will bdSeq = %v, want the bdSeq of the lost session 0", seq)
+	}
+	if seq := sparkplugBdSeq(t, mqtttest.Receive(t, births)); seq != uint64(1) {
+		t.Errorf("NBIRTH bdSeq after the reconnect = %v, want 1", seq)
+	}
+
+	if err := node.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if seq := sparkplugBdSeq(t, mqtttest.Receive(t, deaths)); seq != uint64(1) {
+		t.Errorf("NDEATH bdSeq on close = %v, want 1", seq)
+	}
+	newTestEdgeNode(t, b, sens)
+	if seq := sparkplugBdSeq(t, mqtttest.Receive(t, births)); seq != uint64(2) {
+		t.Errorf("NBIRTH bdSeq after a restart = %v, want the persisted 2", seq)
+	}
+}
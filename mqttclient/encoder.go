@@ -0,0 +1,153 @@
+package mqttclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.viam.com/rdk/components/encoder"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+)
+
+// Encoder model tracking the position from a counter topic
+var EncoderModel = resource.NewModel("lab101", "mqtt", "encoder")
+
+func init() {
+	resource.RegisterComponent(encoder.API, EncoderModel,
+		resource.Registration[encoder.Encoder, *EncoderConfig]{Constructor: newEncoder})
+}
+
+// Maps JSON encoder configuration attributes.
+type EncoderConfig struct {
+	BrokerConfig     `json:",squash"`
+	Topic            string  `json:"topic"`
+	Field            string  `json:"field"` // JSON payload field with the count, the payload is a number if empty
+	QoS              int     `json:"qos"`
+	Rollover         float64 `json:"rollover"`           // Counter modulus, e.g. 65536 for a 16 bit counter
+	TicksPerRotation float64 `json:"ticks_per_rotation"` // Enables positions in degrees
+}
+
+// Implement encoder configuration validation and return implicit dependencies.
+func (cfg *EncoderConfig) Validate(path string) ([]string, error) {
+	if cfg.Topic == "" {
+		return nil, fmt.Errorf("topic is required %q", path)
+	}
+	if err := cfg.BrokerConfig.Validate(path); err != nil {
+		return nil, err
+	}
+	if cfg.QoS < 0 || cfg.QoS > 2 {
+		return nil, fmt.Errorf("qos must be between 0 and 2 %q", path)
+	}
+	if cfg.Rollover < 0 || cfg.TicksPerRotation < 0 {
+		return nil, fmt.Errorf("rollover and ticks_per_rotation must be >= 0 %q", path)
+	}
+	return []string{}, nil
+}
+
+type mqttEncoder struct {
+	resource.Named
+	resource.AlwaysRebuild
+	logger   logging.Logger
+	client   mqtt.Client
+	cfg      *EncoderConfig
+	count    float64 // Last counter value
+	hasCount bool
+	ticks    float64 // Ticks since the first count or the last reset
+	mutex    sync.Mutex
+}
+
+// Encoder constructor, the encoder is rebuilt on reconfiguration
+func newEncoder(ctx context.Context, deps resource.Dependencies, conf resource.Config, logger logging.Logger) (encoder.Encoder, error) {
+	encoderConfig, err := resource.NativeConfig[*EncoderConfig](conf)
+	if err != nil {
+		return nil, err
+	}
+	e := &mqttEncoder{
+		Named:  conf.ResourceName().AsNamed(),
+		logger: logger,
+		cfg:    encoderConfig,
+	}
+	e.client, err = encoderConfig.connectAndSubscribe(ctx, encoderConfig.Topic, byte(encoderConfig.QoS), e.onCount)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing mqtt encoder: %v", err)
+	}
+	return e, nil
+}
+
+// Accumulate the counter change, a change of more than half the rollover is a counter wrap
+func (e *mqttEncoder) onCount(client mqtt.Client, msg mqtt.Message) {
+	var v interface{} = string(msg.Payload())
+	if e.cfg.Field != "" {
+		var payload interface{}
+		if err := json.Unmarshal(msg.Payload(), &payload); err != nil {
+			e.logger.Debugf("invalid counter payload: %v", err)
+			return
+		}
+		var ok bool
+		if v, ok = lookupField(payload, e.cfg.Field); !ok {
+			return
+		}
+	}
+	count, ok := toFloat(v)
+	if !ok {
+		e.logger.Debugf("non numeric count %v", v)
+		return
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if !e.hasCount {
+		e.count, e.ticks, e.hasCount = count, count, true
+		return
+	}
+	delta := count - e.count
+	if r := e.cfg.Rollover; r > 0 {
+		if delta < -r/2 {
+			delta += r
+		} else if delta > r/2 {
+			delta -= r
+		}
+	}
+	e.count = count
+	e.ticks += delta
+}
+
+// Return the position in ticks, or in degrees if ticks_per_rotation is set
+func (e *mqttEncoder) Position(ctx context.Context, positionType encoder.PositionType, extra map[string]interface{}) (float64, encoder.PositionType, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if positionType == encoder.PositionTypeDegrees {
+		if e.cfg.TicksPerRotation == 0 {
+			return math.NaN(), encoder.PositionTypeUnspecified, encoder.NewPositionTypeUnsupportedError(positionType)
+		}
+		return e.ticks / e.cfg.TicksPerRotation * 360, encoder.PositionTypeDegrees, nil
+	}
+	return e.ticks, encoder.PositionTypeTicks, nil
+}
+
+// Reset the position to zero, the counter itself is not reset
+func (e *mqttEncoder) ResetPosition(ctx context.Context, extra map[string]interface{}) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.ticks = 0
+	return nil
+}
+
+// Ticks are always supported, degrees with ticks_per_rotation
+func (e *mqttEncoder) Properties(ctx context.Context, extra map[string]interface{}) (encoder.Properties, error) {
+	return encoder.Properties{
+		TicksCountSupported:   true,
+		AngleDegreesSupported: e.cfg.TicksPerRotation > 0,
+	}, nil
+}
+
+// Disconnect from the broker
+func (e *mqttEncoder) Close(ctx context.Context) error {
+	if e.client != nil {
+		e.client.Disconnect(250) // Timeout in milliseconds
+	}
+	return nil
+}
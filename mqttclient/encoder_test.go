@@ -0,0 +1,62 @@
+package mqttclient
+
+import (
+	"context"
+	"testing"
+
+	"go.viam.com/rdk/components/encoder"
+	"go.viam.com/rdk/logging"
+)
+
+func TestEncoderCounts(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      EncoderConfig
+		payloads []string
+		want     float64
+	}{
+		{"first count is the position", EncoderConfig{}, []string{"120"}, 120},
+		{"forward and back", EncoderConfig{}, []string{"100", "150", "130"}, 130},
+		{"forward wrap", EncoderConfig{Rollover: 65536}, []string{"65530", "4"}, 65540},
+		{"backward wrap", EncoderConfig{Rollover: 65536}, []string{"4", "65530"}, -6},
+		{"change of half the rollover is no wrap", EncoderConfig{Rollover: 100}, []string{"10", "60"}, 60},
+		{"wraps in both directions", EncoderConfig{Rollover: 256}, []string{"200", "50", "250", "10"}, 266},
+		{"without rollover a drop is a move back", EncoderConfig{}, []string{"65530", "4"}, 4},
+		{"field", EncoderConfig{Field: "enc.count", Rollover: 1000}, []string{`{"enc": {"count": 990}}`, `{"enc": {"count": 5}}`}, 1005},
+		{"invalid payloads are ignored", EncoderConfig{Field: "count"}, []string{`{"count": 10}`, `{"count": "n/a"}`, `{}`, "12", `{"count": 15}`}, 15},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			e := &mqttEncoder{logger: logging.NewTestLogger(t), cfg: &cfg}
+			for _, p := range tt.payloads {
+				e.onCount(nil, &injectedMessage{topic: "enc", payload: []byte(p)})
+			}
+			ticks, _, err := e.Position(context.Background(), encoder.PositionTypeTicks, nil)
+			if err != nil || ticks != tt.want {
+				t.Errorf("position %v (%v), want %v", ticks, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncoderDegrees(t *testing.T) {
+	e := &mqttEncoder{logger: logging.NewTestLogger(t), cfg: &EncoderConfig{TicksPerRotation: 400}}
+	e.onCount(nil, &injectedMessage{topic: "enc", payload: []byte("100")})
+	ctx := context.Background()
+	if deg, typ, err := e.Position(ctx, encoder.PositionTypeDegrees, nil); err != nil || deg != 90 || typ != encoder.PositionTypeDegrees {
+		t.Errorf("position %v %v (%v), want 90 degrees", deg, typ, err)
+	}
+	if err := e.ResetPosition(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	e.onCount(nil, &injectedMessage{topic: "enc", payload: []byte("140")})
+	if ticks, _, _ := e.Position(ctx, encoder.PositionTypeTicks, nil); ticks != 40 {
+		t.Errorf("position after reset %v, want 40", ticks)
+	}
+
+	e.cfg.TicksPerRotation = 0
+	if _, _, err := e.Position(ctx, encoder.PositionTypeDegrees, nil); err == nil {
+		t.Error("degrees without ticks_per_rotation")
+	}
+}
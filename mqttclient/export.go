@@ -0,0 +1,100 @@
+package mqttclient
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+	"unicode/utf8"
+)
+
+// Arguments of the export command
+type exportArgs struct {
+	Source string `json:"source"` // "queue" (default) or "history"
+	Dir    string `json:"dir"`    // Default $VIAM_MODULE_DATA or the temporary directory
+	Topic  string `json:"topic"`  // Optional topic filter
+}
+
+// One line of an export file, the raw payload is kept as string if it is valid UTF-8
+type exportedMessage struct {
+	Topic         string `json:"topic"`
+	QoS           byte   `json:"qos"`
+	Retained      bool   `json:"retained"`
+	Duplicate     bool   `json:"duplicate"`
+	MessageID     uint16 `json:"message_id"`
+	Received      string `json:"received"`
+	Seq           uint64 `json:"seq,omitempty"`
+	Payload       string `json:"payload,omitempty"`
+	PayloadBase64 string `json:"payload_base64,omitempty"`
+}
+
+func newExportedMessage(msg *receivedMessage) exportedMessage {
+	line := exportedMessage{
+		Topic:     msg.Topic(),
+		QoS:       msg.Qos(),
+		Retained:  msg.Retained(),
+		Duplicate: msg.Duplicate(),
+		MessageID: msg.MessageID(),
+		Received:  msg.received.UTC().Format(time.RFC3339Nano),
+		Seq:       msg.seq,
+	}
+	if utf8.Valid(msg.Payload()) {
+		line.Payload = string(msg.Payload())
+	} else {
+		line.PayloadBase64 = base64.StdEncoding.EncodeToString(msg.Payload())
+	}
+	return line
+}
+
+// Write the buffered messages as JSON lines to a new file and return its path. Must be called with
+// the mutex held.
+func (s *mqttClient) export(args exportArgs) (map[string]interface{}, error) {
+	var messages []*receivedMessage
+	switch args.Source {
+	case "", "queue":
+		messages = s.messageQueue
+	case "history":
+		messages = s.history.last(len(s.history.messages), "")
+	default:
+		return nil, fmt.Errorf("invalid export source %q (should be queue or history)", args.Source)
+	}
+	if args.Topic != "" && !validTopicFilter(args.Topic) {
+		return nil, fmt.Errorf("invalid topic filter %q", args.Topic)
+	}
+	dir := args.Dir
+	if dir == "" {
+		if dir = os.Getenv("VIAM_MODULE_DATA"); dir == "" {
+			dir = os.TempDir()
+		}
+	}
+	name := fmt.Sprintf("%s-%s.jsonl", discoveryInvalidChars.ReplaceAllString(s.Name().ShortName(), "_"), time.Now().UTC().Format("20060102T150405.000"))
+	path := filepath.Join(dir, name)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	exported := 0
+	for _, msg := range messages {
+		if args.Topic != "" && !topicMatches(args.Topic, msg.Topic()) {
+			continue
+		}
+		if err := enc.Encode(newExportedMessage(msg)); err != nil {
+			return nil, err
+		}
+		exported++
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"path": path, "messages": exported}, nil
+}
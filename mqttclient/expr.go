@@ -0,0 +1,792 @@
+package mqttclient
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Small expression language used for message filters, derived fields and transforms, e.g.
+//
+//	msg.status == "FAULT" || topic.endsWith("/alarm")
+//
+// Supported: number, string, bool, null, list and map literals, field access (a.b, a["b"]),
+// arithmetic (+ - * / %), comparisons, logical operators (&& || !), "in",
+// string methods (startsWith, endsWith, contains, matches, size) and the functions
+// has, size, string, double and int. The syntax follows CEL, but all numbers are float64, has is
+// the only macro and types are only checked on evaluation. The README lists the differences.
+type expr interface {
+	eval(env map[string]interface{}) (interface{}, error)
+}
+
+var errNoSuchKey = errors.New("no such key")
+
+// Compile an expression
+func compileExpr(src string) (expr, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.peek().text, p.peek().pos)
+	}
+	return e, nil
+}
+
+// Evaluate an expression which must result in a boolean
+func evalBool(e expr, env map[string]interface{}) (bool, error) {
+	v, err := e.eval(env)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression result is %T, not bool", v)
+	}
+	return b, nil
+}
+
+// Tokenizer
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokString
+	tokIdent
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func tokenize(src string) ([]token, error) {
+	var tokens []token
+	runes := []rune(src)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.' || runes[i] == 'e' || runes[i] == 'E' ||
+				((runes[i] == '-' || runes[i] == '+') && (runes[i-1] == 'e' || runes[i-1] == 'E'))) {
+				i++
+			}
+			tokens = append(tokens, token{tokNumber, string(runes[start:i]), start})
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, token{tokIdent, string(runes[start:i]), start})
+		case r == '"' || r == '\'':
+			start := i
+			var sb strings.Builder
+			i++
+			for i < len(runes) && runes[i] != r {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+					switch runes[i] {
+					case 'n':
+						sb.WriteRune('\n')
+					case 't':
+						sb.WriteRune('\t')
+					default:
+						sb.WriteRune(runes[i])
+					}
+				} else {
+					sb.WriteRune(runes[i])
+				}
+				i++
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			i++
+			tokens = append(tokens, token{tokString, sb.String(), start})
+		default:
+			start := i
+			two := ""
+			if i+1 < len(runes) {
+				two = string(runes[i : i+2])
+			}
+			switch two {
+			case "&&", "||", "==", "!=", "<=", ">=":
+				tokens = append(tokens, token{tokOp, two, start})
+				i += 2
+				continue
+			}
+			if !strings.ContainsRune("+-*/%<>!()[]{}:.,", r) {
+				return nil, fmt.Errorf("unexpected character %q at position %d", r, start)
+			}
+			tokens = append(tokens, token{tokOp, string(r), start})
+			i++
+		}
+	}
+	return append(tokens, token{tokEOF, "", len(runes)}), nil
+}
+
+// Parser
+
+type exprParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *exprParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *exprParser) accept(ops ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != tokOp && !(t.kind == tokIdent && t.text == "in") {
+		return "", false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) expect(op string) error {
+	if _, ok := p.accept(op); !ok {
+		return fmt.Errorf("expected %q at position %d", op, p.peek().pos)
+	}
+	return nil
+}
+
+func (p *exprParser) parseBinary(next func() (expr, error), ops ...string) (expr, error) {
+	left, err := next()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept(ops...)
+		if !ok {
+			return left, nil
+		}
+		right, err := next()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseOr() (expr, error) {
+	return p.parseBinary(p.parseAnd, "||")
+}
+
+func (p *exprParser) parseAnd() (expr, error) {
+	return p.parseBinary(p.parseRelation, "&&")
+}
+
+func (p *exprParser) parseRelation() (expr, error) {
+	return p.parseBinary(p.parseAdditive, "==", "!=", "<", "<=", ">", ">=", "in")
+}
+
+func (p *exprParser) parseAdditive() (expr, error) {
+	return p.parseBinary(p.parseMultiplicative, "+", "-")
+}
+
+func (p *exprParser) parseMultiplicative() (expr, error) {
+	return p.parseBinary(p.parseUnary, "*", "/", "%")
+}
+
+func (p *exprParser) parseUnary() (expr, error) {
+	if op, ok := p.accept("!", "-"); ok {
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op: op, x: x}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *exprParser) parsePostfix() (expr, error) {
+	x, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("."); ok {
+			name := p.next()
+			if name.kind != tokIdent {
+				return nil, fmt.Errorf("expected field name at position %d", name.pos)
+			}
+			if _, ok := p.accept("("); ok {
+				args, err := p.parseArgs(")")
+				if err != nil {
+					return nil, err
+				}
+				call := &callExpr{recv: x, name: name.text, args: args}
+				if err := call.compilePattern(); err != nil {
+					return nil, err
+				}
+				x = call
+			} else {
+				x = &memberExpr{x: x, name: name.text}
+			}
+		} else if _, ok := p.accept("["); ok {
+			key, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			x = &indexExpr{x: x, key: key}
+		} else {
+			return x, nil
+		}
+	}
+}
+
+func (p *exprParser) parseArgs(closing string) ([]expr, error) {
+	var args []expr
+	if _, ok := p.accept(closing); ok {
+		return args, nil
+	}
+	for {
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if _, ok := p.accept(closing); ok {
+			return args, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *exprParser) parsePrimary() (expr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", t.text, t.pos)
+		}
+		return &literalExpr{value: f}, nil
+	case tokString:
+		return &literalExpr{value: t.text}, nil
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return &literalExpr{value: true}, nil
+		case "false":
+			return &literalExpr{value: false}, nil
+		case "null":
+			return &literalExpr{value: nil}, nil
+		}
+		if _, ok := p.accept("("); ok {
+			args, err := p.parseArgs(")")
+			if err != nil {
+				return nil, err
+			}
+			call := &callExpr{name: t.text, args: args}
+			if err := call.compilePattern(); err != nil {
+				return nil, err
+			}
+			return call, nil
+		}
+		return &identExpr{name: t.text}, nil
+	case tokOp:
+		switch t.text {
+		case "(":
+			x, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		case "[":
+			items, err := p.parseArgs("]")
+			if err != nil {
+				return nil, err
+			}
+			return &listExpr{items: items}, nil
+		case "{":
+			return p.parseMap()
+		}
+	}
+	if t.kind == tokEOF {
+		return nil, errors.New("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at position %d", t.text, t.pos)
+}
+
+// Parse the entries of a map literal after the opening brace
+func (p *exprParser) parseMap() (expr, error) {
+	m := &mapExpr{}
+	if _, ok := p.accept("}"); ok {
+		return m, nil
+	}
+	for {
+		key, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		value, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		m.keys = append(m.keys, key)
+		m.values = append(m.values, value)
+		if _, ok := p.accept("}"); ok {
+			return m, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Expression nodes
+
+type literalExpr struct {
+	value interface{}
+}
+
+func (e *literalExpr) eval(env map[string]interface{}) (interface{}, error) {
+	return e.value, nil
+}
+
+type identExpr struct {
+	name string
+}
+
+func (e *identExpr) eval(env map[string]interface{}) (interface{}, error) {
+	v, ok := env[e.name]
+	if !ok {
+		return nil, fmt.Errorf("undeclared reference to %q", e.name)
+	}
+	return v, nil
+}
+
+type listExpr struct {
+	items []expr
+}
+
+func (e *listExpr) eval(env map[string]interface{}) (interface{}, error) {
+	list := make([]interface{}, 0, len(e.items))
+	for _, item := range e.items {
+		v, err := item.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+type mapExpr struct {
+	keys   []expr
+	values []expr
+}
+
+func (e *mapExpr) eval(env map[string]interface{}) (interface{}, error) {
+	m := make(map[string]interface{}, len(e.keys))
+	for i, key := range e.keys {
+		k, err := key.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		s, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("map keys must be strings, got %v", k)
+		}
+		if m[s], err = e.values[i].eval(env); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+type memberExpr struct {
+	x    expr
+	name string
+}
+
+func (e *memberExpr) eval(env map[string]interface{}) (interface{}, error) {
+	x, err := e.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	return selectKey(x, e.name)
+}
+
+type indexExpr struct {
+	x   expr
+	key expr
+}
+
+func (e *indexExpr) eval(env map[string]interface{}) (interface{}, error) {
+	x, err := e.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	key, err := e.key.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if list, ok := x.([]interface{}); ok {
+		f, ok := toFloat(key)
+		if !ok || f != math.Trunc(f) || f < 0 || int(f) >= len(list) {
+			return nil, fmt.Errorf("invalid list index %v", key)
+		}
+		return list[int(f)], nil
+	}
+	return selectKey(x, fmt.Sprint(key))
+}
+
+func selectKey(x interface{}, key string) (interface{}, error) {
+	m, ok := x.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot select field %q from %T", key, x)
+	}
+	v, ok := m[key]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errNoSuchKey, key)
+	}
+	return v, nil
+}
+
+type unaryExpr struct {
+	op string
+	x  expr
+}
+
+func (e *unaryExpr) eval(env map[string]interface{}) (interface{}, error) {
+	x, err := e.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "!":
+		b, ok := x.(bool)
+		if !ok {
+			return nil, fmt.Errorf("cannot negate %T", x)
+		}
+		return !b, nil
+	default:
+		f, ok := numeric(x)
+		if !ok {
+			return nil, fmt.Errorf("cannot negate %T", x)
+		}
+		return -f, nil
+	}
+}
+
+type binaryExpr struct {
+	op    string
+	left  expr
+	right expr
+}
+
+func (e *binaryExpr) eval(env map[string]interface{}) (interface{}, error) {
+	// Logical operators short circuit and tolerate errors on one side, as in CEL
+	if e.op == "||" || e.op == "&&" {
+		short := e.op == "||"
+		l, lerr := e.left.eval(env)
+		if lb, ok := l.(bool); lerr == nil && ok && lb == short {
+			return short, nil
+		}
+		r, rerr := e.right.eval(env)
+		if rb, ok := r.(bool); rerr == nil && ok && rb == short {
+			return short, nil
+		}
+		if lerr != nil {
+			return nil, lerr
+		}
+		if rerr != nil {
+			return nil, rerr
+		}
+		if _, ok := l.(bool); !ok {
+			return nil, fmt.Errorf("operator %s not defined for %T", e.op, l)
+		}
+		if _, ok := r.(bool); !ok {
+			return nil, fmt.Errorf("operator %s not defined for %T", e.op, r)
+		}
+		return !short, nil
+	}
+
+	l, err := e.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	r, err := e.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "==":
+		return valuesEqual(l, r), nil
+	case "!=":
+		return !valuesEqual(l, r), nil
+	case "in":
+		switch c := r.(type) {
+		case []interface{}:
+			for _, item := range c {
+				if valuesEqual(l, item) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case map[string]interface{}:
+			_, ok := c[fmt.Sprint(l)]
+			return ok, nil
+		}
+		return nil, fmt.Errorf("operator in not defined for %T", r)
+	case "<", "<=", ">", ">=":
+		var cmp int
+		if lf, ok := numeric(l); ok {
+			rf, ok := numeric(r)
+			if !ok {
+				return nil, fmt.Errorf("cannot compare %T and %T", l, r)
+			}
+			switch {
+			case lf < rf:
+				cmp = -1
+			case lf > rf:
+				cmp = 1
+			}
+		} else if ls, ok := l.(string); ok {
+			rs, ok := r.(string)
+			if !ok {
+				return nil, fmt.Errorf("cannot compare %T and %T", l, r)
+			}
+			cmp = strings.Compare(ls, rs)
+		} else {
+			return nil, fmt.Errorf("cannot compare %T and %T", l, r)
+		}
+		switch e.op {
+		case "<":
+			return cmp < 0, nil
+		case "<=":
+			return cmp <= 0, nil
+		case ">":
+			return cmp > 0, nil
+		default:
+			return cmp >= 0, nil
+		}
+	case "+":
+		if ls, ok := l.(string); ok {
+			if rs, ok := r.(string); ok {
+				return ls + rs, nil
+			}
+		}
+	}
+
+	lf, lok := numeric(l)
+	rf, rok := numeric(r)
+	if !lok || !rok {
+		return nil, fmt.Errorf("operator %s not defined for %T and %T", e.op, l, r)
+	}
+	switch e.op {
+	case "+":
+		return lf + rf, nil
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	case "/":
+		if rf == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return lf / rf, nil
+	default:
+		if rf == 0 {
+			return nil, errors.New("modulus by zero")
+		}
+		return math.Mod(lf, rf), nil
+	}
+}
+
+type callExpr struct {
+	recv    expr
+	name    string
+	args    []expr
+	pattern *regexp.Regexp // Compiled literal pattern of matches()
+}
+
+// Compile the literal pattern of matches() once with the expression instead of on every evaluation,
+// an invalid pattern fails the compilation
+func (e *callExpr) compilePattern() error {
+	if e.name != "matches" || len(e.args) == 0 {
+		return nil
+	}
+	lit, ok := e.args[len(e.args)-1].(*literalExpr)
+	if !ok {
+		return nil
+	}
+	src, ok := lit.value.(string)
+	if !ok {
+		return nil
+	}
+	re, err := regexp.Compile(src)
+	if err != nil {
+		return fmt.Errorf("invalid matches() pattern %q: %v", src, err)
+	}
+	e.pattern = re
+	return nil
+}
+
+func (e *callExpr) eval(env map[string]interface{}) (interface{}, error) {
+	// has() is a macro which tests for field presence instead of evaluating its argument
+	if e.recv == nil && e.name == "has" {
+		if len(e.args) != 1 {
+			return nil, errors.New("has() expects one argument")
+		}
+		_, err := e.args[0].eval(env)
+		if errors.Is(err, errNoSuchKey) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	var args []interface{}
+	if e.recv != nil {
+		recv, err := e.recv.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, recv)
+	}
+	for _, arg := range e.args {
+		v, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+
+	switch e.name {
+	case "size":
+		if len(args) != 1 {
+			return nil, errors.New("size() expects one argument")
+		}
+		switch v := args[0].(type) {
+		case string:
+			return float64(len([]rune(v))), nil
+		case []interface{}:
+			return float64(len(v)), nil
+		case map[string]interface{}:
+			return float64(len(v)), nil
+		}
+		return nil, fmt.Errorf("size() not defined for %T", args[0])
+	case "string":
+		if len(args) != 1 {
+			return nil, errors.New("string() expects one argument")
+		}
+		if f, ok := args[0].(float64); ok {
+			return strconv.FormatFloat(f, 'f', -1, 64), nil
+		}
+		return fmt.Sprint(args[0]), nil
+	case "double", "int":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%s() expects one argument", e.name)
+		}
+		f, ok := toFloat(args[0])
+		if !ok {
+			return nil, fmt.Errorf("cannot convert %v to %s", args[0], e.name)
+		}
+		if e.name == "int" {
+			f = math.Trunc(f)
+		}
+		return f, nil
+	case "startsWith", "endsWith", "contains", "matches":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("%s() expects one argument", e.name)
+		}
+		s, ok1 := args[0].(string)
+		arg, ok2 := args[1].(string)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("%s() not defined for %T and %T", e.name, args[0], args[1])
+		}
+		switch e.name {
+		case "startsWith":
+			return strings.HasPrefix(s, arg), nil
+		case "endsWith":
+			return strings.HasSuffix(s, arg), nil
+		case "contains":
+			return strings.Contains(s, arg), nil
+		default:
+			re := e.pattern
+			if re == nil {
+				var err error
+				if re, err = regexp.Compile(arg); err != nil {
+					return nil, err
+				}
+			}
+			return re.MatchString(s), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown function %q", e.name)
+}
+
+// Convert numeric values (not strings) to float64
+func numeric(v interface{}) (float64, bool) {
+	switch v.(type) {
+	case string, bool:
+		return 0, false
+	}
+	return toFloat(v)
+}
+
+func valuesEqual(a, b interface{}) bool {
+	if af, ok := numeric(a); ok {
+		bf, ok := numeric(b)
+		return ok && af == bf
+	}
+	switch av := a.(type) {
+	case nil:
+		return b == nil
+	case string, bool:
+		return a == b
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !valuesEqual(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
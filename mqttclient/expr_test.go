@@ -0,0 +1,167 @@
+package mqttclient
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func testExprEnv() map[string]interface{} {
+	return map[string]interface{}{
+		"msg": map[string]interface{}{
+			"status":    "FAULT",
+			"current_a": 180.0,
+			"tags":      []interface{}{"mig", "cell3"},
+			"meta":      map[string]interface{}{"line": "B"},
+		},
+		"topic": "weld/cell3/alarm",
+	}
+}
+
+func TestExprEval(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want interface{}
+	}{
+		{"filter example", `msg.status == "FAULT" || topic.endsWith("/alarm")`, true},
+		{"filter example right side", `msg.status == "OK" || topic.endsWith("/alarm")`, true},
+		{"filter example neither side", `msg.status == "OK" || topic.endsWith("/data")`, false},
+		{"multiplication before addition", `1 + 2 * 3`, 7.0},
+		{"parentheses", `(1 + 2) * 3`, 9.0},
+		{"left associative subtraction", `10 - 4 - 3`, 3.0},
+		{"unary minus", `-2 * 3`, -6.0},
+		{"modulus", `7 % 4`, 3.0},
+		{"and before or", `true || false && false`, true},
+		{"and before or grouped", `(true || false) && false`, false},
+		{"comparison before and", `msg.current_a > 100 && msg.current_a <= 180`, true},
+		{"arithmetic before comparison", `msg.current_a / 2 == 90`, true},
+		{"negation", `!(msg.current_a < 100)`, true},
+		{"startsWith", `topic.startsWith("weld/")`, true},
+		{"endsWith", `topic.endsWith("/data")`, false},
+		{"contains", `topic.contains("cell3")`, true},
+		{"matches", `topic.matches("^weld/cell[0-9]+/alarm$")`, true},
+		{"matches function", `matches(msg.status, "^F")`, true},
+		{"matches dynamic pattern", `topic.matches("^" + "weld")`, true},
+		{"string size", `size(msg.status)`, 5.0},
+		{"string size method", `msg.status.size()`, 5.0},
+		{"string concatenation", `msg.status + "/" + msg.meta.line`, "FAULT/B"},
+		{"in list", `"mig" in msg.tags`, true},
+		{"in map", `"line" in msg.meta`, true},
+		{"index", `msg.tags[1] == "cell3" && msg["status"] == "FAULT"`, true},
+		{"has present", `has(msg.meta.line)`, true},
+		{"has missing", `has(msg.voltage_v)`, false},
+		{"missing field tolerated by or", `msg.voltage_v > 20 || msg.status == "FAULT"`, true},
+		{"missing field tolerated by and", `msg.voltage_v > 20 && msg.status == "OK"`, false},
+		{"conversions", `int(double("2.7")) == 2 && string(1.5) == "1.5"`, true},
+		{"number equality", `msg.current_a == 180 && 1 != 2`, true},
+		{"null", `msg.status != null`, true},
+		{"list literal", `[1, "a"] == [1, "a"]`, true},
+		{"map literal", `{"a": 1}.a`, 1.0},
+		{"string comparison", `"abc" < "abd"`, true},
+	}
+	env := testExprEnv()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := compileExpr(tt.src)
+			if err != nil {
+				t.Fatalf("compiling %s: %v", tt.src, err)
+			}
+			got, err := e.eval(env)
+			if err != nil {
+				t.Fatalf("evaluating %s: %v", tt.src, err)
+			}
+			if !valuesEqual(got, tt.want) {
+				t.Errorf("%s = %v, want %v", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExprEvalErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"missing field", `msg.voltage_v > 20`, "no such key"},
+		{"missing field on both sides of or", `msg.voltage_v > 20 || msg.wire > 1`, "no such key"},
+		{"undeclared variable", `payload.status == "FAULT"`, `undeclared reference to "payload"`},
+		{"field of a string", `msg.status.code`, `cannot select field "code" from string`},
+		{"compare string and number", `msg.status < 1`, "cannot compare string and float64"},
+		{"add string and number", `msg.status + 1`, "operator + not defined for string and float64"},
+		{"negate a string", `!msg.status`, "cannot negate string"},
+		{"or of numbers", `1 || 2`, "operator || not defined for float64"},
+		{"endsWith of a number", `msg.current_a.endsWith("0")`, "endsWith() not defined for float64 and string"},
+		{"in a string", `"a" in msg.status`, "operator in not defined for string"},
+		{"list index out of range", `msg.tags[2]`, "invalid list index 2"},
+		{"division by zero", `msg.current_a / 0`, "division by zero"},
+		{"unknown function", `lower(msg.status)`, `unknown function "lower"`},
+		{"invalid dynamic pattern", `topic.matches("(" + msg.status)`, "error parsing regexp"},
+	}
+	env := testExprEnv()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := compileExpr(tt.src)
+			if err != nil {
+				t.Fatalf("compiling %s: %v", tt.src, err)
+			}
+			if got, err := e.eval(env); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("%s = %v, %v; want error %q", tt.src, got, err, tt.want)
+			}
+		})
+	}
+
+	e, err := compileExpr(`msg.voltage_v`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.eval(env); !errors.Is(err, errNoSuchKey) {
+		t.Errorf("missing field error %v is not errNoSuchKey", err)
+	}
+	if e, err = compileExpr(`msg.current_a + 1`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := evalBool(e, env); err == nil || !strings.Contains(err.Error(), "not bool") {
+		t.Errorf("numeric filter result = %v, want an error", err)
+	}
+}
+
+func TestCompileExprErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{`msg.status == "FAULT`, "unterminated string at position 14"},
+		{`msg.status == `, "unexpected end of expression"},
+		{`msg.status = "FAULT"`, `unexpected character '=' at position 11`},
+		{`msg.status == "FAULT" "OK"`, `unexpected "OK" at position 22`},
+		{`(1 + 2`, `expected ")" at position 6`},
+		{`msg.(status)`, "expected field name at position 4"},
+		{`msg.status # 1`, `unexpected character '#' at position 11`},
+		{`topic.matches("(")`, `invalid matches() pattern "("`},
+		{`matches(topic, "[")`, `invalid matches() pattern "["`},
+	}
+	for _, tt := range tests {
+		if _, err := compileExpr(tt.src); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("compiling %s = %v, want error %q", tt.src, err, tt.want)
+		}
+	}
+}
+
+// Literal patterns are compiled with the expression, not on every evaluation
+func TestExprCompilesLiteralPattern(t *testing.T) {
+	e, err := compileExpr(`topic.matches("^weld/")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if call, ok := e.(*callExpr); !ok || call.pattern == nil {
+		t.Fatalf("matches() of a literal pattern not compiled: %#v", e)
+	}
+	if e, err = compileExpr(`topic.matches(msg.status)`); err != nil {
+		t.Fatal(err)
+	}
+	if call := e.(*callExpr); call.pattern != nil {
+		t.Error("matches() of a dynamic pattern compiled with the expression")
+	}
+}
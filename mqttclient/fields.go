@@ -0,0 +1,79 @@
+package mqttclient
+
+import "strings"
+
+// Keep only the included fields and drop the excluded fields of an object payload.
+// Nested fields are separated by dots, other payload types are returned unchanged.
+func selectFields(payload interface{}, include, exclude []string) interface{} {
+	fields, ok := payload.(map[string]interface{})
+	if !ok || (len(include) == 0 && len(exclude) == 0) {
+		return payload
+	}
+	if len(include) > 0 {
+		selected := map[string]interface{}{}
+		for _, path := range include {
+			if v, ok := lookupField(fields, path); ok {
+				setField(selected, path, v)
+			}
+		}
+		fields = selected
+	}
+	for _, path := range exclude {
+		fields = deleteField(fields, strings.Split(path, "."))
+	}
+	return fields
+}
+
+// Set a nested field, creating intermediate objects as needed
+func setField(fields map[string]interface{}, path string, value interface{}) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := fields[key].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			fields[key] = next
+		}
+		fields = next
+	}
+	fields[keys[len(keys)-1]] = value
+}
+
+// Return a copy of fields without the nested field, the input is not modified
+func deleteField(fields map[string]interface{}, keys []string) map[string]interface{} {
+	v, ok := fields[keys[0]]
+	if !ok {
+		return fields
+	}
+	out := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		out[k] = v
+	}
+	if len(keys) == 1 {
+		delete(out, keys[0])
+		return out
+	}
+	if nested, ok := v.(map[string]interface{}); ok {
+		out[keys[0]] = deleteField(nested, keys[1:])
+	}
+	return out
+}
+
+// Return a copy of fields with the nested field replaced by a placeholder, the input is not modified
+func redactField(fields map[string]interface{}, keys []string) map[string]interface{} {
+	v, ok := fields[keys[0]]
+	if !ok {
+		return fields
+	}
+	out := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		out[k] = v
+	}
+	if len(keys) == 1 {
+		out[keys[0]] = "[redacted]"
+		return out
+	}
+	if nested, ok := v.(map[string]interface{}); ok {
+		out[keys[0]] = redactField(nested, keys[1:])
+	}
+	return out
+}
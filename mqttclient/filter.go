@@ -0,0 +1,148 @@
+package mqttclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Maps the payload_regex configuration attribute
+type RegexFilter struct {
+	Include string `json:"include"` // Only queue messages whose payload matches
+	Exclude string `json:"exclude"` // Never queue messages whose payload matches
+}
+
+// Compiled payload regex filter
+type payloadRegex struct {
+	include *regexp.Regexp
+	exclude *regexp.Regexp
+}
+
+// Compile the payload regex filter, an empty expression is not applied
+func newPayloadRegex(cfg *RegexFilter) (*payloadRegex, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	r := &payloadRegex{}
+	var err error
+	if cfg.Include != "" {
+		if r.include, err = regexp.Compile(cfg.Include); err != nil {
+			return nil, fmt.Errorf("invalid payload_regex include: %v", err)
+		}
+	}
+	if cfg.Exclude != "" {
+		if r.exclude, err = regexp.Compile(cfg.Exclude); err != nil {
+			return nil, fmt.Errorf("invalid payload_regex exclude: %v", err)
+		}
+	}
+	return r, nil
+}
+
+// Check a string payload against the include and exclude expressions
+func (r *payloadRegex) match(payload string) bool {
+	if r.include != nil && !r.include.MatchString(payload) {
+		return false
+	}
+	if r.exclude != nil && r.exclude.MatchString(payload) {
+		return false
+	}
+	return true
+}
+
+// Threshold filter rule, e.g. "current_amps > 30"
+type filterRule struct {
+	field string
+	op    string
+	value float64
+}
+
+// Parse a filter rule of the form "<field> <op> <value>"
+func parseFilterRule(rule string) (filterRule, error) {
+	parts := strings.Fields(rule)
+	if len(parts) != 3 {
+		return filterRule{}, fmt.Errorf("invalid filter rule %q (expected \"<field> <op> <value>\")", rule)
+	}
+	switch parts[1] {
+	case ">", ">=", "<", "<=", "==", "!=":
+	default:
+		return filterRule{}, fmt.Errorf("invalid filter operator %q in rule %q", parts[1], rule)
+	}
+	value, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil {
+		return filterRule{}, fmt.Errorf("invalid filter value %q in rule %q", parts[2], rule)
+	}
+	return filterRule{field: parts[0], op: parts[1], value: value}, nil
+}
+
+// Check the rule against a parsed payload, missing or non numeric fields never match
+func (r filterRule) match(payload interface{}) bool {
+	v, ok := lookupField(payload, r.field)
+	if !ok {
+		return false
+	}
+	f, ok := toFloat(v)
+	if !ok {
+		return false
+	}
+	switch r.op {
+	case ">":
+		return f > r.value
+	case ">=":
+		return f >= r.value
+	case "<":
+		return f < r.value
+	case "<=":
+		return f <= r.value
+	case "==":
+		return f == r.value
+	case "!=":
+		return f != r.value
+	}
+	return false
+}
+
+// Lookup a field in a parsed payload, nested fields are separated by dots (e.g. "weld.current")
+func lookupField(payload interface{}, path string) (interface{}, bool) {
+	current := payload
+	for _, key := range strings.Split(path, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = m[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// Convert a payload value to float64
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		return f, err == nil
+	case bool:
+		if n {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
@@ -0,0 +1,144 @@
+package mqttclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.viam.com/rdk/components/sensor"
+	"go.viam.com/rdk/data"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+)
+
+// Gauge sensor model mapping one topic to one named numeric reading
+var GaugeModel = resource.NewModel("lab101", "mqtt", "gauge")
+
+func init() {
+	resource.RegisterComponent(sensor.API, GaugeModel,
+		resource.Registration[sensor.Sensor, *GaugeConfig]{Constructor: newGauge})
+}
+
+// Maps JSON gauge configuration attributes.
+type GaugeConfig struct {
+	BrokerConfig `json:",squash"`
+	Topic        string   `json:"topic"`
+	QoS          int      `json:"qos"`
+	Name         string   `json:"name"`  // Reading name, default "value"
+	Field        string   `json:"field"` // JSON payload field with the value, the payload is a number if empty
+	Unit         string   `json:"unit"`
+	Scale        *float64 `json:"scale"`      // Multiplier applied to the value, default 1
+	Offset       float64  `json:"offset"`     // Added to the scaled value
+	MaxAgeMs     int      `json:"max_age_ms"` // Values older than this are stale, 0 never expires
+}
+
+// Implement gauge configuration validation and return implicit dependencies.
+func (cfg *GaugeConfig) Validate(path string) ([]string, error) {
+	if cfg.Topic == "" {
+		return nil, fmt.Errorf("topic is required %q", path)
+	}
+	if err := cfg.BrokerConfig.Validate(path); err != nil {
+		return nil, err
+	}
+	if cfg.QoS < 0 || cfg.QoS > 2 {
+		return nil, fmt.Errorf("qos must be between 0 and 2 %q", path)
+	}
+	if cfg.MaxAgeMs < 0 {
+		return nil, fmt.Errorf("max_age_ms must be >= 0 %q", path)
+	}
+	return []string{}, nil
+}
+
+type mqttGauge struct {
+	resource.Named
+	resource.AlwaysRebuild
+	logger   logging.Logger
+	client   mqtt.Client
+	cfg      *GaugeConfig
+	name     string
+	scale    float64
+	value    float64
+	received time.Time
+	mutex    sync.Mutex
+}
+
+// Gauge constructor, the sensor is rebuilt on reconfiguration
+func newGauge(ctx context.Context, deps resource.Dependencies, conf resource.Config, logger logging.Logger) (sensor.Sensor, error) {
+	gaugeConfig, err := resource.NativeConfig[*GaugeConfig](conf)
+	if err != nil {
+		return nil, err
+	}
+	g := &mqttGauge{
+		Named:  conf.ResourceName().AsNamed(),
+		logger: logger,
+		cfg:    gaugeConfig,
+		name:   gaugeConfig.Name,
+		scale:  1,
+	}
+	if g.name == "" {
+		g.name = "value"
+	}
+	if gaugeConfig.Scale != nil {
+		g.scale = *gaugeConfig.Scale
+	}
+	g.client, err = gaugeConfig.connectAndSubscribe(ctx, gaugeConfig.Topic, byte(gaugeConfig.QoS), g.onMessage)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing mqtt gauge: %v", err)
+	}
+	return g, nil
+}
+
+// Store the scaled value of a message
+func (g *mqttGauge) onMessage(client mqtt.Client, msg mqtt.Message) {
+	var v interface{} = string(msg.Payload())
+	if g.cfg.Field != "" {
+		var payload interface{}
+		if err := json.Unmarshal(msg.Payload(), &payload); err != nil {
+			g.logger.Debugf("invalid gauge payload: %v", err)
+			return
+		}
+		var ok bool
+		if v, ok = lookupField(payload, g.cfg.Field); !ok {
+			return
+		}
+	}
+	value, ok := toFloat(v)
+	if !ok {
+		g.logger.Debugf("non numeric gauge value %v", v)
+		return
+	}
+	g.mutex.Lock()
+	g.value = value*g.scale + g.cfg.Offset
+	g.received = time.Now()
+	g.mutex.Unlock()
+}
+
+// Return the value and its unit, no value is returned before the first message or when it is stale
+func (g *mqttGauge) Readings(ctx context.Context, extra map[string]interface{}) (map[string]interface{}, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	stale := g.received.IsZero() ||
+		(g.cfg.MaxAgeMs > 0 && time.Since(g.received) > time.Duration(g.cfg.MaxAgeMs)*time.Millisecond)
+	if stale {
+		if extra[data.FromDMString] == true {
+			return nil, data.ErrNoCaptureToStore
+		}
+		return nil, nil
+	}
+	readings := map[string]interface{}{g.name: g.value}
+	if g.cfg.Unit != "" {
+		readings["unit"] = g.cfg.Unit
+	}
+	return readings, nil
+}
+
+// Disconnect from the broker
+func (g *mqttGauge) Close(ctx context.Context) error {
+	if g.client != nil {
+		g.client.Disconnect(250) // Timeout in milliseconds
+	}
+	return nil
+}
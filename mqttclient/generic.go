@@ -0,0 +1,269 @@
+package mqttclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.viam.com/rdk/components/generic"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+)
+
+// Generic model exposing publish, subscribe, unsubscribe, read and stats commands
+var GenericModel = resource.NewModel("lab101", "mqtt", "generic")
+
+// Default number of buffered messages of the generic model
+const defaultBufferLength = 100
+
+func init() {
+	resource.RegisterComponent(generic.API, GenericModel,
+		resource.Registration[resource.Resource, *GenericConfig]{Constructor: newGeneric})
+}
+
+// Maps JSON generic configuration attributes.
+type GenericConfig struct {
+	BrokerConfig `json:",squash"`
+	Topics       []string `json:"topics"` // Topics subscribed at startup
+	QoS          int      `json:"qos"`
+	BufferLength int      `json:"buffer_length"` // Maximum number of buffered messages, default 100
+}
+
+// Implement generic configuration validation and return implicit dependencies.
+func (cfg *GenericConfig) Validate(path string) ([]string, error) {
+	if err := cfg.BrokerConfig.Validate(path); err != nil {
+		return nil, err
+	}
+	if cfg.QoS < 0 || cfg.QoS > 2 {
+		return nil, fmt.Errorf("qos must be between 0 and 2 %q", path)
+	}
+	if cfg.BufferLength < 0 {
+		return nil, fmt.Errorf("buffer_length must be >= 0 %q", path)
+	}
+	return []string{}, nil
+}
+
+type mqttGeneric struct {
+	resource.Named
+	resource.AlwaysRebuild
+	logger        logging.Logger
+	client        mqtt.Client
+	bufferLength  int
+	buffer        []*receivedMessage
+	subscriptions map[string]byte
+	throughput    throughput
+	dropped       uint64
+	mutex         sync.Mutex
+}
+
+// Generic constructor, the component is rebuilt on reconfiguration
+func newGeneric(ctx context.Context, deps resource.Dependencies, conf resource.Config, logger logging.Logger) (resource.Resource, error) {
+	genericConfig, err := resource.NativeConfig[*GenericConfig](conf)
+	if err != nil {
+		return nil, err
+	}
+	g := &mqttGeneric{
+		Named:         conf.ResourceName().AsNamed(),
+		logger:        logger,
+		bufferLength:  genericConfig.BufferLength,
+		subscriptions: map[string]byte{},
+	}
+	if g.bufferLength == 0 {
+		g.bufferLength = defaultBufferLength
+	}
+	if g.client, err = genericConfig.connect(ctx); err != nil {
+		return nil, fmt.Errorf("error initializing mqtt generic: %v", err)
+	}
+	for _, topic := range genericConfig.Topics {
+		if err := g.subscribe(ctx, topic, byte(genericConfig.QoS)); err != nil {
+			g.client.Disconnect(250)
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// Buffer a received message, the oldest message is dropped when the buffer is full
+func (g *mqttGeneric) onMessage(client mqtt.Client, m mqtt.Message) {
+	msg := &receivedMessage{Message: m, received: time.Now()}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.throughput.add(msg.received, len(m.Payload()))
+	if len(g.buffer) >= g.bufferLength {
+		g.buffer = g.buffer[1:]
+		g.dropped++
+	}
+	g.buffer = append(g.buffer, msg)
+}
+
+// Subscribe to a topic filter
+func (g *mqttGeneric) subscribe(ctx context.Context, topic string, qos byte) error {
+	if topic == "" {
+		return fmt.Errorf("topic is required")
+	}
+	if err := waitForToken(ctx, g.client.Subscribe(topic, qos, g.onMessage)); err != nil {
+		return err
+	}
+	g.mutex.Lock()
+	g.subscriptions[topic] = qos
+	g.mutex.Unlock()
+	return nil
+}
+
+// Unsubscribe from a topic filter, buffered messages are kept
+func (g *mqttGeneric) unsubscribe(ctx context.Context, topic string) error {
+	if err := waitForToken(ctx, g.client.Unsubscribe(topic)); err != nil {
+		return err
+	}
+	g.mutex.Lock()
+	delete(g.subscriptions, topic)
+	g.mutex.Unlock()
+	return nil
+}
+
+// Return up to count buffered messages matching the topic filter, oldest first. Unless peek is
+// set the returned messages are removed from the buffer.
+func (g *mqttGeneric) read(topic string, count int, peek bool) []interface{} {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	messages := []interface{}{}
+	kept := g.buffer[:0:0]
+	for _, msg := range g.buffer {
+		if (count <= 0 || len(messages) < count) && (topic == "" || topicMatches(topic, msg.Topic())) {
+			messages = append(messages, messageReadings(msg))
+			if peek {
+				kept = append(kept, msg)
+			}
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	g.buffer = kept
+	return messages
+}
+
+// Format a buffered message, JSON payloads are decoded and other payloads returned as string
+func messageReadings(msg *receivedMessage) map[string]interface{} {
+	var payload interface{}
+	if err := json.Unmarshal(msg.Payload(), &payload); err != nil {
+		payload = string(msg.Payload())
+	}
+	readings := map[string]interface{}{
+		"topic":    msg.Topic(),
+		"qos":      msg.Qos(),
+		"retained": msg.Retained(),
+		"received": msg.received.UTC().Format(time.RFC3339Nano),
+		"payload":  payload,
+	}
+	if props := userProperties(msg.Message); props != nil {
+		readings["user_properties"] = props
+	}
+	return readings
+}
+
+// Return the subscriptions, buffer usage and throughput
+func (g *mqttGeneric) stats() map[string]interface{} {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	topics := make([]string, 0, len(g.subscriptions))
+	for topic := range g.subscriptions {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	subscriptions := make([]interface{}, 0, len(topics))
+	for _, topic := range topics {
+		subscriptions = append(subscriptions, map[string]interface{}{"topic": topic, "qos": g.subscriptions[topic]})
+	}
+	stats := g.throughput.readings(time.Now())
+	stats["subscriptions"] = subscriptions
+	stats["buffered"] = len(g.buffer)
+	stats["buffer_length"] = g.bufferLength
+	stats["dropped"] = g.dropped
+	stats["connected"] = g.client.IsConnected()
+	return stats
+}
+
+// Decode a DoCommand argument into a struct, a plain string sets the topic
+func decodeCommandArgs(v interface{}, args interface{}) error {
+	if topic, ok := v.(string); ok {
+		v = map[string]interface{}{"topic": topic}
+	}
+	jsonbody, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(jsonbody, args)
+}
+
+// DoCommand implements the MQTT commands:
+//
+//	{"publish": {"topic": "t", "qos": 0, "retained": false, "payload": "hello"}}
+//	{"subscribe": {"topic": "t/#", "qos": 1}}
+//	{"unsubscribe": "t/#"}
+//	{"read": {"topic": "t/#", "count": 10, "peek": false}}
+//	{"stats": true}
+func (g *mqttGeneric) DoCommand(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	for k, v := range cmd {
+		switch k {
+		case "publish":
+			msg := Message{}
+			if err := decodeCommandArgs(v, &msg); err != nil {
+				return nil, err
+			}
+			if err := publishAndWait(ctx, g.client, msg.Topic, msg.Qos, msg.Retained, msg.Payload); err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{"result": "success"}, nil
+		case "subscribe":
+			args := struct {
+				Topic string `json:"topic"`
+				QoS   byte   `json:"qos"`
+			}{}
+			if err := decodeCommandArgs(v, &args); err != nil {
+				return nil, err
+			}
+			if err := g.subscribe(ctx, args.Topic, args.QoS); err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{"result": "success"}, nil
+		case "unsubscribe":
+			args := struct {
+				Topic string `json:"topic"`
+			}{}
+			if err := decodeCommandArgs(v, &args); err != nil {
+				return nil, err
+			}
+			if err := g.unsubscribe(ctx, args.Topic); err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{"result": "success"}, nil
+		case "read":
+			args := struct {
+				Topic string `json:"topic"`
+				Count int    `json:"count"`
+				Peek  bool   `json:"peek"`
+			}{}
+			if v != true {
+				if err := decodeCommandArgs(v, &args); err != nil {
+					return nil, err
+				}
+			}
+			return map[string]interface{}{"messages": g.read(args.Topic, args.Count, args.Peek)}, nil
+		case "stats":
+			return g.stats(), nil
+		}
+	}
+	return nil, errUnimplemented
+}
+
+// Disconnect from the broker
+func (g *mqttGeneric) Close(ctx context.Context) error {
+	if g.client != nil {
+		g.client.Disconnect(250) // Timeout in milliseconds
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package mqttclient
+
+import (
+	"sync"
+)
+
+// Default ingest_buffer with parse workers
+const defaultWorkerBuffer = 1024
+
+// A message handed off by the MQTT callback
+type handoffMessage struct {
+	msg   *receivedMessage
+	ready chan struct{} // Closed when a parse worker parsed the message, nil without workers
+}
+
+// Buffer between the MQTT callback and the goroutine processing the messages, so the callback never
+// waits for the component mutex held by Readings or DoCommand. The processing goroutine still takes the
+// mutex, Readings delays the processing while the buffer absorbs the messages arriving meanwhile. With
+// parse workers the payloads are parsed concurrently before the messages are processed in the order
+// they were received.
+type messageHandoff struct {
+	messages chan *handoffMessage
+	work     chan *handoffMessage // Messages to parse, nil without workers
+	done     chan struct{}        // Closed when the processing goroutine handled the remaining messages
+	senders  sync.WaitGroup       // Callbacks sending to the buffer, the channels are closed once they returned
+}
+
+// Hand a received message off to the processing goroutine, false if there is no handoff buffer. The
+// callback only blocks if the buffer is full.
+func (s *mqttClient) handOff(msg *receivedMessage) bool {
+	// The lock is not held while sending, stopping the handoff must not wait for a full buffer
+	s.handoffMutex.RLock()
+	h := s.handoff
+	if h != nil {
+		h.senders.Add(1)
+	}
+	s.handoffMutex.RUnlock()
+	if h == nil {
+		return false
+	}
+	defer h.senders.Done()
+	item := &handoffMessage{msg: msg}
+	if h.work != nil {
+		item.ready = make(chan struct{})
+	}
+	h.messages <- item
+	if h.work != nil {
+		h.work <- item
+	}
+	return true
+}
+
+// Start a handoff buffer of the given size with the given number of parse workers. Without buffer and
+// workers the messages are processed in the MQTT callback. Must be called after the configuration was
+// applied, the workers parse with it.
+func (s *mqttClient) startHandoff(size, workers int) {
+	if size == 0 && workers > 0 {
+		size = defaultWorkerBuffer
+	}
+	if size == 0 {
+		return
+	}
+	h := &messageHandoff{messages: make(chan *handoffMessage, size), done: make(chan struct{})}
+	var parsing sync.WaitGroup
+	if workers > 0 {
+		h.work = make(chan *handoffMessage, size)
+		for i := 0; i < workers; i++ {
+			parsing.Add(1)
+			go func() {
+				defer parsing.Done()
+				for item := range h.work {
+					s.preParse(item.msg)
+					close(item.ready)
+				}
+			}()
+		}
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(h.done)
+		for item := range h.messages {
+			if item.ready != nil {
+				<-item.ready
+			}
+			s.receive(item.msg)
+		}
+		parsing.Wait()
+	}()
+	s.handoffMutex.Lock()
+	s.handoff = h
+	s.handoffMutex.Unlock()
+}
+
+// Stop handing off messages and process the buffered messages. Must not be called with the mutex held,
+// the remaining messages are processed before it returns.
+func (s *mqttClient) stopHandoff() {
+	s.handoffMutex.Lock()
+	h := s.handoff
+	s.handoff = nil
+	s.handoffMutex.Unlock()
+	if h == nil {
+		return
+	}
+	// No callback sends to the buffer anymore once the callbacks in progress returned, they may wait for
+	// the processing goroutine to make room
+	h.senders.Wait()
+	close(h.messages)
+	if h.work != nil {
+		close(h.work)
+	}
+	<-h.done
+}
+
+// Parse the payload of a message in a parse worker, unless it is dropped or not parsed by the pipeline
+func (s *mqttClient) preParse(msg *receivedMessage) {
+	if s.maxPayloadBytes > 0 && len(msg.Payload()) > s.maxPayloadBytes {
+		return
+	}
+	if s.isBinaryTopic(msg.Topic()) {
+		return
+	}
+	s.decode(msg)
+}
+
+// Number of messages waiting in the handoff buffer
+func (s *mqttClient) handoffDepth() int {
+	s.handoffMutex.RLock()
+	defer s.handoffMutex.RUnlock()
+	if s.handoff == nil {
+		return 0
+	}
+	return len(s.handoff.messages)
+}
@@ -0,0 +1,78 @@
+package mqttclient
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lab101/mqtt-welding/internal/mqtttest"
+)
+
+// With the handoff buffer the MQTT callback doesn't wait for the mutex held by Readings
+func TestHandoffWhileMutexHeld(t *testing.T) {
+	b := startTestBroker(t)
+	s := newTestSensor(t, b, "handoff", &Config{Topic: "weld/cell1/data", QueueLength: 10, PayloadType: "json", IngestBuffer: 10})
+	payload := mqtttest.JSON(t, mqtttest.WeldSample(180, 21.5))
+
+	s.mutex.Lock()
+	handedOff := make(chan struct{})
+	go func() {
+		defer close(handedOff)
+		for i := 0; i < 5; i++ {
+			s.onMessage(nil, &injectedMessage{topic: "weld/cell1/data", payload: payload})
+		}
+	}()
+	select {
+	case <-handedOff:
+	case <-time.After(mqtttest.Timeout):
+		t.Fatal("callback blocked by the mutex")
+	}
+	// The first message may wait in the processing goroutine
+	if depth := s.handoffDepth(); depth < 4 {
+		t.Errorf("handoff depth = %d, want the messages buffered", depth)
+	}
+	s.mutex.Unlock()
+	awaitReceived(t, s, 5)
+}
+
+// Stopping the handoff doesn't deadlock with a callback waiting for room in the buffer
+func TestStopHandoffWithFullBuffer(t *testing.T) {
+	b := startTestBroker(t)
+	s := newTestSensor(t, b, "handoff-full", &Config{Topic: "weld/cell1/data", QueueLength: 10, PayloadType: "json", IngestBuffer: 1})
+	payload := mqtttest.JSON(t, mqtttest.WeldSample(180, 21.5))
+
+	s.mutex.Lock()
+	handedOff := make(chan struct{})
+	go func() {
+		defer close(handedOff)
+		for i := 0; i < 3; i++ {
+			s.onMessage(nil, &injectedMessage{topic: "weld/cell1/data", payload: payload})
+		}
+	}()
+	// The processing goroutine waits for the mutex and the buffer is full, the last callback waits
+	mqtttest.Eventually(t, func() bool { return s.handoffDepth() == 1 }, "buffer not full")
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		s.stopHandoff()
+	}()
+	// Metrics don't wait for the stopping handoff
+	time.Sleep(50 * time.Millisecond)
+	depth := make(chan int, 1)
+	go func() { depth <- s.handoffDepth() }()
+	select {
+	case <-depth:
+	case <-time.After(time.Second):
+		t.Error("handoff depth blocked by the stopping handoff")
+	}
+	s.mutex.Unlock()
+	for _, done := range []chan struct{}{handedOff, stopped} {
+		select {
+		case <-done:
+		case <-time.After(mqtttest.Timeout):
+			t.Fatal("handoff not stopped")
+		}
+	}
+	if got := s.metrics.received.Load(); got != 3 {
+		t.Errorf("received %d messages, want the 3 handed off", got)
+	}
+}
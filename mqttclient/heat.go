@@ -0,0 +1,197 @@
+package mqttclient
+
+import (
+	"fmt"
+	"time"
+)
+
+// Maps the heat_input configuration attribute
+type HeatInputConfig struct {
+	Voltage         string  `json:"voltage"`           // Voltage field in V, default voltage_v
+	Current         string  `json:"current"`           // Current field in A, default current_a
+	TravelSpeed     string  `json:"travel_speed"`      // Travel speed field, default travel_speed_mm_s
+	TravelSpeedUnit string  `json:"travel_speed_unit"` // Supported mm_s (default), mm_min, cm_min, m_min
+	Process         string  `json:"process"`           // Welding process selecting the default efficiency
+	Efficiency      float64 `json:"efficiency"`        // Thermal efficiency factor, default by process or 0.8
+	Mode            string  `json:"mode"`              // Supported message (default), segment
+}
+
+// Thermal efficiency factors of the welding processes according to ISO/TR 17671-1
+var processEfficiency = map[string]float64{
+	"saw":  1.0,
+	"smaw": 0.8,
+	"gmaw": 0.8,
+	"fcaw": 0.8,
+	"gtaw": 0.6,
+	"paw":  0.6,
+}
+
+const defaultEfficiency = 0.8
+
+// Factors converting a travel speed to mm/s
+var travelSpeedUnits = map[string]float64{
+	"":       1,
+	"mm_s":   1,
+	"mm_min": 1.0 / 60,
+	"cm_min": 10.0 / 60,
+	"m_min":  1000.0 / 60,
+}
+
+// Validate the heat input configuration, the segment mode uses the arc state of the arc tracking
+func (cfg *HeatInputConfig) Validate(arcTracking bool) error {
+	if _, ok := travelSpeedUnits[cfg.TravelSpeedUnit]; !ok {
+		return fmt.Errorf("heat_input travel_speed_unit must be mm_s, mm_min, cm_min or m_min")
+	}
+	if _, ok := processEfficiency[cfg.Process]; !ok && cfg.Process != "" {
+		return fmt.Errorf("unknown heat_input process %q (should be one of %v)", cfg.Process, sortedKeys(processEfficiency))
+	}
+	if cfg.Efficiency < 0 || cfg.Efficiency > 1 {
+		return fmt.Errorf("heat_input efficiency must be between 0 and 1")
+	}
+	switch cfg.Mode {
+	case "", "message":
+	case "segment":
+		if !arcTracking {
+			return fmt.Errorf("heat_input segment mode requires arc_tracking")
+		}
+	default:
+		return fmt.Errorf("heat_input mode must be message or segment")
+	}
+	return nil
+}
+
+// Computes the heat input per message or per weld segment
+type heatInput struct {
+	voltage, current, travelSpeed string
+	speedFactor                   float64
+	efficiency                    float64
+	segments                      bool
+	// Running segment
+	active           bool
+	last             time.Time
+	lastValues       [3]float64 // Voltage, current and travel speed of the last message, they apply until the next
+	energyJ          float64
+	lengthMm         float64
+	duration         time.Duration
+	lastSegment      map[string]interface{}
+	completeSegments uint64
+}
+
+func newHeatInput(cfg *HeatInputConfig) *heatInput {
+	if cfg == nil {
+		return nil
+	}
+	h := &heatInput{
+		voltage:     cfg.Voltage,
+		current:     cfg.Current,
+		travelSpeed: cfg.TravelSpeed,
+		speedFactor: travelSpeedUnits[cfg.TravelSpeedUnit],
+		efficiency:  cfg.Efficiency,
+		segments:    cfg.Mode == "segment",
+	}
+	if h.voltage == "" {
+		h.voltage = weldVoltage
+	}
+	if h.current == "" {
+		h.current = weldCurrent
+	}
+	if h.travelSpeed == "" {
+		h.travelSpeed = weldTravelSpeed
+	}
+	if h.efficiency == 0 {
+		if h.efficiency = processEfficiency[cfg.Process]; h.efficiency == 0 {
+			h.efficiency = defaultEfficiency
+		}
+	}
+	return h
+}
+
+// Return the voltage, current and travel speed in mm/s of a payload
+func (h *heatInput) values(payload interface{}) (float64, float64, float64, bool) {
+	var values [3]float64
+	for i, field := range []string{h.voltage, h.current, h.travelSpeed} {
+		v, ok := lookupField(payload, field)
+		if !ok {
+			return 0, 0, 0, false
+		}
+		if values[i], ok = toFloat(v); !ok {
+			return 0, 0, 0, false
+		}
+	}
+	return values[0], values[1], values[2] * h.speedFactor, true
+}
+
+// Heat input in kJ/mm: efficiency * U * I / v
+func (h *heatInput) kJPerMm(u, i, v float64) float64 {
+	return h.efficiency * u * i / v / 1000
+}
+
+// Add the values of a message to the running segment, the segment ends when the arc is off and its
+// summary is returned
+func (h *heatInput) addSegment(arcOn bool, values [3]float64, at time.Time, maxGap time.Duration) map[string]interface{} {
+	if h.active && !h.last.IsZero() {
+		if dt := at.Sub(h.last); dt > 0 && dt <= maxGap {
+			h.energyJ += h.lastValues[0] * h.lastValues[1] * dt.Seconds()
+			h.lengthMm += h.lastValues[2] * dt.Seconds()
+			h.duration += dt
+		}
+	}
+	h.last = at
+	h.lastValues = values
+	if arcOn {
+		h.active = true
+		return nil
+	}
+	if !h.active {
+		return nil
+	}
+	h.active = false
+	h.completeSegments++
+	h.lastSegment = map[string]interface{}{
+		"energy_kj":  h.energyJ / 1000,
+		"length_mm":  h.lengthMm,
+		"duration_s": h.duration.Seconds(),
+		"ended":      at.UTC().Format(time.RFC3339Nano),
+	}
+	if h.lengthMm > 0 {
+		h.lastSegment["kj_mm"] = h.efficiency * h.energyJ / 1000 / h.lengthMm
+	}
+	h.energyJ, h.lengthMm, h.duration = 0, 0, 0
+	return h.lastSegment
+}
+
+func (h *heatInput) readings() map[string]interface{} {
+	readings := map[string]interface{}{"segments": h.completeSegments}
+	if h.lastSegment != nil {
+		readings["last_segment"] = h.lastSegment
+	}
+	return readings
+}
+
+// Compute the heat input of a newly received message and add it to the derived fields. Must be called
+// with the mutex held, after the arc tracking.
+func (s *mqttClient) computeHeatInput(msg *receivedMessage) {
+	if s.heatInput == nil {
+		return
+	}
+	payload, err := s.parseWithDerived(msg)
+	if err != nil {
+		return
+	}
+	u, i, v, ok := s.heatInput.values(payload)
+	if s.heatInput.segments {
+		// Messages without values, e.g. arc state changes, keep the previous values
+		values := [3]float64{u, i, v}
+		if !ok {
+			values = s.heatInput.lastValues
+		}
+		// The message ending a segment carries its summary
+		if segment := s.heatInput.addSegment(s.arc.on, values, msg.received, s.arc.maxGap); segment != nil {
+			msg.setDerived("heat_input_segment", segment)
+		}
+		return
+	}
+	if ok && v > 0 {
+		msg.setDerived("heat_input_kj_mm", s.heatInput.kJPerMm(u, i, v))
+	}
+}
@@ -0,0 +1,108 @@
+package mqttclient
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestHeatInputPerMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     HeatInputConfig
+		payload map[string]interface{}
+		want    float64
+		wantOK  bool
+	}{
+		{"default efficiency", HeatInputConfig{}, map[string]interface{}{"voltage_v": 25, "current_a": 200, "travel_speed_mm_s": 5}, 0.8, true},
+		{"process efficiency", HeatInputConfig{Process: "gtaw"}, map[string]interface{}{"voltage_v": 25, "current_a": 200, "travel_speed_mm_s": 5}, 0.6, true},
+		{"efficiency overrides the process", HeatInputConfig{Process: "gtaw", Efficiency: 1}, map[string]interface{}{"voltage_v": 25, "current_a": 200, "travel_speed_mm_s": 5}, 1, true},
+		{"mm per minute", HeatInputConfig{TravelSpeedUnit: "mm_min"}, map[string]interface{}{"voltage_v": 25, "current_a": 200, "travel_speed_mm_s": 300}, 0.8, true},
+		{"cm per minute", HeatInputConfig{TravelSpeedUnit: "cm_min"}, map[string]interface{}{"voltage_v": 25, "current_a": 200, "travel_speed_mm_s": 30}, 0.8, true},
+		{"m per minute", HeatInputConfig{TravelSpeedUnit: "m_min"}, map[string]interface{}{"voltage_v": 25, "current_a": 200, "travel_speed_mm_s": 0.3}, 0.8, true},
+		{"custom fields", HeatInputConfig{Voltage: "u", Current: "i", TravelSpeed: "weld.speed"}, map[string]interface{}{"u": 20, "i": 150, "weld": map[string]interface{}{"speed": 4}}, 0.6, true},
+		{"numeric strings", HeatInputConfig{}, map[string]interface{}{"voltage_v": "25", "current_a": "200", "travel_speed_mm_s": "5"}, 0.8, true},
+		{"missing travel speed", HeatInputConfig{}, map[string]interface{}{"voltage_v": 25, "current_a": 200}, 0, false},
+		{"non numeric current", HeatInputConfig{}, map[string]interface{}{"voltage_v": 25, "current_a": "high", "travel_speed_mm_s": 5}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHeatInput(&tt.cfg)
+			u, i, v, ok := h.values(tt.payload)
+			if ok != tt.wantOK {
+				t.Fatalf("values ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if got := h.kJPerMm(u, i, v); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("heat input %v kJ/mm, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeatInputSegments(t *testing.T) {
+	start := time.Date(2024, 5, 6, 7, 0, 0, 0, time.UTC)
+	type sample struct {
+		offset time.Duration
+		arcOn  bool
+		values [3]float64 // Voltage, current and travel speed in mm/s
+	}
+	tests := []struct {
+		name    string
+		samples []sample
+		energy  float64 // kJ
+		length  float64 // mm
+		kjMm    float64
+	}{
+		{
+			name: "constant values",
+			samples: []sample{
+				{0, true, [3]float64{20, 100, 4}},
+				{time.Second, true, [3]float64{20, 100, 4}},
+				{2 * time.Second, false, [3]float64{0, 0, 0}},
+			},
+			energy: 4, length: 8, kjMm: 0.4,
+		},
+		{
+			name: "values apply until the next message",
+			samples: []sample{
+				{0, true, [3]float64{20, 100, 4}},
+				{time.Second, true, [3]float64{30, 200, 2}},
+				{2 * time.Second, false, [3]float64{0, 0, 0}},
+			},
+			energy: 8, length: 6, kjMm: 0.8 * 8 / 6,
+		},
+		{
+			name: "gaps are not integrated",
+			samples: []sample{
+				{0, true, [3]float64{20, 100, 4}},
+				{time.Second, true, [3]float64{20, 100, 4}},
+				{time.Minute, true, [3]float64{20, 100, 4}},
+				{time.Minute + time.Second, false, [3]float64{0, 0, 0}},
+			},
+			energy: 4, length: 8, kjMm: 0.4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHeatInput(&HeatInputConfig{Mode: "segment"})
+			var segment map[string]interface{}
+			for i, s := range tt.samples {
+				segment = h.addSegment(s.arcOn, s.values, start.Add(s.offset), 5*time.Second)
+				if (segment != nil) != (i == len(tt.samples)-1) {
+					t.Fatalf("sample %d: segment %v", i, segment)
+				}
+			}
+			for field, want := range map[string]float64{"energy_kj": tt.energy, "length_mm": tt.length, "kj_mm": tt.kjMm} {
+				if got, _ := segment[field].(float64); math.Abs(got-want) > 1e-9 {
+					t.Errorf("%s = %v, want %v", field, got, want)
+				}
+			}
+			if h.completeSegments != 1 {
+				t.Errorf("%d segments, want 1", h.completeSegments)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package mqttclient
+
+import (
+	"encoding/base64"
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+// Default number of received messages kept for the history command
+const defaultHistoryLength = 100
+
+// Ring buffer of the last received messages, independent of the data capture queue
+type messageHistory struct {
+	messages []*receivedMessage
+	next     int
+	size     int
+}
+
+func newMessageHistory(size int) messageHistory {
+	if size == 0 {
+		size = defaultHistoryLength
+	}
+	return messageHistory{size: size}
+}
+
+// Store a message, the oldest message is overwritten when the buffer is full
+func (h *messageHistory) add(msg *receivedMessage) {
+	if h.size <= 0 {
+		return
+	}
+	if len(h.messages) < h.size {
+		h.messages = append(h.messages, msg)
+		return
+	}
+	h.messages[h.next] = msg
+	h.next = (h.next + 1) % h.size
+}
+
+// Return up to count of the most recent messages matching the topic filter, oldest first
+func (h *messageHistory) last(count int, topic string) []*receivedMessage {
+	var messages []*receivedMessage
+	for i := len(h.messages) - 1; i >= 0 && len(messages) < count; i-- {
+		msg := h.messages[(h.next+i)%len(h.messages)]
+		if topic == "" || topicMatches(topic, msg.Topic()) {
+			messages = append(messages, msg)
+		}
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages
+}
+
+// Arguments of the history command
+type historyArgs struct {
+	Count   int    `json:"count"`    // Number of messages, default 20
+	Topic   string `json:"topic"`    // Optional topic filter
+	MsgType string `json:"msg_type"` // Optional payload format replacing the configured format
+}
+
+// Return the recent messages with their metadata for the history command
+func (s *mqttClient) historyReadings(args historyArgs) (map[string]interface{}, error) {
+	if args.Count == 0 {
+		args.Count = 20
+	}
+	if args.Count < 0 {
+		return nil, fmt.Errorf("invalid count %v (should be >= 1)", args.Count)
+	}
+	if args.Topic != "" && !validTopicFilter(args.Topic) {
+		return nil, fmt.Errorf("invalid topic filter %q", args.Topic)
+	}
+	if args.MsgType != "" && !payloadTypes[args.MsgType] {
+		return nil, fmt.Errorf("invalid msg_type %q", args.MsgType)
+	}
+	messages := []interface{}{}
+	for _, msg := range s.history.last(args.Count, args.Topic) {
+		messages = append(messages, s.historyEntry(msg, args.MsgType))
+	}
+	return map[string]interface{}{"messages": messages, "history_length": len(s.history.messages)}, nil
+}
+
+// Return a message with its metadata, payloads failing parsing are returned as string or base64. The
+// payload is parsed in the given format unless it is empty.
+func (s *mqttClient) historyEntry(msg *receivedMessage, msgType string) map[string]interface{} {
+	m := map[string]interface{}{
+		"topic":      msg.Topic(),
+		"qos":        msg.Qos(),
+		"retained":   msg.Retained(),
+		"duplicate":  msg.Duplicate(),
+		"message_id": msg.MessageID(),
+		"received":   msg.received.UTC().Format(time.RFC3339Nano),
+		"size":       len(msg.Payload()),
+	}
+	if msg.seq != 0 {
+		m["seq"] = msg.seq
+	}
+	if props := userProperties(msg.Message); props != nil {
+		m["user_properties"] = props
+	}
+	if payload, err := s.parseAs(msg, msgType); err == nil {
+		if raw, ok := payload.([]byte); ok && s.rawEncoding != "" {
+			setRawPayload(m, raw, s.rawEncoding)
+		} else {
+			m["payload"] = payload
+		}
+	} else if utf8.Valid(msg.Payload()) {
+		m["payload"] = string(msg.Payload())
+		m["parse_error"] = err.Error()
+	} else {
+		m["payload_base64"] = base64.StdEncoding.EncodeToString(msg.Payload())
+		m["parse_error"] = err.Error()
+	}
+	return m
+}
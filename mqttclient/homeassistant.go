@@ -0,0 +1,149 @@
+package mqttclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Default Home Assistant discovery topic prefix
+const defaultDiscoveryPrefix = "homeassistant"
+
+// Maps the home_assistant attribute of the publishing models
+type HomeAssistantConfig struct {
+	DiscoveryPrefix string            `json:"discovery_prefix"` // Default "homeassistant"
+	NodeID          string            `json:"node_id"`          // Identifies the device, default the edge node ID or resource name
+	DeviceName      string            `json:"device_name"`      // Default the node ID
+	Units           map[string]string `json:"units"`            // Unit of measurement per metric
+	StateTopic      string            `json:"state_topic"`      // JSON state topic of the edge node
+}
+
+// Validate the discovery node ID, it is used as a topic level
+func (cfg *HomeAssistantConfig) Validate(path string) error {
+	if cfg.NodeID != "" && !discoveryIDRegex.MatchString(cfg.NodeID) {
+		return fmt.Errorf("home_assistant node_id may only contain letters, digits, _ and - %q", path)
+	}
+	if cfg.StateTopic != "" && !validTopicName(cfg.StateTopic) {
+		return fmt.Errorf("invalid home_assistant state_topic %q %q", cfg.StateTopic, path)
+	}
+	return nil
+}
+
+var (
+	discoveryIDRegex      = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+	discoveryInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+)
+
+// Home Assistant discovery config message
+type discoveryMessage struct {
+	topic   string
+	payload []byte
+}
+
+// Emits a Home Assistant discovery config once for every metric of a state topic
+type haDiscovery struct {
+	prefix     string
+	nodeID     string
+	deviceName string
+	units      map[string]string
+	announced  map[string]bool
+}
+
+// Create the discovery publisher, the node ID defaults to the given name
+func newHADiscovery(cfg *HomeAssistantConfig, name string) *haDiscovery {
+	if cfg == nil {
+		return nil
+	}
+	d := &haDiscovery{
+		prefix:     cfg.DiscoveryPrefix,
+		nodeID:     cfg.NodeID,
+		deviceName: cfg.DeviceName,
+		units:      cfg.Units,
+		announced:  map[string]bool{},
+	}
+	if d.prefix == "" {
+		d.prefix = defaultDiscoveryPrefix
+	}
+	if d.nodeID == "" {
+		d.nodeID = discoveryInvalidChars.ReplaceAllString(name, "_")
+	}
+	if d.deviceName == "" {
+		d.deviceName = d.nodeID
+	}
+	return d
+}
+
+// Return the config messages of the metrics not announced yet. The path of a metric is the list of
+// JSON keys of its value in the state payload.
+func (d *haDiscovery) configs(stateTopic string, metrics map[string][]string, values map[string]interface{}) []discoveryMessage {
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var messages []discoveryMessage
+	for _, name := range names {
+		key := stateTopic + "\x00" + name
+		if d.announced[key] {
+			continue
+		}
+		d.announced[key] = true
+		objectID := discoveryInvalidChars.ReplaceAllString(strings.TrimPrefix(stateTopic+"_"+name, "/"), "_")
+		var template strings.Builder
+		template.WriteString("{{ value_json")
+		for _, k := range metrics[name] {
+			fmt.Fprintf(&template, "[%q]", k)
+		}
+		template.WriteString(" }}")
+		config := map[string]interface{}{
+			"name":           name,
+			"unique_id":      d.nodeID + "_" + objectID,
+			"object_id":      objectID,
+			"state_topic":    stateTopic,
+			"value_template": template.String(),
+			"device": map[string]interface{}{
+				"identifiers":  []string{d.nodeID},
+				"name":         d.deviceName,
+				"manufacturer": "Lab101",
+			},
+		}
+		component := "sensor"
+		if _, ok := values[name].(bool); ok {
+			component = "binary_sensor"
+			config["payload_on"] = "True"
+			config["payload_off"] = "False"
+		} else if unit, ok := d.units[name]; ok {
+			config["unit_of_measurement"] = unit
+		}
+		payload, err := json.Marshal(config)
+		if err != nil {
+			continue
+		}
+		messages = append(messages, discoveryMessage{
+			topic:   fmt.Sprintf("%s/%s/%s/%s/config", d.prefix, component, d.nodeID, objectID),
+			payload: payload,
+		})
+	}
+	return messages
+}
+
+// Collect the leaf values of a JSON object with their key paths, metric names join the keys with "/"
+func jsonMetrics(prefix []string, v interface{}, paths map[string][]string, values map[string]interface{}) {
+	if m, ok := v.(map[string]interface{}); ok {
+		for k, child := range m {
+			jsonMetrics(append(append([]string{}, prefix...), k), child, paths, values)
+		}
+		return
+	}
+	if len(prefix) == 0 {
+		return
+	}
+	switch v.(type) {
+	case float64, bool, string:
+		name := strings.Join(prefix, "/")
+		paths[name] = prefix
+		values[name] = v
+	}
+}
@@ -0,0 +1,116 @@
+package mqttclient
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Maps the join configuration attribute
+type JoinConfig struct {
+	Topics   []string `json:"topics"`    // Topics whose latest messages are combined into one reading
+	Key      string   `json:"key"`       // Optional payload field which must match across all topics, e.g. "weld_id"
+	WindowMs int      `json:"window_ms"` // Max time between the messages if no key is set, default 1000
+}
+
+const defaultJoinWindow = time.Second
+
+// Validate the join configuration
+func (cfg *JoinConfig) Validate() error {
+	if len(cfg.Topics) < 2 {
+		return fmt.Errorf("join requires at least two topics")
+	}
+	for _, topic := range cfg.Topics {
+		if topic == "" {
+			return fmt.Errorf("join topics must not be empty")
+		}
+	}
+	if cfg.WindowMs < 0 {
+		return fmt.Errorf("join window_ms must be >= 0")
+	}
+	return nil
+}
+
+// Check if a topic matches a subscription filter with + and # wildcards
+func topicMatches(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// Whether a message is processed on its own instead of joined: messages of the program topic update the
+// context of the joined messages, fault and ack messages latch and acknowledge alarms, also if a join
+// topic covers them. Must be called with the mutex held.
+func (s *mqttClient) bypassesJoin(topic string) bool {
+	if s.programs != nil && topicMatches(s.programs.topic, topic) {
+		return true
+	}
+	if s.alarms != nil {
+		return s.alarms.isFaultTopic(topic) || s.alarms.AckTopic != "" && topicMatches(s.alarms.AckTopic, topic)
+	}
+	return false
+}
+
+// Store a message from one of the join topics and return the combined message once the latest
+// messages of all topics correlate, nil otherwise. Must be called with the mutex held.
+func (s *mqttClient) correlate(msg *receivedMessage) *receivedMessage {
+	matched := ""
+	for _, topic := range s.join.Topics {
+		if topicMatches(topic, msg.Topic()) {
+			matched = topic
+			break
+		}
+	}
+	if matched == "" {
+		return nil
+	}
+	if _, err := s.parse(msg); err != nil {
+		s.logger.Debugf("dropped unparsable message on join topic %s: %v", msg.Topic(), err)
+		s.metrics.drop(dropParseFailure)
+		return nil
+	}
+	s.joinLatest[matched] = msg
+	if len(s.joinLatest) < len(s.join.Topics) {
+		return nil
+	}
+
+	window := defaultJoinWindow
+	if s.join.WindowMs > 0 {
+		window = time.Duration(s.join.WindowMs) * time.Millisecond
+	}
+	for _, other := range s.joinLatest {
+		if s.join.Key != "" {
+			key, ok := lookupField(msg.parsed, s.join.Key)
+			otherKey, otherOk := lookupField(other.parsed, s.join.Key)
+			if !ok || !otherOk || !valuesEqual(key, otherKey) {
+				return nil
+			}
+		} else if d := msg.received.Sub(other.received); d > window || d < -window {
+			return nil
+		}
+	}
+
+	// Object payloads are merged, other payloads are stored under the last topic level
+	combined := map[string]interface{}{}
+	for _, topic := range s.join.Topics {
+		part := s.joinLatest[topic]
+		if fields, ok := part.parsed.(map[string]interface{}); ok {
+			for k, v := range fields {
+				combined[k] = v
+			}
+		} else {
+			levels := strings.Split(part.Topic(), "/")
+			combined[levels[len(levels)-1]] = part.parsed
+		}
+	}
+	s.joinLatest = map[string]*receivedMessage{}
+	return &receivedMessage{Message: msg.Message, received: msg.received, parsed: combined, isParsed: true}
+}
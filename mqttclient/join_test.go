@@ -0,0 +1,95 @@
+package mqttclient
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/lab101/mqtt-welding/internal/mqtttest"
+)
+
+func newJoinTestSensor(t *testing.T, b *mqtttest.Broker, name string, cfg *Config) *mqttClient {
+	t.Helper()
+	cfg.QueueLength, cfg.PayloadType = 10, "json"
+	cfg.Join = &JoinConfig{Topics: []string{"weld/current", "weld/voltage"}, Key: "weld_id"}
+	return newTestSensor(t, b, name, cfg)
+}
+
+// Publish the two parts of a joined message and wait until the joined message is queued
+func publishJoined(t *testing.T, s *mqttClient, pub mqtt.Client, weldID int) {
+	t.Helper()
+	mqtttest.Publish(t, pub, "weld/current", map[string]interface{}{"weld_id": weldID, "current_a": 180}, false)
+	mqtttest.Publish(t, pub, "weld/voltage", map[string]interface{}{"weld_id": weldID, "voltage_v": 21.5}, false)
+	mqtttest.Eventually(t, func() bool {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		return s.latestMessage != nil && s.latestMessage.parsed.(map[string]interface{})["weld_id"] == float64(weldID)
+	}, "weld %d not joined", weldID)
+}
+
+func TestJoinWithProgramContext(t *testing.T) {
+	b := startTestBroker(t)
+	s := newJoinTestSensor(t, b, "join-program", &Config{ProgramContext: &ProgramContextConfig{Topic: "robot/program"}})
+	pub := b.Client(t, "publisher")
+
+	mqtttest.Publish(t, pub, "robot/program", map[string]interface{}{"program": 12}, false)
+	publishJoined(t, s, pub, 1)
+	readings, err := s.Readings(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := payloadField(t, readings, "program"); got != 12.0 {
+		t.Errorf("program of the joined message = %v, want 12: %v", got, readings)
+	}
+	if got := readings["program_context"].(map[string]interface{})["program"]; got != 12.0 {
+		t.Errorf("program context = %v, want 12", readings["program_context"])
+	}
+}
+
+func TestJoinWithAlarms(t *testing.T) {
+	b := startTestBroker(t)
+	s := newJoinTestSensor(t, b, "join-alarms", &Config{Alarms: &AlarmsConfig{Topics: []string{"cell/fault"}, IDField: "code", AckTopic: "cell/ack"}})
+	pub := b.Client(t, "publisher")
+
+	mqtttest.Publish(t, pub, "cell/fault", map[string]interface{}{"code": "E231"}, false)
+	mqtttest.Publish(t, pub, "cell/fault", map[string]interface{}{"code": "E17"}, false)
+	publishJoined(t, s, pub, 1)
+	readings, err := s.Readings(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alarms := readings["active_alarms"].([]interface{}); len(alarms) != 2 {
+		t.Fatalf("active alarms = %v, want E231 and E17", alarms)
+	}
+
+	mqtttest.Publish(t, pub, "cell/ack", "E231", false)
+	publishJoined(t, s, pub, 2)
+	if readings, err = s.Readings(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	alarms := readings["active_alarms"].([]interface{})
+	if len(alarms) != 1 || alarms[0].(map[string]interface{})["id"] != "E17" {
+		t.Errorf("active alarms after the ack = %v, want E17", alarms)
+	}
+}
+
+func TestJoinRejectsBackfillReplayTopic(t *testing.T) {
+	cfg := &Config{
+		Host:           "localhost",
+		Port:           1883,
+		Join:           &JoinConfig{Topics: []string{"weld/current", "weld/voltage"}},
+		CaptureTime:    "payload",
+		TimestampField: "ts",
+		DirectCapture:  true,
+		Backfill:       &BackfillConfig{RequestTopic: "weld/backlog/request", ReplayTopic: "weld/backlog/replay"},
+	}
+	if _, err := cfg.Validate("join"); err == nil || !strings.Contains(err.Error(), "replay_topic") {
+		t.Errorf("join with backfill replay_topic = %v, want a replay_topic error", err)
+	}
+	cfg.Backfill.ReplayTopic = ""
+	if _, err := cfg.Validate("join"); err != nil {
+		t.Errorf("join with backfill on the join topics: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package mqttclient
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Number of latency samples used for the percentiles
+const latencyWindow = 100
+
+// Parse a payload timestamp, either an RFC 3339 string or a unix epoch number
+// in seconds, milliseconds, microseconds or nanoseconds (detected by magnitude)
+func parseTimestamp(v interface{}) (time.Time, error) {
+	if s, ok := v.(string); ok {
+		if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			return t, nil
+		}
+		if _, err := strconv.ParseFloat(s, 64); err != nil {
+			return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+		}
+	}
+	f, ok := toFloat(v)
+	if !ok {
+		return time.Time{}, fmt.Errorf("invalid timestamp %v", v)
+	}
+	switch abs := math.Abs(f); {
+	case abs < 1e11:
+		return time.Unix(0, int64(f*1e9)), nil
+	case abs < 1e14:
+		return time.UnixMilli(int64(f)), nil
+	case abs < 1e17:
+		return time.UnixMicro(int64(f)), nil
+	default:
+		return time.Unix(0, int64(f)), nil
+	}
+}
+
+// Tracks the delay between payload timestamps and the local receive time
+type latencyTracker struct {
+	samples []time.Duration
+	next    int
+	last    time.Duration
+}
+
+func (l *latencyTracker) add(d time.Duration) {
+	l.last = d
+	if len(l.samples) < latencyWindow {
+		l.samples = append(l.samples, d)
+		return
+	}
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % latencyWindow
+}
+
+// Return the last, p50 and p95 latency in milliseconds as a readings map
+func (l *latencyTracker) readings() map[string]interface{} {
+	if len(l.samples) == 0 {
+		return map[string]interface{}{}
+	}
+	sorted := make([]time.Duration, len(l.samples))
+	copy(sorted, l.samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	percentile := func(p float64) float64 {
+		i := int(math.Ceil(p*float64(len(sorted)))) - 1
+		return float64(sorted[max(i, 0)]) / float64(time.Millisecond)
+	}
+	return map[string]interface{}{
+		"last_ms": float64(l.last) / float64(time.Millisecond),
+		"p50_ms":  percentile(0.5),
+		"p95_ms":  percentile(0.95),
+		"samples": len(l.samples),
+	}
+}
+
+// Read the payload timestamp of a newly received message and record its latency.
+// Must be called with the mutex held.
+func (s *mqttClient) computeLatency(msg *receivedMessage) {
+	if s.timestampField == "" {
+		return
+	}
+	payload, err := s.parse(msg)
+	if err != nil {
+		return
+	}
+	v, ok := lookupField(payload, s.timestampField)
+	if !ok {
+		return
+	}
+	ts, err := parseTimestamp(v)
+	if err != nil {
+		s.logger.Debugf("cannot read payload timestamp: %v", err)
+		return
+	}
+	msg.timestamp = ts
+	s.latency.add(msg.received.Sub(ts))
+}
@@ -0,0 +1,162 @@
+package mqttclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// A received MQTT message with the data computed when it arrived
+type receivedMessage struct {
+	mqtt.Message
+	received  time.Time
+	timestamp time.Time // Payload timestamp if timestamp_field is configured
+	seq       uint64    // Per topic sequence number, assigned when queued for data capture
+	derived   map[string]interface{}
+	merged    map[string]interface{} // Copy of an object payload with the derived fields, shared by the pipeline stages
+	binary    *binaryPayload         // Set if the payload was written as binary capture
+	parsed    interface{}
+	parseErr  error
+	isParsed  bool
+	counted   bool // Set once the parse failure was counted in the metrics
+}
+
+// Parse the message payload once and cache the result
+func (s *mqttClient) parse(msg *receivedMessage) (interface{}, error) {
+	if msg.binary != nil {
+		return msg.binary.readings(), nil
+	}
+	s.decode(msg)
+	if msg.parseErr != nil && !msg.counted {
+		s.metrics.parseFailures.Add(1)
+		msg.counted = true
+	}
+	return msg.parsed, msg.parseErr
+}
+
+// Whether the MQTT 5 message expiry interval of the message elapsed since it was received
+func (msg *receivedMessage) expiryElapsed(now time.Time) bool {
+	expiry, ok := messageExpiry(msg.Message)
+	return ok && now.Sub(msg.received) >= expiry
+}
+
+// Set a derived field of the message, it is also added to the merged copy of the payload if there is one
+func (msg *receivedMessage) setDerived(name string, v interface{}) {
+	if msg.derived == nil {
+		msg.derived = map[string]interface{}{}
+	}
+	msg.derived[name] = v
+	if msg.merged != nil {
+		msg.merged[name] = v
+	}
+}
+
+// Parse the message payload and merge the derived fields into it. The payload is copied once, when the
+// first derived field has to be merged, and the stages only read the copy, they don't retain it.
+func (s *mqttClient) parseWithDerived(msg *receivedMessage) (interface{}, error) {
+	payload, err := s.parse(msg)
+	if err != nil || len(msg.derived) == 0 {
+		return payload, err
+	}
+	if msg.merged != nil {
+		return msg.merged, nil
+	}
+	merged, ok := mergeDerived(payload, msg.derived)
+	if ok {
+		msg.merged = merged.(map[string]interface{})
+	}
+	return merged, nil
+}
+
+// Payload formats of the "msg_type" extra parameter
+var payloadTypes = map[string]bool{"json": true, "string": true, "auto": true, "raw": true, "telwin": true}
+
+// Return the payload format of the "msg_type" extra parameter, empty if the configured format is used
+func msgTypeOverride(extra map[string]interface{}) (string, error) {
+	v, ok := extra["msg_type"]
+	if !ok {
+		return "", nil
+	}
+	if msgType, ok := v.(string); ok && payloadTypes[msgType] {
+		return msgType, nil
+	}
+	return "", fmt.Errorf("invalid msg_type %v (should be json, string, auto, raw or telwin)", v)
+}
+
+// Parse the message payload in the given format, or the configured format if it is empty. Payloads are
+// reinterpreted without preset and the result is not cached, the pipeline keeps using the configured format.
+func (s *mqttClient) parseAs(msg *receivedMessage, msgType string) (interface{}, error) {
+	if msgType == "" || msg.binary != nil {
+		return s.parse(msg)
+	}
+	payload, err := parsePayload(msgType, msg)
+	return s.sanitize(payload), err
+}
+
+// Parse the message payload unless it was parsed before, a parse worker may parse it before the
+// pipeline uses it
+func (s *mqttClient) decode(msg *receivedMessage) {
+	if msg.isParsed {
+		return
+	}
+	msg.parsed, msg.parseErr = parsePayload(s.payloadType, msg)
+	msg.parsed = s.sanitize(msg.parsed)
+	if msg.parseErr == nil && s.preset != nil {
+		msg.parsed, msg.parseErr = s.preset.decode(msg.parsed)
+	}
+	msg.isParsed = true
+}
+
+// Replace the invalid UTF-8 sequences of a string payload, they break the JSON serialization of readings.
+// Strings in JSON payloads are already sanitized by the JSON decoder.
+func (s *mqttClient) sanitize(payload interface{}) interface{} {
+	if str, ok := payload.(string); ok && !utf8.ValidString(str) {
+		return strings.ToValidUTF8(str, s.utf8Replacement)
+	}
+	return payload
+}
+
+// Buffers of the JSON encodings on the message path, reused to reduce the garbage at high message rates
+var encodeBuffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// Larger buffers are not kept in the pool, a single large payload must not stay allocated
+const maxPooledBufferSize = 1024 * 1024
+
+// Encode v as a JSON line into a pooled buffer, which must be released with releaseBuffer
+func encodePooled(v interface{}) (*bytes.Buffer, error) {
+	buf := encodeBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		releaseBuffer(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+func releaseBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBufferSize {
+		encodeBuffers.Put(buf)
+	}
+}
+
+// A message injected with the inject command as if it was received from the broker
+type injectedMessage struct {
+	topic    string
+	qos      byte
+	retained bool
+	payload  []byte
+}
+
+func (m *injectedMessage) Duplicate() bool   { return false }
+func (m *injectedMessage) Qos() byte         { return m.qos }
+func (m *injectedMessage) Retained() bool    { return m.retained }
+func (m *injectedMessage) Topic() string     { return m.topic }
+func (m *injectedMessage) MessageID() uint16 { return 0 }
+func (m *injectedMessage) Payload() []byte   { return m.payload }
+func (m *injectedMessage) Ack()              {}
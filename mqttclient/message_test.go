@@ -0,0 +1,189 @@
+package mqttclient
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.viam.com/rdk/data"
+	"go.viam.com/rdk/logging"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/lab101/mqtt-welding/internal/mqtttest"
+)
+
+// A msg_type override must not assume the payload has the format of the override
+func TestMsgTypeTelwinOnJSONPayload(t *testing.T) {
+	b := startTestBroker(t)
+	s := newTestSensor(t, b, "msgtype", &Config{Topic: "weld/cell1/data", QueueLength: 10, PayloadType: "json"})
+	pub := b.Client(t, "publisher")
+
+	// Splits into less than the four fields of a telwin payload
+	mqtttest.Publish(t, pub, "weld/cell1/data", `{"current_a": 180}`, false)
+	awaitReceived(t, s, 1)
+
+	ctx := context.Background()
+	telwin := map[string]interface{}{"msg_type": "telwin"}
+	if _, err := s.Readings(ctx, telwin); err == nil || !strings.Contains(err.Error(), "expected 4 fields") {
+		t.Errorf("telwin readings of a JSON payload = %v, want a telwin parse error", err)
+	}
+	readings, err := s.Readings(ctx, map[string]interface{}{"msg_type": "telwin", "topic": "weld/cell1/data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := readings["parse_error"]; !ok {
+		t.Errorf("telwin topic readings of a JSON payload = %v, want a parse_error", readings)
+	}
+	// Queued messages failing to parse are skipped
+	readings, err = s.Readings(ctx, map[string]interface{}{"msg_type": "telwin", "mode": "peek", "count": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messages := readings["messages"].([]interface{}); len(messages) != 0 {
+		t.Errorf("telwin peek of a JSON payload = %v, want no messages", messages)
+	}
+}
+
+// The direct conversion of readings matches their JSON round trip
+func TestStructValue(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+	}{
+		{"null", nil},
+		{"bool", true},
+		{"string", "arc on"},
+		{"invalid UTF-8", "amps\xff"},
+		{"float", 21.5},
+		{"integers", map[string]interface{}{"qos": int32(1), "seq": uint64(7), "count": 3, "total": int64(-4)}},
+		{"nested", map[string]interface{}{"weld": map[string]interface{}{"current_a": 180.0, "tags": []interface{}{"root", 2.0}}}},
+		{"invalid UTF-8 key", map[string]interface{}{"volt\xff": 1.0}},
+		{"string slice", []string{"max_current", "min_voltage"}},
+		{"time", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := structValue(tt.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := json.Marshal(tt.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decoded interface{}
+			if err := json.Unmarshal(b, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			want, err := structpb.NewValue(decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(got, want) {
+				t.Errorf("structValue(%v) = %v, want %v", tt.v, got, want)
+			}
+		})
+	}
+	// Like JSON, numbers which are not finite are rejected
+	if _, err := structValue(map[string]interface{}{"current_a": math.NaN()}); err == nil {
+		t.Error("structValue(NaN) succeeded, want an error")
+	}
+}
+
+// The pipeline stages share one merged copy of the payload, new derived fields are added to it
+func TestParseWithDerived(t *testing.T) {
+	s := &mqttClient{logger: logging.NewTestLogger(t), payloadType: "json"}
+	msg := &receivedMessage{Message: &injectedMessage{topic: "weld/cell1/data", payload: []byte(`{"current_a": 180}`)}}
+	parsed, err := s.parse(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := s.parseWithDerived(msg)
+	if !reflect.DeepEqual(payload, map[string]interface{}{"current_a": 180.0}) {
+		t.Errorf("payload without derived fields = %v", payload)
+	}
+
+	msg.setDerived("power_w", 3870.0)
+	merged, _ := s.parseWithDerived(msg)
+	want := map[string]interface{}{"current_a": 180.0, "power_w": 3870.0}
+	if !reflect.DeepEqual(merged, want) {
+		t.Errorf("merged payload = %v, want %v", merged, want)
+	}
+	if again, _ := s.parseWithDerived(msg); reflect.ValueOf(again).Pointer() != reflect.ValueOf(merged).Pointer() {
+		t.Error("merged payload copied again")
+	}
+	if len(parsed.(map[string]interface{})) != 1 {
+		t.Errorf("parsed payload modified: %v", parsed)
+	}
+
+	msg.setDerived("power_w_ewma", 3870.0)
+	want["power_w_ewma"] = 3870.0
+	if merged, _ := s.parseWithDerived(msg); !reflect.DeepEqual(merged, want) {
+		t.Errorf("merged payload after a new derived field = %v, want %v", merged, want)
+	}
+}
+
+// Benchmarks of the message path from the MQTT callback to the capture. The queue and capture
+// benchmarks include the ingest of the message.
+
+func newBenchmarkSensor(b *testing.B, cfg *Config) (*mqttClient, []byte) {
+	s := newTestSensor(b, startTestBroker(b), b.Name(), cfg)
+	return s, mqtttest.JSON(b, mqtttest.WeldSample(180, 21.5))
+}
+
+func BenchmarkIngest(b *testing.B) {
+	s, payload := newBenchmarkSensor(b, &Config{Topic: "weld/cell1/data", QueueLength: 1000, PayloadType: "json"})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.onMessage(nil, &injectedMessage{topic: "weld/cell1/data", payload: payload})
+	}
+}
+
+func BenchmarkDataManagerCapture(b *testing.B) {
+	s, payload := newBenchmarkSensor(b, &Config{Topic: "weld/cell1/data", QueueLength: 1000, PayloadType: "json"})
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.onMessage(nil, &injectedMessage{topic: "weld/cell1/data", payload: payload})
+		if _, err := s.Readings(ctx, data.FromDMExtraMap); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDirectCapture(b *testing.B) {
+	s, payload := newBenchmarkSensor(b, &Config{Topic: "weld/cell1/data", QueueLength: 1000, PayloadType: "json", DirectCapture: true, CaptureDir: b.TempDir()})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.onMessage(nil, &injectedMessage{topic: "weld/cell1/data", payload: payload})
+	}
+	b.StopTimer()
+	if dropped := s.metrics.droppedTotal(); dropped != 0 {
+		b.Fatalf("dropped %d messages: %v", dropped, s.metrics.readings())
+	}
+}
+
+func BenchmarkPipeline(b *testing.B) {
+	s, payload := newBenchmarkSensor(b, &Config{
+		Topic:         "weld/cell1/data",
+		QueueLength:   1000,
+		PayloadType:   "json",
+		DerivedFields: []string{"power_w = current_a * voltage_v"},
+		Filters:       []string{"power_w > 0"},
+		RollingStats:  &RollingStatsConfig{Fields: []string{"current_a", "power_w"}},
+		Derivatives:   &DerivativesConfig{Fields: []string{"current_a"}},
+	})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.onMessage(nil, &injectedMessage{topic: "weld/cell1/data", payload: payload})
+	}
+}
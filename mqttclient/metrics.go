@@ -0,0 +1,208 @@
+package mqttclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.viam.com/rdk/logging"
+)
+
+// Reasons a received message is not captured
+type dropReason int
+
+const (
+	dropQueueOverflow dropReason = iota
+	dropTTLExpired
+	dropMessageExpired
+	dropFilterRejected
+	dropParseFailure
+	dropOversize
+	dropCapturePaused
+	dropCaptureFailure
+	dropSampled
+	dropSubscriptionOptions
+	numDropReasons
+)
+
+var dropReasonNames = [numDropReasons]string{
+	"queue_overflow", "ttl_expired", "message_expired", "filter_rejected", "parse_failure", "oversize", "capture_paused", "capture_failure", "sampled", "subscription_options",
+}
+
+// Counters and gauges of a client component, exposed through DoCommand and the Prometheus endpoint
+type clientMetrics struct {
+	received       atomic.Uint64
+	dropped        [numDropReasons]atomic.Uint64
+	parseFailures  atomic.Uint64
+	connects       atomic.Uint64
+	watchdogResets atomic.Uint64
+	queueDepth     func() int
+	handoffDepth   func() int
+}
+
+// Count a dropped message
+func (m *clientMetrics) drop(reason dropReason) {
+	m.dropped[reason].Add(1)
+}
+
+// Messages dropped for any reason
+func (m *clientMetrics) droppedTotal() uint64 {
+	var total uint64
+	for i := range m.dropped {
+		total += m.dropped[i].Load()
+	}
+	return total
+}
+
+// Return the metrics as a DoCommand response
+func (m *clientMetrics) readings() map[string]interface{} {
+	drops := map[string]interface{}{}
+	for reason, name := range dropReasonNames {
+		drops[name] = m.dropped[reason].Load()
+	}
+	readings := map[string]interface{}{
+		"received":        m.received.Load(),
+		"dropped":         m.droppedTotal(),
+		"drops":           drops,
+		"parse_failures":  m.parseFailures.Load(),
+		"reconnects":      m.reconnects(),
+		"watchdog_resets": m.watchdogResets.Load(),
+	}
+	if m.queueDepth != nil {
+		readings["queue_depth"] = m.queueDepth()
+	}
+	if m.handoffDepth != nil {
+		readings["handoff_depth"] = m.handoffDepth()
+	}
+	return readings
+}
+
+// Connections after the first one
+func (m *clientMetrics) reconnects() uint64 {
+	if connects := m.connects.Load(); connects > 1 {
+		return connects - 1
+	}
+	return 0
+}
+
+// Metrics of all client components of the module by resource name
+var metricsRegistry = struct {
+	clients map[string]*clientMetrics
+	mutex   sync.Mutex
+}{clients: map[string]*clientMetrics{}}
+
+func registerMetrics(name string, m *clientMetrics) {
+	metricsRegistry.mutex.Lock()
+	defer metricsRegistry.mutex.Unlock()
+	metricsRegistry.clients[name] = m
+}
+
+func unregisterMetrics(name string, m *clientMetrics) {
+	metricsRegistry.mutex.Lock()
+	defer metricsRegistry.mutex.Unlock()
+	if metricsRegistry.clients[name] == m {
+		delete(metricsRegistry.clients, name)
+	}
+}
+
+// Sample of a Prometheus metric with its additional labels
+type prometheusSample struct {
+	labels string
+	value  float64
+}
+
+func singleSample(v float64) []prometheusSample {
+	return []prometheusSample{{value: v}}
+}
+
+// Prometheus metric families in exposition order
+var prometheusMetrics = []struct {
+	name, help, kind string
+	samples          func(m *clientMetrics) []prometheusSample
+}{
+	{"mqtt_messages_received_total", "Messages received from the broker.", "counter",
+		func(m *clientMetrics) []prometheusSample { return singleSample(float64(m.received.Load())) }},
+	{"mqtt_messages_dropped_total", "Messages not captured by reason.", "counter",
+		func(m *clientMetrics) []prometheusSample {
+			samples := make([]prometheusSample, numDropReasons)
+			for reason, name := range dropReasonNames {
+				samples[reason] = prometheusSample{fmt.Sprintf(",reason=%q", name), float64(m.dropped[reason].Load())}
+			}
+			return samples
+		}},
+	{"mqtt_parse_failures_total", "Messages whose payload could not be parsed.", "counter",
+		func(m *clientMetrics) []prometheusSample { return singleSample(float64(m.parseFailures.Load())) }},
+	{"mqtt_reconnects_total", "Connections to the broker after the first one.", "counter",
+		func(m *clientMetrics) []prometheusSample { return singleSample(float64(m.reconnects())) }},
+	{"mqtt_watchdog_resets_total", "Reconnects forced by the silent stall watchdog.", "counter",
+		func(m *clientMetrics) []prometheusSample { return singleSample(float64(m.watchdogResets.Load())) }},
+	{"mqtt_queue_depth", "Messages queued for data capture.", "gauge",
+		func(m *clientMetrics) []prometheusSample {
+			if m.queueDepth == nil {
+				return singleSample(0)
+			}
+			return singleSample(float64(m.queueDepth()))
+		}},
+	{"mqtt_handoff_depth", "Messages waiting between the MQTT callback and the processing.", "gauge",
+		func(m *clientMetrics) []prometheusSample {
+			if m.handoffDepth == nil {
+				return singleSample(0)
+			}
+			return singleSample(float64(m.handoffDepth()))
+		}},
+}
+
+// Write the metrics of all clients in the Prometheus text format
+func writePrometheusMetrics(w http.ResponseWriter, r *http.Request) {
+	metricsRegistry.mutex.Lock()
+	names := sortedKeys(metricsRegistry.clients)
+	clients := make([]*clientMetrics, len(names))
+	for i, name := range names {
+		clients[i] = metricsRegistry.clients[name]
+	}
+	metricsRegistry.mutex.Unlock()
+
+	var b strings.Builder
+	for _, metric := range prometheusMetrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		for i, name := range names {
+			for _, sample := range metric.samples(clients[i]) {
+				fmt.Fprintf(&b, "%s{resource=%q%s} %g\n", metric.name, name, sample.labels, sample.value)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = w.Write([]byte(b.String()))
+}
+
+// Serve the metrics of all client components on /metrics until the context is done. Nothing is served
+// if the address is empty.
+func ServeMetrics(ctx context.Context, address string, logger logging.Logger) error {
+	if address == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("error starting metrics listener: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", writePrometheusMetrics)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Errorf("metrics server stopped: %v", err)
+		}
+	}()
+	logger.Infof("serving Prometheus metrics on %s/metrics", listener.Addr())
+	return nil
+}
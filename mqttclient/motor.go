@@ -0,0 +1,273 @@
+package mqttclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.viam.com/rdk/components/motor"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+)
+
+// Motor model publishing setpoints to a command topic, e.g. for positioners and turn tables
+var MotorModel = resource.NewModel("lab101", "mqtt", "motor")
+
+// Default position tolerance in revolutions when waiting for GoFor and GoTo
+const defaultPositionTolerance = 0.01
+
+func init() {
+	resource.RegisterComponent(motor.API, MotorModel,
+		resource.Registration[motor.Motor, *MotorConfig]{Constructor: newMotor})
+}
+
+// Maps JSON motor configuration attributes.
+type MotorConfig struct {
+	BrokerConfig  `json:",squash"`
+	CommandTopic  string  `json:"command_topic"`  // Topic the setpoints are published to
+	PositionTopic string  `json:"position_topic"` // Optional topic with the position feedback in revolutions
+	PositionField string  `json:"position_field"` // JSON payload field with the position, the payload is a number if empty
+	QoS           int     `json:"qos"`
+	Tolerance     float64 `json:"tolerance"` // Position tolerance in revolutions, default 0.01
+}
+
+// Implement motor configuration validation and return implicit dependencies.
+func (cfg *MotorConfig) Validate(path string) ([]string, error) {
+	if cfg.CommandTopic == "" {
+		return nil, fmt.Errorf("command_topic is required %q", path)
+	}
+	if err := cfg.BrokerConfig.Validate(path); err != nil {
+		return nil, err
+	}
+	if cfg.QoS < 0 || cfg.QoS > 2 {
+		return nil, fmt.Errorf("qos must be between 0 and 2 %q", path)
+	}
+	if cfg.Tolerance < 0 {
+		return nil, fmt.Errorf("tolerance must be >= 0 %q", path)
+	}
+	return []string{}, nil
+}
+
+type mqttMotor struct {
+	resource.Named
+	resource.AlwaysRebuild
+	logger    logging.Logger
+	client    mqtt.Client
+	cfg       *MotorConfig
+	tolerance float64
+	position  float64 // Last reported raw position
+	hasPos    bool
+	zero      float64 // Raw position of the zero position
+	power     float64
+	moving    bool
+	op        uint64 // Incremented by every command to end pending moves
+	mutex     sync.Mutex
+}
+
+// Motor constructor, the motor is rebuilt on reconfiguration
+func newMotor(ctx context.Context, deps resource.Dependencies, conf resource.Config, logger logging.Logger) (motor.Motor, error) {
+	motorConfig, err := resource.NativeConfig[*MotorConfig](conf)
+	if err != nil {
+		return nil, err
+	}
+	m := &mqttMotor{
+		Named:     conf.ResourceName().AsNamed(),
+		logger:    logger,
+		cfg:       motorConfig,
+		tolerance: motorConfig.Tolerance,
+	}
+	if m.tolerance == 0 {
+		m.tolerance = defaultPositionTolerance
+	}
+	if motorConfig.PositionTopic != "" {
+		m.client, err = motorConfig.connectAndSubscribe(ctx, motorConfig.PositionTopic, byte(motorConfig.QoS), m.onPosition)
+	} else {
+		m.client, err = motorConfig.connect(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error initializing mqtt motor: %v", err)
+	}
+	return m, nil
+}
+
+// Update the position from a feedback message
+func (m *mqttMotor) onPosition(client mqtt.Client, msg mqtt.Message) {
+	var v interface{} = string(msg.Payload())
+	if m.cfg.PositionField != "" {
+		var payload interface{}
+		if err := json.Unmarshal(msg.Payload(), &payload); err != nil {
+			m.logger.Debugf("invalid position payload: %v", err)
+			return
+		}
+		var ok bool
+		if v, ok = lookupField(payload, m.cfg.PositionField); !ok {
+			return
+		}
+	}
+	position, ok := toFloat(v)
+	if !ok {
+		m.logger.Debugf("non numeric position %v", v)
+		return
+	}
+	m.mutex.Lock()
+	m.position = position
+	m.hasPos = true
+	m.mutex.Unlock()
+}
+
+// Publish a setpoint and start a new operation, ending pending moves
+func (m *mqttMotor) command(ctx context.Context, setpoint map[string]interface{}, power float64, moving bool) (uint64, error) {
+	payload, err := json.Marshal(setpoint)
+	if err != nil {
+		return 0, err
+	}
+	if err := publishAndWait(ctx, m.client, m.cfg.CommandTopic, byte(m.cfg.QoS), false, payload); err != nil {
+		return 0, err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.op++
+	m.power = power
+	m.moving = moving
+	return m.op, nil
+}
+
+// Wait until the position is within the tolerance of the raw target, the context is done or
+// another command is issued
+func (m *mqttMotor) waitForPosition(ctx context.Context, op uint64, target float64) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		m.mutex.Lock()
+		if m.op != op {
+			m.mutex.Unlock()
+			return nil
+		}
+		if m.hasPos && math.Abs(m.position-target) <= m.tolerance {
+			m.moving = false
+			m.power = 0
+			m.mutex.Unlock()
+			return nil
+		}
+		m.mutex.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Publish a power setpoint between -1 and 1
+func (m *mqttMotor) SetPower(ctx context.Context, powerPct float64, extra map[string]interface{}) error {
+	powerPct = math.Max(-1, math.Min(1, powerPct))
+	_, err := m.command(ctx, map[string]interface{}{"command": "set_power", "power": powerPct}, powerPct, powerPct != 0)
+	return err
+}
+
+// Publish a relative move setpoint and wait until the target position is reached. With zero
+// revolutions the motor runs at the given speed until stopped.
+func (m *mqttMotor) GoFor(ctx context.Context, rpm, revolutions float64, extra map[string]interface{}) error {
+	if math.Abs(rpm) < 0.1 {
+		return motor.NewZeroRPMError()
+	}
+	if revolutions == 0 {
+		return m.SetRPM(ctx, rpm, extra)
+	}
+	// Negative rpm or revolutions move backwards, both negative move forward
+	revolutions = math.Abs(revolutions) * math.Copysign(1, rpm*revolutions)
+	m.mutex.Lock()
+	hasPos, target := m.hasPos, m.position+revolutions
+	m.mutex.Unlock()
+	setpoint := map[string]interface{}{"command": "go_for", "rpm": math.Abs(rpm), "revolutions": revolutions}
+	if hasPos {
+		setpoint["position"] = target
+	}
+	op, err := m.command(ctx, setpoint, math.Copysign(1, revolutions), true)
+	if err != nil || !hasPos {
+		return err
+	}
+	return m.waitForPosition(ctx, op, target)
+}
+
+// Publish an absolute move setpoint and wait until the position is reached
+func (m *mqttMotor) GoTo(ctx context.Context, rpm, positionRevolutions float64, extra map[string]interface{}) error {
+	if m.cfg.PositionTopic == "" {
+		return motor.NewGoToUnsupportedError(m.Name().ShortName())
+	}
+	m.mutex.Lock()
+	target := positionRevolutions + m.zero
+	m.mutex.Unlock()
+	op, err := m.command(ctx, map[string]interface{}{"command": "go_to", "rpm": math.Abs(rpm), "position": target}, 1, true)
+	if err != nil {
+		return err
+	}
+	return m.waitForPosition(ctx, op, target)
+}
+
+// Publish a speed setpoint, the motor runs until stopped
+func (m *mqttMotor) SetRPM(ctx context.Context, rpm float64, extra map[string]interface{}) error {
+	_, err := m.command(ctx, map[string]interface{}{"command": "set_rpm", "rpm": rpm}, math.Copysign(1, rpm), rpm != 0)
+	return err
+}
+
+// Set the current position to the offset, positions are published relative to the raw feedback
+func (m *mqttMotor) ResetZeroPosition(ctx context.Context, offset float64, extra map[string]interface{}) error {
+	if m.cfg.PositionTopic == "" {
+		return motor.NewPropertyUnsupportedError(motor.Properties{}, m.Name().ShortName())
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.zero = m.position - offset
+	return nil
+}
+
+// Return the position in revolutions relative to the zero position
+func (m *mqttMotor) Position(ctx context.Context, extra map[string]interface{}) (float64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.position - m.zero, nil
+}
+
+// Position reporting requires a position topic
+func (m *mqttMotor) Properties(ctx context.Context, extra map[string]interface{}) (motor.Properties, error) {
+	return motor.Properties{PositionReporting: m.cfg.PositionTopic != ""}, nil
+}
+
+// Return whether the motor is powered and the last power setpoint
+func (m *mqttMotor) IsPowered(ctx context.Context, extra map[string]interface{}) (bool, float64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.power != 0, m.power, nil
+}
+
+// Return whether a setpoint is active
+func (m *mqttMotor) IsMoving(ctx context.Context) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.moving, nil
+}
+
+// Publish a stop setpoint
+func (m *mqttMotor) Stop(ctx context.Context, extra map[string]interface{}) error {
+	_, err := m.command(ctx, map[string]interface{}{"command": "stop"}, 0, false)
+	return err
+}
+
+// Stop the motor and disconnect from the broker
+func (m *mqttMotor) Close(ctx context.Context) error {
+	if m.client == nil {
+		return nil
+	}
+	if m.client.IsConnected() {
+		if err := m.Stop(ctx, nil); err != nil {
+			m.logger.Warnf("error stopping motor: %v", err)
+		}
+	}
+	m.client.Disconnect(250) // Timeout in milliseconds
+	return nil
+}
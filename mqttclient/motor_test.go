@@ -0,0 +1,163 @@
+package mqttclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.viam.com/rdk/components/motor"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+
+	"github.com/lab101/mqtt-welding/internal/mqtttest"
+)
+
+// Create a motor with position feedback, it is closed when the test ends. The positioner answers
+// every setpoint with a target position by reporting that position, the setpoints are returned.
+func newTestMotor(t *testing.T, b *mqtttest.Broker, name string, start float64) (*mqttMotor, <-chan map[string]interface{}) {
+	t.Helper()
+	cfg := &MotorConfig{
+		BrokerConfig:  BrokerConfig{Host: b.Host, Port: b.Port, ClientID: name},
+		CommandTopic:  name + "/cmd",
+		PositionTopic: name + "/position",
+		QoS:           1,
+	}
+	setpoints := make(chan map[string]interface{}, 10)
+	positioner := b.Client(t, name+"-positioner")
+	token := positioner.Subscribe(cfg.CommandTopic, 1, func(client mqtt.Client, m mqtt.Message) {
+		var setpoint map[string]interface{}
+		if err := json.Unmarshal(m.Payload(), &setpoint); err != nil {
+			t.Errorf("invalid setpoint %q", m.Payload())
+			return
+		}
+		setpoints <- setpoint
+		if position, ok := setpoint["position"]; ok {
+			client.Publish(cfg.PositionTopic, 1, false, fmt.Sprint(position))
+		}
+	})
+	if !token.WaitTimeout(mqtttest.Timeout) || token.Error() != nil {
+		t.Fatalf("subscribing the positioner: %v", token.Error())
+	}
+
+	conf := resource.Config{Name: name, API: motor.API, Model: MotorModel, ConvertedAttributes: cfg}
+	res, err := newMotor(context.Background(), nil, conf, logging.NewTestLogger(t))
+	if err != nil {
+		t.Fatalf("creating motor: %v", err)
+	}
+	m := res.(*mqttMotor)
+	t.Cleanup(func() { m.Close(context.Background()) })
+	mqtttest.Publish(t, positioner, cfg.PositionTopic, fmt.Sprint(start), false)
+	mqtttest.Eventually(t, func() bool {
+		pos, _ := m.Position(context.Background(), nil)
+		return pos == start
+	}, "start position not received")
+	return m, setpoints
+}
+
+func TestMotorMoves(t *testing.T) {
+	b := startTestBroker(t)
+	tests := []struct {
+		name     string
+		zero     float64 // Offset of the current position set by ResetZeroPosition, 0 keeps the raw position
+		move     func(ctx context.Context, m *mqttMotor) error
+		setpoint map[string]interface{}
+		position float64 // Position after the move relative to the zero position
+		moving   bool
+	}{
+		{
+			name:     "go for forward",
+			move:     func(ctx context.Context, m *mqttMotor) error { return m.GoFor(ctx, 10, 2, nil) },
+			setpoint: map[string]interface{}{"command": "go_for", "rpm": 10.0, "revolutions": 2.0, "position": 7.0},
+			position: 7,
+		},
+		{
+			name:     "go for backward with negative rpm",
+			move:     func(ctx context.Context, m *mqttMotor) error { return m.GoFor(ctx, -10, 2, nil) },
+			setpoint: map[string]interface{}{"command": "go_for", "rpm": 10.0, "revolutions": -2.0, "position": 3.0},
+			position: 3,
+		},
+		{
+			name:     "go for backward with negative revolutions",
+			move:     func(ctx context.Context, m *mqttMotor) error { return m.GoFor(ctx, 10, -2, nil) },
+			setpoint: map[string]interface{}{"command": "go_for", "rpm": 10.0, "revolutions": -2.0, "position": 3.0},
+			position: 3,
+		},
+		{
+			name:     "go for forward with both negative",
+			move:     func(ctx context.Context, m *mqttMotor) error { return m.GoFor(ctx, -10, -2, nil) },
+			setpoint: map[string]interface{}{"command": "go_for", "rpm": 10.0, "revolutions": 2.0, "position": 7.0},
+			position: 7,
+		},
+		{
+			name:     "go for without revolutions runs",
+			move:     func(ctx context.Context, m *mqttMotor) error { return m.GoFor(ctx, -30, 0, nil) },
+			setpoint: map[string]interface{}{"command": "set_rpm", "rpm": -30.0},
+			position: 5, moving: true,
+		},
+		{
+			name:     "go to",
+			move:     func(ctx context.Context, m *mqttMotor) error { return m.GoTo(ctx, -20, 8, nil) },
+			setpoint: map[string]interface{}{"command": "go_to", "rpm": 20.0, "position": 8.0},
+			position: 8,
+		},
+		{
+			name:     "go to relative to the zero position",
+			zero:     1,
+			move:     func(ctx context.Context, m *mqttMotor) error { return m.GoTo(ctx, 20, 3, nil) },
+			setpoint: map[string]interface{}{"command": "go_to", "rpm": 20.0, "position": 7.0},
+			position: 3,
+		},
+		{
+			name:     "power is limited",
+			move:     func(ctx context.Context, m *mqttMotor) error { return m.SetPower(ctx, 1.5, nil) },
+			setpoint: map[string]interface{}{"command": "set_power", "power": 1.0},
+			position: 5, moving: true,
+		},
+		{
+			name:     "stop",
+			move:     func(ctx context.Context, m *mqttMotor) error { return m.Stop(ctx, nil) },
+			setpoint: map[string]interface{}{"command": "stop"},
+			position: 5,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, setpoints := newTestMotor(t, b, fmt.Sprintf("motor%d", i), 5)
+			ctx, cancel := context.WithTimeout(context.Background(), mqtttest.Timeout)
+			defer cancel()
+			if tt.zero != 0 {
+				if err := m.ResetZeroPosition(ctx, tt.zero, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tt.move(ctx, m); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case setpoint := <-setpoints:
+				if !reflect.DeepEqual(setpoint, tt.setpoint) {
+					t.Errorf("setpoint %v, want %v", setpoint, tt.setpoint)
+				}
+			case <-ctx.Done():
+				t.Fatal("no setpoint published")
+			}
+			if pos, _ := m.Position(ctx, nil); math.Abs(pos-tt.position) > defaultPositionTolerance {
+				t.Errorf("position %v, want %v", pos, tt.position)
+			}
+			if moving, _ := m.IsMoving(ctx); moving != tt.moving {
+				t.Errorf("moving %v, want %v", moving, tt.moving)
+			}
+		})
+	}
+}
+
+func TestMotorGoForZeroRPM(t *testing.T) {
+	m := &mqttMotor{cfg: &MotorConfig{}}
+	if err := m.GoFor(context.Background(), 0.05, 1, nil); err == nil {
+		t.Error("GoFor with zero rpm succeeded")
+	}
+}
@@ -0,0 +1,281 @@
+package mqttclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/golang/geo/r3"
+	geo "github.com/kellydunn/golang-geo"
+	"go.viam.com/rdk/components/movementsensor"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+	"go.viam.com/rdk/spatialmath"
+)
+
+// Movement sensor model fed by NMEA or JSON position and orientation messages
+var MovementSensorModel = resource.NewModel("lab101", "mqtt", "movement-sensor")
+
+func init() {
+	resource.RegisterComponent(movementsensor.API, MovementSensorModel,
+		resource.Registration[movementsensor.MovementSensor, *MovementSensorConfig]{Constructor: newMovementSensor})
+}
+
+// Maps JSON movement sensor configuration attributes.
+type MovementSensorConfig struct {
+	BrokerConfig     `json:",squash"`
+	QoS              int    `json:"qos"`
+	PositionTopic    string `json:"position_topic"`    // NMEA GGA/RMC sentences or JSON {"lat", "lng", "alt", "speed", "heading"}
+	OrientationTopic string `json:"orientation_topic"` // JSON {"roll", "pitch", "yaw"} in degrees
+}
+
+// Implement movement sensor configuration validation and return implicit dependencies.
+func (cfg *MovementSensorConfig) Validate(path string) ([]string, error) {
+	if cfg.PositionTopic == "" && cfg.OrientationTopic == "" {
+		return nil, fmt.Errorf("position_topic or orientation_topic is required %q", path)
+	}
+	if err := cfg.BrokerConfig.Validate(path); err != nil {
+		return nil, err
+	}
+	if cfg.QoS < 0 || cfg.QoS > 2 {
+		return nil, fmt.Errorf("qos must be between 0 and 2 %q", path)
+	}
+	return []string{}, nil
+}
+
+type mqttMovementSensor struct {
+	resource.Named
+	resource.AlwaysRebuild
+	logger           logging.Logger
+	client           mqtt.Client
+	positionTopic    string
+	orientationTopic string
+	position         *geo.Point
+	altitude         float64
+	velocity         *r3.Vector
+	heading          *float64
+	orientation      *spatialmath.EulerAngles
+	accuracy         *movementsensor.Accuracy
+	mutex            sync.Mutex
+}
+
+// Movement sensor constructor, the sensor is rebuilt on reconfiguration
+func newMovementSensor(ctx context.Context, deps resource.Dependencies, conf resource.Config, logger logging.Logger) (movementsensor.MovementSensor, error) {
+	sensorConfig, err := resource.NativeConfig[*MovementSensorConfig](conf)
+	if err != nil {
+		return nil, err
+	}
+	m := &mqttMovementSensor{
+		Named:            conf.ResourceName().AsNamed(),
+		logger:           logger,
+		positionTopic:    sensorConfig.PositionTopic,
+		orientationTopic: sensorConfig.OrientationTopic,
+	}
+	m.client, err = sensorConfig.connect(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing mqtt movement sensor: %v", err)
+	}
+	filters := map[string]byte{}
+	for _, topic := range []string{m.positionTopic, m.orientationTopic} {
+		if topic != "" {
+			filters[topic] = byte(sensorConfig.QoS)
+		}
+	}
+	if err := waitForToken(ctx, m.client.SubscribeMultiple(filters, m.onMessage)); err != nil {
+		m.client.Disconnect(250)
+		return nil, fmt.Errorf("error initializing mqtt movement sensor: %v", err)
+	}
+	return m, nil
+}
+
+// Update the movement data from a NMEA or JSON message
+func (m *mqttMovementSensor) onMessage(client mqtt.Client, msg mqtt.Message) {
+	payload := strings.TrimSpace(string(msg.Payload()))
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if strings.HasPrefix(payload, "$") {
+		for _, sentence := range strings.Split(payload, "\n") {
+			fix, err := parseNMEA(sentence)
+			if err != nil {
+				m.logger.Debugf("dropped NMEA sentence: %v", err)
+				continue
+			}
+			m.updateFromNMEA(fix)
+		}
+		return
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(payload), &fields); err != nil {
+		m.logger.Debugf("error parsing JSON message: %v", err)
+		return
+	}
+	m.updateFromJSON(fields)
+}
+
+func (m *mqttMovementSensor) updateFromNMEA(fix nmeaFix) {
+	if fix.hasPos {
+		m.position = geo.NewPoint(fix.lat, fix.lng)
+	}
+	if fix.alt != nil {
+		m.altitude = *fix.alt
+	}
+	if fix.speed != nil {
+		// Like the Viam GPS models the speed over ground is reported along the Y axis
+		m.velocity = &r3.Vector{Y: *fix.speed}
+	}
+	if fix.course != nil {
+		m.heading = fix.course
+	}
+	if fix.quality != nil || fix.hdop != nil {
+		if m.accuracy == nil {
+			m.accuracy = &movementsensor.Accuracy{}
+		}
+		if fix.quality != nil {
+			m.accuracy.NmeaFix = *fix.quality
+		}
+		if fix.hdop != nil {
+			m.accuracy.Hdop = float32(*fix.hdop)
+		}
+	}
+}
+
+func (m *mqttMovementSensor) updateFromJSON(fields map[string]interface{}) {
+	lat, hasLat := firstNumber(fields, "lat", "latitude")
+	lng, hasLng := firstNumber(fields, "lng", "lon", "longitude")
+	if hasLat && hasLng {
+		m.position = geo.NewPoint(lat, lng)
+	}
+	if alt, ok := firstNumber(fields, "alt", "altitude"); ok {
+		m.altitude = alt
+	}
+	if speed, ok := firstNumber(fields, "speed"); ok {
+		m.velocity = &r3.Vector{Y: speed}
+	}
+	if v, ok := fields["linear_velocity"].(map[string]interface{}); ok {
+		x, _ := firstNumber(v, "x")
+		y, _ := firstNumber(v, "y")
+		z, _ := firstNumber(v, "z")
+		m.velocity = &r3.Vector{X: x, Y: y, Z: z}
+	}
+	if heading, ok := firstNumber(fields, "heading", "course"); ok {
+		m.heading = &heading
+	}
+	roll, hasRoll := firstNumber(fields, "roll")
+	pitch, hasPitch := firstNumber(fields, "pitch")
+	yaw, hasYaw := firstNumber(fields, "yaw")
+	if hasRoll || hasPitch || hasYaw {
+		m.orientation = &spatialmath.EulerAngles{
+			Roll:  roll * math.Pi / 180,
+			Pitch: pitch * math.Pi / 180,
+			Yaw:   yaw * math.Pi / 180,
+		}
+	}
+}
+
+// Return the first numeric field found
+func firstNumber(fields map[string]interface{}, keys ...string) (float64, bool) {
+	for _, key := range keys {
+		if v, ok := fields[key]; ok {
+			if f, ok := toFloat(v); ok {
+				return f, true
+			}
+		}
+	}
+	return 0, false
+}
+
+var errNoMovementData = errors.New("no data received yet")
+
+func (m *mqttMovementSensor) Position(ctx context.Context, extra map[string]interface{}) (*geo.Point, float64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.positionTopic == "" {
+		return nil, 0, movementsensor.ErrMethodUnimplementedPosition
+	}
+	if m.position == nil {
+		return nil, 0, errNoMovementData
+	}
+	return m.position, m.altitude, nil
+}
+
+func (m *mqttMovementSensor) LinearVelocity(ctx context.Context, extra map[string]interface{}) (r3.Vector, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.positionTopic == "" {
+		return r3.Vector{}, movementsensor.ErrMethodUnimplementedLinearVelocity
+	}
+	if m.velocity == nil {
+		return r3.Vector{}, errNoMovementData
+	}
+	return *m.velocity, nil
+}
+
+func (m *mqttMovementSensor) AngularVelocity(ctx context.Context, extra map[string]interface{}) (spatialmath.AngularVelocity, error) {
+	return spatialmath.AngularVelocity{}, movementsensor.ErrMethodUnimplementedAngularVelocity
+}
+
+func (m *mqttMovementSensor) LinearAcceleration(ctx context.Context, extra map[string]interface{}) (r3.Vector, error) {
+	return r3.Vector{}, movementsensor.ErrMethodUnimplementedLinearAcceleration
+}
+
+// Compass heading from the position course, or the orientation yaw if there is no course
+func (m *mqttMovementSensor) CompassHeading(ctx context.Context, extra map[string]interface{}) (float64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.heading != nil {
+		return math.Mod(*m.heading+360, 360), nil
+	}
+	if m.orientation != nil {
+		return math.Mod(m.orientation.Yaw*180/math.Pi+360, 360), nil
+	}
+	return 0, errNoMovementData
+}
+
+func (m *mqttMovementSensor) Orientation(ctx context.Context, extra map[string]interface{}) (spatialmath.Orientation, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.orientationTopic == "" {
+		return nil, movementsensor.ErrMethodUnimplementedOrientation
+	}
+	if m.orientation == nil {
+		return nil, errNoMovementData
+	}
+	return m.orientation, nil
+}
+
+func (m *mqttMovementSensor) Properties(ctx context.Context, extra map[string]interface{}) (*movementsensor.Properties, error) {
+	return &movementsensor.Properties{
+		PositionSupported:       m.positionTopic != "",
+		LinearVelocitySupported: m.positionTopic != "",
+		CompassHeadingSupported: true,
+		OrientationSupported:    m.orientationTopic != "",
+	}, nil
+}
+
+// Accuracy from the NMEA GGA fix quality and HDOP
+func (m *mqttMovementSensor) Accuracy(ctx context.Context, extra map[string]interface{}) (*movementsensor.Accuracy, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.accuracy == nil {
+		return nil, movementsensor.ErrMethodUnimplementedAccuracy
+	}
+	accuracy := *m.accuracy
+	return &accuracy, nil
+}
+
+func (m *mqttMovementSensor) Readings(ctx context.Context, extra map[string]interface{}) (map[string]interface{}, error) {
+	return movementsensor.DefaultAPIReadings(ctx, m, extra)
+}
+
+// Disconnect from the broker
+func (m *mqttMovementSensor) Close(ctx context.Context) error {
+	if m.client != nil {
+		m.client.Disconnect(250) // Timeout in milliseconds
+	}
+	return nil
+}
@@ -0,0 +1,656 @@
+package mqttclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.golang/paho/session/state"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Protocol versions of the broker connections, the protocol level of the CONNECT packet
+const (
+	protocolMQTT311 = 4
+	protocolMQTT5   = 5
+)
+
+// An MQTT 5 broker connection behind the client interface of the MQTT 3.1.1 library, so the models and the
+// shared connections use both protocol versions the same way. The connection is configured with the 3.1.1
+// client options: broker, credentials, TLS, clean session, last will, ordering, automatic reconnects and the
+// connection handlers. The file store and the websocket options are not supported.
+type mqtt5Client struct {
+	opts          mqtt.ClientOptions
+	aliasMaximum  uint16                         // Topic aliases the broker may use, and the most this client uses
+	receiveMax    uint16                         // QoS 1 and 2 messages the broker may send unacknowledged, 0 for the default
+	sessionExpiry uint32                         // Seconds the broker keeps the session after the connection is lost
+	willDelay     uint32                         // Seconds the broker waits before it publishes the last will
+	session       *state.State                   // Kept across reconnects, a persistent session sends the unacknowledged messages again
+	routes        map[string]mqtt.MessageHandler // Handlers by topic filter
+	conn          *paho.Client                   // Nil while not connected
+	netConn       net.Conn                       // Network connection of conn, written by the publishes
+	aliases       *outboundAliases               // Topic aliases of the publishes written to netConn
+	dropped       chan struct{}                  // Closed when the unacknowledged publishes are dropped from the session
+	retry         bool                           // Set while the connection attempts are retried
+	started       bool
+	ctx           context.Context // Done once disconnected
+	cancel        context.CancelFunc
+	done          chan struct{} // Closed when the connection goroutine returned
+	mutex         sync.Mutex
+	send          sync.Mutex // Publishes are added to the session and written in order
+}
+
+func newMQTT5Client(cfg *BrokerConfig, opts *mqtt.ClientOptions) *mqtt5Client {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &mqtt5Client{
+		opts:          *opts,
+		aliasMaximum:  uint16(cfg.TopicAliasMaximum),
+		receiveMax:    uint16(cfg.ReceiveMaximum),
+		sessionExpiry: uint32(math.Ceil(cfg.SessionExpiry)),
+		willDelay:     uint32(math.Ceil(cfg.WillDelay)),
+		session:       state.NewInMemory(),
+		routes:        map[string]mqtt.MessageHandler{},
+		dropped:       make(chan struct{}),
+		ctx:           ctx,
+		cancel:        cancel,
+		done:          make(chan struct{}),
+	}
+}
+
+// The topic aliases of the publishes sent on one connection, the aliases of a connection are not known on the
+// next one. Used with the send mutex held.
+type outboundAliases struct {
+	maximum uint16
+	topics  map[string]uint16
+}
+
+func newOutboundAliases(maximum uint16) *outboundAliases {
+	return &outboundAliases{maximum: maximum, topics: map[string]uint16{}}
+}
+
+// Replace the topic of a publish by its alias. The first publish of a topic sends both to set the alias, the
+// topics are sent in full once all aliases are assigned.
+func (a *outboundAliases) apply(pb *packets.Publish) {
+	alias, known := a.topics[pb.Topic]
+	if !known {
+		if len(a.topics) >= int(a.maximum) {
+			return
+		}
+		alias = uint16(len(a.topics) + 1)
+		a.topics[pb.Topic] = alias
+	}
+	if pb.Properties == nil {
+		pb.Properties = &packets.Properties{}
+	}
+	pb.Properties.TopicAlias = &alias
+	if known {
+		pb.Topic = ""
+	}
+}
+
+// A refused MQTT 5 connection with the reason code of the CONNACK
+type connectRefusedError struct {
+	code byte
+}
+
+func (e *connectRefusedError) reason() string {
+	return (&packets.Connack{ReasonCode: e.code}).Reason()
+}
+
+func (e *connectRefusedError) Error() string {
+	return fmt.Sprintf("connection refused: %s", e.reason())
+}
+
+// The token of an operation of an MQTT 5 connection
+type mqtt5Token struct {
+	done           chan struct{}
+	err            error
+	sessionPresent bool            // The broker had a session for the client when it connected
+	granted        map[string]byte // Granted QoS by topic filter of a subscription, rejected filters have 0x80
+}
+
+func newMQTT5Token() *mqtt5Token {
+	return &mqtt5Token{done: make(chan struct{})}
+}
+
+func (t *mqtt5Token) complete(err error) {
+	t.err = err
+	close(t.done)
+}
+
+func (t *mqtt5Token) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *mqtt5Token) WaitTimeout(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-t.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (t *mqtt5Token) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *mqtt5Token) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+// A message received over an MQTT 5 connection, with its properties
+type mqtt5Message struct {
+	publish *paho.Publish
+}
+
+func (m *mqtt5Message) Duplicate() bool   { return m.publish.Duplicate() }
+func (m *mqtt5Message) Qos() byte         { return m.publish.QoS }
+func (m *mqtt5Message) Retained() bool    { return m.publish.Retain }
+func (m *mqtt5Message) Topic() string     { return m.publish.Topic }
+func (m *mqtt5Message) MessageID() uint16 { return m.publish.PacketID }
+func (m *mqtt5Message) Payload() []byte   { return m.publish.Payload }
+
+// The message is acknowledged by the connection once the handlers returned
+func (m *mqtt5Message) Ack() {}
+
+// The MQTT 5 user properties of a message by key, nil without user properties and for MQTT 3.1.1 messages.
+// A key set several times has the list of its values.
+func userProperties(m mqtt.Message) map[string]interface{} {
+	msg, ok := m.(*mqtt5Message)
+	if !ok || msg.publish.Properties == nil || len(msg.publish.Properties.User) == 0 {
+		return nil
+	}
+	props := map[string]interface{}{}
+	for _, p := range msg.publish.Properties.User {
+		switch v := props[p.Key].(type) {
+		case nil:
+			props[p.Key] = p.Value
+		case string:
+			props[p.Key] = []interface{}{v, p.Value}
+		case []interface{}:
+			props[p.Key] = append(v, p.Value)
+		}
+	}
+	return props
+}
+
+// The first value of an MQTT 5 user property of a message
+func userProperty(m mqtt.Message, key string) (string, bool) {
+	msg, ok := m.(*mqtt5Message)
+	if !ok || msg.publish.Properties == nil {
+		return "", false
+	}
+	for _, p := range msg.publish.Properties.User {
+		if p.Key == key {
+			return p.Value, true
+		}
+	}
+	return "", false
+}
+
+// The MQTT 5 message expiry interval of a message, false without expiry and for MQTT 3.1.1 messages. The broker
+// already deducted the time the message waited for delivery.
+func messageExpiry(m mqtt.Message) (time.Duration, bool) {
+	msg, ok := m.(*mqtt5Message)
+	if !ok || msg.publish.Properties == nil || msg.publish.Properties.MessageExpiry == nil {
+		return 0, false
+	}
+	return time.Duration(*msg.publish.Properties.MessageExpiry) * time.Second, true
+}
+
+// Connect in the background, the token completes with the first connection or with the error of the first
+// attempt if the attempts are not retried
+func (c *mqtt5Client) Connect() mqtt.Token {
+	token := newMQTT5Token()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.started {
+		token.complete(errors.New("already connected"))
+		return token
+	}
+	c.started = true
+	c.retry = c.opts.ConnectRetry
+	go c.run(token)
+	return token
+}
+
+// Connect and reconnect until Disconnect is called
+func (c *mqtt5Client) run(token *mqtt5Token) {
+	defer close(c.done)
+	defer c.setRetry(false)
+	var delay time.Duration
+	for connects := 0; ; {
+		if connects > 0 && c.opts.OnReconnecting != nil {
+			c.opts.OnReconnecting(c, &c.opts)
+		}
+		lost, sessionPresent, err := c.attempt(connects > 0)
+		if err != nil {
+			if connects == 0 && !c.opts.ConnectRetry {
+				token.complete(err)
+				return
+			}
+			// The first connection is retried at the retry interval, reconnects back off up to the maximum interval
+			if connects == 0 {
+				delay = c.opts.ConnectRetryInterval
+			} else {
+				delay = min(max(2*delay, time.Second), c.opts.MaxReconnectInterval)
+			}
+			select {
+			case <-time.After(delay):
+				continue
+			case <-c.ctx.Done():
+				if connects == 0 {
+					token.complete(err)
+				}
+				return
+			}
+		}
+		if connects == 0 {
+			token.sessionPresent = sessionPresent
+			token.complete(nil)
+			c.setRetry(c.opts.AutoReconnect)
+		}
+		connects++
+		delay = 0
+		if c.opts.OnConnect != nil {
+			go c.opts.OnConnect(c)
+		}
+
+		select {
+		case err = <-lost:
+		case <-c.ctx.Done():
+			return
+		}
+		c.mutex.Lock()
+		c.conn, c.netConn, c.aliases = nil, nil, nil
+		c.mutex.Unlock()
+		if c.opts.CleanSession && c.sessionExpiry == 0 {
+			// The session ends with the connection
+			c.dropPending()
+		}
+		if c.opts.OnConnectionLost != nil {
+			go c.opts.OnConnectionLost(c, err)
+		}
+		if !c.opts.AutoReconnect {
+			return
+		}
+	}
+}
+
+// Open the network connection and connect, the returned channel receives the reason once the connection is
+// lost. A reconnect resumes a session which didn't expire. Returns whether the broker had a session for the
+// client.
+func (c *mqtt5Client) attempt(reconnect bool) (<-chan error, bool, error) {
+	server := c.opts.Servers[0]
+	tlsConfig := c.opts.TLSConfig
+	if c.opts.OnConnectAttempt != nil {
+		tlsConfig = c.opts.OnConnectAttempt(server, tlsConfig)
+	}
+	ctx := c.ctx
+	if c.opts.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.ConnectTimeout)
+		defer cancel()
+	}
+	netConn, err := c.dial(ctx, server, tlsConfig)
+	if err != nil {
+		return nil, false, err
+	}
+	// The publishes are written besides the packets of the connection
+	netConn = packets.NewThreadSafeConn(netConn)
+	lost := make(chan error, 1)
+	report := func(err error) {
+		select {
+		case lost <- err:
+		default:
+		}
+	}
+	// The topic aliases of the broker only apply to this connection
+	aliases := map[uint16]string{}
+	conn := paho.NewClient(paho.ClientConfig{
+		Conn:    netConn,
+		Session: c.session,
+		OnPublishReceived: []func(paho.PublishReceived) (bool, error){func(received paho.PublishReceived) (bool, error) {
+			if err := resolveTopicAlias(received.Packet, aliases); err != nil {
+				report(err)
+				return false, err
+			}
+			return c.onPublish(received)
+		}},
+		OnClientError: report,
+		OnServerDisconnect: func(d *paho.Disconnect) {
+			report(fmt.Errorf("disconnected by the broker: %s", (&packets.Disconnect{ReasonCode: d.ReasonCode}).Reason()))
+		},
+	})
+	connack, err := conn.Connect(ctx, c.connectPacket(reconnect))
+	if err != nil {
+		if connack != nil {
+			return nil, false, &connectRefusedError{code: connack.ReasonCode}
+		}
+		return nil, false, err
+	}
+	if !connack.SessionPresent {
+		// The broker has no session, the unacknowledged publishes won't be sent again
+		c.dropPending()
+	}
+	c.mutex.Lock()
+	if c.ctx.Err() != nil {
+		c.mutex.Unlock()
+		conn.Disconnect(&paho.Disconnect{})
+		return nil, false, c.ctx.Err()
+	}
+	c.conn, c.netConn = conn, netConn
+	c.aliases = newOutboundAliases(0)
+	if connack.Properties != nil && connack.Properties.TopicAliasMaximum != nil {
+		c.aliases.maximum = min(c.aliasMaximum, *connack.Properties.TopicAliasMaximum)
+	}
+	c.mutex.Unlock()
+	return lost, connack.SessionPresent, nil
+}
+
+// Open the network connection to the broker, with TLS for ssl:// brokers
+func (c *mqtt5Client) dial(ctx context.Context, server *url.URL, tlsConfig *tls.Config) (net.Conn, error) {
+	if c.opts.CustomOpenConnectionFn != nil {
+		return c.opts.CustomOpenConnectionFn(server, c.opts)
+	}
+	switch server.Scheme {
+	case "tcp", "mqtt":
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", server.Host)
+	case "ssl", "tls", "mqtts":
+		dialer := tls.Dialer{Config: tlsConfig}
+		return dialer.DialContext(ctx, "tcp", server.Host)
+	}
+	return nil, fmt.Errorf("unsupported broker scheme %q", server.Scheme)
+}
+
+// Build the CONNECT packet from the options, the will is set by the reconnecting handler
+func (c *mqtt5Client) connectPacket(reconnect bool) *paho.Connect {
+	cp := &paho.Connect{
+		ClientID:     c.opts.ClientID,
+		KeepAlive:    uint16(c.opts.KeepAlive),
+		CleanStart:   c.opts.CleanSession && !(reconnect && c.sessionExpiry > 0),
+		Username:     c.opts.Username,
+		UsernameFlag: c.opts.Username != "",
+		Password:     []byte(c.opts.Password),
+		PasswordFlag: c.opts.Password != "",
+		// Without problem information the broker may leave out the user properties, e.g. Mochi MQTT
+		Properties: &paho.ConnectProperties{RequestProblemInfo: true},
+	}
+	switch {
+	case c.sessionExpiry > 0:
+		cp.Properties.SessionExpiryInterval = paho.Uint32(c.sessionExpiry)
+	case !c.opts.CleanSession:
+		// An MQTT 5 session ends with the connection by default, a 3.1.1 persistent session is kept
+		cp.Properties.SessionExpiryInterval = paho.Uint32(math.MaxUint32)
+	}
+	if c.aliasMaximum > 0 {
+		cp.Properties.TopicAliasMaximum = paho.Uint16(c.aliasMaximum)
+	}
+	if c.receiveMax > 0 {
+		// The handlers acknowledge the messages, the broker waits for them once this many are unacknowledged
+		cp.Properties.ReceiveMaximum = paho.Uint16(c.receiveMax)
+	}
+	if c.opts.WillEnabled {
+		cp.WillMessage = &paho.WillMessage{Topic: c.opts.WillTopic, Payload: c.opts.WillPayload, QoS: c.opts.WillQos, Retain: c.opts.WillRetained}
+		if c.willDelay > 0 {
+			cp.WillProperties = &paho.WillProperties{WillDelayInterval: paho.Uint32(c.willDelay)}
+		}
+	}
+	return cp
+}
+
+// Fail the publishes waiting for an acknowledgement which won't come, the session dropped them
+func (c *mqtt5Client) dropPending() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	close(c.dropped)
+	c.dropped = make(chan struct{})
+}
+
+func (c *mqtt5Client) setRetry(retry bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.retry = retry
+}
+
+// Set the topic of a received publish sent with a topic alias, or remember the alias of its topic
+func resolveTopicAlias(p *paho.Publish, aliases map[uint16]string) error {
+	if p.Properties == nil || p.Properties.TopicAlias == nil {
+		return nil
+	}
+	alias := *p.Properties.TopicAlias
+	if p.Topic != "" {
+		aliases[alias] = p.Topic
+		return nil
+	}
+	topic, ok := aliases[alias]
+	if !ok {
+		return fmt.Errorf("the broker sent the unknown topic alias %d", alias)
+	}
+	p.Topic = topic
+	return nil
+}
+
+// Call the handlers of the filters matching the topic of a received message. The message is acknowledged
+// once the handlers returned, or right away if the handlers are called concurrently.
+func (c *mqtt5Client) onPublish(received paho.PublishReceived) (bool, error) {
+	msg := &mqtt5Message{publish: received.Packet}
+	c.mutex.Lock()
+	var handlers []mqtt.MessageHandler
+	for filter, handler := range c.routes {
+		if topicMatches(filter, msg.Topic()) {
+			handlers = append(handlers, handler)
+		}
+	}
+	if len(handlers) == 0 && c.opts.DefaultPublishHandler != nil {
+		handlers = append(handlers, c.opts.DefaultPublishHandler)
+	}
+	c.mutex.Unlock()
+	for _, handler := range handlers {
+		if c.opts.Order {
+			handler(c, msg)
+		} else {
+			go handler(c, msg)
+		}
+	}
+	return true, nil
+}
+
+func (c *mqtt5Client) IsConnected() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.conn != nil || c.retry
+}
+
+func (c *mqtt5Client) IsConnectionOpen() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.conn != nil
+}
+
+// Publish a message, the token of a QoS 1 or 2 message completes once the broker acknowledged it. The
+// messages are sent without waiting for the acknowledgement of the previous ones.
+func (c *mqtt5Client) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	token := newMQTT5Token()
+	var data []byte
+	switch p := payload.(type) {
+	case string:
+		data = []byte(p)
+	case []byte:
+		data = p
+	case bytes.Buffer:
+		data = p.Bytes()
+	default:
+		token.complete(errors.New("unknown payload type"))
+		return token
+	}
+	c.send.Lock()
+	defer c.send.Unlock()
+	c.mutex.Lock()
+	conn, aliases, dropped := c.netConn, c.aliases, c.dropped
+	c.mutex.Unlock()
+	if conn == nil {
+		token.complete(mqtt.ErrNotConnected)
+		return token
+	}
+	pb := (&paho.Publish{Topic: topic, QoS: qos, Retain: retained, Payload: data}).Packet()
+	if qos == 0 {
+		aliases.apply(pb)
+		_, err := pb.WriteTo(conn)
+		token.complete(err)
+		return token
+	}
+	acked := make(chan packets.ControlPacket, 1)
+	if err := c.session.AddToSession(c.ctx, pb, acked); err != nil {
+		token.complete(err)
+		return token
+	}
+	// The session keeps the message with its topic, it may be sent again on another connection. A failed write
+	// loses the connection, the message stays in the session until it is dropped or sent again.
+	aliases.apply(pb)
+	_, _ = pb.WriteTo(conn)
+	go func() {
+		select {
+		case ack := <-acked:
+			token.complete(publishAckError(ack))
+		case <-dropped:
+			token.complete(errors.New("the connection was lost before the broker acknowledged the publish"))
+		case <-c.ctx.Done():
+			token.complete(errors.New("disconnected before the broker acknowledged the publish"))
+		}
+	}()
+	return token
+}
+
+// The error of a PUBACK, PUBREC or PUBCOMP, a packet without type means the session was closed
+func publishAckError(ack packets.ControlPacket) error {
+	switch p := ack.Content.(type) {
+	case *packets.Puback:
+		if p.ReasonCode >= 0x80 {
+			return fmt.Errorf("publish rejected: %s", p.Reason())
+		}
+		return nil
+	case *packets.Pubrec:
+		if p.ReasonCode >= 0x80 {
+			return fmt.Errorf("publish rejected: %s", p.Reason())
+		}
+		return nil
+	case *packets.Pubcomp:
+		return nil
+	}
+	return errors.New("the publish was not acknowledged before the session was closed")
+}
+
+func (c *mqtt5Client) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+// Subscribe to topic filters, the token has the granted QoS of every filter like the subscribe token of the
+// 3.1.1 client. Filters rejected by the broker have 0x80 whatever the reason code.
+func (c *mqtt5Client) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	token := newMQTT5Token()
+	c.mutex.Lock()
+	if callback != nil {
+		for filter := range filters {
+			c.routes[filter] = callback
+		}
+	}
+	conn := c.conn
+	c.mutex.Unlock()
+	if conn == nil {
+		token.complete(mqtt.ErrNotConnected)
+		return token
+	}
+	subscribe := &paho.Subscribe{}
+	for _, filter := range sortedKeys(filters) {
+		subscribe.Subscriptions = append(subscribe.Subscriptions, paho.SubscribeOptions{Topic: filter, QoS: filters[filter]})
+	}
+	go func() {
+		suback, err := conn.Subscribe(c.ctx, subscribe)
+		if suback == nil {
+			token.complete(err)
+			return
+		}
+		token.granted = make(map[string]byte, len(suback.Reasons))
+		for i, reason := range suback.Reasons {
+			if i >= len(subscribe.Subscriptions) {
+				break
+			}
+			if reason >= 0x80 {
+				reason = subscriptionFailure
+			}
+			token.granted[subscribe.Subscriptions[i].Topic] = reason
+		}
+		token.complete(nil)
+	}()
+	return token
+}
+
+func (c *mqtt5Client) Unsubscribe(topics ...string) mqtt.Token {
+	token := newMQTT5Token()
+	c.mutex.Lock()
+	for _, topic := range topics {
+		delete(c.routes, topic)
+	}
+	conn := c.conn
+	c.mutex.Unlock()
+	if conn == nil {
+		token.complete(mqtt.ErrNotConnected)
+		return token
+	}
+	go func() {
+		_, err := conn.Unsubscribe(c.ctx, &paho.Unsubscribe{Topics: topics})
+		token.complete(err)
+	}()
+	return token
+}
+
+func (c *mqtt5Client) AddRoute(topic string, callback mqtt.MessageHandler) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.routes[topic] = callback
+}
+
+// The options reader of the 3.1.1 client can't be created for other clients, it is not used by the models
+func (c *mqtt5Client) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.ClientOptionsReader{}
+}
+
+// Disconnect with a normal DISCONNECT, so the broker doesn't publish the will, and stop reconnecting
+func (c *mqtt5Client) Disconnect(quiesce uint) {
+	c.mutex.Lock()
+	if c.ctx.Err() != nil {
+		c.mutex.Unlock()
+		return
+	}
+	c.cancel()
+	conn, started := c.conn, c.started
+	c.conn, c.netConn = nil, nil
+	c.mutex.Unlock()
+	if conn != nil {
+		_ = conn.Disconnect(&paho.Disconnect{ReasonCode: 0})
+	}
+	if started {
+		<-c.done
+	}
+	_ = c.session.Close()
+}
@@ -0,0 +1,356 @@
+package mqttclient
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.viam.com/rdk/logging"
+
+	"github.com/lab101/mqtt-welding/internal/mqtttest"
+)
+
+// An MQTT 5 connection subscribes and publishes in order at every QoS
+func TestMQTT5Connection(t *testing.T) {
+	b := startTestBroker(t)
+	cfg := &BrokerConfig{Host: b.Host, Port: b.Port, ClientID: "cell5", ProtocolVersion: protocolMQTT5}
+	client, err := cfg.connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(250)
+
+	messages := make(chan mqtt.Message, 10)
+	token := client.SubscribeMultiple(map[string]byte{"weld/#": 2}, func(_ mqtt.Client, m mqtt.Message) { messages <- m })
+	if err := waitForToken(context.Background(), token); err != nil {
+		t.Fatal(err)
+	}
+	if granted := subscribeResult(token); !reflect.DeepEqual(granted, map[string]byte{"weld/#": 2}) {
+		t.Errorf("granted %v, want QoS 2 for weld/#", granted)
+	}
+
+	for qos := byte(0); qos <= 2; qos++ {
+		if err := publishAndWait(context.Background(), client, "weld/cell5/data", qos, false, fmt.Sprint(qos)); err != nil {
+			t.Fatalf("publishing with QoS %d: %v", qos, err)
+		}
+	}
+	for qos := byte(0); qos <= 2; qos++ {
+		m := mqtttest.Receive(t, messages)
+		if string(m.Payload()) != fmt.Sprint(qos) || m.Qos() != qos {
+			t.Errorf("received %q with QoS %d, want %q with QoS %d", m.Payload(), m.Qos(), fmt.Sprint(qos), qos)
+		}
+	}
+}
+
+// A refused MQTT 5 connection reports the reason code of the CONNACK and is not retried
+func TestMQTT5ConnectRefused(t *testing.T) {
+	b := mqtttest.StartBroker(t, func(address string) (func(), error) {
+		broker, err := newEmbeddedBroker(address, "cell", "secret", nil, logging.NewTestLogger(t))
+		if err != nil {
+			return nil, err
+		}
+		return func() { broker.close() }, nil
+	})
+	cfg := &BrokerConfig{Host: b.Host, Port: b.Port, ClientID: "cell5", Username: "cell", Password: "wrong", ProtocolVersion: protocolMQTT5}
+	opts, err := newClientOptions(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.SetAutoReconnect(false)
+	token := newMQTTClient(cfg, opts).Connect()
+	if !token.WaitTimeout(mqtttest.Timeout) || token.Error() == nil {
+		t.Fatalf("connect = %v, want a refused connection", token.Error())
+	}
+	code, reason, ok := connectRefusal(token)
+	if !ok || code != 0x86 || !strings.HasPrefix(reason, "Bad User Name or Password") {
+		t.Errorf("refusal %#x %q, want 0x86 Bad User Name or Password", code, reason)
+	}
+	if _, code := connectResult(token); !haltingReturnCodes[code] {
+		t.Errorf("reason code %#x is retried", code)
+	}
+}
+
+// The user properties of MQTT 5 messages are added to the readings
+func TestMQTT5UserProperties(t *testing.T) {
+	b := startTestBroker(t)
+	s := newTestSensor(t, b, "properties", &Config{Topic: "weld/+/data", PayloadType: "json", ProtocolVersion: protocolMQTT5})
+	publisher := b.Client5(t, "gateway")
+	mqtttest.Publish5(t, publisher, &paho.Publish{
+		Topic:   "weld/cell3/data",
+		QoS:     1,
+		Payload: mqtttest.JSON(t, mqtttest.WeldSample(180, 21)),
+		Properties: &paho.PublishProperties{User: paho.UserProperties{
+			{Key: "line", Value: "L2"},
+			{Key: "cell", Value: "c3"},
+			{Key: "shift", Value: "early"},
+			{Key: "shift", Value: "late"},
+		}},
+	})
+	awaitReceived(t, s, 1)
+
+	readings, err := s.Readings(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"line": "L2", "cell": "c3", "shift": []interface{}{"early", "late"}}
+	if got := readings["user_properties"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("user properties %v, want %v", got, want)
+	}
+}
+
+// Capture tags take the first value of a user property
+func TestUserPropertyCaptureTags(t *testing.T) {
+	tags, err := parseCaptureTags(map[string]string{"line": "user_property[line]", "cell": "topic[1]"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &mqttClient{captureTagSources: tags}
+	tests := []struct {
+		name string
+		msg  mqtt.Message
+		want []string
+	}{
+		{
+			name: "user property",
+			msg: &mqtt5Message{publish: &paho.Publish{Topic: "weld/cell3/data", Properties: &paho.PublishProperties{
+				User: paho.UserProperties{{Key: "line", Value: "L2"}, {Key: "line", Value: "L3"}},
+			}}},
+			want: []string{"cell:cell3", "line:L2"},
+		},
+		{
+			name: "missing user property",
+			msg:  &mqtt5Message{publish: &paho.Publish{Topic: "weld/cell3/data"}},
+			want: []string{"cell:cell3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.captureTags(&receivedMessage{Message: tt.msg}, nil); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tags %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Queued MQTT 5 messages are dropped once their expiry interval elapsed
+func TestMQTT5MessageExpiry(t *testing.T) {
+	received := time.Now().Add(-2 * time.Second)
+	message := func(topic string, expiry *uint32) *receivedMessage {
+		publish := &paho.Publish{Topic: topic, Properties: &paho.PublishProperties{MessageExpiry: expiry}}
+		return &receivedMessage{Message: &mqtt5Message{publish: publish}, received: received}
+	}
+	queue := []*receivedMessage{
+		message("weld/expired", paho.Uint32(1)),
+		message("weld/valid", paho.Uint32(60)),
+		message("weld/unlimited", nil),
+		{Message: &injectedMessage{topic: "weld/v311"}, received: received},
+		message("weld/expired", paho.Uint32(0)),
+	}
+	want := []string{"weld/valid", "weld/unlimited", "weld/v311"}
+
+	t.Run("pop", func(t *testing.T) {
+		s := &mqttClient{messageQueue: slices.Clone(queue)}
+		var topics []string
+		for msg := s.popMessage(); msg != nil; msg = s.popMessage() {
+			topics = append(topics, msg.Topic())
+		}
+		if !reflect.DeepEqual(topics, want) || s.metrics.dropped[dropMessageExpired].Load() != 2 {
+			t.Errorf("popped %v, %d expired, want %v, 2 expired", topics, s.metrics.dropped[dropMessageExpired].Load(), want)
+		}
+	})
+	t.Run("drop", func(t *testing.T) {
+		s := &mqttClient{messageQueue: slices.Clone(queue)}
+		s.dropExpired(time.Now())
+		var topics []string
+		for _, msg := range s.messageQueue {
+			topics = append(topics, msg.Topic())
+		}
+		if !reflect.DeepEqual(topics, want) || s.metrics.dropped[dropMessageExpired].Load() != 2 {
+			t.Errorf("kept %v, %d expired, want %v, 2 expired", topics, s.metrics.dropped[dropMessageExpired].Load(), want)
+		}
+	})
+}
+
+// Topic aliases are assigned up to the maximum and the topic is only sent with the first use of an alias
+func TestOutboundTopicAliases(t *testing.T) {
+	aliases := newOutboundAliases(2)
+	tests := []struct {
+		topic string
+		sent  string
+		alias uint16 // 0 if sent without alias
+	}{
+		{"weld/cell1/data", "weld/cell1/data", 1},
+		{"weld/cell2/data", "weld/cell2/data", 2},
+		{"weld/cell1/data", "", 1},
+		{"weld/cell3/data", "weld/cell3/data", 0},
+		{"weld/cell2/data", "", 2},
+		{"weld/cell3/data", "weld/cell3/data", 0},
+	}
+	for i, tt := range tests {
+		pb := (&paho.Publish{Topic: tt.topic}).Packet()
+		aliases.apply(pb)
+		var alias uint16
+		if pb.Properties != nil && pb.Properties.TopicAlias != nil {
+			alias = *pb.Properties.TopicAlias
+		}
+		if pb.Topic != tt.sent || alias != tt.alias {
+			t.Errorf("publish %d on %q sent %q with alias %d, want %q with alias %d", i, tt.topic, pb.Topic, alias, tt.sent, tt.alias)
+		}
+	}
+}
+
+// A topic alias of the broker without known topic is an error
+func TestResolveTopicAlias(t *testing.T) {
+	aliases := map[uint16]string{}
+	set := &paho.Publish{Topic: "weld/cell1/data", Properties: &paho.PublishProperties{TopicAlias: paho.Uint16(1)}}
+	if err := resolveTopicAlias(set, aliases); err != nil {
+		t.Fatal(err)
+	}
+	used := &paho.Publish{Properties: &paho.PublishProperties{TopicAlias: paho.Uint16(1)}}
+	if err := resolveTopicAlias(used, aliases); err != nil || used.Topic != "weld/cell1/data" {
+		t.Errorf("resolved %q, %v, want weld/cell1/data", used.Topic, err)
+	}
+	unknown := &paho.Publish{Properties: &paho.PublishProperties{TopicAlias: paho.Uint16(2)}}
+	if err := resolveTopicAlias(unknown, aliases); err == nil {
+		t.Errorf("unknown alias resolved to %q", unknown.Topic)
+	}
+}
+
+// Messages sent and received with topic aliases keep their topics
+func TestMQTT5TopicAliases(t *testing.T) {
+	b := startTestBroker(t)
+	cfg := &BrokerConfig{Host: b.Host, Port: b.Port, ClientID: "cell5", ProtocolVersion: protocolMQTT5, TopicAliasMaximum: 2}
+	client, err := cfg.connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(250)
+	messages := make(chan mqtt.Message, 10)
+	if err := waitForToken(context.Background(), client.Subscribe("weld/#", 1, func(_ mqtt.Client, m mqtt.Message) { messages <- m })); err != nil {
+		t.Fatal(err)
+	}
+	subscriber := mqtttest.Subscribe(t, b.Client(t, "subscriber"), "weld/#")
+
+	topics := []string{"weld/cell1/data", "weld/cell2/data", "weld/cell1/data", "weld/cell3/data", "weld/cell2/data", "weld/cell3/data"}
+	for i, topic := range topics {
+		if err := publishAndWait(context.Background(), client, topic, byte(i%2), false, fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, received := range []<-chan mqtt.Message{messages, subscriber} {
+		for i, topic := range topics {
+			m := mqtttest.Receive(t, received)
+			if m.Topic() != topic || string(m.Payload()) != fmt.Sprint(i) {
+				t.Errorf("received %q on %q, want %q on %q", m.Payload(), m.Topic(), fmt.Sprint(i), topic)
+			}
+		}
+	}
+}
+
+// The broker is told the receive maximum and delivers all messages while the handler holds them back
+func TestMQTT5ReceiveMaximum(t *testing.T) {
+	broker, b := newTestEmbeddedBroker(t)
+	cfg := &BrokerConfig{Host: b.Host, Port: b.Port, ClientID: "cell5", ProtocolVersion: protocolMQTT5, ReceiveMaximum: 2}
+	client, err := cfg.connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(250)
+	release := make(chan struct{})
+	messages := make(chan mqtt.Message, 10)
+	token := client.Subscribe("weld/#", 1, func(_ mqtt.Client, m mqtt.Message) {
+		<-release
+		messages <- m
+	})
+	if err := waitForToken(context.Background(), token); err != nil {
+		t.Fatal(err)
+	}
+	cl, ok := broker.server.Clients.Get("cell5")
+	if !ok || cl.Properties.Props.ReceiveMaximum != uint16(cfg.ReceiveMaximum) {
+		t.Fatalf("broker client %v, want receive maximum 1", cl)
+	}
+
+	publisher := b.Client(t, "publisher")
+	for i := 0; i < 3; i++ {
+		mqtttest.Publish(t, publisher, "weld/cell5/data", fmt.Sprint(i), false)
+	}
+	close(release)
+	for i := 0; i < 3; i++ {
+		if m := mqtttest.Receive(t, messages); string(m.Payload()) != fmt.Sprint(i) {
+			t.Errorf("received %q, want %q", m.Payload(), fmt.Sprint(i))
+		}
+	}
+}
+
+// Connect an MQTT 5 client with the options, it is disconnected when the test ends
+func connect5(t *testing.T, cfg *BrokerConfig, configure func(*mqtt.ClientOptions)) *mqtt5Client {
+	t.Helper()
+	opts, err := newClientOptions(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configure(opts)
+	client := newMQTTClient(cfg, opts).(*mqtt5Client)
+	if err := waitForToken(context.Background(), client.Connect()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect(0) })
+	return client
+}
+
+// Close the network connection of the client without DISCONNECT, like a network failure
+func breakConnection(c *mqtt5Client) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.netConn.Close()
+}
+
+// A session with an expiry interval is resumed by a reconnect, the messages of the outage are received
+func TestMQTT5SessionExpiry(t *testing.T) {
+	b := startTestBroker(t)
+	cfg := &BrokerConfig{Host: b.Host, Port: b.Port, ClientID: "cell5", ProtocolVersion: protocolMQTT5, SessionExpiry: 10}
+	// The client reconnects once the message of the outage was published
+	reconnecting, published := make(chan struct{}), make(chan struct{})
+	client := connect5(t, cfg, func(opts *mqtt.ClientOptions) {
+		opts.SetReconnectingHandler(func(mqtt.Client, *mqtt.ClientOptions) {
+			close(reconnecting)
+			<-published
+		})
+	})
+	messages := make(chan mqtt.Message, 10)
+	if err := waitForToken(context.Background(), client.Subscribe("weld/#", 1, func(_ mqtt.Client, m mqtt.Message) { messages <- m })); err != nil {
+		t.Fatal(err)
+	}
+
+	breakConnection(client)
+	<-reconnecting
+	mqtttest.Publish(t, b.Client(t, "publisher"), "weld/cell5/data", "outage", false)
+	close(published)
+	if m := mqtttest.Receive(t, messages); string(m.Payload()) != "outage" {
+		t.Errorf("received %q, want the message of the outage", m.Payload())
+	}
+}
+
+// The broker publishes the last will after the will delay
+func TestMQTT5WillDelay(t *testing.T) {
+	b := startTestBroker(t)
+	wills := mqtttest.Subscribe(t, b.Client(t, "subscriber"), "cell5/state")
+	cfg := &BrokerConfig{Host: b.Host, Port: b.Port, ClientID: "cell5", ProtocolVersion: protocolMQTT5, SessionExpiry: 10, WillDelay: 1}
+	client := connect5(t, cfg, func(opts *mqtt.ClientOptions) {
+		opts.SetBinaryWill("cell5/state", []byte("offline"), 1, false)
+		opts.SetAutoReconnect(false)
+	})
+
+	lost := time.Now()
+	breakConnection(client)
+	m := mqtttest.Receive(t, wills)
+	if elapsed := time.Since(lost); string(m.Payload()) != "offline" || elapsed < time.Second {
+		t.Errorf("received will %q after %v, want offline after 1s", m.Payload(), elapsed)
+	}
+}
@@ -0,0 +1,56 @@
+package mqttclient
+
+import "time"
+
+// Default interval of the message summary log
+const defaultLogSummaryInterval = time.Minute
+
+// Rate limited logging of the received messages. A summary is logged periodically instead of a line
+// per message, which floods the logs at high message rates.
+type messageLog struct {
+	interval   time.Duration // 0 disables the summary
+	perMessage bool          // Log every message at debug level
+	since      time.Time
+	received   uint64
+	queued     uint64
+	dropped    uint64
+}
+
+func newMessageLog(intervalS float64) messageLog {
+	l := messageLog{interval: defaultLogSummaryInterval, since: time.Now()}
+	if intervalS != 0 {
+		l.interval = time.Duration(intervalS * float64(time.Second))
+	}
+	if l.interval < 0 {
+		l.interval = 0
+	}
+	return l
+}
+
+// Count a message and log the summary when the interval has passed. Must be called with the mutex held.
+func (s *mqttClient) logMessage(msg *receivedMessage, queued, dropped bool) {
+	l := &s.messageLog
+	l.received++
+	if queued {
+		l.queued++
+	}
+	if dropped {
+		l.dropped++
+	}
+	if l.perMessage {
+		s.logger.Debugf("message on %q, queued %v, queue length %v", msg.Topic(), queued, len(s.messageQueue))
+	}
+	if l.interval == 0 || msg.received.Sub(l.since) < l.interval {
+		return
+	}
+	s.logger.Infof("%d messages received, %d queued, %d dropped in the last %v, queue length %v",
+		l.received, l.queued, l.dropped, msg.received.Sub(l.since).Round(time.Second), len(s.messageQueue))
+	l.since = msg.received
+	l.received, l.queued, l.dropped = 0, 0, 0
+}
+
+// Arguments of the message_logging command
+type messageLogArgs struct {
+	SummaryIntervalS *float64 `json:"summary_interval_s"` // 0 disables the summary
+	PerMessage       *bool    `json:"per_message"`
+}
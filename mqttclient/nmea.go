@@ -0,0 +1,115 @@
+package mqttclient
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Meters per second per knot
+const knotsToMps = 0.514444
+
+// Position and motion data decoded from a NMEA sentence, fields which are not part of the sentence are nil
+type nmeaFix struct {
+	lat, lng float64
+	hasPos   bool
+	alt      *float64
+	speed    *float64 // m/s
+	course   *float64 // degrees
+	quality  *int32
+	hdop     *float64
+}
+
+// Parse a GGA or RMC NMEA sentence, other sentences are ignored
+func parseNMEA(sentence string) (nmeaFix, error) {
+	var fix nmeaFix
+	sentence = strings.TrimSpace(sentence)
+	if !strings.HasPrefix(sentence, "$") {
+		return fix, fmt.Errorf("invalid NMEA sentence %q", sentence)
+	}
+	body, checksum, hasChecksum := strings.Cut(sentence[1:], "*")
+	if hasChecksum {
+		var sum byte
+		for i := 0; i < len(body); i++ {
+			sum ^= body[i]
+		}
+		expected, err := strconv.ParseUint(checksum, 16, 8)
+		if err != nil || byte(expected) != sum {
+			return fix, fmt.Errorf("invalid NMEA checksum in %q", sentence)
+		}
+	}
+	fields := strings.Split(body, ",")
+	if len(fields[0]) < 5 {
+		return fix, fmt.Errorf("invalid NMEA sentence %q", sentence)
+	}
+	switch fields[0][len(fields[0])-3:] {
+	case "GGA":
+		// $GPGGA,time,lat,N,lng,E,quality,satellites,hdop,alt,M,...
+		if len(fields) < 10 {
+			return fix, fmt.Errorf("invalid GGA sentence %q", sentence)
+		}
+		if q, err := strconv.Atoi(fields[6]); err == nil {
+			quality := int32(q)
+			fix.quality = &quality
+			if q == 0 {
+				return fix, nil
+			}
+		}
+		if err := fix.setPosition(fields[2], fields[3], fields[4], fields[5]); err != nil {
+			return fix, err
+		}
+		fix.hdop = parseOptionalFloat(fields[8])
+		fix.alt = parseOptionalFloat(fields[9])
+	case "RMC":
+		// $GPRMC,time,status,lat,N,lng,E,speed,course,...
+		if len(fields) < 9 {
+			return fix, fmt.Errorf("invalid RMC sentence %q", sentence)
+		}
+		if fields[2] != "A" {
+			return fix, nil
+		}
+		if err := fix.setPosition(fields[3], fields[4], fields[5], fields[6]); err != nil {
+			return fix, err
+		}
+		if knots := parseOptionalFloat(fields[7]); knots != nil {
+			speed := *knots * knotsToMps
+			fix.speed = &speed
+		}
+		fix.course = parseOptionalFloat(fields[8])
+	}
+	return fix, nil
+}
+
+func (fix *nmeaFix) setPosition(lat, latDir, lng, lngDir string) error {
+	var err error
+	if fix.lat, err = parseNMEACoordinate(lat, latDir); err != nil {
+		return err
+	}
+	if fix.lng, err = parseNMEACoordinate(lng, lngDir); err != nil {
+		return err
+	}
+	fix.hasPos = true
+	return nil
+}
+
+// Convert a NMEA (d)ddmm.mmmm coordinate to decimal degrees
+func parseNMEACoordinate(value, dir string) (float64, error) {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid NMEA coordinate %q", value)
+	}
+	degrees := float64(int(f / 100))
+	decimal := degrees + (f-degrees*100)/60
+	if dir == "S" || dir == "W" {
+		decimal = -decimal
+	}
+	return decimal, nil
+}
+
+func parseOptionalFloat(value string) *float64 {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil
+	}
+	return &f
+}
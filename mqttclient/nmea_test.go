@@ -0,0 +1,94 @@
+package mqttclient
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseNMEA(t *testing.T) {
+	float := func(f float64) *float64 { return &f }
+	tests := []struct {
+		name     string
+		sentence string
+		wantErr  bool
+		hasPos   bool
+		lat, lng float64
+		alt      *float64
+		speed    *float64
+		course   *float64
+		quality  int32 // -1 if not part of the sentence
+	}{
+		{
+			name:     "GGA",
+			sentence: "$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*47",
+			hasPos:   true, lat: 48.1173, lng: 11.516667, alt: float(545.4), quality: 1,
+		},
+		{
+			name:     "GGA southern and western hemisphere without altitude",
+			sentence: "$GNGGA,123519,3345.1230,S,15112.4560,W,2,10,1.2,,M,,M,,*6F",
+			hasPos:   true, lat: -33.75205, lng: -151.2076, quality: 2,
+		},
+		{
+			name:     "GGA without fix",
+			sentence: "$GPGGA,123519,,,,,0,00,,,M,,M,,*6B",
+			quality:  0,
+		},
+		{
+			name:     "RMC",
+			sentence: "$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6A",
+			hasPos:   true, lat: 48.1173, lng: 11.516667, speed: float(22.4 * knotsToMps), course: float(84.4), quality: -1,
+		},
+		{
+			name:     "RMC void",
+			sentence: "$GPRMC,123519,V,,,,,,,230394,,*33",
+			quality:  -1,
+		},
+		{
+			name:     "without checksum",
+			sentence: "$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,",
+			hasPos:   true, lat: 48.1173, lng: 11.516667, alt: float(545.4), quality: 1,
+		},
+		{
+			name:     "other sentences are ignored",
+			sentence: "$GPGSV,3,1,11,03,03,111,00*4A",
+			quality:  -1,
+		},
+		{name: "wrong checksum", sentence: "$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*48", wantErr: true},
+		{name: "missing dollar", sentence: "GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,", wantErr: true},
+		{name: "short GGA", sentence: "$GPGGA,123519,4807.038,N", wantErr: true},
+		{name: "invalid coordinate", sentence: "$GPRMC,123519,A,north,N,01131.000,E,022.4,084.4,230394,003.1,W", wantErr: true},
+	}
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-5 }
+	nearPtr := func(a, b *float64) bool { return (a == nil) == (b == nil) && (a == nil || near(*a, *b)) }
+	value := func(f *float64) interface{} {
+		if f == nil {
+			return nil
+		}
+		return *f
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fix, err := parseNMEA(tt.sentence)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseNMEA error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if fix.hasPos != tt.hasPos || !near(fix.lat, tt.lat) || !near(fix.lng, tt.lng) {
+				t.Errorf("position %v %v,%v, want %v %v,%v", fix.hasPos, fix.lat, fix.lng, tt.hasPos, tt.lat, tt.lng)
+			}
+			if !nearPtr(fix.alt, tt.alt) || !nearPtr(fix.speed, tt.speed) || !nearPtr(fix.course, tt.course) {
+				t.Errorf("altitude %v, speed %v, course %v, want %v, %v, %v",
+					value(fix.alt), value(fix.speed), value(fix.course), value(tt.alt), value(tt.speed), value(tt.course))
+			}
+			quality := int32(-1)
+			if fix.quality != nil {
+				quality = *fix.quality
+			}
+			if quality != tt.quality {
+				t.Errorf("quality %d, want %d", quality, tt.quality)
+			}
+		})
+	}
+}
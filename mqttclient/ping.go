@@ -0,0 +1,119 @@
+package mqttclient
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Defaults of the ping command
+const (
+	defaultPingCount   = 3
+	defaultPingTimeout = 2 * time.Second
+)
+
+// Arguments of the ping command
+type pingArgs struct {
+	Topic     string `json:"topic"`      // Probe topic, default "viam/ping/<client_id>"
+	Count     int    `json:"count"`      // Number of probes, default 3
+	TimeoutMs int    `json:"timeout_ms"` // Timeout per probe, default 2000
+}
+
+// Measure the round trip time to the broker by publishing probes to a topic the client subscribes to.
+// The publish acknowledgement time of QoS 1 is reported separately from the loopback time.
+func ping(ctx context.Context, client mqtt.Client, clientID string, args pingArgs) (map[string]interface{}, error) {
+	if client == nil || !client.IsConnectionOpen() {
+		return nil, fmt.Errorf("MQTT client not connected")
+	}
+	if args.Topic == "" {
+		args.Topic = "viam/ping/" + discoveryInvalidChars.ReplaceAllString(clientID, "_")
+	}
+	if !validTopicName(args.Topic) {
+		return nil, fmt.Errorf("invalid ping topic %q", args.Topic)
+	}
+	if args.Count <= 0 {
+		args.Count = defaultPingCount
+	}
+	timeout := defaultPingTimeout
+	if args.TimeoutMs > 0 {
+		timeout = time.Duration(args.TimeoutMs) * time.Millisecond
+	}
+
+	echo := make(chan string, args.Count)
+	token := client.Subscribe(args.Topic, 1, func(_ mqtt.Client, msg mqtt.Message) {
+		select {
+		case echo <- string(msg.Payload()):
+		default:
+		}
+	})
+	if !token.WaitTimeout(timeout) {
+		return nil, fmt.Errorf("ping subscription timed out")
+	}
+	if token.Error() != nil {
+		return nil, token.Error()
+	}
+	defer client.Unsubscribe(args.Topic)
+
+	var rtts, acks []float64
+	lost := 0
+	for i := 0; i < args.Count; i++ {
+		probe := strconv.FormatInt(time.Now().UnixNano(), 10)
+		start := time.Now()
+		t := client.Publish(args.Topic, 1, false, probe)
+		if !t.WaitTimeout(timeout) || t.Error() != nil {
+			lost++
+			continue
+		}
+		acks = append(acks, float64(time.Since(start).Microseconds())/1000)
+		if waitForEcho(ctx, echo, probe, start.Add(timeout)) {
+			rtts = append(rtts, float64(time.Since(start).Microseconds())/1000)
+		} else {
+			lost++
+		}
+	}
+	result := map[string]interface{}{
+		"topic": args.Topic,
+		"sent":  args.Count,
+		"lost":  lost,
+	}
+	if len(rtts) > 0 {
+		result["rtt_ms"] = latencySummary(rtts)
+	}
+	if len(acks) > 0 {
+		result["puback_ms"] = latencySummary(acks)
+	}
+	return result, nil
+}
+
+// Wait for a probe to come back, late echoes of previous probes are skipped
+func waitForEcho(ctx context.Context, echo chan string, probe string, deadline time.Time) bool {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for {
+		select {
+		case payload := <-echo:
+			if payload == probe {
+				return true
+			}
+		case <-timer.C:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// Minimum, average and maximum of the samples
+func latencySummary(samples []float64) map[string]interface{} {
+	low, high, sum := math.Inf(1), math.Inf(-1), 0.0
+	for _, v := range samples {
+		low = math.Min(low, v)
+		high = math.Max(high, v)
+		sum += v
+	}
+	return map[string]interface{}{"min": low, "avg": sum / float64(len(samples)), "max": high}
+}
@@ -0,0 +1,181 @@
+package mqttclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.viam.com/rdk/components/powersensor"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+)
+
+// Power sensor model mapping payload fields to voltage, current and power
+var PowerSensorModel = resource.NewModel("lab101", "mqtt", "powersensor")
+
+func init() {
+	resource.RegisterComponent(powersensor.API, PowerSensorModel,
+		resource.Registration[powersensor.PowerSensor, *PowerSensorConfig]{Constructor: newPowerSensor})
+}
+
+// Maps JSON power sensor configuration attributes.
+type PowerSensorConfig struct {
+	BrokerConfig `json:",squash"`
+	Topic        string `json:"topic"`
+	QoS          int    `json:"qos"`
+	PayloadType  string `json:"payload"`       // Supported json (default), telwin
+	VoltageField string `json:"voltage_field"` // Payload field with the voltage in volts
+	CurrentField string `json:"current_field"` // Payload field with the current in amps
+	PowerField   string `json:"power_field"`   // Optional payload field with the power in watts, default voltage * current
+	IsAC         bool   `json:"is_ac"`         // Whether voltage and current are AC
+}
+
+// Implement power sensor configuration validation and return implicit dependencies.
+func (cfg *PowerSensorConfig) Validate(path string) ([]string, error) {
+	if cfg.Topic == "" {
+		return nil, fmt.Errorf("topic is required %q", path)
+	}
+	if err := cfg.BrokerConfig.Validate(path); err != nil {
+		return nil, err
+	}
+	if cfg.QoS < 0 || cfg.QoS > 2 {
+		return nil, fmt.Errorf("qos must be between 0 and 2 %q", path)
+	}
+	if cfg.PayloadType != "" && cfg.PayloadType != "json" && cfg.PayloadType != "telwin" {
+		return nil, fmt.Errorf("payload must be json or telwin %q", path)
+	}
+	if cfg.VoltageField == "" && cfg.CurrentField == "" && cfg.PowerField == "" {
+		return nil, fmt.Errorf("at least one of voltage_field, current_field and power_field is required %q", path)
+	}
+	return []string{}, nil
+}
+
+type mqttPowerSensor struct {
+	resource.Named
+	resource.AlwaysRebuild
+	logger        logging.Logger
+	client        mqtt.Client
+	cfg           *PowerSensorConfig
+	latestPayload interface{}
+	mutex         sync.Mutex
+}
+
+// Power sensor constructor, the sensor is rebuilt on reconfiguration
+func newPowerSensor(ctx context.Context, deps resource.Dependencies, conf resource.Config, logger logging.Logger) (powersensor.PowerSensor, error) {
+	sensorConfig, err := resource.NativeConfig[*PowerSensorConfig](conf)
+	if err != nil {
+		return nil, err
+	}
+	if sensorConfig.PayloadType == "" {
+		sensorConfig.PayloadType = "json"
+	}
+	p := &mqttPowerSensor{
+		Named:  conf.ResourceName().AsNamed(),
+		logger: logger,
+		cfg:    sensorConfig,
+	}
+	p.client, err = sensorConfig.connectAndSubscribe(ctx, sensorConfig.Topic, byte(sensorConfig.QoS), p.onMessage)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing mqtt power sensor: %v", err)
+	}
+	return p, nil
+}
+
+// Store the latest parsed payload
+func (p *mqttPowerSensor) onMessage(client mqtt.Client, msg mqtt.Message) {
+	payload, err := parsePayload(p.cfg.PayloadType, msg)
+	if err != nil {
+		p.logger.Debugf("dropped power message: %v", err)
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.latestPayload = payload
+}
+
+// Read a numeric field from the latest payload
+func (p *mqttPowerSensor) field(name string) (float64, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.latestPayload == nil {
+		return 0, errors.New("no data received yet")
+	}
+	v, ok := lookupField(p.latestPayload, name)
+	if !ok {
+		return 0, fmt.Errorf("field %q not found in payload", name)
+	}
+	f, ok := toFloat(v)
+	if !ok {
+		return 0, fmt.Errorf("field %q is not numeric: %v", name, v)
+	}
+	return f, nil
+}
+
+func (p *mqttPowerSensor) Voltage(ctx context.Context, extra map[string]interface{}) (float64, bool, error) {
+	if p.cfg.VoltageField == "" {
+		return 0, false, errUnimplemented
+	}
+	v, err := p.field(p.cfg.VoltageField)
+	return v, p.cfg.IsAC, err
+}
+
+func (p *mqttPowerSensor) Current(ctx context.Context, extra map[string]interface{}) (float64, bool, error) {
+	if p.cfg.CurrentField == "" {
+		return 0, false, errUnimplemented
+	}
+	c, err := p.field(p.cfg.CurrentField)
+	return c, p.cfg.IsAC, err
+}
+
+// Power from the power field, or voltage * current if no power field is configured
+func (p *mqttPowerSensor) Power(ctx context.Context, extra map[string]interface{}) (float64, error) {
+	if p.cfg.PowerField != "" {
+		return p.field(p.cfg.PowerField)
+	}
+	v, _, err := p.Voltage(ctx, extra)
+	if err != nil {
+		return 0, err
+	}
+	c, _, err := p.Current(ctx, extra)
+	if err != nil {
+		return 0, err
+	}
+	return v * c, nil
+}
+
+// Readings returns the configured values like the other Viam power sensors
+func (p *mqttPowerSensor) Readings(ctx context.Context, extra map[string]interface{}) (map[string]interface{}, error) {
+	readings := map[string]interface{}{}
+	if p.cfg.VoltageField != "" {
+		v, isAC, err := p.Voltage(ctx, extra)
+		if err != nil {
+			return nil, err
+		}
+		readings["voltage"] = v
+		readings["is_ac"] = isAC
+	}
+	if p.cfg.CurrentField != "" {
+		c, isAC, err := p.Current(ctx, extra)
+		if err != nil {
+			return nil, err
+		}
+		readings["current"] = c
+		readings["is_ac"] = isAC
+	}
+	if power, err := p.Power(ctx, extra); err == nil {
+		readings["power"] = power
+	} else if p.cfg.PowerField != "" {
+		return nil, err
+	}
+	return readings, nil
+}
+
+// Disconnect from the broker
+func (p *mqttPowerSensor) Close(ctx context.Context) error {
+	if p.client != nil {
+		p.client.Disconnect(250) // Timeout in milliseconds
+	}
+	return nil
+}
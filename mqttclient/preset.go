@@ -0,0 +1,222 @@
+package mqttclient
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Fields of the standard weld reading schema used across the fleet
+const (
+	weldCurrent       = "current_a"
+	weldVoltage       = "voltage_v"
+	weldWireFeedSpeed = "wire_feed_speed_m_min"
+	weldGasFlow       = "gas_flow_l_min"
+	weldTravelSpeed   = "travel_speed_mm_s"
+	weldArcOn         = "arc_on"
+)
+
+// A decoder normalizing vendor payloads into the standard weld reading schema
+type weldPreset struct {
+	// Source fields of each standard field, the first one present in the payload is used
+	sources map[string][]string
+	// Factors converting source fields to the unit of the standard field
+	scales map[string]float64
+	// Fields holding arrays of {"name", "value"} channel objects, the channels are decoded as fields
+	channels []string
+}
+
+// Supported presets by name
+var weldPresets = map[string]*weldPreset{
+	"weld_basic": {
+		sources: map[string][]string{
+			weldCurrent:       {"current_a", "current", "amps", "I"},
+			weldVoltage:       {"voltage_v", "voltage", "volts", "U"},
+			weldWireFeedSpeed: {"wire_feed_speed_m_min", "wire_feed_speed", "wfs"},
+			weldGasFlow:       {"gas_flow_l_min", "gas_flow", "gas"},
+			weldTravelSpeed:   {"travel_speed_mm_s", "travel_speed"},
+			weldArcOn:         {"arc_on", "arc", "arc_state"},
+		},
+	},
+	// ESAB WeldCloud telemetry, the measurements are flat or nested in "measurements"
+	"esab_weldcloud": {
+		sources: map[string][]string{
+			weldCurrent:       {"measurements.current", "current", "Current"},
+			weldVoltage:       {"measurements.voltage", "voltage", "Voltage"},
+			weldWireFeedSpeed: {"measurements.wireFeedSpeed", "wireFeedSpeed", "WireFeedSpeed"},
+			weldGasFlow:       {"measurements.gasFlow", "gasFlow", "GasFlow"},
+			weldTravelSpeed:   {"measurements.travelSpeed", "travelSpeed", "TravelSpeed"},
+			weldArcOn:         {"arcOn", "ArcOn", "weldState", "WeldState"},
+		},
+	},
+	// Fronius WeldCube and TPS-i power source telemetry, flat or as documentation channel layout
+	"fronius": {
+		sources: map[string][]string{
+			weldCurrent:       {"WeldingCurrent", "Current", "I"},
+			weldVoltage:       {"WeldingVoltage", "Voltage", "U"},
+			weldWireFeedSpeed: {"WireFeedSpeed", "WireSpeed", "Vd"},
+			weldGasFlow:       {"GasFlow", "Gas"},
+			weldTravelSpeed:   {"WeldingSpeed", "TravelSpeed"},
+			weldArcOn:         {"ArcOn", "ArcActive", "CurrentFlow"},
+		},
+		scales: map[string]float64{
+			"WeldingSpeed": 10.0 / 60, // cm/min
+			"TravelSpeed":  10.0 / 60,
+		},
+		channels: []string{"Channels", "channels"},
+	},
+	// Lincoln Electric CheckPoint and ArcLink weld data in US units
+	"lincoln": {
+		sources: map[string][]string{
+			weldCurrent:       {"WeldCurrent", "weldCurrent", "Amps"},
+			weldVoltage:       {"WeldVoltage", "weldVoltage", "Volts"},
+			weldWireFeedSpeed: {"WireFeedSpeed", "wireFeedSpeed", "WFS"},
+			weldGasFlow:       {"GasFlow", "gasFlow"},
+			weldTravelSpeed:   {"TravelSpeed", "travelSpeed"},
+			weldArcOn:         {"WeldInProgress", "weldInProgress", "ArcOn"},
+		},
+		scales: map[string]float64{
+			"WireFeedSpeed": 0.0254, // in/min
+			"wireFeedSpeed": 0.0254,
+			"WFS":           0.0254,
+			"GasFlow":       0.4719, // ft³/h
+			"gasFlow":       0.4719,
+			"TravelSpeed":   25.4 / 60, // in/min
+			"travelSpeed":   25.4 / 60,
+		},
+	},
+}
+
+var errPresetPayload = errors.New("preset requires a JSON object payload")
+
+// Return the preset by name with the configured source fields replacing the defaults
+func newWeldPreset(name string, fields map[string]string) (*weldPreset, error) {
+	if name == "" {
+		return nil, nil
+	}
+	preset, ok := weldPresets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown preset %q (should be one of %s)", name, strings.Join(sortedKeys(weldPresets), ", "))
+	}
+	configured := &weldPreset{sources: map[string][]string{}, scales: preset.scales, channels: preset.channels}
+	for field, sources := range preset.sources {
+		configured.sources[field] = sources
+	}
+	for field, source := range fields {
+		if _, ok := preset.sources[field]; !ok {
+			return nil, fmt.Errorf("unknown preset field %q (should be one of %s)", field, strings.Join(sortedKeys(preset.sources), ", "))
+		}
+		configured.sources[field] = []string{source}
+	}
+	return configured, nil
+}
+
+// Normalize a parsed payload into the standard weld reading schema. The source fields are replaced by
+// the standard fields, standard fields which are not present are omitted and other fields are kept.
+func (p *weldPreset) decode(payload interface{}) (map[string]interface{}, error) {
+	fields, ok := payload.(map[string]interface{})
+	if !ok {
+		return nil, errPresetPayload
+	}
+	// The channels are decoded into a copy, so the source fields are looked up in the unchanged payload
+	if len(p.channels) > 0 {
+		flat := make(map[string]interface{}, len(fields))
+		for k, v := range fields {
+			flat[k] = v
+		}
+		for _, name := range p.channels {
+			channels, ok := flat[name]
+			if !ok {
+				continue
+			}
+			decoded, err := decodeChannels(channels)
+			if err != nil {
+				return nil, fmt.Errorf("invalid channels in field %q: %v", name, err)
+			}
+			delete(flat, name)
+			for k, v := range decoded {
+				flat[k] = v
+			}
+		}
+		fields = flat
+	}
+	out := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		out[k] = v
+	}
+	for _, field := range sortedKeys(p.sources) {
+		for _, source := range p.sources[field] {
+			v, ok := lookupField(fields, source)
+			if !ok || v == nil {
+				continue
+			}
+			out = deleteField(out, strings.Split(source, "."))
+			if field == weldArcOn {
+				if out[field], ok = toArcState(v); !ok {
+					return nil, fmt.Errorf("invalid %s value %v in field %q", field, v, source)
+				}
+			} else {
+				f, ok := toFloat(v)
+				if !ok {
+					return nil, fmt.Errorf("invalid %s value %v in field %q", field, v, source)
+				}
+				if scale, ok := p.scales[source]; ok {
+					f *= scale
+				}
+				out[field] = f
+			}
+			break
+		}
+	}
+	return out, nil
+}
+
+// Decode an array of channel objects like {"name": "Current", "value": 231.5, "unit": "A"} into
+// fields by channel name
+func decodeChannels(v interface{}) (map[string]interface{}, error) {
+	channels, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.New("not an array")
+	}
+	fields := make(map[string]interface{}, len(channels))
+	for i, c := range channels {
+		channel, ok := c.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("channel %d is not an object", i)
+		}
+		name, _ := firstField(channel, "name", "Name").(string)
+		if name == "" {
+			return nil, fmt.Errorf("channel %d has no name", i)
+		}
+		fields[name] = firstField(channel, "value", "Value")
+	}
+	return fields, nil
+}
+
+// Return the value of the first present field
+func firstField(fields map[string]interface{}, names ...string) interface{} {
+	for _, name := range names {
+		if v, ok := fields[name]; ok {
+			return v
+		}
+	}
+	return nil
+}
+
+// Convert an arc state to a boolean, numbers are on if not zero
+func toArcState(v interface{}) (bool, bool) {
+	if s, ok := v.(string); ok {
+		switch strings.ToLower(strings.TrimSpace(s)) {
+		case "on", "true", "active", "welding", "1":
+			return true, true
+		case "off", "false", "inactive", "idle", "0":
+			return false, true
+		}
+		return false, false
+	}
+	if b, ok := v.(bool); ok {
+		return b, true
+	}
+	f, ok := toFloat(v)
+	return f != 0, ok
+}
@@ -0,0 +1,165 @@
+package mqttclient
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+type presetTest struct {
+	name    string
+	fields  map[string]string // Configured source fields
+	payload string
+	want    map[string]interface{}
+	wantErr bool
+}
+
+// Decode the JSON payloads with a preset, numbers are compared with a tolerance for the unit conversions
+func testPreset(t *testing.T, preset string, tests []presetTest) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newWeldPreset(preset, tt.fields)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var payload interface{}
+			if err := json.Unmarshal([]byte(tt.payload), &payload); err != nil {
+				t.Fatal(err)
+			}
+			got, err := p.decode(payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decode error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("decoded %v, want %v", got, tt.want)
+			}
+			for field, want := range tt.want {
+				if !presetValueEqual(got[field], want) {
+					t.Errorf("%s = %v, want %v", field, got[field], want)
+				}
+			}
+		})
+	}
+}
+
+func presetValueEqual(got, want interface{}) bool {
+	if w, ok := want.(float64); ok {
+		g, ok := got.(float64)
+		return ok && math.Abs(g-w) < 1e-9
+	}
+	if w, ok := want.(map[string]interface{}); ok {
+		g, ok := got.(map[string]interface{})
+		if !ok || len(g) != len(w) {
+			return false
+		}
+		for k := range w {
+			if !presetValueEqual(g[k], w[k]) {
+				return false
+			}
+		}
+		return true
+	}
+	return got == want
+}
+
+func TestPresetESABWeldCloud(t *testing.T) {
+	testPreset(t, "esab_weldcloud", []presetTest{
+		{
+			name:    "nested measurements",
+			payload: `{"serial": "W123", "arcOn": true, "measurements": {"current": 182.5, "voltage": 24.1, "wireFeedSpeed": 9.5, "gasFlow": 14}}`,
+			want: map[string]interface{}{
+				"serial": "W123", "arc_on": true, "measurements": map[string]interface{}{},
+				weldCurrent: 182.5, weldVoltage: 24.1, weldWireFeedSpeed: 9.5, weldGasFlow: 14.0,
+			},
+		},
+		{
+			name:    "flat measurements",
+			payload: `{"Current": 120, "Voltage": "19.5", "WeldState": "idle"}`,
+			want:    map[string]interface{}{weldCurrent: 120.0, weldVoltage: 19.5, weldArcOn: false},
+		},
+		{
+			name:    "nested measurements take precedence",
+			payload: `{"current": 1, "measurements": {"current": 2}}`,
+			want:    map[string]interface{}{"current": 1.0, "measurements": map[string]interface{}{}, weldCurrent: 2.0},
+		},
+		{
+			name:    "configured source field",
+			fields:  map[string]string{weldCurrent: "data.amps"},
+			payload: `{"data": {"amps": 99}, "current": 1}`,
+			want:    map[string]interface{}{"data": map[string]interface{}{}, "current": 1.0, weldCurrent: 99.0},
+		},
+		{name: "invalid arc state", payload: `{"weldState": "sleeping"}`, wantErr: true},
+		{name: "non numeric current", payload: `{"current": "high"}`, wantErr: true},
+		{name: "array payload", payload: `[1, 2]`, wantErr: true},
+	})
+}
+
+func TestPresetFronius(t *testing.T) {
+	testPreset(t, "fronius", []presetTest{
+		{
+			name:    "flat fields",
+			payload: `{"WeldingCurrent": 231.5, "WeldingVoltage": 27.2, "WireFeedSpeed": 10, "WeldingSpeed": 60, "ArcOn": 1}`,
+			want:    map[string]interface{}{weldCurrent: 231.5, weldVoltage: 27.2, weldWireFeedSpeed: 10.0, weldTravelSpeed: 10.0, weldArcOn: true},
+		},
+		{
+			name: "channel layout",
+			payload: `{"SerialNumber": "28130", "Channels": [
+				{"name": "Current", "value": 231.5, "unit": "A"},
+				{"Name": "Voltage", "Value": 27.2, "Unit": "V"},
+				{"name": "TravelSpeed", "value": 30, "unit": "cm/min"},
+				{"name": "MotorCurrent", "value": 1.2}
+			]}`,
+			want: map[string]interface{}{
+				"SerialNumber": "28130", "MotorCurrent": 1.2,
+				weldCurrent: 231.5, weldVoltage: 27.2, weldTravelSpeed: 5.0,
+			},
+		},
+		{
+			name:    "lower case channels",
+			payload: `{"channels": [{"name": "I", "value": 150}, {"name": "CurrentFlow", "value": "active"}]}`,
+			want:    map[string]interface{}{weldCurrent: 150.0, weldArcOn: true},
+		},
+		{
+			name:    "flat field before channel",
+			payload: `{"WeldingCurrent": 200, "Channels": [{"name": "Current", "value": 100}]}`,
+			want:    map[string]interface{}{"Current": 100.0, weldCurrent: 200.0},
+		},
+		{name: "channels not an array", payload: `{"Channels": {"Current": 100}}`, wantErr: true},
+		{name: "channel without name", payload: `{"Channels": [{"value": 100}]}`, wantErr: true},
+		{name: "channel not an object", payload: `{"Channels": [100]}`, wantErr: true},
+	})
+}
+
+func TestPresetLincoln(t *testing.T) {
+	testPreset(t, "lincoln", []presetTest{
+		{
+			name:    "US units",
+			payload: `{"WeldCurrent": 210, "WeldVoltage": 25.5, "WireFeedSpeed": 400, "GasFlow": 35, "TravelSpeed": 15, "WeldInProgress": "true"}`,
+			want: map[string]interface{}{
+				weldCurrent: 210.0, weldVoltage: 25.5, weldWireFeedSpeed: 10.16, weldGasFlow: 16.5165,
+				weldTravelSpeed: 6.35, weldArcOn: true,
+			},
+		},
+		{
+			name:    "camel case fields",
+			payload: `{"weldCurrent": 150, "weldVoltage": 20, "wireFeedSpeed": 250, "weldInProgress": false}`,
+			want:    map[string]interface{}{weldCurrent: 150.0, weldVoltage: 20.0, weldWireFeedSpeed: 6.35, weldArcOn: false},
+		},
+		{
+			name:    "short field names",
+			payload: `{"Amps": 90, "Volts": 18, "WFS": 100, "ArcOn": 0}`,
+			want:    map[string]interface{}{weldCurrent: 90.0, weldVoltage: 18.0, weldWireFeedSpeed: 2.54, weldArcOn: false},
+		},
+		{
+			name:    "configured source fields are not converted",
+			fields:  map[string]string{weldWireFeedSpeed: "wfs_m_min"},
+			payload: `{"wfs_m_min": 8, "WFS": 100}`,
+			want:    map[string]interface{}{"WFS": 100.0, weldWireFeedSpeed: 8.0},
+		},
+		{name: "null values are skipped", payload: `{"WeldCurrent": null, "Amps": 75}`, want: map[string]interface{}{"WeldCurrent": nil, weldCurrent: 75.0}},
+	})
+}
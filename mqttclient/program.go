@@ -0,0 +1,122 @@
+package mqttclient
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Maps the program_context configuration attribute
+type ProgramContextConfig struct {
+	Topic     string            `json:"topic"`      // Topic filter of the program messages of the robot or welder
+	Fields    map[string]string `json:"fields"`     // Context fields and their source payload fields, default {"program": "program"}
+	CellLevel *int              `json:"cell_level"` // Topic level of the cell, messages only get the context of their cell
+}
+
+// Validate the program context configuration
+func (cfg *ProgramContextConfig) Validate() error {
+	if !validTopicFilter(cfg.Topic) {
+		return fmt.Errorf("invalid program_context topic %q", cfg.Topic)
+	}
+	for name, source := range cfg.Fields {
+		if name == "" || source == "" {
+			return fmt.Errorf("invalid program_context field %q: %q", name, source)
+		}
+	}
+	if cfg.CellLevel != nil && *cfg.CellLevel < 0 {
+		return fmt.Errorf("program_context cell_level must be >= 0")
+	}
+	return nil
+}
+
+// The program and part identifiers of the last program messages, by cell
+type programContext struct {
+	topic     string
+	fields    map[string]string
+	cellLevel int // -1 if all messages share one context
+	contexts  map[string]map[string]interface{}
+}
+
+func newProgramContext(cfg *ProgramContextConfig) *programContext {
+	if cfg == nil {
+		return nil
+	}
+	p := &programContext{topic: cfg.Topic, fields: cfg.Fields, cellLevel: -1, contexts: map[string]map[string]interface{}{}}
+	if len(p.fields) == 0 {
+		p.fields = map[string]string{"program": "program"}
+	}
+	if cfg.CellLevel != nil {
+		p.cellLevel = *cfg.CellLevel
+	}
+	return p
+}
+
+// Return the cell of a topic, empty if all messages share one context
+func (p *programContext) cell(topic string) string {
+	if p.cellLevel < 0 {
+		return ""
+	}
+	levels := strings.Split(topic, "/")
+	if p.cellLevel >= len(levels) {
+		return ""
+	}
+	return levels[p.cellLevel]
+}
+
+// Update the context of the cell with a program message, fields which are not present are kept
+func (p *programContext) update(topic string, payload interface{}) {
+	if !topicMatches(p.topic, topic) {
+		return
+	}
+	cell := p.cell(topic)
+	ctx, ok := p.contexts[cell]
+	if !ok {
+		ctx = map[string]interface{}{}
+		p.contexts[cell] = ctx
+	}
+	for name, source := range p.fields {
+		if v, ok := lookupField(payload, source); ok && v != nil {
+			if _, nested := v.(map[string]interface{}); !nested {
+				ctx[name] = v
+			}
+		}
+	}
+}
+
+// Return the context of the cell of a topic
+func (p *programContext) values(topic string) map[string]interface{} {
+	return p.contexts[p.cell(topic)]
+}
+
+func (p *programContext) readings() map[string]interface{} {
+	if p.cellLevel < 0 {
+		if ctx := p.contexts[""]; ctx != nil {
+			return ctx
+		}
+		return map[string]interface{}{}
+	}
+	readings := map[string]interface{}{}
+	for cell, ctx := range p.contexts {
+		readings[cell] = ctx
+	}
+	return readings
+}
+
+// Update the program context with a newly received message and add the context of its cell to its
+// derived fields, fields of the payload are not replaced. Must be called with the mutex held, after
+// the derived fields are computed.
+func (s *mqttClient) correlateProgram(msg *receivedMessage) {
+	if s.programs == nil {
+		return
+	}
+	payload, err := s.parse(msg)
+	if err != nil {
+		return
+	}
+	s.programs.update(msg.Topic(), payload)
+	for name, v := range s.programs.values(msg.Topic()) {
+		if _, ok := lookupField(payload, name); ok {
+			continue
+		}
+		msg.setDerived(name, v)
+	}
+}
@@ -0,0 +1,78 @@
+package mqttclient
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/url"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/quic-go/quic-go"
+)
+
+// Transports of the broker connections
+const (
+	transportTCP  = "tcp"
+	transportQUIC = "quic"
+)
+
+const (
+	quicALPN      = "mqtt"                 // Application protocol of the MQTT over QUIC listeners, e.g. of EMQX and NanoMQ
+	quicKeepAlive = 15 * time.Second       // QUIC closes a connection idle for 30 seconds, before the MQTT keep alive of 30 seconds pings
+	quicCloseWait = 250 * time.Millisecond // Time the broker has to close the connection after the DISCONNECT was sent
+)
+
+// An MQTT connection over one bidirectional QUIC stream, the packets are exchanged like over TCP so both client
+// libraries use it as network connection
+type quicConn struct {
+	quic.Stream
+	conn quic.Connection
+}
+
+// Open a QUIC connection to the broker and its stream. QUIC always encrypts, the ALPN of MQTT is added to the TLS
+// configuration.
+func dialQUIC(ctx context.Context, address string, tlsConfig *tls.Config) (*quicConn, error) {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{quicALPN}
+	conn, err := quic.DialAddr(ctx, address, tlsConfig, &quic.Config{KeepAlivePeriod: quicKeepAlive})
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, err
+	}
+	return &quicConn{Stream: stream, conn: conn}, nil
+}
+
+// Open the connection of the client options, both client libraries call it instead of dialing TCP
+func openQUICConnection(server *url.URL, opts mqtt.ClientOptions) (net.Conn, error) {
+	ctx := context.Background()
+	if opts.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.ConnectTimeout)
+		defer cancel()
+	}
+	return dialQUIC(ctx, server.Host, opts.TLSConfig)
+}
+
+func (c *quicConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *quicConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close the stream and the connection. Closing the connection discards the data not sent yet, so the broker gets
+// a moment to read the DISCONNECT and close the connection itself, otherwise it publishes the last will.
+func (c *quicConn) Close() error {
+	c.Stream.Close()
+	select {
+	case <-c.conn.Context().Done():
+	case <-time.After(quicCloseWait):
+	}
+	return c.conn.CloseWithError(0, "")
+}
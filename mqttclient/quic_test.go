@@ -0,0 +1,137 @@
+package mqttclient
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/quic-go/quic-go"
+
+	"github.com/lab101/mqtt-welding/internal/mqtttest"
+)
+
+// Accept MQTT over QUIC connections for the embedded broker, with a self-signed certificate. Returns the port of
+// the QUIC listener.
+func startQUICListener(t *testing.T, broker *embeddedBroker) int {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "broker"},
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cert}, PrivateKey: key}},
+		NextProtos:   []string{quicALPN},
+	}
+	l, err := quic.ListenAddr("127.0.0.1:0", tlsConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				stream, err := conn.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				broker.server.EstablishConnection("quic", &quicConn{Stream: stream, conn: conn})
+			}()
+		}
+	}()
+	return l.Addr().(*net.UDPAddr).Port
+}
+
+// Both protocol versions subscribe and publish over QUIC
+func TestQUICConnection(t *testing.T) {
+	broker, b := newTestEmbeddedBroker(t)
+	port := startQUICListener(t, broker)
+	publisher := b.Client(t, "publisher")
+	for _, version := range []int{protocolMQTT311, protocolMQTT5} {
+		cfg := &BrokerConfig{
+			Host:            b.Host,
+			Port:            port,
+			ClientID:        "remote-cell",
+			TLS:             &TLSConfig{InsecureSkipVerify: true},
+			Transport:       transportQUIC,
+			ProtocolVersion: version,
+		}
+		if err := cfg.Validate("quic"); err != nil {
+			t.Fatal(err)
+		}
+		messages := make(chan mqtt.Message, 10)
+		client, err := cfg.connectAndSubscribe(context.Background(), "weld/#", 1, func(_ mqtt.Client, m mqtt.Message) {
+			messages <- m
+		})
+		if err != nil {
+			t.Fatalf("connecting with protocol version %d: %v", version, err)
+		}
+		mqtttest.Publish(t, publisher, "weld/cell9/data", "sample", false)
+		if m := mqtttest.Receive(t, messages); string(m.Payload()) != "sample" {
+			t.Errorf("protocol version %d received %q, want sample", version, m.Payload())
+		}
+		if err := publishAndWait(context.Background(), client, "weld/cell9/cmd", 1, false, "stop"); err != nil {
+			t.Errorf("publishing with protocol version %d: %v", version, err)
+		}
+		if m := mqtttest.Receive(t, messages); string(m.Payload()) != "stop" {
+			t.Errorf("protocol version %d received %q, want stop", version, m.Payload())
+		}
+		client.Disconnect(250)
+	}
+}
+
+// The connection check replaces the TCP and TLS steps with the QUIC handshake
+func TestCheckQUICConnection(t *testing.T) {
+	broker, b := newTestEmbeddedBroker(t)
+	cfg := &BrokerConfig{
+		Host:      b.Host,
+		Port:      startQUICListener(t, broker),
+		ClientID:  "remote-cell",
+		TLS:       &TLSConfig{InsecureSkipVerify: true},
+		Transport: transportQUIC,
+	}
+	result := checkConnection(context.Background(), cfg, map[string]byte{"weld/#": 1}, checkArgs{})
+	if result["ok"] != true {
+		t.Fatalf("check failed: %v", result)
+	}
+	var names []string
+	for _, step := range result["steps"].([]interface{}) {
+		names = append(names, step.(map[string]interface{})["step"].(string))
+	}
+	if want := []string{"dns", "quic", "mqtt_connect", "subscribe"}; !slices.Equal(names, want) {
+		t.Errorf("steps %v, want %v", names, want)
+	}
+}
+
+// A transport other than TCP and QUIC is rejected
+func TestValidateTransport(t *testing.T) {
+	for transport, valid := range map[string]bool{"": true, "tcp": true, "quic": true, "ws": false} {
+		cfg := &BrokerConfig{Host: "broker", Port: 14567, Transport: transport}
+		if err := cfg.Validate("mqtt"); (err == nil) != valid {
+			t.Errorf("transport %q: error %v, want valid %v", transport, err, valid)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package mqttclient
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Maps the record_to_file configuration attribute
+type RecordConfig struct {
+	Dir       string  `json:"dir"`         // Directory of the recording, default $VIAM_MODULE_DATA or the temporary directory
+	Topic     string  `json:"topic"`       // Optional topic filter of the recorded messages
+	MaxFileMB float64 `json:"max_file_mb"` // Size at which the file is rotated, default 64
+	MaxFiles  int     `json:"max_files"`   // Rotated files kept besides the current file, default 5
+}
+
+// Default size at which a recording is rotated
+const defaultRecordFileMB = 64
+
+// Default number of rotated recordings kept
+const defaultRecordFiles = 5
+
+// Validate the record_to_file configuration
+func (cfg *RecordConfig) Validate() error {
+	if cfg.Topic != "" && !validTopicFilter(cfg.Topic) {
+		return fmt.Errorf("invalid record_to_file topic %q", cfg.Topic)
+	}
+	if cfg.MaxFileMB < 0 {
+		return fmt.Errorf("record_to_file max_file_mb must be >= 0")
+	}
+	if cfg.MaxFiles < 0 {
+		return fmt.Errorf("record_to_file max_files must be >= 0")
+	}
+	return nil
+}
+
+// Appends the received messages as JSON lines to a file rotated when it reaches its size cap. The file
+// <name>-record.jsonl is rotated to <name>-record.1.jsonl, the oldest rotated file is removed.
+type recorder struct {
+	topic    string
+	path     string
+	maxBytes int64
+	maxFiles int
+	f        *os.File
+	size     int64
+	failing  bool // Set after a failed write until a write succeeds, to log a failure once
+}
+
+func newRecorder(cfg *RecordConfig, name string) *recorder {
+	if cfg == nil {
+		return nil
+	}
+	dir := cfg.Dir
+	if dir == "" {
+		if dir = os.Getenv("VIAM_MODULE_DATA"); dir == "" {
+			dir = os.TempDir()
+		}
+	}
+	r := &recorder{
+		topic:    cfg.Topic,
+		path:     filepath.Join(dir, discoveryInvalidChars.ReplaceAllString(name, "_")+"-record.jsonl"),
+		maxBytes: int64(defaultRecordFileMB * 1024 * 1024),
+		maxFiles: defaultRecordFiles,
+	}
+	if cfg.MaxFileMB > 0 {
+		r.maxBytes = int64(cfg.MaxFileMB * 1024 * 1024)
+	}
+	if cfg.MaxFiles > 0 {
+		r.maxFiles = cfg.MaxFiles
+	}
+	return r
+}
+
+// Path of a rotated file, 0 is the current file
+func (r *recorder) rotatedPath(i int) string {
+	if i == 0 {
+		return r.path
+	}
+	ext := filepath.Ext(r.path)
+	return fmt.Sprintf("%s.%d%s", r.path[:len(r.path)-len(ext)], i, ext)
+}
+
+// Close the current file and shift the rotated files, the oldest one is removed
+func (r *recorder) rotate() error {
+	if err := r.close(); err != nil {
+		return err
+	}
+	if err := os.Remove(r.rotatedPath(r.maxFiles)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := r.maxFiles - 1; i >= 0; i-- {
+		if err := os.Rename(r.rotatedPath(i), r.rotatedPath(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Append a message to the recording, the file is opened on the first message and appended to if it exists
+func (r *recorder) write(msg *receivedMessage) error {
+	if r.topic != "" && !topicMatches(r.topic, msg.Topic()) {
+		return nil
+	}
+	buf, err := encodePooled(newExportedMessage(msg))
+	if err != nil {
+		return err
+	}
+	defer releaseBuffer(buf)
+	line := buf.Bytes()
+	if r.f != nil && r.size > 0 && r.size+int64(len(line)) > r.maxBytes {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+	if r.f == nil {
+		if r.f, err = os.OpenFile(r.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644); err != nil {
+			return err
+		}
+		info, err := r.f.Stat()
+		if err != nil {
+			return err
+		}
+		r.size = info.Size()
+	}
+	n, err := r.f.Write(line)
+	r.size += int64(n)
+	return err
+}
+
+func (r *recorder) close() error {
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f, r.size = nil, 0
+	return err
+}
+
+// Record a received message if record_to_file is configured. Must be called with the mutex held.
+func (s *mqttClient) record(msg *receivedMessage) {
+	if s.recorder == nil {
+		return
+	}
+	if err := s.recorder.write(msg); err != nil {
+		if !s.recorder.failing {
+			s.logger.Errorf("error recording messages to %v: %v", s.recorder.path, err)
+		}
+		s.recorder.failing = true
+		return
+	}
+	s.recorder.failing = false
+}
+
+// Close the recording of the previous configuration and start recording if configured. Must be called
+// with the mutex held.
+func (s *mqttClient) resetRecorder(cfg *RecordConfig) {
+	if s.recorder != nil {
+		if err := s.recorder.close(); err != nil {
+			s.logger.Errorf("error closing recording %v: %v", s.recorder.path, err)
+		}
+	}
+	s.recorder = newRecorder(cfg, s.Name().ShortName())
+}
@@ -0,0 +1,214 @@
+package mqttclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Maps the replay configuration attribute
+type ReplayConfig struct {
+	Path         string   `json:"path"`          // JSON lines file written by the export command or the recorder
+	Speed        *float64 `json:"speed"`         // Factor of the recorded timing, default 1, 0 replays as fast as possible
+	Topic        string   `json:"topic"`         // Optional topic filter of the replayed messages
+	Loop         bool     `json:"loop"`          // Start again at the beginning of the file at its end
+	RecordedTime bool     `json:"recorded_time"` // Use the recorded receive times instead of the replay time
+}
+
+// Validate the replay configuration
+func (cfg *ReplayConfig) Validate() error {
+	if cfg.Path == "" {
+		return fmt.Errorf("replay requires a path")
+	}
+	if cfg.Speed != nil && *cfg.Speed < 0 {
+		return fmt.Errorf("replay speed must be >= 0")
+	}
+	if cfg.Topic != "" && !validTopicFilter(cfg.Topic) {
+		return fmt.Errorf("invalid replay topic %q", cfg.Topic)
+	}
+	return nil
+}
+
+// Progress of a replay
+type replayProgress struct {
+	path     string
+	replayed uint64 // Messages handled
+	invalid  uint64 // Lines which are not a recorded message
+	loops    uint64 // Completed passes over the file
+	done     bool
+	err      error
+}
+
+func (p *replayProgress) readings() map[string]interface{} {
+	readings := map[string]interface{}{
+		"path":     p.path,
+		"replayed": p.replayed,
+		"invalid":  p.invalid,
+		"loops":    p.loops,
+		"done":     p.done,
+	}
+	if p.err != nil {
+		readings["error"] = p.err.Error()
+	}
+	return readings
+}
+
+// Decode a line of a recording into a message and its recorded receive time, zero if the line has none
+func decodeRecordedMessage(line []byte) (*injectedMessage, time.Time, error) {
+	var rec exportedMessage
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return nil, time.Time{}, err
+	}
+	if !validTopicName(rec.Topic) {
+		return nil, time.Time{}, fmt.Errorf("invalid topic %q", rec.Topic)
+	}
+	msg := &injectedMessage{topic: rec.Topic, qos: rec.QoS, retained: rec.Retained, payload: []byte(rec.Payload)}
+	if rec.PayloadBase64 != "" {
+		payload, err := base64.StdEncoding.DecodeString(rec.PayloadBase64)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		msg.payload = payload
+	}
+	var received time.Time
+	if rec.Received != "" {
+		var err error
+		if received, err = time.Parse(time.RFC3339Nano, rec.Received); err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+	return msg, received, nil
+}
+
+// Stop the running replay and start replaying the recording if configured. Must be called with the
+// mutex held.
+func (s *mqttClient) resetReplay(cfg *ReplayConfig) {
+	if s.stopReplay != nil {
+		s.stopReplay()
+		s.stopReplay = nil
+	}
+	s.replay = nil
+	if cfg == nil {
+		return
+	}
+	speed := 1.0
+	if cfg.Speed != nil {
+		speed = *cfg.Speed
+	}
+	progress := &replayProgress{path: cfg.Path}
+	s.replay = progress
+	s.logger.Infof("replaying %q at speed %v without broker", cfg.Path, speed)
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopReplay = cancel
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			s.mutex.Lock()
+			before := progress.replayed
+			s.mutex.Unlock()
+			err := s.replayFile(ctx, *cfg, speed, progress)
+			s.mutex.Lock()
+			// A recording without matching messages is not looped
+			if err == nil && cfg.Loop && progress.replayed > before {
+				progress.loops++
+				s.mutex.Unlock()
+				continue
+			}
+			if errors.Is(err, context.Canceled) {
+				s.mutex.Unlock()
+				return
+			}
+			if err == nil {
+				progress.loops++
+				s.logger.Infof("replay of %q complete, %d messages", cfg.Path, progress.replayed)
+			} else {
+				s.logger.Errorf("replay of %q failed: %v", cfg.Path, err)
+			}
+			progress.done, progress.err = true, err
+			s.mutex.Unlock()
+			return
+		}
+	}()
+}
+
+// Replay the messages of a recording once, waiting the recorded time between messages divided by the speed
+func (s *mqttClient) replayFile(ctx context.Context, cfg ReplayConfig, speed float64, progress *replayProgress) error {
+	f, err := os.Open(cfg.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var previous time.Time
+	for {
+		// Lines are not limited in length, payloads can be large
+		line, err := r.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if len(line) > 0 {
+			if err := s.replayLine(ctx, cfg, speed, line, &previous, progress); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+func (s *mqttClient) replayLine(ctx context.Context, cfg ReplayConfig, speed float64, line []byte, previous *time.Time, progress *replayProgress) error {
+	msg, recorded, err := decodeRecordedMessage(line)
+	if err != nil {
+		if len(bytes.TrimSpace(line)) > 0 {
+			s.mutex.Lock()
+			progress.invalid++
+			s.mutex.Unlock()
+		}
+		return nil
+	}
+	if cfg.Topic != "" && !topicMatches(cfg.Topic, msg.Topic()) {
+		return nil
+	}
+	if speed > 0 && !recorded.IsZero() && !previous.IsZero() {
+		if wait := time.Duration(float64(recorded.Sub(*previous)) / speed); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-s.done:
+				timer.Stop()
+				return context.Canceled
+			case <-timer.C:
+			}
+		}
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.done:
+		return context.Canceled
+	default:
+	}
+	if !recorded.IsZero() {
+		*previous = recorded
+	}
+	received := time.Now()
+	if cfg.RecordedTime && !recorded.IsZero() {
+		received = recorded
+	}
+	s.receive(&receivedMessage{Message: msg, received: received})
+	s.mutex.Lock()
+	progress.replayed++
+	s.mutex.Unlock()
+	return nil
+}
@@ -0,0 +1,74 @@
+package mqttclient
+
+import (
+	"context"
+	"time"
+)
+
+// Time without retained message after which the broker is assumed to have sent all retained messages
+const retainedQuietPeriod = 250 * time.Millisecond
+
+// Interval at which the retained bootstrap checks for the subscription and the retained messages
+const retainedPollInterval = 20 * time.Millisecond
+
+// Keep a message as latest message, of the component and of its topic. Must be called with the mutex held.
+func (s *mqttClient) setLatest(msg *receivedMessage) {
+	s.latestMessage = msg
+	if s.latestByTopic == nil {
+		s.latestByTopic = map[string]*receivedMessage{}
+	}
+	s.latestByTopic[msg.Topic()] = msg
+	if msg.Retained() {
+		s.retainedAt = msg.received
+	}
+}
+
+// Wait until the subscription is acknowledged and the broker sent the retained messages of the subscribed
+// topics, at most the timeout, so the first Readings call returns the retained state. The broker sends the
+// retained messages right after the SUBACK, they are complete once none arrived for a short while. The
+// start is the time the client started connecting. Must not be called with the mutex held.
+func (s *mqttClient) awaitRetained(ctx context.Context, start time.Time, timeout time.Duration) {
+	deadline := start.Add(timeout)
+	ticker := time.NewTicker(retainedPollInterval)
+	defer ticker.Stop()
+	for {
+		subscribedAt := s.status.lastSubscribed()
+		s.mutex.Lock()
+		retainedAt := s.retainedAt
+		s.mutex.Unlock()
+		if subscribedAt.After(start) && time.Since(maxTime(subscribedAt, retainedAt)) >= retainedQuietPeriod {
+			break
+		}
+		if time.Now().After(deadline) {
+			s.logger.Warnf("retained messages not complete after %v, the first readings may be empty", timeout)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+	}
+	// The buffered messages are processed before the component is ready
+	for s.handoffDepth() > 0 && time.Now().Before(deadline) {
+		time.Sleep(retainedPollInterval)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	topics := 0
+	for _, msg := range s.latestByTopic {
+		if msg.Retained() && !msg.received.Before(start) {
+			topics++
+		}
+	}
+	s.logger.Infof("seeded the latest message of %d topics from retained messages in %v", topics, time.Since(start).Round(time.Millisecond))
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
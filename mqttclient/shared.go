@@ -0,0 +1,416 @@
+package mqttclient
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Broker connections shared by the components with "shared_connection", by broker address and client ID
+var sharedConnections = struct {
+	connections map[string]*sharedConnection
+	mutex       sync.Mutex
+}{connections: map[string]*sharedConnection{}}
+
+// A broker connection and the subscriptions of the components using it. A connection without
+// "shared_connection" is used by one component and restores its subscriptions the same way.
+type sharedConnection struct {
+	cfg       BrokerConfig
+	client    mqtt.Client             // Replaced when the connection is restarted with a new last will
+	key       string                  // Empty for the connection of one component
+	users     int                     // Guarded by the mutex of sharedConnections
+	ready     chan struct{}           // Closed once the first connection attempt completed
+	err       error                   // Error of the first connection attempt, set before ready is closed
+	routes    map[string]*sharedRoute // Subscriptions by topic filter
+	clients   map[*sharedClient]bool  // Components notified of reconnects and lost connections
+	willOwner *sharedClient           // Component whose last will the connection carries
+	will      func() (topic string, payload []byte)
+	mutex     sync.Mutex
+}
+
+// The handlers of the components subscribed to a topic filter. The MQTT library keeps one handler per
+// filter, so the connection dispatches the messages to the components itself.
+type sharedRoute struct {
+	qos      byte
+	handlers map[*sharedClient]mqtt.MessageHandler
+}
+
+// The connection of one component. Subscriptions and disconnects only affect the component, the broker
+// connection is closed when its last component disconnects.
+type sharedClient struct {
+	conn      *sharedConnection
+	onConnect func(mqtt.Client) // Called after every reconnect once the subscriptions are restored
+	onLost    func(error)
+	closed    atomic.Bool // Set by the first Disconnect, the connection is released once
+}
+
+// A token of an operation that completed without a broker round trip
+type completedToken struct{}
+
+var completedChan = func() chan struct{} { ch := make(chan struct{}); close(ch); return ch }()
+
+func (completedToken) Wait() bool                     { return true }
+func (completedToken) WaitTimeout(time.Duration) bool { return true }
+func (completedToken) Done() <-chan struct{}          { return completedChan }
+func (completedToken) Error() error                   { return nil }
+
+// Return a client using the shared connection to the broker, connecting if no component uses it yet.
+// The components acquiring a connection while it connects wait for the attempt until the context is done,
+// the connections to other brokers are not blocked meanwhile.
+func acquireSharedConnection(ctx context.Context, cfg *BrokerConfig) (mqtt.Client, error) {
+	key := sharedConnectionKey(cfg)
+	sharedConnections.mutex.Lock()
+	conn, ok := sharedConnections.connections[key]
+	if !ok {
+		var err error
+		if conn, err = newSharedConnection(cfg, key); err != nil {
+			sharedConnections.mutex.Unlock()
+			return nil, err
+		}
+		sharedConnections.connections[key] = conn
+	}
+	conn.users++
+	sharedConnections.mutex.Unlock()
+
+	if !ok {
+		conn.connect(ctx)
+	}
+	return conn.join(ctx)
+}
+
+// Return a client using a connection of its own, it isn't shared with other components
+func openPrivateConnection(ctx context.Context, cfg *BrokerConfig) (mqtt.Client, error) {
+	conn, err := newSharedConnection(cfg, "")
+	if err != nil {
+		return nil, err
+	}
+	conn.users = 1
+	conn.connect(ctx)
+	return conn.join(ctx)
+}
+
+func newSharedConnection(cfg *BrokerConfig, key string) (*sharedConnection, error) {
+	conn := &sharedConnection{
+		cfg:     *cfg,
+		key:     key,
+		ready:   make(chan struct{}),
+		routes:  map[string]*sharedRoute{},
+		clients: map[*sharedClient]bool{},
+	}
+	var err error
+	if conn.client, err = conn.newClient(true); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Make the first connection attempt, the attempt is abandoned when the context is done
+func (conn *sharedConnection) connect(ctx context.Context) {
+	token := conn.client.Connect()
+	select {
+	case <-token.Done():
+		conn.err = token.Error()
+	case <-ctx.Done():
+		conn.err = fmt.Errorf("timed out connecting to broker %s:%d: %w", conn.cfg.Host, conn.cfg.Port, ctx.Err())
+	}
+	close(conn.ready)
+}
+
+// Wait for the first connection attempt and add a component to the connection
+func (conn *sharedConnection) join(ctx context.Context) (mqtt.Client, error) {
+	select {
+	case <-conn.ready:
+	case <-ctx.Done():
+		conn.release(0)
+		return nil, fmt.Errorf("timed out waiting for the connection to broker %s:%d: %w", conn.cfg.Host, conn.cfg.Port, ctx.Err())
+	}
+	if conn.err != nil {
+		// The failed connection is removed with its last waiting component, the next component connects again
+		conn.release(0)
+		return nil, conn.err
+	}
+	c := &sharedClient{conn: conn}
+	conn.mutex.Lock()
+	conn.clients[c] = true
+	conn.mutex.Unlock()
+	return c, nil
+}
+
+// Create the MQTT client of the connection. The subscriptions of all components are restored after a
+// reconnect, the first connection of the initial client is subscribed by the components.
+func (conn *sharedConnection) newClient(initial bool) (mqtt.Client, error) {
+	opts, err := newClientOptions(&conn.cfg)
+	if err != nil {
+		return nil, err
+	}
+	// A restarted connection is retried until it succeeds, the components already use it
+	opts.SetConnectRetry(!initial)
+	var connections atomic.Uint64
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		if connections.Add(1) == 1 && initial {
+			return
+		}
+		conn.resubscribe(client)
+		for _, c := range conn.listeners() {
+			if c.onConnect != nil {
+				c.onConnect(c)
+			}
+		}
+	})
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		for _, c := range conn.listeners() {
+			if c.onLost != nil {
+				c.onLost(err)
+			}
+		}
+	})
+	// The will is built again for every reconnect, so it carries the state of the owner at the time
+	opts.SetReconnectingHandler(func(_ mqtt.Client, opts *mqtt.ClientOptions) {
+		conn.applyWill(opts)
+	})
+	conn.applyWill(opts)
+	return newMQTTClient(&conn.cfg, opts), nil
+}
+
+// Set the last will of the owner in the options, or remove it if the connection has no owner
+func (conn *sharedConnection) applyWill(opts *mqtt.ClientOptions) {
+	conn.mutex.Lock()
+	build := conn.will
+	conn.mutex.Unlock()
+	if build == nil {
+		opts.WillEnabled = false
+		return
+	}
+	topic, payload := build()
+	opts.SetBinaryWill(topic, payload, 1, false)
+}
+
+// The components of the connection with their handlers
+func (conn *sharedConnection) listeners() []*sharedClient {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	clients := make([]*sharedClient, 0, len(conn.clients))
+	for c := range conn.clients {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// The current MQTT client of the connection
+func (conn *sharedConnection) current() mqtt.Client {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.client
+}
+
+// Reconnect with a new MQTT client, the will is only sent with the CONNECT packet. The old client
+// disconnects cleanly first, so the broker doesn't publish its will or drop the new connection as a
+// client ID takeover.
+func (conn *sharedConnection) restart() error {
+	client, err := conn.newClient(false)
+	if err != nil {
+		return err
+	}
+	conn.mutex.Lock()
+	old := conn.client
+	conn.client = client
+	conn.mutex.Unlock()
+	old.Disconnect(250)
+	if token := client.Connect(); !token.WaitTimeout(defaultConnectTimeout) {
+		return fmt.Errorf("timed out reconnecting to broker %s:%d, retrying in the background", conn.cfg.Host, conn.cfg.Port)
+	} else if token.Error() != nil {
+		return token.Error()
+	}
+	return nil
+}
+
+// Connections are shared by broker address and client ID
+func sharedConnectionKey(cfg *BrokerConfig) string {
+	return fmt.Sprintf("%s:%d/%s", cfg.Host, cfg.Port, cfg.ClientID)
+}
+
+// Remove a component from the connection, the broker connection is closed when its last component is removed
+func (conn *sharedConnection) release(quiesce uint) {
+	sharedConnections.mutex.Lock()
+	conn.users--
+	last := conn.users == 0
+	if last && conn.key != "" && sharedConnections.connections[conn.key] == conn {
+		delete(sharedConnections.connections, conn.key)
+	}
+	sharedConnections.mutex.Unlock()
+	if last {
+		conn.current().Disconnect(quiesce)
+	}
+}
+
+// Dispatch a message of a topic filter to the handlers of the subscribed components
+func (conn *sharedConnection) dispatch(filter string) mqtt.MessageHandler {
+	return func(_ mqtt.Client, m mqtt.Message) {
+		conn.mutex.Lock()
+		route, ok := conn.routes[filter]
+		var clients []*sharedClient
+		var handlers []mqtt.MessageHandler
+		if ok {
+			for c, handler := range route.handlers {
+				clients = append(clients, c)
+				handlers = append(handlers, handler)
+			}
+		}
+		conn.mutex.Unlock()
+		for i, handler := range handlers {
+			handler(clients[i], m)
+		}
+	}
+}
+
+// Subscribe the topic filters of all components again and wait for the broker acknowledgements
+func (conn *sharedConnection) resubscribe(client mqtt.Client) {
+	conn.mutex.Lock()
+	filters := make(map[string]byte, len(conn.routes))
+	for filter, route := range conn.routes {
+		filters[filter] = route.qos
+	}
+	conn.mutex.Unlock()
+	tokens := make([]mqtt.Token, 0, len(filters))
+	for filter, qos := range filters {
+		tokens = append(tokens, client.Subscribe(filter, qos, conn.dispatch(filter)))
+	}
+	for _, token := range tokens {
+		token.WaitTimeout(defaultConnectTimeout)
+	}
+}
+
+// Add the handler of a component to a topic filter and return the QoS to subscribe the filter with, the
+// highest QoS requested by the components
+func (c *sharedClient) addRoute(filter string, qos byte, handler mqtt.MessageHandler) byte {
+	c.conn.mutex.Lock()
+	defer c.conn.mutex.Unlock()
+	route, ok := c.conn.routes[filter]
+	if !ok {
+		route = &sharedRoute{handlers: map[*sharedClient]mqtt.MessageHandler{}}
+		c.conn.routes[filter] = route
+	}
+	route.qos = max(route.qos, qos)
+	route.handlers[c] = handler
+	return route.qos
+}
+
+// Set the handlers called after every reconnect of the connection and when the connection is lost. The
+// subscriptions of the component are restored before onConnect is called with the client of the component.
+func (c *sharedClient) setHandlers(onConnect func(mqtt.Client), onLost func(error)) {
+	c.conn.mutex.Lock()
+	defer c.conn.mutex.Unlock()
+	c.onConnect, c.onLost = onConnect, onLost
+}
+
+// Set the last will of the connection, built again for every connection attempt. Only one component
+// of a connection can own the will. The open connection is restarted to send the will to the broker.
+func (c *sharedClient) setWill(build func() (topic string, payload []byte)) error {
+	c.conn.mutex.Lock()
+	if c.conn.willOwner != nil && c.conn.willOwner != c {
+		c.conn.mutex.Unlock()
+		return fmt.Errorf("the last will of the shared connection to %s is set by another component", c.conn.key)
+	}
+	c.conn.willOwner, c.conn.will = c, build
+	open := c.conn.client.IsConnectionOpen()
+	c.conn.mutex.Unlock()
+	if !open {
+		// The will is set when the connection is restored
+		return nil
+	}
+	return c.conn.restart()
+}
+
+// The connection is managed by the shared connection, connecting a component has no effect
+func (c *sharedClient) Connect() mqtt.Token {
+	return completedToken{}
+}
+
+func (c *sharedClient) IsConnected() bool {
+	return c.conn.current().IsConnected()
+}
+
+func (c *sharedClient) IsConnectionOpen() bool {
+	return c.conn.current().IsConnectionOpen()
+}
+
+func (c *sharedClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	return c.conn.current().Publish(topic, qos, retained, payload)
+}
+
+func (c *sharedClient) AddRoute(topic string, callback mqtt.MessageHandler) {
+	c.conn.current().AddRoute(topic, callback)
+}
+
+func (c *sharedClient) OptionsReader() mqtt.ClientOptionsReader {
+	return c.conn.current().OptionsReader()
+}
+
+func (c *sharedClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	qos = c.addRoute(topic, qos, callback)
+	return c.conn.current().Subscribe(topic, qos, c.conn.dispatch(topic))
+}
+
+func (c *sharedClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	subscribed := make(map[string]byte, len(filters))
+	for filter, qos := range filters {
+		subscribed[filter] = c.addRoute(filter, qos, callback)
+	}
+	// The library routes SubscribeMultiple to a single callback, every filter gets its own dispatcher before
+	// the retained messages arrive
+	client := c.conn.current()
+	for filter := range subscribed {
+		client.AddRoute(filter, c.conn.dispatch(filter))
+	}
+	return client.SubscribeMultiple(subscribed, nil)
+}
+
+// Remove the handlers of the component, the filters no other component subscribed to are unsubscribed
+func (c *sharedClient) Unsubscribe(topics ...string) mqtt.Token {
+	c.conn.mutex.Lock()
+	var unused []string
+	for _, topic := range topics {
+		route, ok := c.conn.routes[topic]
+		if !ok {
+			continue
+		}
+		delete(route.handlers, c)
+		if len(route.handlers) == 0 {
+			delete(c.conn.routes, topic)
+			unused = append(unused, topic)
+		}
+	}
+	c.conn.mutex.Unlock()
+	if len(unused) == 0 {
+		return completedToken{}
+	}
+	return c.conn.current().Unsubscribe(unused...)
+}
+
+// Remove the subscriptions of the component and close the broker connection if no other component uses it.
+// The will of the component is removed from the connection with its next reconnect.
+func (c *sharedClient) Disconnect(quiesce uint) {
+	if !c.closed.CompareAndSwap(false, true) {
+		return
+	}
+	c.conn.mutex.Lock()
+	delete(c.conn.clients, c)
+	if c.conn.willOwner == c {
+		c.conn.willOwner, c.conn.will = nil, nil
+	}
+	var topics []string
+	for filter, route := range c.conn.routes {
+		if _, ok := route.handlers[c]; ok {
+			topics = append(topics, filter)
+		}
+	}
+	c.conn.mutex.Unlock()
+	if len(topics) > 0 {
+		c.Unsubscribe(topics...).WaitTimeout(time.Duration(quiesce) * time.Millisecond)
+	}
+	c.conn.release(quiesce)
+}
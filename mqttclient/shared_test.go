@@ -0,0 +1,204 @@
+package mqttclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/lab101/mqtt-welding/internal/mqtttest"
+)
+
+// Accept connections without ever answering, a connection attempt waits until the listener is closed
+func startSilentListener(t *testing.T) *net.TCPAddr {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns []net.Conn
+	var mutex sync.Mutex
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mutex.Lock()
+			conns = append(conns, conn)
+			mutex.Unlock()
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	return l.Addr().(*net.TCPAddr)
+}
+
+func sharedConnectionCount(key string) int {
+	sharedConnections.mutex.Lock()
+	defer sharedConnections.mutex.Unlock()
+	if conn, ok := sharedConnections.connections[key]; ok {
+		return conn.users
+	}
+	return 0
+}
+
+// A broker which doesn't answer doesn't block the shared connections to other brokers
+func TestSharedConnectionConnectsOutsideLock(t *testing.T) {
+	silent := startSilentListener(t)
+	silentConfig := &BrokerConfig{Host: "127.0.0.1", Port: silent.Port, ClientID: "silent", SharedConnection: true}
+	go func() {
+		if client, err := acquireSharedConnection(context.Background(), silentConfig); err == nil {
+			client.Disconnect(0)
+		}
+	}()
+	mqtttest.Eventually(t, func() bool { return sharedConnectionCount(sharedConnectionKey(silentConfig)) == 1 }, "silent connection not acquired")
+
+	b := startTestBroker(t)
+	acquired := make(chan error, 1)
+	go func() {
+		client, err := acquireSharedConnection(context.Background(), &BrokerConfig{Host: b.Host, Port: b.Port, ClientID: "shared", SharedConnection: true})
+		if err == nil {
+			client.Disconnect(250)
+		}
+		acquired <- err
+	}()
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(mqtttest.Timeout):
+		t.Fatal("shared connection blocked by the connection attempt to another broker")
+	}
+}
+
+// The broker connection is closed with its last component, a failed connection isn't kept
+func TestSharedConnectionRelease(t *testing.T) {
+	b := startTestBroker(t)
+	cfg := &BrokerConfig{Host: b.Host, Port: b.Port, ClientID: "shared", SharedConnection: true}
+	key := sharedConnectionKey(cfg)
+	first, err := acquireSharedConnection(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := acquireSharedConnection(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := sharedConnectionCount(key); n != 2 {
+		t.Fatalf("connection has %d components, want 2", n)
+	}
+	// Concurrent disconnects of a component release the connection once
+	var disconnects sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		disconnects.Add(1)
+		go func() {
+			defer disconnects.Done()
+			first.Disconnect(250)
+		}()
+	}
+	disconnects.Wait()
+	if !second.IsConnectionOpen() || sharedConnectionCount(key) != 1 {
+		t.Fatal("connection closed before its last component")
+	}
+	second.Disconnect(250)
+	if sharedConnectionCount(key) != 0 || second.IsConnectionOpen() {
+		t.Error("connection kept after its last component")
+	}
+
+	refused := &BrokerConfig{Host: "127.0.0.1", Port: mqtttest.FreePort(t), ClientID: "refused", SharedConnection: true}
+	if _, err := acquireSharedConnection(context.Background(), refused); err == nil {
+		t.Fatal("connection to a closed port succeeded")
+	}
+	if sharedConnectionCount(sharedConnectionKey(refused)) != 0 {
+		t.Error("failed connection kept")
+	}
+}
+
+// Client sensors with the same broker and client ID use one connection and only receive their own topics
+func TestSharedConnectionClients(t *testing.T) {
+	b := startTestBroker(t)
+	first := newTestSensor(t, b, "first", &Config{Topic: "cell/first", ClientID: "cell", SharedConnection: true, QueueLength: 10, PayloadType: "json"})
+	second := newTestSensor(t, b, "second", &Config{Topic: "cell/second", ClientID: "cell", SharedConnection: true, QueueLength: 10, PayloadType: "json"})
+	key := sharedConnectionKey(&BrokerConfig{Host: b.Host, Port: b.Port, ClientID: "cell"})
+	if n := sharedConnectionCount(key); n != 2 {
+		t.Fatalf("connection has %d components, want 2", n)
+	}
+
+	pub := b.Client(t, "publisher")
+	mqtttest.Publish(t, pub, "cell/first", mqtttest.WeldSample(100, 20), false)
+	mqtttest.Publish(t, pub, "cell/second", mqtttest.WeldSample(200, 20), false)
+	awaitReceived(t, first, 1)
+	awaitReceived(t, second, 1)
+	if n := first.metrics.received.Load() + second.metrics.received.Load(); n != 2 {
+		t.Errorf("received %d messages, want each message once", n)
+	}
+	if !first.connected() || !second.connected() {
+		t.Error("sensors of the shared connection not connected")
+	}
+}
+
+// The will is owned by one component and rebuilt for every connection, the subscriptions survive the restart
+func TestSharedConnectionWill(t *testing.T) {
+	b := startTestBroker(t)
+	cfg := &BrokerConfig{Host: b.Host, Port: b.Port, ClientID: "will", SharedConnection: true}
+	owner, err := acquireSharedConnection(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer owner.Disconnect(250)
+	other, err := acquireSharedConnection(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Disconnect(250)
+	messages := mqtttest.Subscribe(t, other, "will/data")
+	var reconnects sync.WaitGroup
+	reconnects.Add(1)
+	other.(*sharedClient).setHandlers(func(mqtt.Client) { reconnects.Done() }, nil)
+
+	var builds int
+	build := func() (string, []byte) {
+		builds++
+		return "will/death", []byte(fmt.Sprint(builds))
+	}
+	if err := owner.(*sharedClient).setWill(build); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.(*sharedClient).setWill(build); err == nil {
+		t.Error("second component replaced the will")
+	}
+	reconnects.Wait()
+	options := owner.OptionsReader()
+	if !options.WillEnabled() || options.WillTopic() != "will/death" {
+		t.Errorf("restarted connection without the will, topic %q", options.WillTopic())
+	}
+	mqtttest.Publish(t, b.Client(t, "publisher"), "will/data", "after restart", false)
+	if m := mqtttest.Receive(t, messages); string(m.Payload()) != "after restart" {
+		t.Errorf("received %q", m.Payload())
+	}
+
+	// Every reconnect builds the will again, the will is removed with its owner
+	conn := owner.(*sharedClient).conn
+	opts := mqtt.NewClientOptions()
+	conn.applyWill(opts)
+	if string(opts.WillPayload) != fmt.Sprint(builds) || builds < 2 {
+		t.Errorf("will %q after %d builds", opts.WillPayload, builds)
+	}
+	owner.Disconnect(250)
+	conn.applyWill(opts)
+	if opts.WillEnabled {
+		t.Error("will kept after its owner disconnected")
+	}
+}
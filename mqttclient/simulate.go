@@ -0,0 +1,200 @@
+package mqttclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Maps JSON simulated field attributes
+type SimulatedField struct {
+	Waveform string  `json:"waveform"` // Supported constant (default), sine, square, triangle, sawtooth, random
+	Min      float64 `json:"min"`      // Lowest value of the waveform, constant uses max
+	Max      float64 `json:"max"`      // Highest value of the waveform
+	Period   float64 `json:"period_s"` // Period of the waveform, default 20
+	Duty     float64 `json:"duty"`     // Fraction of the period a square wave is high, default 0.5
+	Phase    float64 `json:"phase_s"`  // Offset of the waveform in the period
+	Noise    float64 `json:"noise"`    // Standard deviation of the normal noise added to the value
+}
+
+// Maps the simulation configuration attribute
+type SimulationConfig struct {
+	Topic  string                    `json:"topic"`   // Topic of the generated messages, default the configured topic
+	Rate   float64                   `json:"rate_hz"` // Generated messages per second, default 10
+	Fields map[string]SimulatedField `json:"fields"`  // Generated payload fields, default weld telemetry in the standard weld schema
+	Seed   int64                     `json:"seed"`    // Seed of the noise, default random
+}
+
+// Default period of the simulated waveforms
+const defaultSimulationPeriod = 20.0
+
+// Default rate of the simulated messages
+const defaultSimulationRate = 10.0
+
+// Welds of 12 s with 8 s pauses, the arc fields share the square wave so they switch together
+var defaultSimulatedFields = map[string]SimulatedField{
+	weldCurrent:       {Waveform: "square", Max: 180, Duty: 0.6, Noise: 4},
+	weldVoltage:       {Waveform: "square", Max: 24, Duty: 0.6, Noise: 0.4},
+	weldWireFeedSpeed: {Waveform: "square", Max: 8, Duty: 0.6, Noise: 0.1},
+	weldGasFlow:       {Waveform: "square", Max: 15, Duty: 0.6, Noise: 0.3},
+	weldTravelSpeed:   {Waveform: "square", Max: 5, Duty: 0.6, Noise: 0.2},
+	weldArcOn:         {Waveform: "square", Max: 1, Duty: 0.6},
+}
+
+var simulatedWaveforms = map[string]bool{"": true, "constant": true, "sine": true, "square": true, "triangle": true, "sawtooth": true, "random": true}
+
+// Validate the simulation configuration
+func (cfg *SimulationConfig) Validate() error {
+	if cfg.Topic != "" && !validTopicName(cfg.Topic) {
+		return fmt.Errorf("invalid simulation topic %q", cfg.Topic)
+	}
+	if cfg.Rate < 0 {
+		return fmt.Errorf("simulation rate_hz must be >= 0")
+	}
+	for name, field := range cfg.Fields {
+		if !simulatedWaveforms[field.Waveform] {
+			return fmt.Errorf("invalid waveform %q of simulated field %q", field.Waveform, name)
+		}
+		if field.Min > field.Max {
+			return fmt.Errorf("min of simulated field %q must be <= max", name)
+		}
+		if field.Period < 0 || field.Noise < 0 {
+			return fmt.Errorf("period_s and noise of simulated field %q must be >= 0", name)
+		}
+		if field.Duty < 0 || field.Duty > 1 {
+			return fmt.Errorf("duty of simulated field %q must be between 0 and 1", name)
+		}
+	}
+	return nil
+}
+
+// Return the value of a waveform at a time since the simulation start
+func (f SimulatedField) value(elapsed float64, rnd *rand.Rand) float64 {
+	period := f.Period
+	if period == 0 {
+		period = defaultSimulationPeriod
+	}
+	// Position in the period from 0 to 1
+	x := math.Mod(elapsed+f.Phase, period) / period
+	var v float64
+	switch f.Waveform {
+	case "sine":
+		v = f.Min + (f.Max-f.Min)*(1+math.Sin(2*math.Pi*x))/2
+	case "square":
+		duty := f.Duty
+		if duty == 0 {
+			duty = 0.5
+		}
+		// The low values stay exact, e.g. no current while the arc is off
+		if x >= duty {
+			return f.Min
+		}
+		v = f.Max
+	case "triangle":
+		v = f.Min + (f.Max-f.Min)*(1-math.Abs(2*x-1))
+	case "sawtooth":
+		v = f.Min + (f.Max-f.Min)*x
+	case "random":
+		v = f.Min + (f.Max-f.Min)*rnd.Float64()
+	default:
+		v = f.Max
+	}
+	return v + f.Noise*rnd.NormFloat64()
+}
+
+// Generates messages without broker
+type simulator struct {
+	topic  string
+	fields map[string]SimulatedField
+	rnd    *rand.Rand
+	start  time.Time
+}
+
+// Create a simulator, the topic defaults to the client topic with its wildcard levels replaced by "sim"
+func newSimulator(cfg *SimulationConfig, topic string, now time.Time) *simulator {
+	if cfg == nil {
+		cfg = &SimulationConfig{}
+	}
+	sim := &simulator{topic: cfg.Topic, fields: cfg.Fields, start: now}
+	if sim.topic == "" {
+		levels := strings.Split(topic, "/")
+		for i, level := range levels {
+			if level == "+" || level == "#" {
+				levels[i] = "sim"
+			}
+		}
+		sim.topic = strings.Join(levels, "/")
+	}
+	if len(sim.fields) == 0 {
+		sim.fields = defaultSimulatedFields
+	}
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = now.UnixNano()
+	}
+	sim.rnd = rand.New(rand.NewSource(seed))
+	return sim
+}
+
+// Generate the payload of a message, the fields are generated in sorted order so a seed reproduces the values
+func (sim *simulator) payload(now time.Time, timestampField string) map[string]interface{} {
+	elapsed := now.Sub(sim.start).Seconds()
+	payload := map[string]interface{}{}
+	for _, name := range sortedKeys(sim.fields) {
+		payload[name] = sim.fields[name].value(elapsed, sim.rnd)
+	}
+	if timestampField != "" {
+		payload[timestampField] = now.UTC().Format(time.RFC3339Nano)
+	}
+	return payload
+}
+
+// Stop the running simulation and start generating messages if the simulation is enabled. Must be called
+// with the mutex held.
+func (s *mqttClient) resetSimulation(enabled bool, cfg *SimulationConfig) {
+	if s.stopSimulation != nil {
+		s.stopSimulation()
+		s.stopSimulation = nil
+	}
+	s.simulation = nil
+	if !enabled {
+		return
+	}
+	sim := newSimulator(cfg, s.Topic, time.Now())
+	s.simulation = sim
+	rate := defaultSimulationRate
+	if cfg != nil && cfg.Rate > 0 {
+		rate = cfg.Rate
+	}
+	s.logger.Infof("simulating %v messages per second on %q without broker", rate, sim.topic)
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopSimulation = cancel
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.done:
+				return
+			case now := <-ticker.C:
+				s.mutex.Lock()
+				payload, err := json.Marshal(sim.payload(now, s.timestampField))
+				qos := s.QoS
+				s.mutex.Unlock()
+				if err != nil {
+					s.logger.Errorf("error encoding simulated message: %v", err)
+					continue
+				}
+				s.onMessage(nil, &injectedMessage{topic: sim.topic, qos: qos, payload: payload})
+			}
+		}
+	}()
+}
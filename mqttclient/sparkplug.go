@@ -0,0 +1,207 @@
+package mqttclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Sparkplug B metric data types
+const (
+	sparkplugInt64   = 4
+	sparkplugUInt64  = 8
+	sparkplugDouble  = 10
+	sparkplugBoolean = 11
+	sparkplugString  = 12
+)
+
+// Sparkplug B metric, the value is an int64, uint64, float64, bool or string
+type sparkplugMetric struct {
+	name      string
+	timestamp uint64
+	value     interface{}
+}
+
+// Sparkplug B payload
+type sparkplugPayload struct {
+	timestamp uint64
+	seq       uint64
+	metrics   []sparkplugMetric
+}
+
+// Encode the payload with the Sparkplug B protobuf schema
+func (p *sparkplugPayload) marshal() []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, p.timestamp)
+	for _, m := range p.metrics {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.marshal())
+	}
+	b = protowire.AppendTag(b, 3, protowire.VarintType)
+	return protowire.AppendVarint(b, p.seq)
+}
+
+// Encode a metric, values of other types are encoded as JSON strings
+func (m *sparkplugMetric) marshal() []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, m.name)
+	if m.timestamp != 0 {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.timestamp)
+	}
+	switch v := m.value.(type) {
+	case int64:
+		b = appendSparkplugType(b, sparkplugInt64)
+		b = protowire.AppendTag(b, 11, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(v))
+	case uint64:
+		b = appendSparkplugType(b, sparkplugUInt64)
+		b = protowire.AppendTag(b, 11, protowire.VarintType)
+		b = protowire.AppendVarint(b, v)
+	case float64:
+		b = appendSparkplugType(b, sparkplugDouble)
+		b = protowire.AppendTag(b, 13, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(v))
+	case bool:
+		b = appendSparkplugType(b, sparkplugBoolean)
+		b = protowire.AppendTag(b, 14, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(v))
+	case string:
+		b = appendSparkplugType(b, sparkplugString)
+		b = protowire.AppendTag(b, 15, protowire.BytesType)
+		b = protowire.AppendString(b, v)
+	case nil:
+		b = appendSparkplugType(b, sparkplugString)
+		b = protowire.AppendTag(b, 7, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(true))
+	default:
+		s, _ := json.Marshal(v)
+		b = appendSparkplugType(b, sparkplugString)
+		b = protowire.AppendTag(b, 15, protowire.BytesType)
+		b = protowire.AppendBytes(b, s)
+	}
+	return b
+}
+
+func appendSparkplugType(b []byte, datatype uint64) []byte {
+	b = protowire.AppendTag(b, 4, protowire.VarintType)
+	return protowire.AppendVarint(b, datatype)
+}
+
+// Decode a Sparkplug B payload, only the metric names and scalar values are decoded
+func unmarshalSparkplugPayload(b []byte) (*sparkplugPayload, error) {
+	p := &sparkplugPayload{}
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, v uint64, data []byte) error {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			p.timestamp = v
+		case num == 2 && typ == protowire.BytesType:
+			m, err := unmarshalSparkplugMetric(data)
+			if err != nil {
+				return err
+			}
+			p.metrics = append(p.metrics, m)
+		case num == 3 && typ == protowire.VarintType:
+			p.seq = v
+		}
+		return nil
+	})
+	return p, err
+}
+
+func unmarshalSparkplugMetric(b []byte) (sparkplugMetric, error) {
+	m := sparkplugMetric{}
+	var datatype uint64
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			m.name = string(data)
+		case 3:
+			m.timestamp = v
+		case 4:
+			datatype = v
+		case 10, 11:
+			m.value = v
+		case 12:
+			m.value = float64(math.Float32frombits(uint32(v)))
+		case 13:
+			m.value = math.Float64frombits(v)
+		case 14:
+			m.value = protowire.DecodeBool(v)
+		case 15:
+			m.value = string(data)
+		}
+		return nil
+	})
+	// Signed integer types are sent as two's complement
+	if u, ok := m.value.(uint64); ok {
+		switch {
+		case datatype >= 1 && datatype <= 3:
+			m.value = int64(int32(uint32(u)))
+		case datatype == sparkplugInt64:
+			m.value = int64(u)
+		}
+	}
+	return m, err
+}
+
+// Iterate over the fields of a protobuf message, varint and fixed values are passed as v and
+// length delimited values as data
+func consumeFields(b []byte, fn func(num protowire.Number, typ protowire.Type, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("invalid protobuf tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		var v uint64
+		var data []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var v32 uint32
+			v32, n = protowire.ConsumeFixed32(b)
+			v = uint64(v32)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			data, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return fmt.Errorf("invalid protobuf field %d: %v", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+		if err := fn(num, typ, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Convert a readings value to a metric value
+func sparkplugValue(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case uint32:
+		return uint64(n)
+	case float32:
+		return float64(n)
+	case json.Number:
+		if i, err := n.Int64(); err == nil {
+			return i
+		}
+		f, _ := n.Float64()
+		return f
+	}
+	return v
+}
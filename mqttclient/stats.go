@@ -0,0 +1,99 @@
+package mqttclient
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Maps the rolling_stats configuration attribute
+type RollingStatsConfig struct {
+	Fields []string `json:"fields"` // Numeric payload or derived fields to compute statistics for
+	Window int      `json:"window"` // Number of samples used for the standard deviation, default 20
+	Alpha  float64  `json:"alpha"`  // EWMA smoothing factor (0 < alpha <= 1), default 2/(window+1)
+}
+
+const defaultStatsWindow = 20
+
+// Validate the rolling statistics configuration
+func (cfg *RollingStatsConfig) Validate() error {
+	if len(cfg.Fields) == 0 {
+		return fmt.Errorf("rolling_stats requires at least one field")
+	}
+	if cfg.Window < 0 {
+		return fmt.Errorf("rolling_stats window must be > 0")
+	}
+	if cfg.Alpha < 0 || cfg.Alpha > 1 {
+		return fmt.Errorf("rolling_stats alpha must be between 0 and 1")
+	}
+	return nil
+}
+
+// Rolling statistics of a single field
+type rollingStat struct {
+	ewma    float64
+	samples []float64
+}
+
+// Add a sample and return the new EWMA and standard deviation over the window
+func (r *rollingStat) add(v float64, window int, alpha float64) (float64, float64) {
+	if len(r.samples) == 0 {
+		r.ewma = v
+	} else {
+		r.ewma = alpha*v + (1-alpha)*r.ewma
+	}
+	r.samples = append(r.samples, v)
+	if len(r.samples) > window {
+		r.samples = r.samples[len(r.samples)-window:]
+	}
+	mean := 0.0
+	for _, s := range r.samples {
+		mean += s
+	}
+	mean /= float64(len(r.samples))
+	variance := 0.0
+	for _, s := range r.samples {
+		variance += (s - mean) * (s - mean)
+	}
+	return r.ewma, math.Sqrt(variance / float64(len(r.samples)))
+}
+
+// Update the rolling statistics with a newly received message and add the
+// <field>_ewma and <field>_std values to its derived fields. Must be called with the mutex held.
+func (s *mqttClient) computeStats(msg *receivedMessage) {
+	if s.rollingStats == nil {
+		return
+	}
+	payload, err := s.parseWithDerived(msg)
+	if err != nil {
+		return
+	}
+
+	window := s.rollingStats.Window
+	if window == 0 {
+		window = defaultStatsWindow
+	}
+	alpha := s.rollingStats.Alpha
+	if alpha == 0 {
+		alpha = 2 / float64(window+1)
+	}
+	for _, field := range s.rollingStats.Fields {
+		v, ok := lookupField(payload, field)
+		if !ok {
+			continue
+		}
+		f, ok := numeric(v)
+		if !ok {
+			continue
+		}
+		stat, ok := s.stats[field]
+		if !ok {
+			stat = &rollingStat{}
+			s.stats[field] = stat
+		}
+		ewma, std := stat.add(f, window, alpha)
+		name := strings.ReplaceAll(field, ".", "_")
+		msg.setDerived(name+"_ewma", ewma)
+		msg.setDerived(name+"_std", std)
+	}
+}
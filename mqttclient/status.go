@@ -0,0 +1,236 @@
+package mqttclient
+
+import (
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Tracks the broker connection for the status command
+type connectionStatus struct {
+	broker         string
+	connectedAt    time.Time
+	sessionPresent bool
+	requested      map[string]byte // Requested QoS per topic filter
+	granted        map[string]byte // Granted QoS per subscription, 0x80 is a rejected subscription
+	subscribedAt   time.Time       // Time of the last SUBACK
+	topics         map[string]*topicCounter
+	connects       uint64
+	connectionLost uint64
+	lastError      string
+	lastErrorAt    time.Time
+	lastErrorOp    string // Operation of the last error: connect, connection_lost, subscribe or publish
+	errors         uint64 // Errors reported by the MQTT library since the component started
+	returnCode     byte   // CONNACK return code of the last refused connection
+	haltedBy       string // Set if the connection attempts stopped because of the return code
+	mutex          sync.Mutex
+}
+
+// Record a successful connection
+func (c *connectionStatus) connected(broker string, sessionPresent bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.broker = broker
+	c.connectedAt = time.Now()
+	c.sessionPresent = sessionPresent
+	c.connects++
+}
+
+// Messages received on a topic
+type topicCounter struct {
+	messages     uint64
+	lastReceived time.Time
+}
+
+// Rejected subscription return code of the SUBACK packet
+const subscriptionFailure = 0x80
+
+// Return the outcome of a subscription: granted, downgraded to a lower QoS, rejected or missing if the
+// SUBACK has no return code for it
+func subscriptionResult(requested byte, granted byte, ok bool) string {
+	switch {
+	case !ok:
+		return "missing"
+	case granted == subscriptionFailure:
+		return "rejected"
+	case granted < requested:
+		return "downgraded"
+	}
+	return "granted"
+}
+
+// Record an automatic reconnect, the session present flag is not known
+func (c *connectionStatus) reconnected() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.connectedAt = time.Now()
+	c.connects++
+}
+
+// Record the requested and granted QoS of subscriptions, they replace the previous subscriptions
+func (c *connectionStatus) subscribed(requested map[string]byte, granted map[string]byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.requested = requested
+	c.granted = granted
+	c.subscribedAt = time.Now()
+}
+
+// Time of the last SUBACK, zero before the first subscription
+func (c *connectionStatus) lastSubscribed() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.subscribedAt
+}
+
+// Count a received message
+func (c *connectionStatus) received(topic string, now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.topics == nil {
+		c.topics = map[string]*topicCounter{}
+	}
+	counter, ok := c.topics[topic]
+	if !ok {
+		counter = &topicCounter{}
+		c.topics[topic] = counter
+	}
+	counter.messages++
+	counter.lastReceived = now
+}
+
+// Return the topic filters with their QoS and the message counters of the topics they match
+func (c *connectionStatus) subscriptions() []interface{} {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	subscriptions := []interface{}{}
+	for _, filter := range sortedKeys(c.requested) {
+		granted, ok := c.granted[filter]
+		var messages uint64
+		topics := map[string]interface{}{}
+		for topic, counter := range c.topics {
+			if !topicMatches(filter, topic) {
+				continue
+			}
+			messages += counter.messages
+			topics[topic] = map[string]interface{}{
+				"messages":      counter.messages,
+				"last_received": counter.lastReceived.UTC().Format(time.RFC3339Nano),
+			}
+		}
+		subscription := map[string]interface{}{
+			"topic":    filter,
+			"qos":      c.requested[filter],
+			"active":   ok && granted != subscriptionFailure,
+			"messages": messages,
+			"topics":   topics,
+		}
+		if ok {
+			subscription["granted_qos"] = granted
+		}
+		subscription["result"] = subscriptionResult(c.requested[filter], granted, ok)
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions
+}
+
+// Record a connection, subscription or publish error of an operation
+func (c *connectionStatus) failed(op string, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lastError = err.Error()
+	c.lastErrorAt = time.Now()
+	c.lastErrorOp = op
+	c.errors++
+}
+
+// Return the error count and the last error as "client_errors" reading
+func (c *connectionStatus) errorReadings() map[string]interface{} {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	readings := map[string]interface{}{"count": c.errors}
+	if c.lastError != "" {
+		readings["last"] = c.lastError
+		readings["last_at"] = c.lastErrorAt.UTC().Format(time.RFC3339Nano)
+		readings["operation"] = c.lastErrorOp
+	}
+	return readings
+}
+
+// Record a connection refused with a return code retrying can't fix
+func (c *connectionStatus) halted(code byte, err error) {
+	c.failed("connect", err)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.returnCode = code
+	c.haltedBy = packets.ConnackReturnCodes[code]
+}
+
+// Clear the halt reason when new connection attempts start
+func (c *connectionStatus) resume() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.haltedBy = ""
+}
+
+// Reason the connection attempts stopped, empty if they didn't
+func (c *connectionStatus) haltReason() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.haltedBy
+}
+
+// Record a lost connection
+func (c *connectionStatus) lost(err error) {
+	c.failed("connection_lost", err)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.connectionLost++
+	c.connectedAt = time.Time{}
+}
+
+// Return the status as a DoCommand response
+func (c *connectionStatus) response(connected bool) map[string]interface{} {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	subscriptions := make([]interface{}, 0, len(c.requested))
+	for _, topic := range sortedKeys(c.requested) {
+		granted, ok := c.granted[topic]
+		subscription := map[string]interface{}{
+			"topic":         topic,
+			"requested_qos": c.requested[topic],
+			"result":        subscriptionResult(c.requested[topic], granted, ok),
+		}
+		if ok {
+			subscription["granted_qos"] = granted
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	status := map[string]interface{}{
+		"broker":          c.broker,
+		"connected":       connected,
+		"session_present": c.sessionPresent,
+		"subscriptions":   subscriptions,
+		"connects":        c.connects,
+		"connection_lost": c.connectionLost,
+		"errors":          c.errors,
+		"uptime_s":        0.0,
+	}
+	if !c.subscribedAt.IsZero() {
+		status["subscribed_at"] = c.subscribedAt.UTC().Format(time.RFC3339Nano)
+	}
+	if connected && !c.connectedAt.IsZero() {
+		status["uptime_s"] = time.Since(c.connectedAt).Seconds()
+	}
+	if c.haltedBy != "" {
+		status["halted"] = c.haltedBy
+		status["return_code"] = c.returnCode
+	}
+	if c.lastError != "" {
+		status["last_error"] = c.lastError
+		status["last_error_at"] = c.lastErrorAt.UTC().Format(time.RFC3339Nano)
+		status["last_error_op"] = c.lastErrorOp
+	}
+	return status
+}
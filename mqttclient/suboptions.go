@@ -0,0 +1,119 @@
+package mqttclient
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Maps JSON subscription options, the client side counterparts of the MQTT 5 subscription options
+type SubscriptionOption struct {
+	NoLocal      bool `json:"no_local"`      // Messages published by this component are not handled
+	SkipRetained bool `json:"skip_retained"` // Retained messages sent when subscribing are not handled
+}
+
+// Maps the subscription_options configuration attribute, the options by topic filter
+type SubscriptionOptions map[string]SubscriptionOption
+
+// Validate the subscription options
+func (options SubscriptionOptions) Validate() error {
+	for filter := range options {
+		if !validTopicFilter(filter) {
+			return fmt.Errorf("invalid subscription_options topic %q", filter)
+		}
+	}
+	return nil
+}
+
+// Own messages are expected back from the broker within this time
+const ownMessageTTL = time.Minute
+
+// Messages recently published by the client, to recognize them when the broker delivers them back
+type ownMessages struct {
+	mutex sync.Mutex
+	sent  map[string]time.Time
+}
+
+func ownMessageKey(topic string, payload []byte) string {
+	return topic + "\x00" + string(payload)
+}
+
+// Record a published message
+func (o *ownMessages) add(topic string, payload []byte, now time.Time) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.sent == nil {
+		o.sent = map[string]time.Time{}
+	}
+	for key, at := range o.sent {
+		if now.Sub(at) > ownMessageTTL {
+			delete(o.sent, key)
+		}
+	}
+	o.sent[ownMessageKey(topic, payload)] = now
+}
+
+// Whether a received message was published by the client, it is only recognized once
+func (o *ownMessages) take(topic string, payload []byte, now time.Time) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	key := ownMessageKey(topic, payload)
+	at, ok := o.sent[key]
+	if !ok {
+		return false
+	}
+	delete(o.sent, key)
+	return now.Sub(at) <= ownMessageTTL
+}
+
+// Publish a message without waiting for the acknowledgement and record it for the no_local option. Nothing
+// is published and nil is returned in simulation mode.
+func (s *mqttClient) publishNoWait(topic string, qos byte, retained bool, payload []byte) mqtt.Token {
+	client := s.currentClient()
+	if client == nil {
+		return nil
+	}
+	s.recordOwnMessage(topic, payload)
+	token := client.Publish(topic, qos, retained, payload)
+	// Most callers don't wait for the token, a failure is recorded once it completes
+	go func() {
+		<-token.Done()
+		if err := token.Error(); err != nil {
+			s.status.failed("publish", fmt.Errorf("publishing to %q failed: %w", topic, err))
+		}
+	}()
+	return token
+}
+
+// Record a published message if its topic matches a filter with no_local, other messages are not expected
+// back. A received message is recognized by its topic and payload, the broker doesn't tell who published it.
+func (s *mqttClient) recordOwnMessage(topic string, payload []byte) {
+	if len(s.subscriptionOpts) == 0 || !s.subscriptionOptions(topic).NoLocal {
+		return
+	}
+	s.ownMessages.add(topic, payload, time.Now())
+}
+
+// Return the subscription options of a topic, the options of the first matching filter in sorted order
+func (s *mqttClient) subscriptionOptions(topic string) SubscriptionOption {
+	for _, filter := range sortedKeys(s.subscriptionOpts) {
+		if topicMatches(filter, topic) {
+			return s.subscriptionOpts[filter]
+		}
+	}
+	return SubscriptionOption{}
+}
+
+// Whether a received message is skipped according to the subscription options of its topic
+func (s *mqttClient) skipBySubscriptionOptions(m mqtt.Message, now time.Time) bool {
+	if len(s.subscriptionOpts) == 0 {
+		return false
+	}
+	opts := s.subscriptionOptions(m.Topic())
+	if opts.SkipRetained && m.Retained() {
+		return true
+	}
+	return opts.NoLocal && s.ownMessages.take(m.Topic(), m.Payload(), now)
+}
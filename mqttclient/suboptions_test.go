@@ -0,0 +1,28 @@
+package mqttclient
+
+import (
+	"testing"
+	"time"
+)
+
+// Only the messages of topics with no_local are expected back
+func TestOwnMessagesRecordedWithNoLocal(t *testing.T) {
+	s := &mqttClient{subscriptionOpts: SubscriptionOptions{
+		"cell/+/cmd":   {NoLocal: true},
+		"cell/+/alarm": {SkipRetained: true},
+	}}
+	s.recordOwnMessage("cell/3/cmd", []byte("start"))
+	s.recordOwnMessage("cell/3/alarm", []byte("overcurrent"))
+	s.recordOwnMessage("cell/3/summary", []byte("{}"))
+
+	now := time.Now()
+	if !s.ownMessages.take("cell/3/cmd", []byte("start"), now) {
+		t.Error("own message of a no_local topic not recognized")
+	}
+	if s.ownMessages.take("cell/3/cmd", []byte("start"), now) {
+		t.Error("own message recognized twice")
+	}
+	if n := len(s.ownMessages.sent); n != 0 {
+		t.Errorf("%d messages of topics without no_local recorded", n)
+	}
+}
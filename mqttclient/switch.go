@@ -0,0 +1,159 @@
+package mqttclient
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.viam.com/rdk/components/generic"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+)
+
+// Switch model publishing position payloads to a command topic. The RDK version used by
+// this module has no switch API yet, so the switch is a generic component controlled
+// with the set_position, get_position and get_number_of_positions commands.
+var SwitchModel = resource.NewModel("lab101", "mqtt", "switch")
+
+func init() {
+	resource.RegisterComponent(generic.API, SwitchModel,
+		resource.Registration[resource.Resource, *SwitchConfig]{Constructor: newSwitch})
+}
+
+// Maps JSON switch configuration attributes.
+type SwitchConfig struct {
+	BrokerConfig `json:",squash"`
+	CommandTopic string   `json:"command_topic"` // Topic the position payloads are published to
+	StateTopic   string   `json:"state_topic"`   // Optional topic reporting the actual position
+	QoS          int      `json:"qos"`
+	Retained     bool     `json:"retained"`
+	Positions    []string `json:"positions"` // Payload per position, default ["off", "on"]
+}
+
+// Implement switch configuration validation and return implicit dependencies.
+func (cfg *SwitchConfig) Validate(path string) ([]string, error) {
+	if cfg.CommandTopic == "" {
+		return nil, fmt.Errorf("command_topic is required %q", path)
+	}
+	if err := cfg.BrokerConfig.Validate(path); err != nil {
+		return nil, err
+	}
+	if cfg.QoS < 0 || cfg.QoS > 2 {
+		return nil, fmt.Errorf("qos must be between 0 and 2 %q", path)
+	}
+	if len(cfg.Positions) == 1 {
+		return nil, fmt.Errorf("positions requires at least two payloads %q", path)
+	}
+	return []string{}, nil
+}
+
+type mqttSwitch struct {
+	resource.Named
+	resource.AlwaysRebuild
+	logger    logging.Logger
+	client    mqtt.Client
+	cfg       *SwitchConfig
+	positions []string
+	position  uint32
+	mutex     sync.Mutex
+}
+
+// Switch constructor, the switch is rebuilt on reconfiguration
+func newSwitch(ctx context.Context, deps resource.Dependencies, conf resource.Config, logger logging.Logger) (resource.Resource, error) {
+	switchConfig, err := resource.NativeConfig[*SwitchConfig](conf)
+	if err != nil {
+		return nil, err
+	}
+	sw := &mqttSwitch{
+		Named:     conf.ResourceName().AsNamed(),
+		logger:    logger,
+		cfg:       switchConfig,
+		positions: switchConfig.Positions,
+	}
+	if len(sw.positions) == 0 {
+		sw.positions = []string{"off", "on"}
+	}
+	if switchConfig.StateTopic != "" {
+		sw.client, err = switchConfig.connectAndSubscribe(ctx, switchConfig.StateTopic, byte(switchConfig.QoS), sw.onState)
+	} else {
+		sw.client, err = switchConfig.connect(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error initializing mqtt switch: %v", err)
+	}
+	return sw, nil
+}
+
+// Update the position from a state message, either one of the position payloads or the position index
+func (sw *mqttSwitch) onState(client mqtt.Client, msg mqtt.Message) {
+	state := strings.TrimSpace(string(msg.Payload()))
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+	for i, payload := range sw.positions {
+		if state == payload {
+			sw.position = uint32(i)
+			return
+		}
+	}
+	if i, err := strconv.Atoi(state); err == nil && i >= 0 && i < len(sw.positions) {
+		sw.position = uint32(i)
+		return
+	}
+	sw.logger.Debugf("unknown switch state %q", state)
+}
+
+// Publish the payload of a position to the command topic
+func (sw *mqttSwitch) SetPosition(ctx context.Context, position uint32) error {
+	if int(position) >= len(sw.positions) {
+		return fmt.Errorf("invalid position %d (should be < %d)", position, len(sw.positions))
+	}
+	if err := publishAndWait(ctx, sw.client, sw.cfg.CommandTopic, byte(sw.cfg.QoS), sw.cfg.Retained, sw.positions[position]); err != nil {
+		return err
+	}
+	// Without a state topic the last commanded position is reported
+	if sw.cfg.StateTopic == "" {
+		sw.mutex.Lock()
+		sw.position = position
+		sw.mutex.Unlock()
+	}
+	return nil
+}
+
+// Return the current position
+func (sw *mqttSwitch) GetPosition(ctx context.Context) uint32 {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+	return sw.position
+}
+
+// DoCommand implements the switch methods: {"set_position": 1}, {"get_position": true}, {"get_number_of_positions": true}
+func (sw *mqttSwitch) DoCommand(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	if v, ok := cmd["set_position"]; ok {
+		f, ok := toFloat(v)
+		if !ok || f < 0 {
+			return nil, fmt.Errorf("invalid position %v", v)
+		}
+		if err := sw.SetPosition(ctx, uint32(f)); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"position": uint32(f)}, nil
+	}
+	if _, ok := cmd["get_position"]; ok {
+		return map[string]interface{}{"position": sw.GetPosition(ctx)}, nil
+	}
+	if _, ok := cmd["get_number_of_positions"]; ok {
+		return map[string]interface{}{"number_of_positions": len(sw.positions), "positions": sw.positions}, nil
+	}
+	return nil, errUnimplemented
+}
+
+// Disconnect from the broker
+func (sw *mqttSwitch) Close(ctx context.Context) error {
+	if sw.client != nil {
+		sw.client.Disconnect(250) // Timeout in milliseconds
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package mqttclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.viam.com/rdk/components/sensor"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+)
+
+// Sensor model gating the data manager sync, e.g. to upload only between welds
+var SyncGateModel = resource.NewModel("lab101", "mqtt", "sync-gate")
+
+// Readings key the data manager selective sync looks for
+const shouldSyncKey = "should_sync"
+
+func init() {
+	resource.RegisterComponent(sensor.API, SyncGateModel,
+		resource.Registration[sensor.Sensor, *SyncGateConfig]{Constructor: newSyncGate})
+}
+
+// Maps JSON sync gate configuration attributes.
+type SyncGateConfig struct {
+	BrokerConfig `json:",squash"`
+	Topic        string `json:"topic"`
+	QoS          int    `json:"qos"`
+	ShouldSync   string `json:"should_sync"` // Expression on msg and topic, e.g. `msg.state != "welding"`
+	Default      bool   `json:"default"`     // Returned before the first message and when the state is stale
+	MaxAgeMs     int    `json:"max_age_ms"`  // The state of older messages is stale, 0 never expires
+}
+
+// Implement sync gate configuration validation and return implicit dependencies.
+func (cfg *SyncGateConfig) Validate(path string) ([]string, error) {
+	if cfg.Topic == "" {
+		return nil, fmt.Errorf("topic is required %q", path)
+	}
+	if err := cfg.BrokerConfig.Validate(path); err != nil {
+		return nil, err
+	}
+	if cfg.QoS < 0 || cfg.QoS > 2 {
+		return nil, fmt.Errorf("qos must be between 0 and 2 %q", path)
+	}
+	if cfg.ShouldSync == "" {
+		return nil, fmt.Errorf("should_sync expression is required %q", path)
+	}
+	if _, err := compileExpr(cfg.ShouldSync); err != nil {
+		return nil, fmt.Errorf("invalid should_sync expression: %v %q", err, path)
+	}
+	if cfg.MaxAgeMs < 0 {
+		return nil, fmt.Errorf("max_age_ms must be >= 0 %q", path)
+	}
+	return []string{}, nil
+}
+
+type mqttSyncGate struct {
+	resource.Named
+	resource.AlwaysRebuild
+	logger     logging.Logger
+	client     mqtt.Client
+	cfg        *SyncGateConfig
+	shouldSync expr
+	state      bool
+	received   time.Time
+	override   *bool // Set with DoCommand, takes precedence over the messages
+	mutex      sync.Mutex
+}
+
+// Sync gate constructor, the sensor is rebuilt on reconfiguration
+func newSyncGate(ctx context.Context, deps resource.Dependencies, conf resource.Config, logger logging.Logger) (sensor.Sensor, error) {
+	gateConfig, err := resource.NativeConfig[*SyncGateConfig](conf)
+	if err != nil {
+		return nil, err
+	}
+	g := &mqttSyncGate{
+		Named:  conf.ResourceName().AsNamed(),
+		logger: logger,
+		cfg:    gateConfig,
+	}
+	if g.shouldSync, err = compileExpr(gateConfig.ShouldSync); err != nil {
+		return nil, err
+	}
+	g.client, err = gateConfig.connectAndSubscribe(ctx, gateConfig.Topic, byte(gateConfig.QoS), g.onMessage)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing mqtt sync gate: %v", err)
+	}
+	return g, nil
+}
+
+// Evaluate the should_sync expression on a message
+func (g *mqttSyncGate) onMessage(client mqtt.Client, msg mqtt.Message) {
+	var payload interface{}
+	if err := json.Unmarshal(msg.Payload(), &payload); err != nil {
+		payload = string(msg.Payload())
+	}
+	state, err := evalBool(g.shouldSync, map[string]interface{}{"msg": payload, "topic": msg.Topic()})
+	if err != nil {
+		g.logger.Debugf("should_sync expression failed: %v", err)
+		return
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if state != g.state || g.received.IsZero() {
+		g.logger.Infof("data sync enabled: %v", state)
+	}
+	g.state = state
+	g.received = time.Now()
+}
+
+// Return should_sync for the data manager selective sync and where the value comes from
+func (g *mqttSyncGate) Readings(ctx context.Context, extra map[string]interface{}) (map[string]interface{}, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.override != nil {
+		return map[string]interface{}{shouldSyncKey: *g.override, "source": "override"}, nil
+	}
+	stale := g.received.IsZero() ||
+		(g.cfg.MaxAgeMs > 0 && time.Since(g.received) > time.Duration(g.cfg.MaxAgeMs)*time.Millisecond)
+	if stale {
+		return map[string]interface{}{shouldSyncKey: g.cfg.Default, "source": "default"}, nil
+	}
+	return map[string]interface{}{
+		shouldSyncKey: g.state,
+		"source":      "message",
+		"updated":     g.received.UTC().Format(time.RFC3339Nano),
+	}, nil
+}
+
+// DoCommand overrides the messages, e.g. to force an upload: {"should_sync": true}. A null value
+// returns to the message state.
+func (g *mqttSyncGate) DoCommand(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	v, ok := cmd[shouldSyncKey]
+	if !ok {
+		return nil, errUnimplemented
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	switch b := v.(type) {
+	case bool:
+		g.override = &b
+	case nil:
+		g.override = nil
+	default:
+		return nil, fmt.Errorf("should_sync must be a boolean or null")
+	}
+	return map[string]interface{}{"override": v}, nil
+}
+
+// Disconnect from the broker
+func (g *mqttSyncGate) Close(ctx context.Context) error {
+	if g.client != nil {
+		g.client.Disconnect(250) // Timeout in milliseconds
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package mqttclient
+
+import "time"
+
+// Length of the sliding window used to compute message rates, in one second buckets
+const throughputWindow = 10
+
+// Counts received messages and bytes and computes rates over a sliding window
+type throughput struct {
+	messagesTotal uint64
+	bytesTotal    uint64
+	buckets       [throughputWindow]throughputBucket
+	started       time.Time
+}
+
+type throughputBucket struct {
+	second   int64
+	messages uint64
+	bytes    uint64
+}
+
+// Record a received message
+func (t *throughput) add(now time.Time, size int) {
+	if t.started.IsZero() {
+		t.started = now
+	}
+	t.messagesTotal++
+	t.bytesTotal += uint64(size)
+	sec := now.Unix()
+	b := &t.buckets[sec%throughputWindow]
+	if b.second != sec {
+		*b = throughputBucket{second: sec}
+	}
+	b.messages++
+	b.bytes += uint64(size)
+}
+
+// Return the totals and the rates over the last window as a readings map
+func (t *throughput) readings(now time.Time) map[string]interface{} {
+	var messages, bytes uint64
+	sec := now.Unix()
+	for _, b := range t.buckets {
+		if b.second > sec-throughputWindow && b.second <= sec {
+			messages += b.messages
+			bytes += b.bytes
+		}
+	}
+	// Don't underestimate the rates during the first window after the first message
+	window := float64(throughputWindow)
+	if !t.started.IsZero() {
+		if elapsed := now.Sub(t.started).Seconds(); elapsed < window {
+			window = max(elapsed, 1)
+		}
+	}
+	return map[string]interface{}{
+		"messages_total":      t.messagesTotal,
+		"bytes_total":         t.bytesTotal,
+		"messages_per_second": float64(messages) / window,
+		"bytes_per_second":    float64(bytes) / window,
+	}
+}
@@ -0,0 +1,99 @@
+package mqttclient
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Default time an ad-hoc topic read waits for a message of a topic which is not subscribed
+const defaultTopicReadTimeout = 2 * time.Second
+
+// Return the latest message of a topic for the "topic" extra parameter of Readings. The latest message of
+// a received topic is returned, a topic the component doesn't subscribe to is subscribed until a message
+// arrives, usually its retained message, or the timeout passes. The message doesn't go through the
+// pipeline. Must not be called with the mutex held.
+func (s *mqttClient) topicReadings(ctx context.Context, topic, msgType string, extra map[string]interface{}) (map[string]interface{}, error) {
+	if !validTopicFilter(topic) {
+		return nil, fmt.Errorf("invalid topic %q", topic)
+	}
+	timeout := defaultTopicReadTimeout
+	if v, ok := extra["timeout_ms"]; ok {
+		ms, ok := toFloat(v)
+		if !ok || ms <= 0 {
+			return nil, fmt.Errorf("invalid timeout_ms %v (should be > 0)", v)
+		}
+		timeout = time.Duration(ms * float64(time.Millisecond))
+	}
+
+	s.mutex.Lock()
+	var latest *receivedMessage
+	for t, msg := range s.latestByTopic {
+		if s.expired(msg) {
+			delete(s.latestByTopic, t)
+			continue
+		}
+		if topicMatches(topic, t) && (latest == nil || msg.received.After(latest.received)) {
+			latest = msg
+		}
+	}
+	if latest != nil {
+		defer s.mutex.Unlock()
+		readings := s.historyEntry(latest, msgType)
+		readings["source"] = "latest"
+		return readings, nil
+	}
+	covered := false
+	for filter := range s.topicFilters() {
+		covered = covered || topicMatches(filter, topic)
+	}
+	client, qos := s.currentClient(), s.QoS
+	// A subscribed topic without message has no message to return, subscribing the same filter again
+	// would replace the handler of the component
+	if covered || !s.connected() {
+		defer s.mutex.Unlock()
+		return s.noData()
+	}
+	s.mutex.Unlock()
+
+	messages := make(chan mqtt.Message, 1)
+	token := client.Subscribe(topic, qos, func(_ mqtt.Client, m mqtt.Message) {
+		select {
+		case messages <- m:
+		default:
+		}
+	})
+	defer client.Unsubscribe(topic)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-token.Done():
+		if token.Error() != nil {
+			return nil, fmt.Errorf("subscribing %q failed: %w", topic, token.Error())
+		}
+	case <-timer.C:
+		return nil, fmt.Errorf("subscribing %q timed out", topic)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	var m mqtt.Message
+	select {
+	case m = <-messages:
+	case <-timer.C:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if m == nil {
+		return s.noData()
+	}
+	// Probed messages are not part of the pipeline metrics
+	msg := &receivedMessage{Message: m, received: time.Now(), counted: true}
+	readings := s.historyEntry(msg, msgType)
+	readings["source"] = "subscribed"
+	return readings, nil
+}
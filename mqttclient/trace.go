@@ -0,0 +1,42 @@
+package mqttclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Maximum number of messages traced by a single trace command
+const maxTraceCount = 1000
+
+// Arguments of the trace command
+type traceArgs struct {
+	Count int `json:"count"` // Number of messages to log, 0 stops tracing
+}
+
+// Log a received message while tracing is enabled, the configured redact fields are masked. Must be
+// called with the mutex held.
+func (s *mqttClient) trace(msg *receivedMessage) {
+	if s.traceRemaining == 0 {
+		return
+	}
+	s.traceRemaining--
+	var payload string
+	var fields map[string]interface{}
+	if json.Unmarshal(msg.Payload(), &fields) == nil {
+		for _, path := range s.redactFields {
+			fields = redactField(fields, strings.Split(path, "."))
+		}
+		b, _ := json.Marshal(fields)
+		payload = string(b)
+	} else if len(s.redactFields) > 0 {
+		// Fields cannot be found in other payloads, they are not logged at all
+		payload = fmt.Sprintf("<%d bytes not logged>", len(msg.Payload()))
+	} else if utf8.Valid(msg.Payload()) {
+		payload = string(msg.Payload())
+	} else {
+		payload = fmt.Sprintf("<%d bytes binary>", len(msg.Payload()))
+	}
+	s.logger.Infof("trace %q qos %d retained %v: %s (%d remaining)", msg.Topic(), msg.Qos(), msg.Retained(), payload, s.traceRemaining)
+}
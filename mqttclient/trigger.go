@@ -0,0 +1,264 @@
+package mqttclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.viam.com/rdk/logging"
+	"go.viam.com/rdk/resource"
+	"go.viam.com/rdk/services/generic"
+)
+
+// Service model invoking commands on other resources when matching messages arrive
+var TriggerModel = resource.NewModel("lab101", "mqtt", "trigger")
+
+func init() {
+	resource.RegisterService(generic.API, TriggerModel,
+		resource.Registration[resource.Resource, *TriggerServiceConfig]{Constructor: newTriggerService})
+}
+
+// Maps a trigger to its topic, condition and action
+type TriggerConfig struct {
+	Name       string                 `json:"name"`
+	Topic      string                 `json:"topic"`       // Topic filter, wildcards are supported
+	Filter     string                 `json:"filter"`      // Optional expression on msg and topic, e.g. msg.state == "start"
+	Resource   string                 `json:"resource"`    // Name of the resource the action is invoked on
+	Method     string                 `json:"method"`      // "do_command" (default) or "stop"
+	Command    map[string]interface{} `json:"command"`     // DoCommand argument
+	DebounceMs int                    `json:"debounce_ms"` // Fire once no matching message arrived for this long
+	CooldownMs int                    `json:"cooldown_ms"` // Minimum time between two actions
+}
+
+// Maps JSON trigger service configuration attributes.
+type TriggerServiceConfig struct {
+	BrokerConfig `json:",squash"`
+	QoS          int             `json:"qos"`
+	Triggers     []TriggerConfig `json:"triggers"`
+}
+
+// Implement trigger service configuration validation and return the resources of the triggers as dependencies.
+func (cfg *TriggerServiceConfig) Validate(path string) ([]string, error) {
+	if err := cfg.BrokerConfig.Validate(path); err != nil {
+		return nil, err
+	}
+	if cfg.QoS < 0 || cfg.QoS > 2 {
+		return nil, fmt.Errorf("qos must be between 0 and 2 %q", path)
+	}
+	if len(cfg.Triggers) == 0 {
+		return nil, fmt.Errorf("at least one trigger is required %q", path)
+	}
+	deps := []string{}
+	for i, t := range cfg.Triggers {
+		if t.Topic == "" || t.Resource == "" {
+			return nil, fmt.Errorf("trigger %d requires a topic and a resource %q", i, path)
+		}
+		switch t.Method {
+		case "", "do_command", "stop":
+		default:
+			return nil, fmt.Errorf("invalid trigger method %q (should be do_command or stop) %q", t.Method, path)
+		}
+		if t.Filter != "" {
+			if _, err := compileExpr(t.Filter); err != nil {
+				return nil, fmt.Errorf("invalid trigger filter %q: %v %q", t.Filter, err, path)
+			}
+		}
+		if t.DebounceMs < 0 || t.CooldownMs < 0 {
+			return nil, fmt.Errorf("debounce_ms and cooldown_ms must be >= 0 %q", path)
+		}
+		deps = append(deps, t.Resource)
+	}
+	return deps, nil
+}
+
+type trigger struct {
+	cfg        TriggerConfig
+	filter     expr
+	resource   resource.Resource
+	timer      *time.Timer
+	lastFired  time.Time
+	fired      uint64
+	suppressed uint64
+	failed     uint64
+	lastError  string
+}
+
+type mqttTriggerService struct {
+	resource.Named
+	resource.AlwaysRebuild
+	logger   logging.Logger
+	client   mqtt.Client
+	triggers []*trigger
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	mutex    sync.Mutex
+}
+
+// Trigger service constructor, the service is rebuilt on reconfiguration
+func newTriggerService(ctx context.Context, deps resource.Dependencies, conf resource.Config, logger logging.Logger) (resource.Resource, error) {
+	serviceConfig, err := resource.NativeConfig[*TriggerServiceConfig](conf)
+	if err != nil {
+		return nil, err
+	}
+	s := &mqttTriggerService{
+		Named:  conf.ResourceName().AsNamed(),
+		logger: logger,
+	}
+	filters := map[string]byte{}
+	for i, cfg := range serviceConfig.Triggers {
+		if cfg.Name == "" {
+			cfg.Name = fmt.Sprintf("trigger-%d", i)
+		}
+		t := &trigger{cfg: cfg}
+		if cfg.Filter != "" {
+			if t.filter, err = compileExpr(cfg.Filter); err != nil {
+				return nil, err
+			}
+		}
+		if t.resource, err = dependencyByName(deps, cfg.Resource); err != nil {
+			return nil, err
+		}
+		s.triggers = append(s.triggers, t)
+		filters[cfg.Topic] = byte(serviceConfig.QoS)
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	if s.client, err = serviceConfig.connect(ctx); err != nil {
+		return nil, fmt.Errorf("error initializing mqtt trigger service: %v", err)
+	}
+	if err := waitForToken(ctx, s.client.SubscribeMultiple(filters, s.onMessage)); err != nil {
+		s.client.Disconnect(250)
+		return nil, err
+	}
+	return s, nil
+}
+
+// Find a dependency by its short name
+func dependencyByName(deps resource.Dependencies, name string) (resource.Resource, error) {
+	for n, r := range deps {
+		if n.ShortName() == name || n.Name == name {
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("resource %q not found in dependencies", name)
+}
+
+// Check the message against the triggers and fire or debounce the matching ones
+func (s *mqttTriggerService) onMessage(client mqtt.Client, msg mqtt.Message) {
+	var payload interface{}
+	if err := json.Unmarshal(msg.Payload(), &payload); err != nil {
+		payload = string(msg.Payload())
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, t := range s.triggers {
+		if !topicMatches(t.cfg.Topic, msg.Topic()) {
+			continue
+		}
+		if t.filter != nil {
+			match, err := evalBool(t.filter, map[string]interface{}{"msg": payload, "topic": msg.Topic()})
+			if err != nil {
+				s.logger.Debugf("trigger %q filter failed: %v", t.cfg.Name, err)
+				continue
+			}
+			if !match {
+				continue
+			}
+		}
+		if t.cfg.DebounceMs > 0 {
+			if t.timer != nil {
+				t.timer.Stop()
+			}
+			t := t
+			t.timer = time.AfterFunc(time.Duration(t.cfg.DebounceMs)*time.Millisecond, func() {
+				s.mutex.Lock()
+				defer s.mutex.Unlock()
+				s.fire(t)
+			})
+			continue
+		}
+		s.fire(t)
+	}
+}
+
+// Invoke the action of a trigger unless it is cooling down, the caller holds the mutex
+func (s *mqttTriggerService) fire(t *trigger) {
+	if s.ctx.Err() != nil {
+		return
+	}
+	now := time.Now()
+	if !t.lastFired.IsZero() && now.Sub(t.lastFired) < time.Duration(t.cfg.CooldownMs)*time.Millisecond {
+		t.suppressed++
+		return
+	}
+	t.lastFired = now
+	t.fired++
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		var err error
+		switch t.cfg.Method {
+		case "stop":
+			actuator, ok := t.resource.(resource.Actuator)
+			if !ok {
+				err = fmt.Errorf("resource %q cannot be stopped", t.cfg.Resource)
+				break
+			}
+			err = actuator.Stop(s.ctx, nil)
+		default:
+			_, err = t.resource.DoCommand(s.ctx, t.cfg.Command)
+		}
+		if err != nil {
+			s.logger.Warnf("trigger %q action failed: %v", t.cfg.Name, err)
+			s.mutex.Lock()
+			t.failed++
+			t.lastError = err.Error()
+			s.mutex.Unlock()
+		}
+	}()
+}
+
+// DoCommand returns the trigger counters: {"status": true}
+func (s *mqttTriggerService) DoCommand(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	if _, ok := cmd["status"]; !ok {
+		return nil, errUnimplemented
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	triggers := map[string]interface{}{}
+	for _, t := range s.triggers {
+		status := map[string]interface{}{
+			"fired":      t.fired,
+			"suppressed": t.suppressed,
+			"failed":     t.failed,
+		}
+		if !t.lastFired.IsZero() {
+			status["last_fired"] = t.lastFired.UTC().Format(time.RFC3339Nano)
+		}
+		if t.lastError != "" {
+			status["last_error"] = t.lastError
+		}
+		triggers[t.cfg.Name] = status
+	}
+	return map[string]interface{}{"triggers": triggers, "connected": s.client.IsConnected()}, nil
+}
+
+// Disconnect from the broker and wait for running actions
+func (s *mqttTriggerService) Close(ctx context.Context) error {
+	if s.client != nil {
+		s.client.Disconnect(250) // Timeout in milliseconds
+	}
+	s.mutex.Lock()
+	for _, t := range s.triggers {
+		if t.timer != nil {
+			t.timer.Stop()
+		}
+	}
+	s.mutex.Unlock()
+	s.cancel()
+	s.wg.Wait()
+	return nil
+}
@@ -0,0 +1,69 @@
+package mqttclient
+
+import (
+	"context"
+	"time"
+)
+
+// Start the watchdog forcing a reconnect when the connection is up but no message arrived on the
+// periodic topic within the timeout. A previously started watchdog is stopped.
+func (s *mqttClient) startWatchdog(timeout time.Duration, topic string) {
+	if s.stopWatchdog != nil {
+		s.stopWatchdog()
+		s.stopWatchdog = nil
+	}
+	s.watchdogTopic = topic
+	s.watchdogSeen = time.Now()
+	if timeout <= 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopWatchdog = cancel
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(max(timeout/4, 100*time.Millisecond))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.done:
+				return
+			case <-ticker.C:
+			}
+			s.mutex.Lock()
+			// The silence is only measured while connected
+			if !s.connected() {
+				s.watchdogSeen = time.Now()
+			}
+			silence := time.Since(s.watchdogSeen)
+			s.mutex.Unlock()
+			if silence < timeout {
+				continue
+			}
+			s.logger.Warnf("no message on %q for %v while connected, forcing a reconnect", s.watchdogTopicName(), silence.Round(time.Second))
+			s.metrics.watchdogResets.Add(1)
+			if err := s.reconnect(ctx); err != nil {
+				s.logger.Errorf("watchdog reconnect failed: %v", err)
+			}
+			s.mutex.Lock()
+			s.watchdogSeen = time.Now()
+			s.mutex.Unlock()
+		}
+	}()
+}
+
+// Record a message for the watchdog. Must be called with the mutex held.
+func (s *mqttClient) feedWatchdog(msg *receivedMessage) {
+	if s.watchdogTopic == "" || topicMatches(s.watchdogTopic, msg.Topic()) {
+		s.watchdogSeen = msg.received
+	}
+}
+
+func (s *mqttClient) watchdogTopicName() string {
+	if s.watchdogTopic == "" {
+		return "any topic"
+	}
+	return s.watchdogTopic
+}
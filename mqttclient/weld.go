@@ -0,0 +1,367 @@
+package mqttclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Maps the weld_counting configuration attribute
+type WeldCountingConfig struct {
+	Topic          string   `json:"topic"`           // Optional topic filter of the state messages, default all topics
+	Field          string   `json:"field"`           // Weld state or numeric field, default arc_on
+	StartThreshold *float64 `json:"start_threshold"` // A weld starts when the numeric field rises above the threshold
+	StopThreshold  *float64 `json:"stop_threshold"`  // and stops when it falls below, default start_threshold
+	MinDuration    float64  `json:"min_duration_s"`  // Shorter welds are not counted
+	Reset          string   `json:"reset"`           // Supported none (default), daily, shift
+	ShiftStarts    []string `json:"shift_starts"`    // Local start times of the shifts like "06:00", required for the shift reset
+	Timezone       string   `json:"timezone"`        // IANA time zone of the resets, default the machine time zone
+	SummaryTopic   string   `json:"summary_topic"`   // Optional topic a summary of every weld is published to
+	Voltage        string   `json:"voltage"`         // Voltage field of the weld energy, default voltage_v
+	Current        string   `json:"current"`         // Current field of the weld energy, default current_a
+	Aggregate      []string `json:"aggregate"`       // Numeric fields with average, minimum and maximum in the summary, default current and voltage
+	FaultFields    []string `json:"fault_fields"`    // Fields flagging a fault, listed in the summary if set during the weld
+	Capture        string   `json:"capture"`         // Captured records: samples (default), summaries, both
+}
+
+// Validate the weld counting configuration, the shift reset uses the shift calendar unless shift_starts are set
+func (cfg *WeldCountingConfig) Validate(shifts *ShiftsConfig) error {
+	if cfg.Topic != "" && !validTopicFilter(cfg.Topic) {
+		return fmt.Errorf("invalid weld_counting topic %q", cfg.Topic)
+	}
+	if cfg.StopThreshold != nil && cfg.StartThreshold == nil {
+		return fmt.Errorf("weld_counting stop_threshold requires start_threshold")
+	}
+	if cfg.StopThreshold != nil && *cfg.StopThreshold > *cfg.StartThreshold {
+		return fmt.Errorf("weld_counting stop_threshold must be <= start_threshold")
+	}
+	if cfg.MinDuration < 0 {
+		return fmt.Errorf("weld_counting min_duration_s must be >= 0")
+	}
+	switch cfg.Reset {
+	case "", "none", "daily":
+	case "shift":
+		if len(cfg.ShiftStarts) == 0 && shifts == nil {
+			return fmt.Errorf("weld_counting shift reset requires shift_starts or shifts")
+		}
+	default:
+		return fmt.Errorf("weld_counting reset must be none, daily or shift")
+	}
+	if _, err := newResetSchedule(cfg.Reset, cfg.ShiftStarts, cfg.Timezone, shifts); err != nil {
+		return fmt.Errorf("invalid weld_counting reset: %v", err)
+	}
+	if cfg.SummaryTopic != "" && !validTopicName(cfg.SummaryTopic) {
+		return fmt.Errorf("invalid weld_counting summary_topic %q", cfg.SummaryTopic)
+	}
+	switch cfg.Capture {
+	case "", "samples", "summaries", "both":
+	default:
+		return fmt.Errorf("weld_counting capture must be samples, summaries or both")
+	}
+	return nil
+}
+
+// Statistics of a numeric field over a weld
+type fieldAggregate struct {
+	sum, min, max float64
+	n             int
+}
+
+func (a *fieldAggregate) add(v float64) {
+	if a.n == 0 || v < a.min {
+		a.min = v
+	}
+	if a.n == 0 || v > a.max {
+		a.max = v
+	}
+	a.sum += v
+	a.n++
+}
+
+// Aggregates of the running weld
+type weldSession struct {
+	aggregates map[string]*fieldAggregate
+	faults     map[string]bool
+	violations map[string]bool        // Fields out of the WPS limits
+	context    map[string]interface{} // Program context at the weld start
+	energyJ    float64
+	power      float64 // Power of the last sample in W, it applies until the next sample
+	last       time.Time
+	samples    int
+}
+
+// Detects weld starts and stops and counts the welds and their durations since the last reset
+type weldCounter struct {
+	topic       string
+	field       string
+	start, stop *float64
+	minDuration time.Duration
+	schedule    resetSchedule
+	voltage     string
+	current     string
+	aggregate   []string
+	faultFields []string
+	welding     bool
+	started     time.Time
+	session     weldSession
+	count       uint64
+	total       time.Duration
+	last        time.Duration
+	since       time.Time
+	nextReset   time.Time
+	previous    map[string]interface{} // Totals of the previous period
+}
+
+func newWeldCounter(cfg *WeldCountingConfig, shifts *ShiftsConfig, now time.Time) (*weldCounter, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	schedule, err := newResetSchedule(cfg.Reset, cfg.ShiftStarts, cfg.Timezone, shifts)
+	if err != nil {
+		return nil, err
+	}
+	w := &weldCounter{
+		topic:       cfg.Topic,
+		field:       cfg.Field,
+		start:       cfg.StartThreshold,
+		stop:        cfg.StopThreshold,
+		minDuration: time.Duration(cfg.MinDuration * float64(time.Second)),
+		schedule:    schedule,
+		voltage:     cfg.Voltage,
+		current:     cfg.Current,
+		aggregate:   cfg.Aggregate,
+		faultFields: cfg.FaultFields,
+	}
+	if w.field == "" {
+		w.field = weldArcOn
+	}
+	if w.voltage == "" {
+		w.voltage = weldVoltage
+	}
+	if w.current == "" {
+		w.current = weldCurrent
+	}
+	if len(w.aggregate) == 0 {
+		w.aggregate = []string{w.current, w.voltage}
+	}
+	if w.stop == nil {
+		w.stop = w.start
+	}
+	w.reset(now)
+	return w, nil
+}
+
+// Start a new period, a running weld is counted in the period it ends. The totals of the ended period
+// are kept.
+func (w *weldCounter) reset(now time.Time) {
+	if !w.since.IsZero() {
+		w.previous = map[string]interface{}{
+			"count":            w.count,
+			"total_duration_s": w.total.Seconds(),
+			"since":            w.since.UTC().Format(time.RFC3339),
+			"until":            now.UTC().Format(time.RFC3339),
+		}
+		if shift := w.schedule.shift(w.since); shift != "" {
+			w.previous["shift"] = shift
+		}
+	}
+	w.count, w.total, w.last = 0, 0, 0
+	w.since = now
+	w.nextReset = w.schedule.next(now)
+}
+
+func (w *weldCounter) rollover(now time.Time) {
+	for !w.nextReset.IsZero() && !now.Before(w.nextReset) {
+		w.reset(w.nextReset)
+	}
+}
+
+// Return the weld state of a message, false if it is not a state message. Numeric fields switch on
+// above the start threshold and off below the stop threshold, in between the state is kept.
+func (w *weldCounter) state(topic string, payload interface{}) (bool, bool) {
+	if w.topic != "" && !topicMatches(w.topic, topic) {
+		return false, false
+	}
+	v, ok := lookupField(payload, w.field)
+	if !ok {
+		return false, false
+	}
+	if w.start == nil {
+		return toArcState(v)
+	}
+	f, ok := toFloat(v)
+	if !ok {
+		return false, false
+	}
+	switch {
+	case f > *w.start:
+		return true, true
+	case f < *w.stop:
+		return false, true
+	}
+	return w.welding, true
+}
+
+// Record a weld state and return the summary of the weld it ends, nil if no counted weld ended
+func (w *weldCounter) update(on bool, at time.Time) map[string]interface{} {
+	w.rollover(at)
+	if on == w.welding {
+		return nil
+	}
+	w.welding = on
+	if on {
+		w.started = at
+		w.session = weldSession{aggregates: map[string]*fieldAggregate{}, faults: map[string]bool{}, violations: map[string]bool{}}
+		return nil
+	}
+	// The power of the last sample applies until the stop
+	if !w.session.last.IsZero() {
+		w.session.energyJ += w.session.power * at.Sub(w.session.last).Seconds()
+	}
+	duration := at.Sub(w.started)
+	if duration < w.minDuration {
+		return nil
+	}
+	w.count++
+	w.total += duration
+	w.last = duration
+	summary := map[string]interface{}{
+		"weld":       w.count,
+		"start":      w.started.UTC().Format(time.RFC3339Nano),
+		"end":        at.UTC().Format(time.RFC3339Nano),
+		"duration_s": duration.Seconds(),
+		"energy_kj":  w.session.energyJ / 1000,
+		"samples":    w.session.samples,
+		"faults":     stringList(sortedKeys(w.session.faults)),
+	}
+	for name, v := range w.session.context {
+		if _, ok := summary[name]; !ok {
+			summary[name] = v
+		}
+	}
+	if len(w.session.violations) > 0 {
+		summary["wps_violations"] = stringList(sortedKeys(w.session.violations))
+	}
+	for field, a := range w.session.aggregates {
+		name := strings.ReplaceAll(field, ".", "_")
+		summary[name+"_avg"] = a.sum / float64(a.n)
+		summary[name+"_min"] = a.min
+		summary[name+"_max"] = a.max
+	}
+	return summary
+}
+
+// Add a message received during a weld and its WPS violations to the aggregates of the weld
+func (w *weldCounter) sample(payload interface{}, violations []interface{}, at time.Time) {
+	if !w.welding {
+		return
+	}
+	session := &w.session
+	session.samples++
+	for _, field := range violations {
+		session.violations[fmt.Sprint(field)] = true
+	}
+	for _, field := range w.aggregate {
+		if v, ok := lookupField(payload, field); ok {
+			if f, ok := toFloat(v); ok {
+				if session.aggregates[field] == nil {
+					session.aggregates[field] = &fieldAggregate{}
+				}
+				session.aggregates[field].add(f)
+			}
+		}
+	}
+	for _, field := range w.faultFields {
+		if v, ok := lookupField(payload, field); ok {
+			if fault, ok := toArcState(v); ok && fault {
+				session.faults[field] = true
+			}
+		}
+	}
+	// Messages without voltage and current, e.g. state messages, keep the power of the previous sample
+	u, uok := lookupField(payload, w.voltage)
+	i, iok := lookupField(payload, w.current)
+	if !uok || !iok {
+		return
+	}
+	uf, uok := toFloat(u)
+	iF, iok := toFloat(i)
+	if !uok || !iok {
+		return
+	}
+	if !session.last.IsZero() {
+		session.energyJ += session.power * at.Sub(session.last).Seconds()
+	}
+	session.power = uf * iF
+	session.last = at
+}
+
+func (w *weldCounter) readings(now time.Time) map[string]interface{} {
+	w.rollover(now)
+	readings := map[string]interface{}{
+		"welding":          w.welding,
+		"count":            w.count,
+		"total_duration_s": w.total.Seconds(),
+		"last_duration_s":  w.last.Seconds(),
+		"since":            w.since.UTC().Format(time.RFC3339),
+	}
+	if w.count > 0 {
+		readings["avg_duration_s"] = w.total.Seconds() / float64(w.count)
+	}
+	if shift := w.schedule.shift(now); shift != "" {
+		readings["shift"] = shift
+	}
+	if w.previous != nil {
+		readings["previous"] = w.previous
+	}
+	return readings
+}
+
+// Update the weld counting with a newly received message, publish the summary of an ended weld and
+// return it as message for data capture. Must be called with the mutex held.
+func (s *mqttClient) countWelds(msg *receivedMessage) *receivedMessage {
+	if s.welds == nil {
+		return nil
+	}
+	payload, err := s.parseWithDerived(msg)
+	if err != nil {
+		return nil
+	}
+	var summary map[string]interface{}
+	if on, ok := s.welds.state(msg.Topic(), payload); ok {
+		summary = s.welds.update(on, msg.received)
+	}
+	if s.programs != nil && s.welds.welding && s.welds.session.context == nil {
+		s.welds.session.context = map[string]interface{}{}
+		for name, v := range s.programs.values(msg.Topic()) {
+			s.welds.session.context[name] = v
+		}
+	}
+	violations, _ := msg.derived["wps_violations"].([]interface{})
+	s.welds.sample(payload, violations, msg.received)
+	if summary == nil {
+		return nil
+	}
+	if _, ok := summary["wps_violations"]; ok && s.wps != nil {
+		s.wps.outOfSpecWelds++
+	}
+	b, err := json.Marshal(summary)
+	if err != nil {
+		s.logger.Errorf("error encoding weld summary: %v", err)
+		return nil
+	}
+	topic := s.weldSummaryTopic
+	if topic != "" {
+		// Don't wait for the acknowledgement in the message handler
+		s.publishNoWait(topic, s.QoS, false, b)
+	} else {
+		topic = msg.Topic()
+	}
+	return &receivedMessage{
+		Message:  &injectedMessage{topic: topic, qos: s.QoS, payload: b},
+		received: msg.received,
+		parsed:   summary,
+		isParsed: true,
+	}
+}
@@ -0,0 +1,173 @@
+package mqttclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Maps the wps configuration attribute
+type WPSConfig struct {
+	ProgramField string                         `json:"program_field"` // Field of the weld program ID, default program
+	Programs     map[string]map[string]WPSLimit `json:"programs"`      // Limits of the fields by program ID, "*" applies to other programs
+	AlarmTopic   string                         `json:"alarm_topic"`   // Optional topic an alarm is published to when a limit is violated
+}
+
+// Range of a field allowed by the welding procedure specification
+type WPSLimit struct {
+	Min *float64 `json:"min"`
+	Max *float64 `json:"max"`
+}
+
+// Limits of programs without their own limits
+const wpsDefaultProgram = "*"
+
+// Validate the WPS limits configuration
+func (cfg *WPSConfig) Validate() error {
+	if len(cfg.Programs) == 0 {
+		return fmt.Errorf("wps requires programs")
+	}
+	for program, limits := range cfg.Programs {
+		for field, limit := range limits {
+			if limit.Min == nil && limit.Max == nil {
+				return fmt.Errorf("wps limit of %q in program %q requires min or max", field, program)
+			}
+			if limit.Min != nil && limit.Max != nil && *limit.Min > *limit.Max {
+				return fmt.Errorf("wps limit of %q in program %q: min must be <= max", field, program)
+			}
+		}
+	}
+	if cfg.AlarmTopic != "" && !validTopicName(cfg.AlarmTopic) {
+		return fmt.Errorf("invalid wps alarm_topic %q", cfg.AlarmTopic)
+	}
+	return nil
+}
+
+// Checks the samples against the limits of the running weld program
+type wpsChecker struct {
+	programField     string
+	programs         map[string]map[string]WPSLimit
+	program          string          // Program of the last message with a program ID
+	violating        map[string]bool // Fields out of spec in the last sample, alarms are raised when a field leaves the range
+	samples          uint64
+	outOfSpecSamples uint64
+	outOfSpecWelds   uint64
+	lastViolation    map[string]interface{}
+}
+
+func newWPSChecker(cfg *WPSConfig) *wpsChecker {
+	if cfg == nil {
+		return nil
+	}
+	w := &wpsChecker{programField: cfg.ProgramField, programs: cfg.Programs, violating: map[string]bool{}}
+	if w.programField == "" {
+		w.programField = "program"
+	}
+	return w
+}
+
+// Return the limits of the running program
+func (w *wpsChecker) limits() map[string]WPSLimit {
+	if limits, ok := w.programs[w.program]; ok {
+		return limits
+	}
+	return w.programs[wpsDefaultProgram]
+}
+
+// Check a sample and return its out of spec fields and values, and the fields which newly left their range
+func (w *wpsChecker) check(payload interface{}) (map[string]interface{}, []string) {
+	if v, ok := lookupField(payload, w.programField); ok && v != nil {
+		w.program = fmt.Sprint(v)
+	}
+	limits := w.limits()
+	checked := false
+	violations := map[string]interface{}{}
+	for _, field := range sortedKeys(limits) {
+		v, ok := lookupField(payload, field)
+		if !ok {
+			continue
+		}
+		f, ok := toFloat(v)
+		if !ok {
+			continue
+		}
+		checked = true
+		limit := limits[field]
+		if (limit.Min != nil && f < *limit.Min) || (limit.Max != nil && f > *limit.Max) {
+			violations[field] = f
+		}
+	}
+	if !checked {
+		return nil, nil
+	}
+	w.samples++
+	var raised []string
+	for _, field := range sortedKeys(limits) {
+		_, out := violations[field]
+		if out && !w.violating[field] {
+			raised = append(raised, field)
+		}
+		w.violating[field] = out
+	}
+	if len(violations) > 0 {
+		w.outOfSpecSamples++
+	}
+	return violations, raised
+}
+
+func (w *wpsChecker) readings() map[string]interface{} {
+	readings := map[string]interface{}{
+		"program":             w.program,
+		"samples":             w.samples,
+		"out_of_spec_samples": w.outOfSpecSamples,
+		"out_of_spec_welds":   w.outOfSpecWelds,
+	}
+	if w.lastViolation != nil {
+		readings["last_violation"] = w.lastViolation
+	}
+	return readings
+}
+
+// Check a newly received message against the WPS limits, add its out of spec fields to the derived
+// fields and publish an alarm when a field leaves its range. Must be called with the mutex held.
+func (s *mqttClient) checkWPS(msg *receivedMessage) {
+	if s.wps == nil {
+		return
+	}
+	payload, err := s.parseWithDerived(msg)
+	if err != nil {
+		return
+	}
+	violations, raised := s.wps.check(payload)
+	if len(violations) == 0 {
+		return
+	}
+	msg.setDerived("wps_violations", stringList(sortedKeys(violations)))
+	s.wps.lastViolation = map[string]interface{}{
+		"program": s.wps.program,
+		"topic":   msg.Topic(),
+		"values":  violations,
+		"time":    msg.received.UTC().Format(time.RFC3339Nano),
+	}
+	if len(raised) == 0 || s.wpsAlarmTopic == "" {
+		return
+	}
+	limits := s.wps.limits()
+	alarm := map[string]interface{}{
+		"program": s.wps.program,
+		"topic":   msg.Topic(),
+		"time":    msg.received.UTC().Format(time.RFC3339Nano),
+	}
+	fields := map[string]interface{}{}
+	for _, field := range raised {
+		fields[field] = map[string]interface{}{"value": violations[field], "min": limits[field].Min, "max": limits[field].Max}
+	}
+	alarm["violations"] = fields
+	b, err := json.Marshal(alarm)
+	if err != nil {
+		s.logger.Errorf("error encoding wps alarm: %v", err)
+		return
+	}
+	// Don't wait for the acknowledgement in the message handler
+	s.publishNoWait(s.wpsAlarmTopic, s.QoS, false, b)
+}
@@ -0,0 +1,88 @@
+package mqttclient
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWPSChecker(t *testing.T) {
+	limit := func(min, max *float64) WPSLimit { return WPSLimit{Min: min, Max: max} }
+	float := func(f float64) *float64 { return &f }
+	cfg := &WPSConfig{Programs: map[string]map[string]WPSLimit{
+		"12": {"current_a": limit(float(100), float(200)), "voltage_v": limit(float(18), float(24))},
+		"*":  {"voltage_v": limit(nil, float(30))},
+	}}
+	type step struct {
+		payload    map[string]interface{}
+		violations map[string]interface{}
+		raised     []string
+	}
+	tests := []struct {
+		name    string
+		steps   []step
+		samples uint64
+		out     uint64
+	}{
+		{
+			name: "within limits",
+			steps: []step{
+				{map[string]interface{}{"program": 12, "current_a": 150, "voltage_v": 20}, map[string]interface{}{}, nil},
+			},
+			samples: 1,
+		},
+		{
+			name: "limits are inclusive",
+			steps: []step{
+				{map[string]interface{}{"program": "12", "current_a": 100, "voltage_v": 24}, map[string]interface{}{}, nil},
+			},
+			samples: 1,
+		},
+		{
+			name: "alarm raised once while out of range",
+			steps: []step{
+				{map[string]interface{}{"program": 12, "current_a": 250}, map[string]interface{}{"current_a": 250.0}, []string{"current_a"}},
+				{map[string]interface{}{"current_a": 260}, map[string]interface{}{"current_a": 260.0}, nil},
+				{map[string]interface{}{"current_a": 150}, map[string]interface{}{}, nil},
+				{map[string]interface{}{"current_a": 90}, map[string]interface{}{"current_a": 90.0}, []string{"current_a"}},
+			},
+			samples: 4, out: 3,
+		},
+		{
+			name: "several fields",
+			steps: []step{
+				{map[string]interface{}{"program": 12, "current_a": 90, "voltage_v": 25}, map[string]interface{}{"current_a": 90.0, "voltage_v": 25.0}, []string{"current_a", "voltage_v"}},
+				{map[string]interface{}{"current_a": 150, "voltage_v": 26}, map[string]interface{}{"voltage_v": 26.0}, nil},
+			},
+			samples: 2, out: 2,
+		},
+		{
+			name: "default limits of other programs",
+			steps: []step{
+				{map[string]interface{}{"program": 7, "current_a": 500, "voltage_v": 25}, map[string]interface{}{}, nil},
+				{map[string]interface{}{"voltage_v": 31}, map[string]interface{}{"voltage_v": 31.0}, []string{"voltage_v"}},
+			},
+			samples: 2, out: 1,
+		},
+		{
+			name: "samples without limited fields are not counted",
+			steps: []step{
+				{map[string]interface{}{"program": 12, "wire_feed": 8}, nil, nil},
+				{map[string]interface{}{"current_a": "n/a"}, nil, nil},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newWPSChecker(cfg)
+			for i, s := range tt.steps {
+				violations, raised := w.check(s.payload)
+				if !reflect.DeepEqual(violations, s.violations) || !reflect.DeepEqual(raised, s.raised) {
+					t.Errorf("step %d: violations %v raised %v, want %v %v", i, violations, raised, s.violations, s.raised)
+				}
+			}
+			if w.samples != tt.samples || w.outOfSpecSamples != tt.out {
+				t.Errorf("%d samples, %d out of spec, want %d, %d", w.samples, w.outOfSpecSamples, tt.samples, tt.out)
+			}
+		})
+	}
+}